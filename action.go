@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func actionCommand() *ffcli.Command {
+	var (
+		fs        = flag.NewFlagSet("mb action", flag.ExitOnError)
+		df        = registerDiffFlags(fs)
+		buildable = fs.Bool("buildable", false, "Only output the targets with a build command or steps")
+		fetch     = fs.Bool("fetch", true, "Fetch the base commit of the range when the checkout is shallow")
+	)
+	return &ffcli.Command{
+		Name:      "action",
+		Usage:     "mb action [flags]",
+		ShortHelp: "Output the affected targets of a GitHub Actions workflow",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Compute the affected targets of the pull request or the push of a
+			GitHub Actions workflow, from GITHUB_EVENT_PATH, GITHUB_BASE_REF and
+			GITHUB_SHA unless -commit-range is set, and write them to the step
+			outputs of GITHUB_OUTPUT and the step summary of GITHUB_STEP_SUMMARY.
+			Every target is affected when there is no range, e.g. for the push
+			of a new branch or a scheduled workflow. No build command runs.
+		`, 80),
+		Exec: func([]string) error {
+			ctx := context.Background()
+			ctx, span := tracer.Start(ctx, "mb action")
+			defer span.End()
+			if err := df.resolveBase(ctx); err != nil {
+				return err
+			}
+			all := false
+			if *df.commitRange == "" {
+				r, a, err := build.GitHubActionRange(os.Getenv)
+				if err != nil {
+					return err
+				}
+				*df.commitRange, all = r, a
+			}
+			if *fetch && *df.commitRange != "" && *df.bareRepo == "" {
+				if err := build.FetchRangeBase(ctx, *df.commitRange); err != nil {
+					return err
+				}
+			}
+			b, err := df.buildContextQuiet(ctx)
+			if err != nil {
+				return err
+			}
+			b.All = all
+			affected := b.Affected(*buildable)
+			outputs := build.GitHubActionOutputs(affected, *df.commitRange)
+			if name := os.Getenv("GITHUB_OUTPUT"); name != "" {
+				if err := build.WriteGitHubOutputs(name, outputs); err != nil {
+					return errors.Wrap(err, "GITHUB_OUTPUT")
+				}
+			} else if err := build.WriteAffected(os.Stdout, affected, "text"); err != nil {
+				return err
+			}
+			if name := os.Getenv("GITHUB_STEP_SUMMARY"); name != "" {
+				f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+				if err != nil {
+					return errors.Wrap(err, "GITHUB_STEP_SUMMARY")
+				}
+				build.WriteGitHubActionSummary(f, affected, *df.commitRange)
+				if err := f.Close(); err != nil {
+					return errors.Wrap(err, "GITHUB_STEP_SUMMARY")
+				}
+			}
+			return nil
+		},
+	}
+}
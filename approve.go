@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func approveCommand() *ffcli.Command {
+	var (
+		fs         = flag.NewFlagSet("mb approve", flag.ExitOnError)
+		configFile = fs.String("config", "./monobuild.yaml", "mb config file")
+		key        = fs.String("key", "", "Ed25519 private key of the approver, a PKCS #8 PEM file, e.g. of mb attest keygen")
+		commit     = fs.String("commit", "HEAD", "The commit whose build is approved")
+	)
+	return &ffcli.Command{
+		Name:      "approve",
+		Usage:     "mb approve [flags] <target name or path>...",
+		ShortHelp: "Sign the approval of the protected targets of a commit",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Print the approval tokens of the builds of the targets at the commit,
+			separated by spaces, to set in MB_APPROVAL_TOKEN or in the approval
+			marker of a CI run. The run verifies them with the public key of the
+			approver, given with -approval-key.
+		`, 80),
+		Exec: func(args []string) error {
+			if len(args) == 0 || *key == "" {
+				return errors.New("usage: mb approve -key <private key> <target>...")
+			}
+			ctx := context.Background()
+			ctx, span := tracer.Start(ctx, "mb approve")
+			defer span.End()
+			b, err := build.NewBuildContext(ctx, *configFile, "")
+			if err != nil {
+				return err
+			}
+			tokens, err := b.SignApprovals(ctx, *key, *commit, args)
+			if err != nil {
+				return err
+			}
+			fmt.Println(strings.Join(tokens, " "))
+			return nil
+		},
+	}
+}
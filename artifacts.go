@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func artifactsCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("mb artifacts diff", flag.ExitOnError)
+	runsDir := fs.String("runs-dir", build.DefaultRunsDir, "the directory of the run records")
+	diff := &ffcli.Command{
+		Name:      "diff",
+		Usage:     "mb artifacts diff [flags] <runA> <runB>",
+		ShortHelp: "Compare the artifact digests of two runs",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Compare the artifacts of the targets built by both runs. A run is a
+			run ID of the runs directory or the path of a run record. The command
+			fails when a target had identical inputs in both runs but produced
+			different artifacts.
+		`, 80),
+		Exec: func(args []string) error {
+			if len(args) != 2 {
+				return errors.Errorf("usage: mb artifacts diff <runA> <runB>")
+			}
+			a, err := build.ReadRun(*runsDir, args[0])
+			if err != nil {
+				return err
+			}
+			b, err := build.ReadRun(*runsDir, args[1])
+			if err != nil {
+				return err
+			}
+			if bad := build.ArtifactsDiff(os.Stdout, a, b); len(bad) > 0 {
+				return errors.Errorf("non-reproducible targets: %s", strings.Join(bad, ", "))
+			}
+			return nil
+		},
+	}
+	return &ffcli.Command{
+		Name:        "artifacts",
+		Usage:       "mb artifacts <subcommand>",
+		ShortHelp:   "Inspect the artifacts recorded by previous runs",
+		FlagSet:     flag.NewFlagSet("mb artifacts", flag.ExitOnError),
+		Subcommands: []*ffcli.Command{diff},
+	}
+}
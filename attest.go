@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+// attestFlags are the flags of the commands that attest their plan.
+type attestFlags struct {
+	path *string
+	key  *string
+}
+
+func registerAttestFlags(fs *flag.FlagSet) *attestFlags {
+	return &attestFlags{
+		path: fs.String("attest", "", "Write a signed in-toto attestation of the plan, its commits, config and affected targets, to this file"),
+		key:  fs.String("attest-key", "", "Ed25519 private key of -attest, a PKCS #8 PEM file, e.g. of mb attest keygen"),
+	}
+}
+
+// write writes the attestation of the plan, when -attest is set.
+func (a *attestFlags) write(ctx context.Context, b *build.BuildContext) error {
+	if *a.path == "" {
+		return nil
+	}
+	if *a.key == "" {
+		return errors.New("-attest needs an -attest-key")
+	}
+	return b.WriteAttestation(ctx, *a.path, *a.key)
+}
+
+func attestCommand() *ffcli.Command {
+	kfs := flag.NewFlagSet("mb attest keygen", flag.ExitOnError)
+	prefix := kfs.String("out", "mb-attest", "Write the key pair to <out>.key and <out>.pub")
+	keygen := &ffcli.Command{
+		Name:      "keygen",
+		Usage:     "mb attest keygen [flags]",
+		ShortHelp: "Generate an Ed25519 key pair to sign the attestations",
+		FlagSet:   kfs,
+		Exec: func([]string) error {
+			if err := build.GenerateAttestationKey(*prefix); err != nil {
+				return err
+			}
+			fmt.Printf("wrote %s.key and %s.pub\n", *prefix, *prefix)
+			return nil
+		},
+	}
+	var (
+		vfs    = flag.NewFlagSet("mb attest verify", flag.ExitOnError)
+		key    = vfs.String("key", "", "Ed25519 public key, a PKIX PEM file")
+		head   = vfs.String("head", "", "Fail unless the plan is of the changes to this commit SHA, full or abbreviated, e.g. the commit being deployed")
+		format = vfs.String("format", "text", "Output format: text, one affected target per line, or json with the commits and the config")
+	)
+	verify := &ffcli.Command{
+		Name:      "verify",
+		Usage:     "mb attest verify [flags] <attestation>",
+		ShortHelp: "Verify an attestation and print its affected targets",
+		FlagSet:   vfs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Verify the signature of an attestation of -attest with the public key,
+			and print the affected targets of its plan, e.g. for a deploy pipeline
+			to only deploy the services that mb computed for the commits.
+		`, 80),
+		Exec: func(args []string) error {
+			if len(args) != 1 || *key == "" {
+				return errors.New("usage: mb attest verify -key <public key> <attestation>")
+			}
+			p, err := build.VerifyAttestation(args[0], *key)
+			if err != nil {
+				return err
+			}
+			// An abbreviated commit is at least as long as the ones of git.
+			if *head != "" && (len(*head) < 7 || !strings.HasPrefix(p.Head, *head)) {
+				return errors.Errorf("the plan is of the changes to %s, not %s", p.Head, *head)
+			}
+			switch *format {
+			case "text":
+				for _, t := range p.Affected {
+					fmt.Println(t)
+				}
+				return nil
+			case "json":
+				out, err := json.MarshalIndent(p, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(out))
+				return nil
+			}
+			return errors.Errorf("unknown format %q", *format)
+		},
+	}
+	return &ffcli.Command{
+		Name:        "attest",
+		Usage:       "mb attest <subcommand>",
+		ShortHelp:   "Generate keys for and verify the attestations of the plans",
+		FlagSet:     flag.NewFlagSet("mb attest", flag.ExitOnError),
+		Subcommands: []*ffcli.Command{keygen, verify},
+	}
+}
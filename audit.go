@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func auditCommand() *ffcli.Command {
+	var (
+		fs         = flag.NewFlagSet("mb audit", flag.ExitOnError)
+		configFile = fs.String("config", "./monobuild.yaml", "mb config file")
+		runsDir    = fs.String("runs-dir", build.DefaultRunsDir, "the directory of the run records")
+		window     = fs.String("window", "30d", "Time window of the runs of the CI time estimate, e.g. 7d")
+		top        = fs.Int("top", 10, "Number of shared packages to report")
+		format     = fs.String("format", "text", "Output format: text or json")
+	)
+	return &ffcli.Command{
+		Name:      "audit",
+		Usage:     "mb audit [flags]",
+		ShortHelp: "Report the coverage of the config and the CI time it saves",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Analyze the repository with its config: the main packages that no
+			target builds, the targets that no dependency, dependency directory
+			or watched file affects, the packages shared by the most targets, and
+			an estimate of the CI time saved over building every target, from the
+			run records of the window.
+		`, 80),
+		Exec: func([]string) error {
+			ctx := context.Background()
+			ctx, span := tracer.Start(ctx, "mb audit")
+			defer span.End()
+			d, err := build.ParseWindow(*window)
+			if err != nil {
+				return err
+			}
+			runs, err := build.ReadRuns(*runsDir)
+			if err != nil {
+				return err
+			}
+			b, err := build.NewBuildContext(ctx, *configFile, "")
+			if err != nil {
+				return err
+			}
+			r, err := b.Audit(ctx, *top, runs, *window, time.Now().Add(-d))
+			if err != nil {
+				return err
+			}
+			switch *format {
+			case "text":
+				r.Write(os.Stdout)
+				return nil
+			case "json":
+				out, err := json.MarshalIndent(r, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(out))
+				return nil
+			}
+			return errors.Errorf("unknown format %q", *format)
+		},
+	}
+}
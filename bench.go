@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func benchAnalyzerCommand() *ffcli.Command {
+	var (
+		fs       = flag.NewFlagSet("mb bench-analyzer", flag.ExitOnError)
+		targets  = fs.Int("targets", 50, "Number of synthetic targets")
+		packages = fs.Int("packages", 500, "Number of synthetic packages")
+		files    = fs.Int("files-per-package", 3, "Number of Go files per package")
+		imports  = fs.Int("imports", 3, "Number of imports per package and target")
+		changed  = fs.Int("changed", 100, "Number of changed files to diff")
+		seed     = fs.Int64("seed", 1, "Random seed of the synthetic layout")
+		maxLoad  = fs.Duration("max-load", 0, "Fail if loading the config and Go deps takes longer (0 disables)")
+		maxDiff  = fs.Duration("max-diff", 0, "Fail if matching the changed files takes longer (0 disables)")
+		keep     = fs.Bool("keep", false, "Keep the synthetic repository")
+	)
+	return &ffcli.Command{
+		Name:      "bench-analyzer",
+		Usage:     "mb bench-analyzer [flags]",
+		ShortHelp: "Benchmark the analyzer on a synthetic monorepo",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Developer command that generates a synthetic Go monorepo and measures
+			the plan phases: loading the config with the Go deps of every target,
+			and matching the changed files against the targets. Use -max-load and
+			-max-diff as regression thresholds.
+		`, 80),
+		Exec: func([]string) error {
+			l := build.BenchLayout{
+				Targets:         *targets,
+				Packages:        *packages,
+				FilesPerPackage: *files,
+				ImportsPerPkg:   *imports,
+				Changed:         *changed,
+				Seed:            *seed,
+			}
+			res, err := build.RunBenchAnalyzer(context.Background(), l, *keep)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("targets=%d packages=%d files=%d changed=%d affected=%d\n",
+				l.Targets, l.Packages, l.Packages*l.FilesPerPackage, l.Changed, res.Affected)
+			fmt.Printf("generate %v\n", res.Generate)
+			perTarget := res.Load
+			if l.Targets > 0 {
+				perTarget /= time.Duration(l.Targets)
+			}
+			fmt.Printf("load     %v (%v/target)\n", res.Load, perTarget)
+			fmt.Printf("diff     %v\n", res.Diff)
+			var exceeded []string
+			if *maxLoad > 0 && res.Load > *maxLoad {
+				exceeded = append(exceeded, fmt.Sprintf("load %v > %v", res.Load, *maxLoad))
+			}
+			if *maxDiff > 0 && res.Diff > *maxDiff {
+				exceeded = append(exceeded, fmt.Sprintf("diff %v > %v", res.Diff, *maxDiff))
+			}
+			if len(exceeded) > 0 {
+				return errors.Errorf("regression thresholds exceeded: %s", strings.Join(exceeded, ", "))
+			}
+			return nil
+		},
+	}
+}
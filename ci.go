@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+func ciCommand() *ffcli.Command {
+	var (
+		fs        = flag.NewFlagSet("mb ci github-matrix", flag.ExitOnError)
+		df        = registerDiffFlags(fs)
+		all       = fs.Bool("all", false, "Include every target regardless of the changes")
+		buildable = fs.Bool("buildable", true, "Only include the targets with a build command or steps")
+	)
+	githubMatrix := &ffcli.Command{
+		Name:      "github-matrix",
+		Usage:     "mb ci github-matrix [flags]",
+		ShortHelp: "Print the affected targets as a GitHub Actions matrix",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Print a JSON matrix with an include entry per affected target, with
+			its path, name and build command, for strategy.matrix with fromJSON,
+			so that every target builds in its own job. No build command runs.
+			In a GitHub Actions workflow, the commit range defaults to the one
+			of mb action.
+		`, 80),
+		Exec: func([]string) error {
+			ctx := context.Background()
+			ctx, span := tracer.Start(ctx, "mb ci github-matrix")
+			defer span.End()
+			if err := df.resolveBase(ctx); err != nil {
+				return err
+			}
+			if *df.commitRange == "" && os.Getenv("GITHUB_ACTIONS") == "true" {
+				r, a, err := build.GitHubActionRange(os.Getenv)
+				if err != nil {
+					return err
+				}
+				*df.commitRange, *all = r, *all || a
+			}
+			b, err := df.buildContextQuiet(ctx)
+			if err != nil {
+				return err
+			}
+			b.All = *all
+			out, err := json.Marshal(b.GitHubMatrix(*buildable))
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+			return nil
+		},
+	}
+	var (
+		gfs         = flag.NewFlagSet("mb ci gitlab", flag.ExitOnError)
+		gdf         = registerDiffFlags(gfs)
+		gall        = gfs.Bool("all", false, "Include every target regardless of the changes")
+		gbuildable  = gfs.Bool("buildable", true, "Only include the targets with a build command or steps")
+		jobName     = gfs.String("job-name", build.DefaultGitLabJobName, "Template of the job names")
+		jobTemplate = gfs.String("job-template", "", "YAML file of the job of a target, whose strings are templates of {{.Path}}, {{.Name}}, {{.Command}} and {{.Dir}}")
+	)
+	gitlab := &ffcli.Command{
+		Name:      "gitlab",
+		Usage:     "mb ci gitlab [flags]",
+		ShortHelp: "Print a GitLab child pipeline with a job per affected target",
+		FlagSet:   gfs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Print a GitLab CI config with a job per affected target, for a
+			child pipeline triggered by the parent one, so that only what
+			changed builds. The job runs the build command of the target unless
+			-job-template is set. In a GitLab pipeline, the commit range
+			defaults to the changes of the merge request or of the push.
+		`, 80),
+		Exec: func([]string) error {
+			ctx := context.Background()
+			ctx, span := tracer.Start(ctx, "mb ci gitlab")
+			defer span.End()
+			tmpl := build.DefaultGitLabJobTemplate
+			if *jobTemplate != "" {
+				b, err := ioutil.ReadFile(*jobTemplate)
+				if err != nil {
+					return err
+				}
+				tmpl = string(b)
+			}
+			if err := gdf.resolveBase(ctx); err != nil {
+				return err
+			}
+			if *gdf.commitRange == "" && os.Getenv("GITLAB_CI") == "true" {
+				r, a := build.GitLabCIRange(os.Getenv)
+				*gdf.commitRange, *gall = r, *gall || a
+			}
+			b, err := gdf.buildContextQuiet(ctx)
+			if err != nil {
+				return err
+			}
+			b.All = *gall
+			out, err := b.GitLabPipeline(*jobName, tmpl, *gbuildable)
+			if err != nil {
+				return err
+			}
+			_, err = os.Stdout.Write(out)
+			return err
+		},
+	}
+	return &ffcli.Command{
+		Name:        "ci",
+		Usage:       "mb ci <subcommand>",
+		ShortHelp:   "Generate the configuration of CI systems from the affected targets",
+		FlagSet:     flag.NewFlagSet("mb ci", flag.ExitOnError),
+		Options:     []ff.Option{ff.WithEnvVarPrefix("MB")},
+		Subcommands: []*ffcli.Command{githubMatrix, gitlab},
+		LongHelp: collapse(`
+			Let the CI system build the affected targets in its own jobs, while
+			mb only detects them.
+		`, 80),
+	}
+}
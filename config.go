@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func configCommand() *ffcli.Command {
+	var (
+		fs         = flag.NewFlagSet("mb config effective", flag.ExitOnError)
+		configFile = fs.String("config", "./monobuild.yaml", "mb config file")
+		target     = fs.String("target", "", "Only print the target with this name or path")
+		format     = fs.String("format", "yaml", "Output format: yaml or json")
+	)
+	effective := &ffcli.Command{
+		Name:      "effective",
+		Usage:     "mb config effective [flags]",
+		ShortHelp: "Print the fully resolved config",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Print the config as the targets are built with it: merged with the
+			local override file, with the directory settings applied to the
+			targets and without the settings left to their default. Decrypted
+			!secret values are redacted.
+		`, 80),
+		Exec: func([]string) error {
+			ctx := context.Background()
+			c, local, err := build.EffectiveConfig(ctx, *configFile)
+			if err != nil {
+				return err
+			}
+			var v interface{} = c
+			if *target != "" {
+				t := c.Target(*target)
+				if t == nil {
+					if s := c.SuggestTargets(*target); len(s) > 0 {
+						return errors.Errorf("no target %s in %s, did you mean %s?", *target, *configFile, strings.Join(s, " or "))
+					}
+					return errors.Errorf("no target %s in %s", *target, *configFile)
+				}
+				v = t
+			}
+			// Round trip through YAML to only keep the config fields.
+			yb, err := yaml.Marshal(v)
+			if err != nil {
+				return err
+			}
+			var doc interface{}
+			if err := yaml.Unmarshal(yb, &doc); err != nil {
+				return err
+			}
+			doc = pruneEmpty(doc)
+			var out []byte
+			switch *format {
+			case "yaml":
+				if out, err = yaml.Marshal(doc); err != nil {
+					return err
+				}
+				header := "# Effective config of " + *configFile
+				if local != "" {
+					header += ", merged with " + local
+				}
+				out = append([]byte(header+"\n"), out...)
+			case "json":
+				if out, err = json.MarshalIndent(doc, "", "  "); err != nil {
+					return err
+				}
+				out = append(out, '\n')
+			default:
+				return errors.Errorf("unknown format %q", *format)
+			}
+			fmt.Print(build.RedactSecrets(string(out)))
+			return nil
+		},
+	}
+	schema := &ffcli.Command{
+		Name:      "schema",
+		Usage:     "mb config schema",
+		ShortHelp: "Print the JSON Schema of the config file",
+		FlagSet:   flag.NewFlagSet("mb config schema", flag.ExitOnError),
+		LongHelp: collapse(`
+			Print the JSON Schema of monobuild.yaml, for editors to validate and
+			complete the config, e.g. with a "# yaml-language-server: $schema="
+			comment. Unknown keys are errors, as they are for mb itself.
+		`, 80),
+		Exec: func([]string) error {
+			b, err := build.ConfigSchema()
+			if err != nil {
+				return err
+			}
+			_, err = os.Stdout.Write(b)
+			return err
+		},
+	}
+	return &ffcli.Command{
+		Name:        "config",
+		Usage:       "mb config <subcommand>",
+		ShortHelp:   "Inspect the config",
+		FlagSet:     flag.NewFlagSet("mb config", flag.ExitOnError),
+		Subcommands: []*ffcli.Command{effective, schema},
+	}
+}
+
+// pruneEmpty drops the empty values of a decoded YAML document, i.e. the
+// settings left to their default, and converts the map keys to strings so
+// that the document can be encoded as JSON.
+func pruneEmpty(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, e := range v {
+			if e = pruneEmpty(e); e != nil {
+				m[fmt.Sprint(k)] = e
+			}
+		}
+		if len(m) == 0 {
+			return nil
+		}
+		return m
+	case []interface{}:
+		var l []interface{}
+		for _, e := range v {
+			if e = pruneEmpty(e); e != nil {
+				l = append(l, e)
+			}
+		}
+		if len(l) == 0 {
+			return nil
+		}
+		return l
+	case string:
+		if v == "" {
+			return nil
+		}
+	case bool:
+		if !v {
+			return nil
+		}
+	case int:
+		if v == 0 {
+			return nil
+		}
+	}
+	return v
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func daemonCommand() *ffcli.Command {
+	ctx := context.Background()
+	run := &ffcli.Command{
+		Name:      "run",
+		Usage:     "mb daemon run",
+		ShortHelp: "Run the daemon in the foreground",
+		Exec: func([]string) error {
+			dir, err := os.Getwd()
+			if err != nil {
+				return err
+			}
+			return build.NewDaemon(dir).Serve(ctx)
+		},
+	}
+	start := &ffcli.Command{
+		Name:      "start",
+		Usage:     "mb daemon start",
+		ShortHelp: "Start the daemon in the background",
+		Exec: func(args []string) error {
+			return build.StartDaemon(ctx, args)
+		},
+	}
+	stop := &ffcli.Command{
+		Name:      "stop",
+		Usage:     "mb daemon stop",
+		ShortHelp: "Stop the daemon",
+		Exec: func([]string) error {
+			if err := build.NewDaemonClient().Do(ctx, "/stop", nil, nil); err != nil {
+				return errors.Errorf("the daemon is not running: %v", err)
+			}
+			fmt.Println("the daemon is stopped")
+			return nil
+		},
+	}
+	status := &ffcli.Command{
+		Name:      "status",
+		Usage:     "mb daemon status",
+		ShortHelp: "Print the status of the daemon",
+		Exec: func([]string) error {
+			s := &build.DaemonStatus{}
+			if err := build.NewDaemonClient().Do(ctx, "/status", nil, s); err != nil {
+				return errors.Errorf("the daemon is not running: %v", err)
+			}
+			fmt.Printf("pid: %d\ndir: %s\nuptime: %s\nplans: %d\ncache hits: %d\n",
+				s.PID, s.Dir, time.Since(s.Started).Round(time.Second), s.Plans, s.CacheHits)
+			return nil
+		},
+	}
+	runs := &ffcli.Command{
+		Name:      "runs",
+		Usage:     "mb daemon runs",
+		ShortHelp: "List the active runs of the repository",
+		Exec: func([]string) error {
+			runs, err := build.NewDaemonClient().Runs(ctx)
+			if err != nil {
+				return errors.Errorf("the daemon is not running: %v", err)
+			}
+			for _, r := range runs {
+				fmt.Printf("%s\tpid %d\t%s\tstarted %s ago\n", r.ID, r.PID, r.Branch, time.Since(r.Started).Round(time.Second))
+			}
+			return nil
+		},
+	}
+	cancel := &ffcli.Command{
+		Name:      "cancel",
+		Usage:     "mb daemon cancel <run ID>",
+		ShortHelp: "Cancel an active run",
+		LongHelp: collapse(`
+			Cancel the builds of an active run, which kills their commands. The
+			run is recorded as cancelled, neither failed nor alerted on.
+		`, 80),
+		Exec: func(args []string) error {
+			if len(args) != 1 {
+				return errors.Errorf("usage: mb daemon cancel <run ID>")
+			}
+			if err := build.NewDaemonClient().Cancel(ctx, args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("run %s cancelled\n", args[0])
+			return nil
+		},
+	}
+	return &ffcli.Command{
+		Name:        "daemon",
+		Usage:       "mb daemon <subcommand>",
+		ShortHelp:   "Manage the daemon that keeps the plan computation warm",
+		FlagSet:     flag.NewFlagSet("mb daemon", flag.ExitOnError),
+		Options:     []ff.Option{ff.WithEnvVarPrefix("MB")},
+		Subcommands: []*ffcli.Command{run, start, stop, status, runs, cancel},
+		LongHelp: collapse(`
+			The daemon of a repository listens on .monobuild/daemon.sock and keeps
+			the config and the Go dependencies of the targets loaded until the
+			config, HEAD or the working tree status changes. When the socket
+			exists, mb delegates the plan computation to the daemon and falls back
+			to computing it in-process if the daemon does not answer. The runs of
+			the repository register with the daemon, which can cancel them.
+		`, 80),
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func explainCommand() *ffcli.Command {
+	var (
+		fs            = flag.NewFlagSet("mb explain", flag.ExitOnError)
+		df            = registerDiffFlags(fs)
+		format        = fs.String("format", "markdown", "Output format: markdown or text")
+		post          = fs.String("post", "", "Post or update the explanation as a PR comment: github or gitlab")
+		pr            = fs.Int("pr", 0, "Pull request or merge request number to comment on")
+		githubRepo    = fs.String("github-repo", os.Getenv("GITHUB_REPOSITORY"), "GitHub repository (owner/name)")
+		githubAPIURL  = fs.String("github-api-url", os.Getenv("GITHUB_API_URL"), "GitHub API URL")
+		gitlabURL     = fs.String("gitlab-url", os.Getenv("CI_SERVER_URL"), "GitLab URL")
+		gitlabProject = fs.String("gitlab-project", os.Getenv("CI_PROJECT_ID"), "GitLab project ID or path")
+	)
+	return &ffcli.Command{
+		Name:      "explain",
+		Usage:     "mb explain [flags]",
+		ShortHelp: "Explain which targets will be rebuilt and why",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Render a summary of the affected targets and the changed files that
+			affect them. With -post, the summary is posted as a PR comment, or
+			the previous comment of mb explain is updated. The token is read from
+			GITHUB_TOKEN or GITLAB_TOKEN.
+		`, 80),
+		Exec: func([]string) error {
+			ctx := context.Background()
+			ctx, span := tracer.Start(ctx, "mb explain")
+			defer span.End()
+			b, err := df.buildContextQuiet(ctx)
+			if err != nil {
+				return err
+			}
+			out, err := b.Explain(*format)
+			if err != nil {
+				return err
+			}
+			fmt.Print(out)
+			switch *post {
+			case "":
+				return nil
+			case "github":
+				if *pr == 0 || *githubRepo == "" {
+					return errors.Errorf("-pr and -github-repo are required to post to GitHub")
+				}
+				return build.PostGitHubComment(ctx, *githubAPIURL, *githubRepo, os.Getenv("GITHUB_TOKEN"), *pr, out)
+			case "gitlab":
+				if *pr == 0 || *gitlabProject == "" {
+					return errors.Errorf("-pr and -gitlab-project are required to post to GitLab")
+				}
+				return build.PostGitLabNote(ctx, *gitlabURL, *gitlabProject, os.Getenv("GITLAB_TOKEN"), *pr, out)
+			default:
+				return errors.Errorf("unknown -post target %q", *post)
+			}
+		},
+	}
+}
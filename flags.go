@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/pkg/errors"
+)
+
+// diffFlags are the flags shared by the commands that compute a diff.
+type diffFlags struct {
+	commitRange *string
+	base        *string
+	configFile  *string
+	diffSources *string
+	staged      *bool
+	untracked   *bool
+	files       *string
+	filesFrom   *string
+	bareRepo    *string
+	noDaemon    *bool
+	pathspecs   *stringsFlag
+
+	planCache    *bool
+	planCacheDir *string
+	planCacheURL *string
+
+	gerritURL      *string
+	gerritChange   *string
+	gerritRevision *string
+	bitbucketURL   *string
+	bitbucketRepo  *string
+	bitbucketPR    *int
+}
+
+func registerDiffFlags(fs *flag.FlagSet) *diffFlags {
+	pathspecs := &stringsFlag{}
+	fs.Var(pathspecs, "pathspec", "Restrict the changed files to this git pathspec, e.g. 'services/**' or ':!docs'. Repeatable")
+	return &diffFlags{
+		pathspecs:   pathspecs,
+		commitRange: fs.String("commit-range", "", "Will be used as `git diff --name-only [commit-range]` to find file changes"),
+		base:        fs.String("base", "", "Diff HEAD against its merge base with this branch of origin, e.g. main, fetched when missing, instead of -commit-range"),
+		configFile:  fs.String("config", "./monobuild.yaml", "mb config file"),
+		diffSources: fs.String("diff-sources", build.SourceGit, "Comma-separated diff sources to combine: git, staged, untracked, files, gerrit, bitbucket"),
+		staged:      fs.Bool("staged", false, "Add the changes staged in the index to the diff sources, e.g. the files added with git add"),
+		untracked:   fs.Bool("include-untracked", false, "Add the untracked files that are not ignored to the diff sources"),
+		files:       fs.String("files", "", "Comma-separated list of changed files, combined with the other diff sources"),
+		filesFrom:   fs.String("files-from", "", "Read a newline-separated list of changed files from this file (- for stdin)"),
+		bareRepo:    fs.String("bare-repo", "", "Analyze the commit range against a bare clone at this path without a checkout (implies -diff-only)"),
+		noDaemon:    fs.Bool("no-daemon", false, "Compute the plan in-process even when a daemon is running"),
+
+		planCache:    fs.Bool("plan-cache", true, "Reuse the plan computed for the same commit range and config"),
+		planCacheDir: fs.String("plan-cache-dir", build.DefaultPlanCacheDir(), "Local directory of the plan cache"),
+		planCacheURL: fs.String("plan-cache-url", "", "Remote plan cache URL, where plans are stored with GET and PUT <url>/<key>.json"),
+
+		gerritURL:      fs.String("gerrit-url", "", "Gerrit URL of the gerrit diff source (credentials from GERRIT_USER and GERRIT_PASSWORD)"),
+		gerritChange:   fs.String("gerrit-change", "", "Gerrit change number or ID"),
+		gerritRevision: fs.String("gerrit-revision", "current", "Gerrit change revision"),
+		bitbucketURL:   fs.String("bitbucket-url", "https://api.bitbucket.org", "Bitbucket Cloud API or Bitbucket Server URL of the bitbucket diff source (credentials from BITBUCKET_USER and BITBUCKET_TOKEN)"),
+		bitbucketRepo:  fs.String("bitbucket-repo", "", "Bitbucket repository: workspace/repo on Cloud, PROJECT/repo on Server"),
+		bitbucketPR:    fs.Int("bitbucket-pr", 0, "Bitbucket pull request ID"),
+	}
+}
+
+// buildContext creates the build.BuildContext described by the flags and diffs it.
+func (d *diffFlags) buildContext(ctx context.Context) (*build.BuildContext, error) {
+	return d.newBuildContext(ctx, false)
+}
+
+// buildContextQuiet is like buildContext but silences the debug output of
+// Diff, for commands whose stdout is meant to be consumed.
+func (d *diffFlags) buildContextQuiet(ctx context.Context) (*build.BuildContext, error) {
+	return d.newBuildContext(ctx, true)
+}
+
+// resolveBase sets the commit range to the changes since the merge base
+// with the -base branch.
+func (d *diffFlags) resolveBase(ctx context.Context) error {
+	if *d.base == "" {
+		return nil
+	}
+	if *d.commitRange != "" {
+		return errors.New("-base and -commit-range are mutually exclusive")
+	}
+	if *d.bareRepo != "" {
+		return errors.New("-base needs a checkout, it cannot be used with -bare-repo")
+	}
+	r, err := build.BaseRange(ctx, *d.base)
+	if err != nil {
+		return err
+	}
+	*d.commitRange, *d.base = r, ""
+	return nil
+}
+
+// sources returns the diff sources of -diff-sources, with the staged and
+// untracked ones of -staged and -include-untracked.
+func (d *diffFlags) sources() string {
+	sources := *d.diffSources
+	if *d.staged {
+		sources += "," + build.SourceStaged
+	}
+	if *d.untracked {
+		sources += "," + build.SourceUntracked
+	}
+	return sources
+}
+
+func (d *diffFlags) newBuildContext(ctx context.Context, quiet bool) (*build.BuildContext, error) {
+	if err := d.resolveBase(ctx); err != nil {
+		return nil, err
+	}
+	if *d.bareRepo != "" {
+		b, err := build.NewBareBuildContext(ctx, *d.bareRepo, *d.configFile, *d.commitRange)
+		if err != nil {
+			return nil, err
+		}
+		b.Quiet = quiet
+		b.Pathspecs = *d.pathspecs
+		if err := b.Diff(ctx); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	fileList := build.SplitList(*d.files)
+	if *d.filesFrom != "" {
+		ff, err := build.ReadFileList(*d.filesFrom)
+		if err != nil {
+			return nil, err
+		}
+		fileList = append(fileList, ff...)
+	}
+	opts := d.diffOptions(fileList)
+	// Only the plans of a git commit range are cached.
+	cache := &build.PlanCache{Dir: *d.planCacheDir, URL: *d.planCacheURL}
+	var key string
+	cacheable := *d.planCache && d.sources() == build.SourceGit && len(fileList) == 0
+	if cacheable {
+		key, cacheable = build.PlanKey(ctx, *d.configFile, *d.commitRange, *d.pathspecs...)
+	}
+	if cacheable {
+		if b, ok := cache.Get(ctx, key); ok {
+			b.Quiet = quiet
+			if !quiet {
+				fmt.Printf("plan cache hit: %s\n", key)
+			}
+			return b, nil
+		}
+	}
+	b, err := d.computePlan(ctx, quiet, opts)
+	if err != nil {
+		return nil, err
+	}
+	if cacheable {
+		cache.Put(ctx, key, b)
+	}
+	return b, nil
+}
+
+// computePlan creates and diffs the BuildContext, with the daemon when one
+// is running.
+func (d *diffFlags) computePlan(ctx context.Context, quiet bool, opts build.DiffOptions) (*build.BuildContext, error) {
+	if !*d.noDaemon && daemonListening() {
+		dir, _ := os.Getwd()
+		b, err := build.DelegatePlan(ctx, &build.PlanRequest{Dir: dir, ConfigFile: *d.configFile, DiffSources: d.sources(), Options: opts})
+		if err == nil {
+			b.Quiet = quiet
+			return b, nil
+		}
+		build.Log.Warn("daemon failed, computing the plan in-process", "error", err)
+	}
+	b, err := build.NewLazyBuildContext(ctx, *d.configFile, *d.commitRange)
+	if err != nil {
+		return nil, err
+	}
+	b.Quiet = quiet
+	b.Pathspecs = opts.Pathspecs
+	if b.Providers, err = build.NewDiffProviders(d.sources(), opts); err != nil {
+		return nil, err
+	}
+	if err := b.Diff(ctx); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (d *diffFlags) diffOptions(files []string) build.DiffOptions {
+	return build.DiffOptions{
+		CommitRange: *d.commitRange,
+		Files:       files,
+		Pathspecs:   *d.pathspecs,
+		Gerrit: build.GerritChange{
+			URL:      *d.gerritURL,
+			Change:   *d.gerritChange,
+			Revision: *d.gerritRevision,
+			User:     os.Getenv("GERRIT_USER"),
+			Password: os.Getenv("GERRIT_PASSWORD"),
+		},
+		Bitbucket: build.BitbucketPR{
+			URL:   *d.bitbucketURL,
+			Repo:  *d.bitbucketRepo,
+			PR:    *d.bitbucketPR,
+			User:  os.Getenv("BITBUCKET_USER"),
+			Token: os.Getenv("BITBUCKET_TOKEN"),
+		},
+	}
+}
+
+// stringsFlag is a flag that can be repeated, e.g. -set.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// levelFlag is a boolean flag that sets the level of build.Log, e.g. -verbose.
+type levelFlag struct {
+	level int
+	set   bool
+}
+
+func (f *levelFlag) IsBoolFlag() bool { return true }
+
+func (f *levelFlag) String() string { return strconv.FormatBool(f.set) }
+
+func (f *levelFlag) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if f.set = v; v {
+		build.Log.Level = f.level
+	}
+	return nil
+}
+
+// logFormatFlag sets the format of build.Log.
+type logFormatFlag struct{}
+
+func (logFormatFlag) String() string { return build.LogText }
+
+func (logFormatFlag) Set(s string) error { return build.Log.SetFormat(s) }
+
+// registerLogFlags registers -verbose, -quiet and -log-format, which
+// configure build.Log as soon as they are parsed, for every subcommand.
+func registerLogFlags(fs *flag.FlagSet) {
+	fs.Var(&levelFlag{level: build.LevelDebug}, "verbose", "Log the debug messages, e.g. why each changed file affects a target")
+	fs.Var(&levelFlag{level: build.LevelWarn}, "quiet", "Only log the warnings and errors")
+	fs.Var(logFormatFlag{}, "log-format", "Format of the log messages written to stderr: text or json")
+}
+
+// daemonListening reports whether a daemon socket exists in the working
+// directory.
+func daemonListening() bool {
+	_, err := os.Stat(build.DaemonSocket)
+	return err == nil
+}
+
+// hiddenFlags are the flags left out of the help of mb, e.g. to test a CI
+// pipeline. They are parsed and removed from the args before ffcli parses
+// them, and can be set with their MB_ environment variables too.
+type hiddenFlags struct {
+	fs             *flag.FlagSet
+	injectFailures stringsFlag
+	injectRate     *float64
+}
+
+var hidden = newHiddenFlags()
+
+func newHiddenFlags() *hiddenFlags {
+	h := &hiddenFlags{fs: flag.NewFlagSet("mb", flag.ContinueOnError)}
+	h.fs.Var(&h.injectFailures, "inject-failure", "Fail the build of a target without running it: target=<name or path>. Repeatable")
+	h.injectRate = h.fs.Float64("inject-failure-rate", 0, "Probability of failing the build of each target without running it")
+	return h
+}
+
+// parse sets the hidden flags of args, up to --, and returns the others.
+func (h *hiddenFlags) parse(args []string) ([]string, error) {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			return append(rest, args[i:]...), nil
+		}
+		name := strings.TrimLeft(a, "-")
+		kv := strings.SplitN(name, "=", 2)
+		if !strings.HasPrefix(a, "-") || h.fs.Lookup(kv[0]) == nil {
+			rest = append(rest, a)
+			continue
+		}
+		if len(kv) == 1 {
+			if i+1 == len(args) {
+				return nil, errors.Errorf("flag needs an argument: %s", a)
+			}
+			i++
+			kv = append(kv, args[i])
+		}
+		if err := h.fs.Set(kv[0], kv[1]); err != nil {
+			return nil, errors.Wrapf(err, "-%s", kv[0])
+		}
+	}
+	if len(h.injectFailures) == 0 && os.Getenv("MB_INJECT_FAILURE") != "" {
+		h.injectFailures = build.SplitList(os.Getenv("MB_INJECT_FAILURE"))
+	}
+	if v := os.Getenv("MB_INJECT_FAILURE_RATE"); *h.injectRate == 0 && v != "" {
+		if err := h.fs.Set("inject-failure-rate", v); err != nil {
+			return nil, errors.Wrap(err, "MB_INJECT_FAILURE_RATE")
+		}
+	}
+	return rest, nil
+}
+
+// inject injects the failures of the flags into the build.
+func (h *hiddenFlags) inject(b *build.BuildContext) error {
+	if len(h.injectFailures) == 0 && *h.injectRate == 0 {
+		return nil
+	}
+	return b.InjectFailures(h.injectFailures, *h.injectRate)
+}
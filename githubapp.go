@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func githubAppCommand() *ffcli.Command {
+	var (
+		fs             = flag.NewFlagSet("mb github-app", flag.ExitOnError)
+		addr           = fs.String("addr", ":8080", "Address of the webhook server")
+		apiAddr        = fs.String("api-addr", "127.0.0.1:8081", "Address of the unauthenticated /builds API, keep it private. Empty disables the API")
+		appID          = fs.String("app-id", "", "GitHub App ID")
+		privateKeyFile = fs.String("private-key", "", "GitHub App private key (PEM) file")
+		webhookSecret  = fs.String("webhook-secret", "", "Webhook secret used to verify the payload signatures, required")
+		apiURL         = fs.String("github-api-url", "https://api.github.com", "GitHub API URL")
+		reposDir       = fs.String("repos-dir", filepath.Join(os.TempDir(), "mb-github-app"), "Directory of the bare clones")
+		configFile     = fs.String("config", "monobuild.yaml", "mb config file path inside the repositories")
+		maxInFlight    = fs.Int("max-in-flight", 2, "Maximum number of check suites computed at the same time")
+		branchPriority = fs.String("branch-priority", "main,master,release/*", "Comma-separated branch patterns, optionally with =<priority>, whose check suites start first")
+		schedules      = fs.String("schedule", "", "Comma-separated <owner>/<repo>@<branch>=<interval> whose branch head is checked every interval")
+	)
+	return &ffcli.Command{
+		Name:      "github-app",
+		Usage:     "mb github-app [flags]",
+		ShortHelp: "Run as a GitHub App that creates a check run per target",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Run a daemon that authenticates as a GitHub App and receives
+			check_suite webhooks. For every requested check suite, the repository
+			is fetched into a bare clone, the affected targets of the head SHA are
+			computed without a checkout and a check run is created per target.
+
+			The check suites of the webhooks, of the /builds API and of the
+			schedules go through a queue: at most -max-in-flight are computed at
+			the same time, the branches of -branch-priority start first, the
+			repositories with the fewest check suites in flight go next and a
+			push replaces the queued check suite of the same branch.
+
+			The /builds API has no authentication: it is served on -api-addr, the
+			loopback interface by default, not on the public webhook address.
+		`, 80),
+		Exec: func([]string) error {
+			if *appID == "" || *privateKeyFile == "" || *webhookSecret == "" {
+				return errors.Errorf("-app-id, -private-key and -webhook-secret are required")
+			}
+			pemBytes, err := ioutil.ReadFile(*privateKeyFile)
+			if err != nil {
+				return err
+			}
+			key, err := build.ParseRSAPrivateKey(pemBytes)
+			if err != nil {
+				return err
+			}
+			priorities, err := build.ParseBranchPriorities(*branchPriority)
+			if err != nil {
+				return err
+			}
+			scheduled, err := build.ParseSchedules(*schedules)
+			if err != nil {
+				return err
+			}
+			app := &build.GitHubApp{
+				AppID:         *appID,
+				PrivateKey:    key,
+				WebhookSecret: []byte(*webhookSecret),
+				APIURL:        strings.TrimSuffix(*apiURL, "/"),
+				ReposDir:      *reposDir,
+				ConfigFile:    *configFile,
+				Queue:         build.NewBuildQueue(*maxInFlight, priorities),
+			}
+			for _, s := range scheduled {
+				go app.Schedule(context.Background(), s.Repository, s.Branch, s.Every)
+			}
+			errs := make(chan error, 2)
+			if *apiAddr != "" {
+				api := http.NewServeMux()
+				api.HandleFunc("/builds", app.ServeAPI)
+				log.Printf("mb github-app API listening on %s", *apiAddr)
+				go func() { errs <- http.ListenAndServe(*apiAddr, api) }()
+			}
+			mux := http.NewServeMux()
+			mux.Handle("/webhook", app)
+			log.Printf("mb github-app listening on %s", *addr)
+			go func() { errs <- http.ListenAndServe(*addr, mux) }()
+			return <-errs
+		},
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+func graphCommand() *ffcli.Command {
+	var (
+		fs         = flag.NewFlagSet("mb graph", flag.ExitOnError)
+		configFile = fs.String("config", "./monobuild.yaml", "mb config file")
+	)
+	return &ffcli.Command{
+		Name:      "graph",
+		Usage:     "mb graph [flags] | dot -Tsvg > graph.svg",
+		ShortHelp: "Print the dependency graph of the targets in Graphviz DOT",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Print a DOT graph of the Go packages, dependency directories and
+			watched files of every target, with an edge from each of them to the
+			target a change of it affects. Dashed edges are depends_on.
+		`, 80),
+		Exec: func([]string) error {
+			b, err := build.NewBuildContext(context.Background(), *configFile, "")
+			if err != nil {
+				return err
+			}
+			return b.WriteGraph(os.Stdout)
+		},
+	}
+}
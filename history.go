@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func historyCommand() *ffcli.Command {
+	var (
+		fs          = flag.NewFlagSet("mb history compare", flag.ExitOnError)
+		runsDir     = fs.String("runs-dir", build.DefaultRunsDir, "the directory of the run records")
+		run         = fs.String("run", "", "Run ID or path of the run record to compare. Defaults to the latest run of -branch")
+		branch      = fs.String("branch", "", "Branch of the latest run. Defaults to the latest run of any branch")
+		threshold   = fs.Float64("slow-threshold", 0.5, "Relative duration increase over which a build is newly slow, e.g. 0.5 for 50%")
+		minSlowdown = fs.Duration("min-slowdown", 10*time.Second, "Duration increase under which a build is never newly slow")
+		format      = fs.String("format", "text", "Output format: text, json or markdown")
+		fail        = fs.Bool("fail-on-regression", false, "Fail if a target is newly failing, flaky or slow")
+	)
+	compare := &ffcli.Command{
+		Name:      "compare",
+		Usage:     "mb history compare [flags]",
+		ShortHelp: "Compare the latest run with the previous builds of its branch",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Compare the targets of a run with their previous build on the same
+			branch, from the run records: the targets newly failing, newly flaky,
+			whose outcome changed with the same inputs or on the same commit, newly
+			slow, over -slow-threshold and -min-slowdown, and fixed. The markdown
+			format is meant for PR comments.
+		`, 80),
+		Exec: func([]string) error {
+			runs, err := build.ReadRuns(*runsDir)
+			if err != nil {
+				return err
+			}
+			var r *build.Run
+			if *run != "" {
+				r, err = build.ReadRun(*runsDir, *run)
+			} else {
+				r, err = build.LatestRun(runs, *branch)
+			}
+			if err != nil {
+				return err
+			}
+			c := build.CompareRuns(runs, r, build.CompareOptions{SlowThreshold: *threshold, MinSlowdown: *minSlowdown})
+			if err := c.Write(os.Stdout, *format); err != nil {
+				return err
+			}
+			if *fail && c.Regressed() {
+				return errors.Errorf("run %s regressed", r.ID)
+			}
+			return nil
+		},
+	}
+	return &ffcli.Command{
+		Name:        "history",
+		Usage:       "mb history <subcommand>",
+		ShortHelp:   "Inspect the build history",
+		FlagSet:     flag.NewFlagSet("mb history", flag.ExitOnError),
+		Subcommands: []*ffcli.Command{compare},
+	}
+}
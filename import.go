@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+func importCommand() *ffcli.Command {
+	github := &ffcli.Command{
+		Name:      "github-paths-filter",
+		Usage:     "mb import github-paths-filter <workflow.yml>",
+		ShortHelp: "Convert the path filters of a GitHub Actions workflow into targets",
+		FlagSet:   flag.NewFlagSet("mb import github-paths-filter", flag.ExitOnError),
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Print the targets of the paths of the push and pull_request triggers
+			of a workflow, and of the filters of its dorny/paths-filter steps.
+		`, 80),
+		Exec: func(args []string) error {
+			if len(args) != 1 {
+				return errors.New("usage: mb import github-paths-filter <workflow.yml>")
+			}
+			return printImport(build.ImportGitHubPathsFilter(args[0]))
+		},
+	}
+	gitlab := &ffcli.Command{
+		Name:      "gitlab-rules",
+		Usage:     "mb import gitlab-rules <.gitlab-ci.yml>",
+		ShortHelp: "Convert the rules:changes of GitLab CI jobs into targets",
+		FlagSet:   flag.NewFlagSet("mb import gitlab-rules", flag.ExitOnError),
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Print the targets of the jobs that run on rules:changes or
+			only:changes, built by the job script.
+		`, 80),
+		Exec: func(args []string) error {
+			if len(args) != 1 {
+				return errors.New("usage: mb import gitlab-rules <.gitlab-ci.yml>")
+			}
+			return printImport(build.ImportGitLabRules(args[0]))
+		},
+	}
+	return &ffcli.Command{
+		Name:        "import",
+		Usage:       "mb import <subcommand>",
+		ShortHelp:   "Convert the path filters of a CI system into targets",
+		FlagSet:     flag.NewFlagSet("mb import", flag.ExitOnError),
+		Subcommands: []*ffcli.Command{github, gitlab},
+	}
+}
+
+// printImport prints the imported targets as config YAML, and the warnings of
+// the conversion to stderr.
+func printImport(imp *build.Import, err error) error {
+	if err != nil {
+		return err
+	}
+	if len(imp.Targets) == 0 {
+		return errors.New("no path filter found")
+	}
+	b, err := yaml.Marshal(imp)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(b))
+	for _, w := range imp.Warnings {
+		build.Log.Warn("the path filter is not imported exactly", "warning", w)
+	}
+	return nil
+}
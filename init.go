@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func initCommand() *ffcli.Command {
+	var (
+		fs         = flag.NewFlagSet("mb init", flag.ExitOnError)
+		configFile = fs.String("config", "./monobuild.yaml", "mb config file to write")
+		force      = fs.Bool("force", false, "Overwrite the config file when it exists")
+		dryRun     = fs.Bool("dry-run", false, "Print the config instead of writing it")
+	)
+	return &ffcli.Command{
+		Name:      "init",
+		Usage:     "mb init [flags]",
+		ShortHelp: "Write a starter config with the targets found in the repository",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Inspect the repository and write a starter config: a target per Go
+			main package and per Cargo, Maven or Gradle project, and the top-level
+			directories of the other Go packages as dep_source_dirs.
+		`, 80),
+		Exec: func([]string) error {
+			b, err := build.ScaffoldConfig(".")
+			if err != nil {
+				return err
+			}
+			if *dryRun {
+				fmt.Print(string(b))
+				return nil
+			}
+			if _, err := os.Stat(*configFile); err == nil && !*force {
+				return errors.Errorf("%s already exists, use -force to overwrite it", *configFile)
+			}
+			if err := ioutil.WriteFile(*configFile, b, 0644); err != nil {
+				return err
+			}
+			fmt.Printf("%s written, review it and run `mb validate`\n", *configFile)
+			return nil
+		},
+	}
+}
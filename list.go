@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+func listCommand() *ffcli.Command {
+	var (
+		fs        = flag.NewFlagSet("mb list", flag.ExitOnError)
+		df        = registerDiffFlags(fs)
+		format    = fs.String("format", "text", "Output format: text, one target path per line, or json with the reasons")
+		all       = fs.Bool("all", false, "List every target regardless of the changes")
+		buildable = fs.Bool("buildable", false, "Only list the targets with a build command or steps")
+		attest    = registerAttestFlags(fs)
+	)
+	return &ffcli.Command{
+		Name:      "list",
+		Usage:     "mb list [flags]",
+		ShortHelp: "List the affected targets without building them",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Print the path of every affected target, e.g. for a CI pipeline that
+			fans out its own jobs. No build command runs. The json format lists
+			the changed files that affect each target.
+		`, 80),
+		Exec: func([]string) error {
+			ctx := context.Background()
+			ctx, span := tracer.Start(ctx, "mb list")
+			defer span.End()
+			b, err := df.buildContextQuiet(ctx)
+			if err != nil {
+				return err
+			}
+			b.All = *all
+			if err := attest.write(ctx, b); err != nil {
+				return err
+			}
+			return build.WriteAffected(os.Stdout, b.Affected(*buildable), *format)
+		},
+	}
+}
@@ -2,426 +2,276 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/bzon/monobuild/pkg/build"
 	"github.com/mitchellh/go-wordwrap"
 	"github.com/peterbourgon/ff"
 	"github.com/peterbourgon/ff/ffcli"
-	"go.opencensus.io/exporter/jaeger"
-	"go.opencensus.io/trace"
-
 	"github.com/pkg/errors"
-	"gopkg.in/yaml.v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 func main() {
+	// The build commands of a target with an ulimit run through mb, which
+	// sets the limits before it executes them.
+	if len(os.Args) > 1 && os.Args[1] == build.UlimitExec {
+		build.ExecUlimited(os.Args[2:])
+	}
 	var (
-		gfs         = flag.NewFlagSet("mb", flag.ExitOnError)
-		commitRange = gfs.String("commit-range", "", "Will be used as `git diff --name-only [commit-range]` to find file changes")
-		configFile  = gfs.String("config", "./monobuild.yaml", "mb config file")
-		diffOnly    = gfs.Bool("diff-only", false, "View changes without building")
-		// TODO - put this on another command called 'mb trace'
-		jaegerTrace       = gfs.Bool("trace", false, "Debug monobuild with Jaeger tracing")
-		jaegerAgentEp     = gfs.String("trace-jaeger-agent", "localhost:6831", "Jaeger agent endpoint")
-		jaegerCollectorEp = gfs.String("trace-jaeger-collector", "http://localhost:14268/api/traces", "jaeger collector endpoint API URI.")
+		gfs      = flag.NewFlagSet("mb", flag.ExitOnError)
+		df       = registerDiffFlags(gfs)
+		diffOnly = gfs.Bool("diff-only", false, "View changes without building")
+		output   = gfs.String("output", build.RenderPretty, "Render the diff and the build as pretty, json, yaml, table, quiet, github, teamcity or bamboo")
+		buildAll = gfs.Bool("all", false, "Build every target regardless of the changes")
+		ciMode   = gfs.Bool("ci", os.Getenv("CI") != "", "Run in CI mode, which requires an approval to build protected targets")
+		fetch    = gfs.Bool("fetch", true, "Fetch the git history and refs required by the affected targets instead of failing")
+		verify   = gfs.Bool("verify-reproducible", false, "Build the affected targets with outputs twice in isolated worktrees and fail if their artifacts differ")
+		printCfg = gfs.Bool("print-config", false, "Print the config merged with its local override file, e.g. monobuild.local.yaml, and exit")
+		runsDir  = gfs.String("runs-dir", build.DefaultRunsDir, "Where the input and artifact digests of the built targets are recorded")
+		branch   = gfs.String("branch", "", "Branch of the run, for alerting. Defaults to the checked out branch")
+		results  = gfs.String("result-dir", "", "Write the result file of every built target to <dir>/<target>/result.json. Defaults to the result_dir of the config")
+		noCache  = gfs.Bool("no-cache", false, "Build the affected targets even when the build cache has a successful build of their inputs")
+		cacheDir = gfs.String("cache-dir", build.DefaultCacheDir(), "Directory of the build cache")
+		parallel = gfs.Int("parallel", 0, "Maximum number of targets built at the same time. Defaults to the parallel setting of the config, or 1")
+		determ   = gfs.Bool("deterministic", false, "Build the targets in path order and print the plan and the build output in a stable order, instead of the longest builds first")
+		dirty    = gfs.String("dirty-check", build.DirtyWarn, "Warn about, fail on or ignore the uncommitted changes to the inputs of the affected targets when building a commit range: warn, fail or ignore")
+		seed     = gfs.Int64("seed", 0, "Seed of the order of the parallel builds of the same expected duration, as printed by a previous run. Random when 0")
+		groupBy  = gfs.String("group-by", "", "Group the summary of the run by the value of this target label, e.g. team")
+		mdSum    = gfs.String("markdown-summary", "", "Append a markdown summary of the run to this file, e.g. $GITHUB_STEP_SUMMARY")
+		pushgw   = gfs.String("metrics-pushgateway", "", "Push the metrics of the run to this Prometheus Pushgateway URL, e.g. http://pushgateway:9091")
+		statsd   = gfs.String("metrics-statsd", "", "Send the metrics of the run to this statsd address, e.g. localhost:8125")
+		mPrefix  = gfs.String("metrics-prefix", "mb", "Prefix of the metric names, and job of the Pushgateway")
+		telURL   = gfs.String("telemetry-endpoint", "", "Post an anonymous usage report of the run to this URL. Defaults to the telemetry endpoint of the config")
+		noTel    = gfs.Bool("no-telemetry", false, "Never send usage reports, even with a telemetry endpoint in the config")
+		detailed = gfs.Bool("detailed-exit-code", false, "Exit with 3 instead of 0 when no target is affected, e.g. to skip the next CI steps of a no-op run")
+		keepGo   = gfs.Bool("keep-going", false, "Build every affected target even when one fails, and fail at the end with the failed targets. Parallel builds always keep going")
+		otlpTrace    = gfs.Bool("trace", false, "Debug monobuild with OpenTelemetry tracing, exported with OTLP")
+		otlpEndpoint = gfs.String("trace-endpoint", "", "OTLP/HTTP endpoint URL of the traces, e.g. http://localhost:4318. Defaults to the OTEL_EXPORTER_OTLP_ENDPOINT variable, or localhost:4318")
 	)
+	var sets, reports, approvalKeys stringsFlag
+	gfs.Var(&approvalKeys, "approval-key", "Ed25519 public key of an approver of the protected targets, a PKIX PEM file outside of the repository, e.g. of mb attest keygen. Repeatable")
+	gfs.Var(&reports, "report", "Write a report of the run: junit=<path>, a JUnit XML test case per target. Repeatable")
+	gfs.Var(&sets, "set", "Override a build command field of a target for this run: target.<name or path>.<command|args|dir|timeout|env.KEY>=<value>, e.g. target.cmd/server.args=[build, -race, ./cmd/server]. Repeatable")
+	gfs.BoolVar(&build.NoColor, "no-color", false, "Never color the pretty output, e.g. for CI logs")
+	gfs.BoolVar(&build.NonInteractive, "non-interactive", false, "Never prompt nor read stdin, and prefix every line of the build output with the target path")
+	registerLogFlags(gfs)
+	attest := registerAttestFlags(gfs)
+	var (
+		vfs         = flag.NewFlagSet("mb validate", flag.ExitOnError)
+		vconfigFile = vfs.String("config", "./monobuild.yaml", "mb config file")
+	)
+	validate := &ffcli.Command{
+		Name:      "validate",
+		Usage:     "mb validate [flags]",
+		ShortHelp: "Validate the config file",
+		FlagSet:   vfs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Validate the config file and the Go dependencies of every target.
+			Fails if a deprecated target is past its sunset date.
+		`, 80),
+		Exec: func([]string) error {
+			ctx := context.Background()
+			b, err := build.NewBuildContext(ctx, *vconfigFile, "")
+			if err != nil {
+				return err
+			}
+			var expired []string
+			for _, t := range b.Config.Targets {
+				if t.Deprecated == "" {
+					continue
+				}
+				if t.PastSunset(time.Now()) {
+					expired = append(expired, t.Path)
+					continue
+				}
+				build.Log.Warn("the target is deprecated", "target", t.Path, "reason", t.Deprecated)
+			}
+			if len(expired) > 0 {
+				return errors.Errorf("deprecated targets past their sunset date: %s", strings.Join(expired, ", "))
+			}
+			fmt.Printf("%s is valid\n", *vconfigFile)
+			return nil
+		},
+	}
 	root := &ffcli.Command{
-		Usage:   "mb [flags]",
-		FlagSet: gfs,
-		Options: []ff.Option{ff.WithEnvVarPrefix("MB")},
+		Usage:       "mb [flags] <subcommand>",
+		FlagSet:     gfs,
+		Options:     []ff.Option{ff.WithEnvVarPrefix("MB")},
+		Subcommands: []*ffcli.Command{validate, explainCommand(), benchAnalyzerCommand(), githubAppCommand(), secretCommand(), artifactsCommand(), daemonCommand(), configCommand(), statsCommand(), importCommand(), graphCommand(), initCommand(), watchCommand(), toolsCommand(), historyCommand(), listCommand(), metaCommand(), actionCommand(), ciCommand(), auditCommand(), attestCommand(), testCommand(), releaseScopeCommand(), versionCommand(), selfUpdateCommand(), outputsCommand(), approveCommand()},
 		LongHelp: collapse(`
 			mb is a build tool for Go monorepos.
 		`, 80),
 		Exec: func([]string) error {
-			if *jaegerTrace {
+			ctx := context.Background()
+			if *otlpTrace {
 				fmt.Println("Tracing is enabled.")
-				je, err := jaeger.NewExporter(jaeger.Options{
-					AgentEndpoint:     *jaegerAgentEp,
-					CollectorEndpoint: *jaegerCollectorEp,
-					ServiceName:       "mb-cli",
-				})
+				tp, err := startTracing(ctx, *otlpEndpoint)
 				if err != nil {
-					errors.Errorf("failed to create the Jaeger exporter: %v", err)
+					return err
 				}
-				trace.RegisterExporter(je)
-				trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+				defer func() {
+					if err := tp.Shutdown(context.Background()); err != nil {
+						build.Log.Warn("cannot export the traces", "error", err)
+					}
+				}()
 			}
-			ctx := context.Background()
-			ctx, span := trace.StartSpan(ctx, "ffcli.Command.Exec()")
+			ctx, span := tracer.Start(ctx, "ffcli.Command.Exec()")
 			defer span.End()
 
-			b, err := NewBuildContext(ctx, *configFile, *commitRange)
+			if *printCfg {
+				fb, _, err := build.ReadConfig(ctx, *df.configFile)
+				if err != nil {
+					return err
+				}
+				fmt.Print(build.RedactSecrets(string(fb)))
+				return nil
+			}
+			renderer, err := build.NewRenderer(*output)
 			if err != nil {
 				return err
 			}
-			if err := b.Diff(ctx); err != nil {
+			newBuildContext := df.buildContext
+			if *output != build.RenderPretty {
+				newBuildContext = df.buildContextQuiet
+			}
+			b, err := newBuildContext(ctx)
+			if err != nil {
 				return err
 			}
-			// TODO - pretty print the diff here.
-			fmt.Println("Diff()")
-			fmt.Println(b)
-			if *diffOnly {
-				fmt.Println("diff only")
-				return nil
+			b.All = *buildAll
+			if *determ {
+				b.Sort()
 			}
-			return b.MonoBuild(ctx)
-		},
-	}
-	err := root.Run(os.Args[1:])
-	if *jaegerTrace {
-		time.Sleep(3 * time.Second)
-	}
-	if err != nil {
-		errfatal(err)
-	}
-}
-
-func NewBuildContext(ctx context.Context, configFile, commitRange string) (*BuildContext, error) {
-	ctx, span := trace.StartSpan(ctx, "NewBuildContext")
-	defer span.End()
-	b := &BuildContext{
-		CommitRange: commitRange,
-		ConfigFile:  configFile,
-	}
-	// Parse the config file.
-	fb, err := ioutil.ReadFile(b.ConfigFile)
-	if err != nil {
-		return nil, err
-	}
-	if err := yaml.Unmarshal(fb, &b.Config); err != nil {
-		return nil, err
-	}
-	// Validate the config file.
-	if err := b.Config.validate(ctx); err != nil {
-		return nil, err
-	}
-	// Parse each target Go dependencies and watched files.
-	for i := range b.Config.Targets {
-		if err := b.Config.Targets[i].parseGoDeps(ctx); err != nil {
-			return nil, err
-		}
-		if err := b.Config.Targets[i].parseWatchedFiles(ctx); err != nil {
-			return nil, err
-		}
-	}
-	span.AddAttributes(trace.StringAttribute("build_context", b.String()))
-	return b, nil
-}
-
-// BuildContext represents a monobuild execution context.
-type BuildContext struct {
-	Config      Config
-	Files       []*File
-	ConfigFile  string
-	CommitRange string
-}
-
-func (b *BuildContext) String() string {
-	bc, err := json.MarshalIndent(b, "", "  ")
-	if err != nil {
-		panic(err)
-	}
-	return string(bc)
-}
-
-func (b *BuildContext) Diff(ctx context.Context) error {
-	ctx, span := trace.StartSpan(ctx, "*BuildContext.Diff()")
-	defer span.End()
-	// TODO - use go-git package!
-	cmd := &exec.Cmd{}
-	if b.CommitRange == "" {
-		cmd = exec.CommandContext(ctx, "git", "diff", "--name-only")
-	} else {
-		cmd = exec.CommandContext(ctx, "git", "diff", "--name-only", b.CommitRange)
-	}
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return errors.Errorf(string(out))
-	}
-	files := strings.Split(string(out), "\n")
-	for _, f := range files {
-		// TODO - remove blank files from git diff
-		if f == "" {
-			continue
-		}
-		info, err := os.Stat(f)
-		if err != nil {
-			panic(err) // The file from git diff should always exists!
-		}
-		cf := &File{
-			Name:     f,
-			FileInfo: info,
-		}
-		// TODO change to BuildContext is not applied after this function..
-		for _, t := range b.Config.Targets {
-			if isFileDependencyOfTarget(f, t, b.Config.DepSourceDirs) {
-				cf.DependencyOf = append(cf.DependencyOf, t.Path)
-				t.Changes = append(t.Changes, cf)
-				fmt.Printf("file %s is dependency of target %s\n", f, t.Path)
+			if err := b.ApplyGuardrail(ctx); err != nil {
+				return err
 			}
-			if isFileWatchedByTarget(f, t) {
-				cf.WatchedBy = append(cf.WatchedBy, t.Path)
-				t.Changes = append(t.Changes, cf)
-				fmt.Printf("file %s is watched by target %s\n", f, t.Path)
+			var overrides []*build.Override
+			for _, s := range sets {
+				o, err := build.ParseOverride(s)
+				if err != nil {
+					return err
+				}
+				overrides = append(overrides, o)
 			}
-		}
-		b.Files = append(b.Files, cf)
-		fmt.Printf("file %s added to b.Files\n", f)
-	}
-	// DEBUG
-	for _, bf := range b.Files {
-		fmt.Println(bf)
-	}
-	span.AddAttributes(trace.StringAttribute("build_context", b.String()))
-	return nil
-}
-
-func isFileWatchedByTarget(f string, t *Target) bool {
-	for _, wf := range t.Watches {
-		if f == wf {
-			return true
-		}
-	}
-	return false
-}
-
-func isFileDependencyOfTarget(f string, t *Target, depDirs []string) bool {
-	if t.Deps == nil {
-		return false
-	}
-	fdir := filepath.Dir(f)
-	for _, depDir := range depDirs {
-		// If the changed file has a prefix of any of the defined package directory,
-		// then the changed file is identified as a dependency.
-		if strings.HasPrefix(f, depDir) {
-			// Check if any of the Target's dependency matches it.
-			for _, dep := range t.Deps {
-				if strings.Contains(dep, fdir) {
-					return true
+			if err := b.ApplyOverrides(overrides); err != nil {
+				return err
+			}
+			if err := hidden.inject(b); err != nil {
+				return err
+			}
+			if err := attest.write(ctx, b); err != nil {
+				return err
+			}
+			b.Renderer = renderer
+			if err := renderer.Diff(os.Stdout, b); err != nil {
+				return err
+			}
+			b.CI = *ciMode
+			b.ApprovalKeys = approvalKeys
+			b.RunsDir = *runsDir
+			b.Branch = *branch
+			b.Parallel = *parallel
+			b.Deterministic = *determ
+			b.Seed = *seed
+			b.ResultDir = *results
+			b.NoCache = *noCache
+			b.CacheDir = *cacheDir
+			b.GroupBy = *groupBy
+			b.MarkdownSummary = *mdSum
+			b.KeepGoing = *keepGo
+			for _, s := range reports {
+				r, err := build.ParseReport(s)
+				if err != nil {
+					return err
 				}
+				b.Reports = append(b.Reports, r)
 			}
-		}
-	}
-	return false
-}
-
-// File represents a file from the git diff command.
-type File struct {
-	Name         string
-	DependencyOf []string
-	WatchedBy    []string
-	os.FileInfo  `json:"-"`
-}
-
-func (f *File) String() string {
-	b, err := json.MarshalIndent(f, "", "  ")
-	if err != nil {
-		panic(err)
-	}
-	return string(b)
-}
-
-// Config represents the mb config file.
-type Config struct {
-	DepSourceDirs []string  `yaml:"dep_source_dirs"`
-	Targets       []*Target `yaml:"targets"`
-}
-
-func (c *Config) validate(ctx context.Context) error {
-	_, span := trace.StartSpan(ctx, "*Config.validate()")
-	defer span.End()
-
-	for _, f := range c.DepSourceDirs {
-		finfo, err := os.Stat(f)
-		if os.IsNotExist(err) {
-			return err
-		}
-		if !finfo.IsDir() {
-			return errors.Errorf("dep_source_dir: %s is not a directory", f)
-		}
-	}
-	checkdup := make(map[string]int)
-	for _, t := range c.Targets {
-		if _, found := checkdup[t.Path]; found {
-			return errors.Errorf("target.path: %s has been used more than once", t.Path)
-		}
-		finfo, err := os.Stat(t.Path)
-		if os.IsNotExist(err) {
-			return err
-		}
-		if !finfo.IsDir() {
-			return errors.Errorf("target.path: %s is not a directory", t.Path)
-		}
-		checkdup[t.Path]++
-	}
-	return nil
-}
-
-// Target represents the target config.
-type Target struct {
-	Path         string       `yaml:"path"`
-	BuildCommand BuildCommand `yaml:"build_command"`
-	WatchPattern []string     `yaml:"watch_pattern"` // Any file that are considered as a dependency of the target.
-	Dir          string       `json:"Dir"`           // This will be populated by go list.
-	Deps         []string     `json:"Deps"`          // This will be populated by go list.
-	Watches      []string     // This will be populated after parsing WatchPattern.
-	Changes      []*File      // This will be populated after git diff.
-}
-
-func (c *Config) String() string {
-	b, err := json.MarshalIndent(c, "", "  ")
-	if err != nil {
-		panic(err)
+			b.Metrics = build.MetricsConfig{Pushgateway: *pushgw, Statsd: *statsd, Prefix: *mPrefix}
+			if *telURL != "" {
+				b.Config.Telemetry.Endpoint = *telURL
+			}
+			if *noTel {
+				b.Config.Telemetry.Endpoint = ""
+			}
+			nothing := *detailed && b.NothingToDo()
+			if *diffOnly || b.Bare != nil {
+				if *output == build.RenderPretty {
+					fmt.Println("diff only")
+				}
+				if nothing {
+					return errNothingToDo
+				}
+				return nil
+			}
+			if err := b.CheckDirty(ctx, *dirty); err != nil {
+				return err
+			}
+			if err := b.PrepareGit(ctx, *fetch); err != nil {
+				return err
+			}
+			if *verify {
+				return b.VerifyReproducible(ctx)
+			}
+			if err := b.MonoBuild(ctx); err != nil {
+				return err
+			}
+			if nothing {
+				return errNothingToDo
+			}
+			return nil
+		},
 	}
-	return string(b)
-}
-
-func (t *Target) String() string {
-	b, err := json.MarshalIndent(t, "", "  ")
+	args, err := hidden.parse(os.Args[1:])
 	if err != nil {
-		panic(err)
-	}
-	return string(b)
-}
-
-// BuildCommand  represents the build_command config.
-type BuildCommand struct {
-	Dir     string   `yaml:"dir"`
-	Command string   `yaml:"command"`
-	Args    []string `yaml:"args"`
-	Output  string
-	Error   string
-}
-
-var noTarget = errors.Errorf("no monobuild targets found")
-
-func (b *BuildContext) MonoBuild(ctx context.Context) error {
-	ctx, span := trace.StartSpan(ctx, "*BuildContext.MonoBuild()")
-	defer span.End()
-	span.AddAttributes(trace.StringAttribute("build_context", b.String()))
-	if len(b.Config.Targets) == 0 {
-		return noTarget
-	}
-	for _, t := range b.Config.Targets {
-		// TODO - Prettify the print with debug mode
-		if len(t.Changes) == 0 {
-			fmt.Println("SKIPPING BUILD TARGET: ", t.Path)
-			continue
-		}
-		fmt.Println("-------------------------------")
-		fmt.Println("BUILDING TARGET: ", t.Path)
-		fmt.Println(t.String())
-		fmt.Println("-------------------------------")
-		if err := t.Run(ctx); err != nil {
-			return err
-		}
+		errfatal(err)
 	}
-	return nil
-}
-
-func (t *Target) parseWatchedFiles(ctx context.Context) error {
-	_, span := trace.StartSpan(ctx, "*Target.parseWatchedFiles")
-	defer span.End()
-	var err error
-	for _, p := range t.WatchPattern {
-		t.Watches, err = filepath.Glob(p)
-		if err != nil {
-			return errors.Errorf("problem with target %s watch %s", t.Path, p)
+	if err := root.Run(args); err != nil {
+		if err == errNothingToDo {
+			os.Exit(exitNothingToDo)
 		}
+		errfatal(err)
 	}
-	span.AddAttributes(trace.StringAttribute("target", t.String()))
-	return nil
 }
 
-func (t *Target) parseGoDeps(ctx context.Context) error {
-	_, span := trace.StartSpan(ctx, "*Target.parseGoDeps")
-	defer span.End()
-	// Add the dot slash prefix which is required for the `go list` command.
-	dir := t.Path
-	if !strings.HasPrefix(dir, "./") {
-		dir = "./" + dir
-	}
-	cmd := exec.Command("go", "list", "-json", dir)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return errors.Errorf("go list -json %s: %s", dir, string(out))
-	}
-	if err := json.Unmarshal(out, t); err != nil {
-		panic(err)
-	}
-	span.AddAttributes(trace.StringAttribute("target", t.String()))
-	return nil
-}
+// exitNothingToDo is the exit code of a run without affected target, with
+// -detailed-exit-code.
+const exitNothingToDo = 3
 
-func (t *Target) Run(ctx context.Context) error {
-	ctx, span := trace.StartSpan(ctx, "*Target.Run()")
-	defer span.End()
-	defer func() {
-		span.AddAttributes(trace.StringAttribute("target", t.String()))
-	}()
+var errNothingToDo = errors.New("nothing to do")
 
-	cmd := &exec.Cmd{}
-	if len(t.BuildCommand.Args) > 0 {
-		cmd = exec.CommandContext(ctx, t.BuildCommand.Command, t.BuildCommand.Args...)
-	} else {
-		cmd = exec.CommandContext(ctx, t.BuildCommand.Command)
-	}
-	// Set the command working directory.
-	if t.BuildCommand.Dir != "" {
-		if _, err := os.Stat(t.BuildCommand.Dir); os.IsNotExist(err) {
-			return errors.Errorf("build command error: %s", err)
-		}
-		cmd.Dir = t.BuildCommand.Dir
-	}
+// tracer starts the spans of the commands of mb.
+var tracer = otel.Tracer("github.com/bzon/monobuild")
 
-	var stdoutBuf, stderrBuf bytes.Buffer
-	stdoutIn, _ := cmd.StdoutPipe()
-	stderrIn, _ := cmd.StderrPipe()
-	stdout := io.MultiWriter(os.Stdout, &stdoutBuf)
-	stderr := io.MultiWriter(os.Stderr, &stderrBuf)
-	err := cmd.Start()
-	if err != nil {
-		return err
+// startTracing exports the spans of mb to an OTLP/HTTP endpoint, configured
+// by the OTEL_EXPORTER_OTLP_* variables unless endpoint is set. Shutting
+// down the returned provider exports the remaining spans.
+func startTracing(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	var opts []otlptracehttp.Option
+	if endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
 	}
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	go func() {
-		_, err := io.Copy(stdout, stdoutIn)
-		if err != nil {
-			panic(err)
-		}
-		wg.Done()
-	}()
-
-	_, err = io.Copy(stderr, stderrIn)
+	exporter, err := otlptracehttp.New(ctx, opts...)
 	if err != nil {
-		panic(err)
+		return nil, errors.Wrap(err, "cannot create the OTLP trace exporter")
 	}
-	wg.Wait()
-
-	// Save the stdout and error for testing purposes.
-	t.BuildCommand.Output = string(stdoutBuf.Bytes())
-	t.BuildCommand.Error = string(stderrBuf.Bytes())
-
-	err = cmd.Wait()
-	if err != nil {
-		return err
-	}
-	return nil
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "mb-cli"))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp, nil
 }
 
 func collapse(body string, width uint) string {
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+func metaCommand() *ffcli.Command {
+	var (
+		fs          = flag.NewFlagSet("mb meta", flag.ExitOnError)
+		metaConfig  = fs.String("meta-config", "./monobuild-meta.yaml", "Meta config listing the repositories to build")
+		commitRange = fs.String("commit-range", "", "Commit range of the repositories without a commit_range")
+		parallel    = fs.Int("parallel", 0, "Maximum number of repositories built at the same time. Defaults to the parallel setting of the meta config, or 1")
+		format      = fs.String("format", "text", "Format of the summary: text or json")
+	)
+	return &ffcli.Command{
+		Name:      "meta",
+		Usage:     "mb meta [flags] [-- mb flags]",
+		ShortHelp: "Build the affected targets of several repositories",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Compute and execute the plan of every repository of the meta config,
+			each with its own mb config and commit range, and print a single
+			summary of their targets. The output lines of each repository are
+			prefixed with its name. The arguments after -- are passed to mb in
+			every repository, e.g. -- -keep-going -output quiet.
+		`, 80),
+		Exec: func(args []string) error {
+			ctx := context.Background()
+			ctx, span := tracer.Start(ctx, "mb meta")
+			defer span.End()
+			mc, err := build.ReadMetaConfig(*metaConfig)
+			if err != nil {
+				return err
+			}
+			exe, err := os.Executable()
+			if err != nil {
+				return err
+			}
+			results := build.RunMeta(ctx, mc, build.MetaOptions{
+				Executable:  exe,
+				CommitRange: *commitRange,
+				Args:        args,
+				Parallel:    *parallel,
+			}, os.Stdout)
+			return build.WriteMetaSummary(os.Stdout, results, *format)
+		},
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func outputsCommand() *ffcli.Command {
+	var (
+		fs         = flag.NewFlagSet("mb outputs", flag.ExitOnError)
+		configFile = fs.String("config", "./monobuild.yaml", "mb config file")
+		runsDir    = fs.String("runs-dir", build.DefaultRunsDir, "the directory of the run records")
+		check      = fs.Bool("check", false, "Fail when an output is missing, stale or modified since its last build")
+		format     = fs.String("format", "text", "Output format: text or json")
+	)
+	return &ffcli.Command{
+		Name:      "outputs",
+		Usage:     "mb outputs [flags] [<target name or path>...]",
+		ShortHelp: "List the declared outputs of the targets and their state",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			List the files of the outputs of the targets, or of the given targets,
+			with their sha256 and the sha256 recorded by the last successful build
+			of the runs directory. An output is missing when no file matches it,
+			stale when it is older than an input of the target and modified when
+			it changed since its last build.
+		`, 80),
+		Exec: func(args []string) error {
+			ctx := context.Background()
+			ctx, span := tracer.Start(ctx, "mb outputs")
+			defer span.End()
+			b, err := build.NewBuildContext(ctx, *configFile, "")
+			if err != nil {
+				return err
+			}
+			for _, sel := range args {
+				if b.Config.Target(sel) != nil {
+					continue
+				}
+				if s := b.Config.SuggestTargets(sel); len(s) > 0 {
+					return errors.Errorf("no target %s in %s, did you mean %s?", sel, *configFile, strings.Join(s, " or "))
+				}
+				return errors.Errorf("no target %s in %s", sel, *configFile)
+			}
+			outputs, err := b.Outputs(ctx, *runsDir)
+			if err != nil {
+				return err
+			}
+			if len(args) > 0 {
+				var selected []*build.TargetOutputs
+				for _, to := range outputs {
+					for _, sel := range args {
+						if b.Config.Target(sel).Path == to.Path {
+							selected = append(selected, to)
+							break
+						}
+					}
+				}
+				outputs = selected
+			}
+			if err := build.WriteOutputs(os.Stdout, outputs, *format); err != nil {
+				return err
+			}
+			if !*check {
+				return nil
+			}
+			var bad []string
+			for _, to := range outputs {
+				for _, f := range to.Files {
+					if f.Status != build.OutputOK {
+						bad = append(bad, f.Path+" ("+f.Status+")")
+					}
+				}
+			}
+			if len(bad) > 0 {
+				return errors.Errorf("outputs not up to date: %s", strings.Join(bad, ", "))
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,221 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AlertingConfig pages when the builds of a protected branch keep failing,
+// and resolves the alert when the target builds again.
+type AlertingConfig struct {
+	Branches            []string        `yaml:"branches"`             // The protected branches, e.g. main.
+	ConsecutiveFailures int             `yaml:"consecutive_failures"` // Failed runs of a target before paging. Defaults to 1.
+	PagerDuty           PagerDutyConfig `yaml:"pagerduty"`
+	Opsgenie            OpsgenieConfig  `yaml:"opsgenie"`
+}
+
+// PagerDutyConfig represents a PagerDuty Events API v2 integration.
+type PagerDutyConfig struct {
+	RoutingKey string `yaml:"routing_key"`
+	Severity   string `yaml:"severity"` // Defaults to error.
+	URL        string `yaml:"url"`      // Defaults to https://events.pagerduty.com/v2/enqueue.
+}
+
+// OpsgenieConfig represents an Opsgenie Alert API integration.
+type OpsgenieConfig struct {
+	APIKey   string `yaml:"api_key"`
+	Priority string `yaml:"priority"` // Defaults to P3.
+	URL      string `yaml:"url"`      // Defaults to https://api.opsgenie.com, use https://api.eu.opsgenie.com for EU accounts.
+}
+
+func (a AlertingConfig) enabled() bool {
+	return len(a.Branches) > 0 && (a.PagerDuty.RoutingKey != "" || a.Opsgenie.APIKey != "")
+}
+
+func (a AlertingConfig) validate() error {
+	if a.ConsecutiveFailures < 0 {
+		return errors.Errorf("alerting.consecutive_failures: %d must be positive", a.ConsecutiveFailures)
+	}
+	switch a.PagerDuty.Severity {
+	case "", "critical", "error", "warning", "info":
+	default:
+		return errors.Errorf("alerting.pagerduty.severity: %s must be one of critical, error, warning or info", a.PagerDuty.Severity)
+	}
+	switch a.Opsgenie.Priority {
+	case "", "P1", "P2", "P3", "P4", "P5":
+	default:
+		return errors.Errorf("alerting.opsgenie.priority: %s must be one of P1 to P5", a.Opsgenie.Priority)
+	}
+	return nil
+}
+
+func (a AlertingConfig) threshold() int {
+	if a.ConsecutiveFailures > 0 {
+		return a.ConsecutiveFailures
+	}
+	return 1
+}
+
+func (a AlertingConfig) protects(branch string) bool {
+	for _, b := range a.Branches {
+		if b == branch {
+			return true
+		}
+	}
+	return false
+}
+
+// failureStreak returns the number of consecutive failed builds of a target,
+// by ID, on a branch, from the most recent run.
+func failureStreak(runs []*Run, branch, id string) int {
+	streak := 0
+	for i := len(runs) - 1; i >= 0; i-- {
+		if runs[i].Branch != branch {
+			continue
+		}
+		for _, rt := range runs[i].Targets {
+			if rt.ID() != id {
+				continue
+			}
+			if rt.Status == RunCancelled {
+				continue
+			}
+			if rt.Status != RunFailure {
+				return streak
+			}
+			streak++
+		}
+	}
+	return streak
+}
+
+// alert pages for the targets of a protected branch run that failed for
+// the configured number of consecutive runs, and resolves the alerts of the
+// targets that recovered. The run must already be saved in the runs directory.
+// Failures to page are only warnings, they must not hide the build result.
+func (b *BuildContext) alert(ctx context.Context, run *Run) {
+	ctx, span := tracer.Start(ctx, "*BuildContext.alert()")
+	defer span.End()
+	a := b.Config.Alerting
+	if !a.enabled() || !a.protects(run.Branch) {
+		return
+	}
+	runs, err := ReadRuns(b.RunsDir)
+	if err != nil {
+		Log.Warn("alerting failed", "error", err)
+		return
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Time.Before(runs[j].Time) })
+	var previous []*Run
+	for _, r := range runs {
+		if r.ID != run.ID {
+			previous = append(previous, r)
+		}
+	}
+	for _, rt := range run.Targets {
+		var err error
+		switch streak := failureStreak(runs, run.Branch, rt.ID()); {
+		case streak >= a.threshold():
+			summary := fmt.Sprintf("monobuild: %s failed on %s for %d consecutive runs", rt.Path, run.Branch, streak)
+			b.renderer().Info(os.Stdout, "ALERTING: "+summary)
+			err = a.send(ctx, "trigger", run, rt.ID(), summary)
+		case rt.Status == RunSuccess:
+			if failureStreak(previous, run.Branch, rt.ID()) >= a.threshold() {
+				b.renderer().Info(os.Stdout, fmt.Sprintf("RESOLVING ALERT: %s recovered on %s", rt.Path, run.Branch))
+				err = a.send(ctx, "resolve", run, rt.ID(), "")
+			}
+		}
+		if err != nil {
+			Log.Warn("alerting failed", "error", err)
+		}
+	}
+}
+
+// alertKey deduplicates the alerts of a target, by ID, on a branch, so that
+// the following failures update the open alert and the recovery resolves it.
+func alertKey(branch, id string) string {
+	return "monobuild/" + branch + "/" + id
+}
+
+func (a AlertingConfig) send(ctx context.Context, action string, run *Run, id, summary string) error {
+	key := alertKey(run.Branch, id)
+	var errs []string
+	if a.PagerDuty.RoutingKey != "" {
+		if err := a.PagerDuty.send(ctx, action, key, id, summary, run); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if a.Opsgenie.APIKey != "" {
+		if err := a.Opsgenie.send(ctx, action, key, summary, run); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (p PagerDutyConfig) send(ctx context.Context, action, key, path, summary string, run *Run) error {
+	endpoint := p.URL
+	if endpoint == "" {
+		endpoint = "https://events.pagerduty.com/v2/enqueue"
+	}
+	event := map[string]interface{}{
+		"routing_key":  p.RoutingKey,
+		"event_action": action,
+		"dedup_key":    key,
+	}
+	if action == "trigger" {
+		severity := p.Severity
+		if severity == "" {
+			severity = "error"
+		}
+		host, _ := os.Hostname()
+		event["payload"] = map[string]interface{}{
+			"summary":   summary,
+			"source":    host,
+			"severity":  severity,
+			"component": path,
+			"custom_details": map[string]string{
+				"run":    run.ID,
+				"commit": run.Commit,
+			},
+		}
+	}
+	return errors.Wrap(doJSON(ctx, http.MethodPost, endpoint, nil, event, nil), "pagerduty")
+}
+
+func (o OpsgenieConfig) send(ctx context.Context, action, key, summary string, run *Run) error {
+	endpoint := strings.TrimSuffix(o.URL, "/")
+	if endpoint == "" {
+		endpoint = "https://api.opsgenie.com"
+	}
+	header := http.Header{"Authorization": {"GenieKey " + o.APIKey}}
+	if action == "resolve" {
+		endpoint += "/v2/alerts/" + url.PathEscape(key) + "/close?identifierType=alias"
+		return errors.Wrap(doJSON(ctx, http.MethodPost, endpoint, header, map[string]string{"source": "monobuild"}, nil), "opsgenie")
+	}
+	priority := o.Priority
+	if priority == "" {
+		priority = "P3"
+	}
+	alert := map[string]interface{}{
+		"message":  summary,
+		"alias":    key,
+		"priority": priority,
+		"source":   "monobuild",
+		"details": map[string]string{
+			"run":    run.ID,
+			"commit": run.Commit,
+		},
+	}
+	return errors.Wrap(doJSON(ctx, http.MethodPost, endpoint+"/v2/alerts", header, alert, nil), "opsgenie")
+}
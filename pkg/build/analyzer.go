@@ -0,0 +1,131 @@
+package build
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Analyzer names accepted by target.analyzer.
+const (
+	AnalyzerGo     = "go"
+	AnalyzerCargo  = "cargo"
+	AnalyzerMaven  = "maven"
+	AnalyzerGradle = "gradle"
+	AnalyzerDocker = "docker"
+	AnalyzerNone   = "none"
+)
+
+// An Analyzer finds the dependencies of a target. It populates Target.Deps,
+// Target.DepDirs and Target.DepFiles, and may add build files to
+// Target.Watches.
+type Analyzer interface {
+	Analyze(ctx context.Context, t *Target) error
+}
+
+var analyzers = map[string]Analyzer{
+	AnalyzerGo:     goAnalyzer{},
+	AnalyzerCargo:  cargoAnalyzer{},
+	AnalyzerMaven:  mavenAnalyzer{},
+	AnalyzerGradle: gradleAnalyzer{},
+	AnalyzerDocker: dockerAnalyzer{},
+	AnalyzerNone:   noAnalyzer{},
+}
+
+func validateAnalyzer(t *Target) error {
+	if _, ok := analyzers[t.Analyzer]; t.Analyzer != "" && !ok {
+		return errors.Errorf("target.analyzer: %s of target %s must be one of go, cargo, maven, gradle, docker or none", t.Analyzer, t.Path)
+	}
+	return nil
+}
+
+// detectAnalyzer returns the analyzer of a target: docker for a docker
+// target, else the one of the build files found in its directory, defaulting
+// to Go.
+func detectAnalyzer(t *Target) string {
+	dir := t.Path
+	switch {
+	case t.Type == TargetDocker:
+		return AnalyzerDocker
+	case fileExists(filepath.Join(dir, "Cargo.toml")):
+		return AnalyzerCargo
+	case fileExists(filepath.Join(dir, "pom.xml")):
+		return AnalyzerMaven
+	case fileExists(filepath.Join(dir, "build.gradle")), fileExists(filepath.Join(dir, "build.gradle.kts")):
+		return AnalyzerGradle
+	}
+	return AnalyzerGo
+}
+
+// analyze runs the analyzer of the target, detected when not configured.
+func (t *Target) analyze(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "*Target.analyze")
+	defer span.End()
+	if t.Analyzer == "" {
+		t.Analyzer = detectAnalyzer(t)
+	}
+	span.SetAttributes(attribute.String("analyzer", t.Analyzer))
+	if err := analyzers[t.Analyzer].Analyze(ctx, t); err != nil {
+		return err
+	}
+	// The sources that the Dockerfile of another target copies into its
+	// image are dependencies too.
+	if t.Analyzer != AnalyzerDocker && fileExists(t.dockerfile()) {
+		return t.analyzeDockerfile()
+	}
+	return nil
+}
+
+type goAnalyzer struct{}
+
+func (goAnalyzer) Analyze(ctx context.Context, t *Target) error { return t.parseGoDeps(ctx) }
+
+// noAnalyzer only relies on the watch patterns of the target.
+type noAnalyzer struct{}
+
+func (noAnalyzer) Analyze(ctx context.Context, t *Target) error { return nil }
+
+// addDepDir records a directory whose files are dependencies of the target.
+func (t *Target) addDepDir(dir string) {
+	dir = filepath.ToSlash(filepath.Clean(dir))
+	if !contains(t.DepDirs, dir) {
+		t.DepDirs = append(t.DepDirs, dir)
+	}
+}
+
+// addWatch watches a build file of the target when it exists.
+func (t *Target) addWatch(name string) {
+	name = filepath.Clean(name)
+	if fileExists(name) && !contains(t.Watches, name) {
+		t.Watches = append(t.Watches, name)
+	}
+}
+
+// isFileInDepDirs reports whether a file is under a dependency directory of
+// the target.
+func isFileInDepDirs(f string, t *Target) bool {
+	for _, d := range t.DepDirs {
+		if d == "." || strings.HasPrefix(f, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// findUp returns the nearest ancestor of dir, dir included, that contains
+// one of the names, or "" if there is none up to the repository root.
+func findUp(dir string, names ...string) string {
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		for _, n := range names {
+			if fileExists(filepath.Join(d, n)) {
+				return d
+			}
+		}
+		if d == "." || d == filepath.Dir(d) {
+			return ""
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// doJSON sends a JSON request and decodes the JSON response into out, which may be nil.
+func doJSON(ctx context.Context, method, url string, header http.Header, in, out interface{}) error {
+	rb, err := doRequest(ctx, method, url, header, in)
+	if err != nil {
+		return err
+	}
+	if out == nil || len(rb) == 0 {
+		return nil
+	}
+	return json.Unmarshal(rb, out)
+}
+
+// doRequest sends a request with an optional JSON body and returns the
+// response body. Non-2xx responses are returned as errors.
+func doRequest(ctx context.Context, method, url string, header http.Header, in interface{}) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "doRequest")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("method", method),
+		attribute.String("url", url),
+	)
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	rb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, errors.Errorf("%s %s: %s: %s", method, url, resp.Status, bytes.TrimSpace(rb))
+	}
+	return rb, nil
+}
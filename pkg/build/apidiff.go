@@ -0,0 +1,206 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// skipTransitive reports whether a changed Go file of a dependency of the
+// target only changed the implementation of its package, not its exported
+// API, and the target does not import that package directly. The target is
+// then not rebuilt for the file with the experimental minimal_rebuild.
+func (b *BuildContext) skipTransitive(ctx context.Context, f string, t *Target) bool {
+	if !b.Config.MinimalRebuild || b.Bare != nil || !strings.HasSuffix(f, ".go") {
+		return false
+	}
+	// The imports of the target are unknown without the Go analyzer, and the
+	// files of its dependency directories are always dependencies.
+	dir := filepath.ToSlash(filepath.Dir(f))
+	if t.Imports == nil || isFileInDepDirs(f, t) || CleanTreePath(t.Path) == dir || importsDir(t.Imports, dir) {
+		return false
+	}
+	changed, err := b.apiChanged(ctx, dir)
+	if err != nil {
+		Log.Debug("minimal rebuild: cannot compare the API of the package, rebuilding its dependents", "package", dir, "error", err)
+		return false
+	}
+	return !changed
+}
+
+// importsDir reports whether one of the import paths is the package of a
+// directory.
+func importsDir(imports []string, dir string) bool {
+	for _, imp := range imports {
+		if imp == dir || strings.HasSuffix(imp, "/"+dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiChanged reports whether the exported API of the Go package of a
+// directory differs between the base revision of the diff and the working
+// tree. Both versions are type-checked.
+func (b *BuildContext) apiChanged(ctx context.Context, dir string) (bool, error) {
+	_, span := tracer.Start(ctx, "*BuildContext.apiChanged")
+	defer span.End()
+	span.SetAttributes(attribute.String("dir", dir))
+	if changed, ok := b.apiChanges[dir]; ok {
+		return changed, nil
+	}
+	tree, err := b.baseTree()
+	if err != nil {
+		return false, err
+	}
+	if tree == nil {
+		return true, nil
+	}
+	baseFiles, err := treeGoFiles(tree, dir)
+	if err != nil {
+		return false, err
+	}
+	headFiles, err := diskGoFiles(dir)
+	if err != nil {
+		return false, err
+	}
+	fset := token.NewFileSet()
+	imp := importer.ForCompiler(fset, "source", nil)
+	baseAPI, err := packageAPI(fset, imp, dir, baseFiles)
+	if err != nil {
+		return false, errors.Wrap(err, "base revision")
+	}
+	headAPI, err := packageAPI(fset, imp, dir, headFiles)
+	if err != nil {
+		return false, err
+	}
+	changed := !reflect.DeepEqual(baseAPI, headAPI)
+	if b.apiChanges == nil {
+		b.apiChanges = make(map[string]bool)
+	}
+	b.apiChanges[dir] = changed
+	return changed, nil
+}
+
+// packageAPI type-checks the Go files of a package, by name, and returns its
+// exported objects and methods. The files excluded by their build
+// constraints and the test files are ignored.
+func packageAPI(fset *token.FileSet, imp types.Importer, dir string, files map[string][]byte) ([]string, error) {
+	ctxt := build.Default
+	ctxt.OpenFile = func(name string) (io.ReadCloser, error) {
+		src, ok := files[filepath.Base(name)]
+		if !ok {
+			return nil, errors.Errorf("%s not found", name)
+		}
+		return ioutil.NopCloser(bytes.NewReader(src)), nil
+	}
+	var parsed []*ast.File
+	for name, src := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if ok, err := ctxt.MatchFile(dir, name); err != nil || !ok {
+			continue
+		}
+		f, err := parser.ParseFile(fset, path.Join(dir, name), src, 0)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, f)
+	}
+	if len(parsed) == 0 {
+		return nil, nil
+	}
+	conf := types.Config{Importer: imp}
+	pkg, err := conf.Check(dir, fset, parsed, nil)
+	if err != nil {
+		return nil, err
+	}
+	return exportedAPI(pkg), nil
+}
+
+// exportedAPI returns the declarations of the exported objects of a package
+// and the exported methods of its types, in name order.
+func exportedAPI(pkg *types.Package) []string {
+	q := types.RelativeTo(pkg)
+	scope := pkg.Scope()
+	var api []string
+	for _, name := range scope.Names() {
+		obj := scope.Lookup(name)
+		if !obj.Exported() {
+			continue
+		}
+		api = append(api, types.ObjectString(obj, q))
+		if _, ok := obj.(*types.TypeName); !ok {
+			continue
+		}
+		methods := types.NewMethodSet(types.NewPointer(obj.Type()))
+		for i := 0; i < methods.Len(); i++ {
+			if m := methods.At(i).Obj(); m.Exported() {
+				api = append(api, types.ObjectString(m, q))
+			}
+		}
+	}
+	return api
+}
+
+// diskGoFiles reads the Go files of a directory of the working tree.
+func diskGoFiles(dir string) (map[string][]byte, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	for _, fi := range infos {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".go") {
+			continue
+		}
+		if files[fi.Name()], err = ioutil.ReadFile(filepath.Join(dir, fi.Name())); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// treeGoFiles reads the Go files of a directory of a git tree, none when the
+// directory does not exist in the tree.
+func treeGoFiles(tree *object.Tree, dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	sub, err := tree.Tree(CleanTreePath(dir))
+	if err == object.ErrDirectoryNotFound {
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range sub.Entries {
+		if !e.Mode.IsFile() || !strings.HasSuffix(e.Name, ".go") {
+			continue
+		}
+		f, err := sub.TreeEntryFile(&e)
+		if err != nil {
+			return nil, err
+		}
+		s, err := f.Contents()
+		if err != nil {
+			return nil, err
+		}
+		files[e.Name] = []byte(s)
+	}
+	return files, nil
+}
@@ -0,0 +1,176 @@
+package build
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const defaultApprovalEnv = "MB_APPROVAL_TOKEN"
+
+// ApprovalConfig represents the approval config that gates protected targets
+// and steps in CI mode.
+//
+// An approval is a token of mb approve: the Ed25519 signature of a target
+// and of the commit being built, by the key of an approver. The public keys
+// of the approvers are given to the build with -approval-key, never read
+// from the checked out tree, so that a change cannot approve itself.
+type ApprovalConfig struct {
+	Env    string `yaml:"env"`    // Env var holding the approval tokens, separated by spaces. Defaults to MB_APPROVAL_TOKEN.
+	Marker string `yaml:"marker"` // Absolute path of a file of approval tokens outside of the repository, e.g. written by the CI system.
+}
+
+func (a ApprovalConfig) env() string {
+	if a.Env == "" {
+		return defaultApprovalEnv
+	}
+	return a.Env
+}
+
+// approvalMessage is what an approver signs: the path of a target and the
+// full SHA of the commit whose build is approved.
+func approvalMessage(path, commit string) []byte {
+	return []byte(fmt.Sprintf("mb approve %s %s\n", CleanTreePath(path), commit))
+}
+
+// approve decides whether a target may be built and records the decision in
+// t.Approval. Unprotected targets and runs outside of CI are always approved.
+//
+// A target with protected steps, e.g. deploy or publish, is built without an
+// approval up to its first protected step, which fails: only a target that
+// is protected as a whole is refused before its build.
+func (b *BuildContext) approve(ctx context.Context, t *Target) bool {
+	if !b.CI || !t.Protected && !t.protectedSteps() {
+		return true
+	}
+	by, err := b.verifyApproval(ctx, t)
+	if err != nil {
+		t.Approval, t.refused = "refused: "+err.Error(), true
+		return t.protectedSteps()
+	}
+	t.Approval = "approved by " + by
+	return true
+}
+
+// verifyApproval returns the approver of the build of the target at HEAD,
+// by one of the tokens of the env var or of the marker.
+func (b *BuildContext) verifyApproval(ctx context.Context, t *Target) (string, error) {
+	a := b.Config.Approval
+	if len(b.ApprovalKeys) == 0 {
+		return "", errors.New("protected target requires an approver key in CI mode, set with -approval-key")
+	}
+	commit, err := gitOutput(ctx, "rev-parse", "HEAD")
+	if err != nil {
+		return "", errors.Wrap(err, "cannot resolve the approved commit")
+	}
+	tokens := strings.Fields(os.Getenv(a.env()))
+	if a.Marker != "" {
+		marker, err := approvalMarker(ctx, a.Marker)
+		if err != nil {
+			return "", err
+		}
+		tokens = append(tokens, marker...)
+	}
+	if len(tokens) == 0 {
+		return "", errors.Errorf("protected target requires an approval of commit %s in %s or the marker in CI mode", commit, a.env())
+	}
+	msg := approvalMessage(t.Path, commit)
+	for _, name := range b.ApprovalKeys {
+		if err := outsideRepository(ctx, name, "approval key"); err != nil {
+			return "", err
+		}
+		pub, err := readVerifyingKey(name)
+		if err != nil {
+			return "", err
+		}
+		for _, token := range tokens {
+			sig, err := base64.StdEncoding.DecodeString(token)
+			if err == nil && ed25519.Verify(pub, msg, sig) {
+				return fmt.Sprintf("key %.12s for commit %.12s", keyID(pub), commit), nil
+			}
+		}
+	}
+	return "", errors.Errorf("no approval of %s for commit %s by the approver keys", t.Path, commit)
+}
+
+// outsideRepository returns an error unless name is an absolute path outside
+// of the repository, symlinks resolved: a file of the checked out tree is
+// written by the change being built, e.g. to approve itself.
+func outsideRepository(ctx context.Context, name, what string) error {
+	if !filepath.IsAbs(name) {
+		return errors.Errorf("%s %s must be an absolute path outside of the repository", what, name)
+	}
+	top, _, err := inRepository(ctx, ".", name)
+	if err != nil {
+		return err
+	}
+	if top != "" {
+		return errors.Errorf("%s %s is in the repository, which the change being built can write", what, name)
+	}
+	return nil
+}
+
+// approvalMarker returns the tokens of the marker file, which must be outside
+// of the repository.
+func approvalMarker(ctx context.Context, marker string) ([]string, error) {
+	if err := outsideRepository(ctx, marker, "approval marker"); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(marker)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// SignApprovals returns the approval tokens of the builds of the targets at
+// the commit of rev, e.g. HEAD, signed with the Ed25519 private key of an
+// approver.
+func (b *BuildContext) SignApprovals(ctx context.Context, keyFile, rev string, names []string) ([]string, error) {
+	key, err := readSigningKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := gitOutput(ctx, "rev-parse", "--verify", rev+"^{commit}")
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot resolve %s", rev)
+	}
+	var tokens []string
+	for _, name := range names {
+		t := b.Config.Target(name)
+		if t == nil {
+			return nil, b.Config.noTarget("approve", name)
+		}
+		tokens = append(tokens, base64.StdEncoding.EncodeToString(ed25519.Sign(key, approvalMessage(t.Path, commit))))
+	}
+	return tokens, nil
+}
+
+// protectedSteps reports whether the approval gates some steps of the target
+// instead of the whole target.
+func (t *Target) protectedSteps() bool {
+	if len(t.Steps) == 0 {
+		return false
+	}
+	for _, s := range t.commandSteps() {
+		if s.Protected {
+			return true
+		}
+	}
+	return false
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,43 @@
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutsideRepository(t *testing.T) {
+	outside, err := ioutil.TempDir("", "monobuild-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	defer testRepo(t, map[string]string{"keys/approver.pub": "committed"})()
+	repo, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(outside, "approver.pub"), "ci secret")
+	if err := os.Symlink(filepath.Join(repo, "keys", "approver.pub"), filepath.Join(outside, "link.pub")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{filepath.Join(outside, "approver.pub"), true},
+		{filepath.Join(outside, "missing.pub"), true},
+		{filepath.Join(repo, "keys", "approver.pub"), false},
+		{filepath.Join(repo, "keys", "missing.pub"), false},
+		{"keys/approver.pub", false},
+		{filepath.Join(outside, "link.pub"), false},
+	}
+	for _, tt := range tests {
+		err := outsideRepository(context.Background(), tt.name, "approval key")
+		if (err == nil) != tt.valid {
+			t.Errorf("outsideRepository(%s) = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
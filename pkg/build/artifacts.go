@@ -0,0 +1,387 @@
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultRunsDir is where the records of the runs are written.
+const DefaultRunsDir = ".monobuild/runs"
+
+// Run statuses of a built target.
+const (
+	RunSuccess   = "success"
+	RunFailure   = "failure"
+	RunCancelled = "cancelled" // The run was cancelled while the target was built.
+)
+
+// Run records the targets built by one mb run: their status and duration,
+// and the digests of their inputs and artifacts when they declare outputs.
+// The run records are the build history of `mb stats` and are compared by
+// `mb artifacts diff`.
+type Run struct {
+	ID      string       `json:"id"`
+	Commit  string       `json:"commit"`
+	Branch  string       `json:"branch,omitempty"`
+	Time    time.Time    `json:"time"`
+	Seed    int64        `json:"seed,omitempty"` // Seed of the order of the parallel builds, see -seed.
+	Targets []*RunTarget `json:"targets"`
+	Cache   *CacheStats  `json:"cache,omitempty"` // The lookups of the build cache.
+	// Cancelled through the daemon. The interrupted targets have the
+	// cancelled status, which is neither a success nor a failure.
+	Cancelled bool `json:"cancelled,omitempty"`
+	// The run-time overrides of the build commands, e.g.
+	// target.cmd/server.args=[-race].
+	Overrides []string `json:"overrides,omitempty"`
+
+	mu sync.Mutex // Guards Targets during parallel builds.
+}
+
+// RunTarget is the record of one built target.
+type RunTarget struct {
+	Path        string            `json:"path"`
+	Name        string            `json:"name,omitempty"` // The name of the target, when it has one.
+	Status      string            `json:"status"`
+	Started     time.Time         `json:"started"`
+	Duration    time.Duration     `json:"duration"`
+	Inputs      string            `json:"inputs,omitempty"`       // Digest of the build command and of the files the target depends on.
+	Artifacts   map[string]string `json:"artifacts,omitempty"`    // Artifact path to sha256.
+	SideEffects []string          `json:"side_effects,omitempty"` // Undeclared files modified by the build.
+	Problems    []Problem         `json:"problems,omitempty"`     // Matched by the problem matchers of the target.
+	TmpUsage    int64             `json:"tmp_usage,omitempty"`    // Peak disk usage of the TMPDIR of the build, in bytes.
+	Steps       []RunStep         `json:"steps,omitempty"`        // The steps run, up to the first failed one.
+	Approval    string            `json:"approval,omitempty"`     // The approval decision of a protected target.
+	Error       string            `json:"error,omitempty"`        // Why the build failed, e.g. a command timed out.
+}
+
+// newRun starts the record of a run on a branch, the checked out branch when
+// empty.
+func newRun(ctx context.Context, branch string) *Run {
+	now := time.Now().UTC()
+	commit, _ := gitOutput(ctx, "rev-parse", "HEAD")
+	if branch == "" {
+		// A detached HEAD, as in most CI checkouts, has no branch.
+		if b, err := gitOutput(ctx, "symbolic-ref", "--short", "-q", "HEAD"); err == nil {
+			branch = b
+		}
+	}
+	id := now.Format("20060102T150405Z")
+	if len(commit) >= 7 {
+		id += "-" + commit[:7]
+	}
+	return &Run{ID: id, Commit: commit, Branch: branch, Time: now}
+}
+
+// start records the start of the build of a target.
+func (r *Run) start(t *Target) *RunTarget {
+	rt := &RunTarget{Path: t.Path, Name: t.Name, Started: time.Now().UTC(), Approval: t.Approval}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Targets = append(r.Targets, rt)
+	return rt
+}
+
+// outcome returns the outcome of the build of a target in the run, for the
+// summaries.
+func (r *Run) outcome(path string, err error) *TargetOutcome {
+	o := &TargetOutcome{Path: path, Status: RunSuccess, Error: err}
+	switch {
+	case cancelled(err):
+		o.Status = RunCancelled
+	case err != nil:
+		o.Status = RunFailure
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rt := range r.Targets {
+		if rt.Path != path {
+			continue
+		}
+		o.TmpUsage = rt.TmpUsage
+		for _, s := range rt.Steps {
+			if s.Status == StepAllowedFailure {
+				o.AllowedFailures = append(o.AllowedFailures, s.Name)
+			}
+		}
+	}
+	return o
+}
+
+// finish records the result of the build of a target.
+func (rt *RunTarget) finish(err error) {
+	rt.Duration = time.Since(rt.Started)
+	rt.Status = RunSuccess
+	if err != nil {
+		rt.Status = RunFailure
+		rt.Error = err.Error()
+	}
+	if cancelled(err) {
+		rt.Status = RunCancelled
+	}
+}
+
+// cancelled reports whether err is the cancellation of the run.
+func cancelled(err error) bool {
+	return err != nil && errors.Cause(err) == context.Canceled
+}
+
+// recordOutputs digests the inputs and the outputs of a built target.
+func (r *Run) recordOutputs(ctx context.Context, rt *RunTarget, t *Target, depDirs []string) error {
+	_, span := tracer.Start(ctx, "*Run.recordOutputs()")
+	defer span.End()
+	inputs, err := inputDigest(ctx, t, depDirs)
+	if err != nil {
+		return errors.Wrapf(err, "target %s: inputs digest", t.Path)
+	}
+	artifacts, err := artifactDigests(".", t.Outputs)
+	if err != nil {
+		return errors.Wrapf(err, "target %s", t.Path)
+	}
+	rt.Inputs, rt.Artifacts, rt.SideEffects = inputs, artifacts, t.SideEffects
+	return nil
+}
+
+// artifactDigests returns the sha256 of the files matching the output
+// patterns under root, keyed by their path relative to root.
+func artifactDigests(root string, outputs []string) (map[string]string, error) {
+	artifacts := make(map[string]string)
+	for _, pattern := range outputs {
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return nil, errors.Errorf("invalid output pattern %s: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, errors.Errorf("output %s was not produced", pattern)
+		}
+		for _, m := range matches {
+			err := filepath.Walk(m, func(p string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				sum, err := fileDigest(p)
+				if err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(root, p)
+				if err != nil {
+					return err
+				}
+				artifacts[filepath.ToSlash(rel)] = sum
+				return nil
+			})
+			if err != nil {
+				return nil, errors.Wrap(err, "artifact digest")
+			}
+		}
+	}
+	return artifacts, nil
+}
+
+// inputFiles returns the tracked files that would mark the target as
+// changed in a diff.
+func inputFiles(ctx context.Context, t *Target, depDirs []string) ([]string, error) {
+	files, err := gitLines(ctx, "ls-files")
+	if err != nil {
+		return nil, err
+	}
+	var inputs []string
+	dir := CleanTreePath(t.Path)
+	for _, f := range files {
+		if strings.HasPrefix(f, dir+"/") || isFileDependencyOfTarget(f, t, depDirs) || isFileWatchedByTarget(f, t) {
+			inputs = append(inputs, f)
+		}
+	}
+	return inputs, nil
+}
+
+// inputDigest hashes the build command of a target and the content of the
+// tracked files that would mark the target as changed in a diff.
+func inputDigest(ctx context.Context, t *Target, depDirs []string) (string, error) {
+	files, err := inputFiles(ctx, t, depDirs)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	cmd, _ := json.Marshal(t.BuildCommand.input())
+	h.Write(cmd)
+	if len(t.Steps) > 0 {
+		var steps []*Step
+		for _, s := range t.Steps {
+			steps = append(steps, s.input())
+		}
+		b, _ := json.Marshal(steps)
+		h.Write(b)
+	}
+	dir := CleanTreePath(t.Path)
+	for _, f := range files {
+		name := f
+		if t.Name != "" && strings.HasPrefix(f, dir+"/") {
+			// The files of a named target are hashed relative to its
+			// directory, for its key to survive a move.
+			name = "./" + strings.TrimPrefix(f, dir+"/")
+		}
+		sum, err := fileDigest(f)
+		if os.IsNotExist(err) {
+			continue // Deleted in the working tree.
+		}
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %s\n", name, sum)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// input returns the command without the output of its last run, which is
+// not an input of the build.
+func (c BuildCommand) input() BuildCommand {
+	c.Output, c.Error = "", ""
+	return c
+}
+
+// input returns a copy of the hooks, as BuildCommand.input.
+func (h Hooks) input() Hooks {
+	stages := h.stages()
+	for i, hooks := range stages {
+		cmds := make([]BuildCommand, len(hooks))
+		for j, c := range hooks {
+			cmds[j] = c.input()
+		}
+		stages[i] = cmds
+	}
+	return Hooks{Before: stages[0], OnFailure: stages[1], After: stages[2]}
+}
+
+// input returns a copy of the step and of the steps of its group, as
+// BuildCommand.input.
+func (s *Step) input() *Step {
+	c := s.clone()
+	c.BuildCommand = c.BuildCommand.input()
+	for i, p := range c.Parallel {
+		c.Parallel[i] = p.input()
+	}
+	return c
+}
+
+func fileDigest(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// save writes the run record, when at least one target was built or looked
+// up in the build cache.
+func (r *Run) save(dir string) error {
+	if len(r.Targets) == 0 && r.Cache == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "cannot record the run")
+	}
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, r.ID+".json"), b, 0644); err != nil {
+		return errors.Wrap(err, "cannot record the run")
+	}
+	return nil
+}
+
+// ReadRun reads a run record by ID from the runs directory, or from a path.
+func ReadRun(dir, idOrPath string) (*Run, error) {
+	name := idOrPath
+	if !fileExists(name) {
+		name = filepath.Join(dir, idOrPath+".json")
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.Errorf("run %s not found: %v", idOrPath, err)
+	}
+	r := &Run{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, errors.Errorf("run %s: %v", idOrPath, err)
+	}
+	return r, nil
+}
+
+// ArtifactsDiff compares the artifacts of the targets built by both runs and
+// returns the targets that are not reproducible: identical inputs but
+// different artifacts.
+func ArtifactsDiff(w io.Writer, a, b *Run) []string {
+	byPath := make(map[string]*RunTarget)
+	for _, t := range b.Targets {
+		byPath[t.Path] = t
+	}
+	var nonReproducible []string
+	for _, ta := range a.Targets {
+		tb, ok := byPath[ta.Path]
+		// Only the targets with outputs have their artifacts recorded.
+		if !ok || ta.Inputs == "" || tb.Inputs == "" {
+			continue
+		}
+		sameInputs := ta.Inputs == tb.Inputs
+		var lines []string
+		for _, name := range artifactNames(ta, tb) {
+			da, db := ta.Artifacts[name], tb.Artifacts[name]
+			switch {
+			case da == db:
+				continue
+			case da == "":
+				lines = append(lines, fmt.Sprintf("  + %s", name))
+			case db == "":
+				lines = append(lines, fmt.Sprintf("  - %s", name))
+			default:
+				lines = append(lines, fmt.Sprintf("  ~ %s %.12s -> %.12s", name, da, db))
+			}
+		}
+		status := "identical"
+		switch {
+		case len(lines) > 0 && sameInputs:
+			status = "NOT REPRODUCIBLE: identical inputs, different artifacts"
+			nonReproducible = append(nonReproducible, ta.Path)
+		case len(lines) > 0:
+			status = "changed: inputs differ"
+		case !sameInputs:
+			status = "identical artifacts, inputs differ"
+		}
+		fmt.Fprintf(w, "%s: %s\n", ta.Path, status)
+		for _, l := range lines {
+			fmt.Fprintln(w, l)
+		}
+	}
+	return nonReproducible
+}
+
+func artifactNames(a, b *RunTarget) []string {
+	var names []string
+	for n := range a.Artifacts {
+		names = append(names, n)
+	}
+	for n := range b.Artifacts {
+		if _, ok := a.Artifacts[n]; !ok {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,310 @@
+package build
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The in-toto attestation of a plan is a DSSE envelope of an in-toto
+// Statement, signed with an Ed25519 key.
+const (
+	inTotoStatementType = "https://in-toto.io/Statement/v1"
+	inTotoPayloadType   = "application/vnd.in-toto+json"
+	PlanPredicateType   = "https://github.com/bzon/monobuild/plan/v1"
+	planSubjectName     = "affected-targets"
+)
+
+// PlanPredicate is the predicate of the attestation of a plan: its inputs,
+// the commits and the config, and its output, the affected targets.
+type PlanPredicate struct {
+	CommitRange string            `json:"commitRange,omitempty"`
+	Base        string            `json:"base,omitempty"` // The commit the changes are from, none for the working tree.
+	Head        string            `json:"head"`           // The commit the changes are to, HEAD for the clean working tree.
+	Config      map[string]string `json:"config"`         // The sha256 of the config file and of its included fragments.
+	Pathspecs   []string          `json:"pathspecs,omitempty"`
+	All         bool              `json:"all,omitempty"`
+	Affected    []string          `json:"affected"` // The IDs of the affected targets, in config order.
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []inTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     *PlanPredicate  `json:"predicate"`
+}
+
+// dsseEnvelope is a signed envelope of the DSSE specification.
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// dssePAE is the pre-authentication encoding of a payload, which is signed.
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// affectedDigest is the digest of the subject of the attestation: the IDs of
+// the affected targets, a line each.
+func affectedDigest(affected []string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(affected, "\n"))))
+}
+
+// planPredicate returns the inputs and the output of the plan.
+func (b *BuildContext) planPredicate(ctx context.Context) (*PlanPredicate, error) {
+	p := &PlanPredicate{CommitRange: b.CommitRange, Config: make(map[string]string), Pathspecs: b.Pathspecs, All: b.All, Affected: []string{}}
+	if b.Bare == nil {
+		if err := cleanWorkTree(ctx); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if p.Base, p.Head, err = b.rangeCommits(ctx); err != nil {
+		return nil, err
+	}
+	for _, name := range b.ConfigFiles {
+		var data []byte
+		if b.Bare != nil {
+			data, err = b.Bare.readFile(name)
+		} else {
+			data, err = ioutil.ReadFile(name)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "config digest")
+		}
+		p.Config[name] = fmt.Sprintf("%x", sha256.Sum256(data))
+	}
+	for _, t := range b.Config.Targets {
+		if len(t.Changes) > 0 || b.All {
+			p.Affected = append(p.Affected, t.ID())
+		}
+	}
+	return p, nil
+}
+
+// cleanWorkTree refuses to attest a plan of uncommitted changes: the
+// attestation records commits, and the working tree of a single revision
+// range and the config files are read from the checkout.
+func cleanWorkTree(ctx context.Context) error {
+	status, err := gitLines(ctx, "status", "--porcelain", "--untracked-files=all")
+	if err != nil {
+		return err
+	}
+	if len(status) > 0 {
+		return errors.Errorf("cannot attest the plan of a dirty working tree, commit or stash its %d changed files first", len(status))
+	}
+	return nil
+}
+
+// rangeCommits resolves the commits of the commit range: the merge base of a
+// base...head range, and HEAD for the working tree, which is clean.
+func (b *BuildContext) rangeCommits(ctx context.Context) (base, head string, err error) {
+	if b.Bare != nil {
+		return b.Bare.Base, b.Bare.Head, nil
+	}
+	r := b.CommitRange
+	// A single revision is compared with the working tree, at HEAD.
+	left, right, sym := r, "", false
+	if i := strings.Index(r, "..."); i >= 0 {
+		left, right, sym = r[:i], r[i+3:], true
+	} else if i := strings.Index(r, ".."); i >= 0 {
+		left, right = r[:i], r[i+2:]
+	}
+	if right == "" {
+		right = "HEAD"
+	}
+	if head, err = gitOutput(ctx, "rev-parse", "--verify", right+"^{commit}"); err != nil {
+		return "", "", errors.Wrapf(err, "resolve %s", right)
+	}
+	if left == "" {
+		return "", head, nil
+	}
+	if sym {
+		base, err = gitOutput(ctx, "merge-base", left, head)
+	} else {
+		base, err = gitOutput(ctx, "rev-parse", "--verify", left+"^{commit}")
+	}
+	return base, head, errors.Wrapf(err, "resolve %s", left)
+}
+
+// WriteAttestation signs the plan with the Ed25519 private key of keyFile,
+// a PKCS #8 PEM file, and writes its in-toto attestation to name.
+func (b *BuildContext) WriteAttestation(ctx context.Context, name, keyFile string) error {
+	ctx, span := tracer.Start(ctx, "*BuildContext.WriteAttestation()")
+	defer span.End()
+	key, err := readSigningKey(keyFile)
+	if err != nil {
+		return err
+	}
+	p, err := b.planPredicate(ctx)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(&inTotoStatement{
+		Type:          inTotoStatementType,
+		Subject:       []inTotoSubject{{Name: planSubjectName, Digest: map[string]string{"sha256": affectedDigest(p.Affected)}}},
+		PredicateType: PlanPredicateType,
+		Predicate:     p,
+	})
+	if err != nil {
+		return err
+	}
+	env := &dsseEnvelope{
+		PayloadType: inTotoPayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []dsseSignature{{
+			KeyID: keyID(key.Public().(ed25519.PublicKey)),
+			Sig:   base64.StdEncoding.EncodeToString(ed25519.Sign(key, dssePAE(inTotoPayloadType, payload))),
+		}},
+	}
+	out, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.String("attestation", name), attribute.Int("affected", len(p.Affected)))
+	return ioutil.WriteFile(name, append(out, '\n'), 0644)
+}
+
+// VerifyAttestation verifies the signature of an attestation with the
+// Ed25519 public key of keyFile, a PKIX PEM file, and returns its plan.
+func VerifyAttestation(name, keyFile string) (*PlanPredicate, error) {
+	pub, err := readVerifyingKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var env dsseEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, errors.Wrapf(err, "attestation %s", name)
+	}
+	if env.PayloadType != inTotoPayloadType {
+		return nil, errors.Errorf("attestation %s: payload type %q, want %q", name, env.PayloadType, inTotoPayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, errors.Wrapf(err, "attestation %s: payload", name)
+	}
+	verified := false
+	for _, s := range env.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err == nil && ed25519.Verify(pub, dssePAE(env.PayloadType, payload), sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.Errorf("attestation %s: no valid signature of key %s", name, keyID(pub))
+	}
+	var st inTotoStatement
+	if err := json.Unmarshal(payload, &st); err != nil {
+		return nil, errors.Wrapf(err, "attestation %s: statement", name)
+	}
+	switch {
+	case st.Type != inTotoStatementType || st.PredicateType != PlanPredicateType || st.Predicate == nil:
+		return nil, errors.Errorf("attestation %s: not a monobuild plan", name)
+	case len(st.Subject) != 1 || st.Subject[0].Digest["sha256"] != affectedDigest(st.Predicate.Affected):
+		return nil, errors.Errorf("attestation %s: the subject does not match the affected targets", name)
+	}
+	return st.Predicate, nil
+}
+
+// keyID identifies a public key: the sha256 of its PKIX encoding.
+func keyID(pub ed25519.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	return fmt.Sprintf("%x", sha256.Sum256(der))
+}
+
+func readSigningKey(name string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(name)
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "signing key %s", name)
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("signing key %s: not an Ed25519 key", name)
+	}
+	return key, nil
+}
+
+func readVerifyingKey(name string) (ed25519.PublicKey, error) {
+	block, err := readPEM(name)
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "public key %s", name)
+	}
+	pub, ok := k.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("public key %s: not an Ed25519 key", name)
+	}
+	return pub, nil
+}
+
+func readPEM(name string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("%s: no PEM block", name)
+	}
+	return block, nil
+}
+
+// GenerateAttestationKey writes a new Ed25519 key pair to the PEM files
+// <prefix>.key, private, and <prefix>.pub.
+func GenerateAttestationKey(prefix string) error {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(prefix+".key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	if der, err = x509.MarshalPKIXPublicKey(pub); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(prefix+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+}
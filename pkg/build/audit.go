@@ -0,0 +1,220 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// AuditReport is the onboarding report of a repository and its config: the
+// gaps of the config and what mb saves over building every target.
+type AuditReport struct {
+	Targets         int              `json:"targets"`
+	UntargetedMains []string         `json:"untargeted_main_packages"` // Directories of the main packages under no target.
+	Uncovered       []string         `json:"uncovered_targets"`        // Targets with no dependency, dependency directory or watched file.
+	SharedPackages  []*SharedPackage `json:"shared_packages"`          // The dependencies of the most targets, first.
+	Savings         *AuditSavings    `json:"savings,omitempty"`        // None without run records.
+}
+
+// SharedPackage is a Go package or a dependency directory shared by several
+// targets, which a change rebuilds all of.
+type SharedPackage struct {
+	Package string   `json:"package"`
+	Targets []string `json:"targets"`
+}
+
+// AuditSavings estimates the CI time saved by building the affected targets
+// only, from the run records of a time window: the builds of every target,
+// at their median duration, minus the builds of the runs. The times are the
+// sums of the build durations, not the wall-clock times of parallel runs.
+type AuditSavings struct {
+	Window     string        `json:"window"`
+	Runs       int           `json:"runs"`
+	BuildAll   time.Duration `json:"build_all"` // Every target built by every run.
+	Built      time.Duration `json:"built"`
+	Saved      time.Duration `json:"saved"`
+	SavedRatio float64       `json:"saved_ratio"`
+	// The targets never built in the window, whose duration is unknown and
+	// not counted.
+	WithoutHistory []string `json:"without_history,omitempty"`
+}
+
+// Audit analyzes the repository and the config: the main packages that no
+// target builds, the targets that nothing but their directory affects, the
+// top shared packages and, with runs, the time saved in the window since.
+func (b *BuildContext) Audit(ctx context.Context, top int, runs []*Run, window string, since time.Time) (*AuditReport, error) {
+	ctx, span := tracer.Start(ctx, "*BuildContext.Audit()")
+	defer span.End()
+	r := &AuditReport{Targets: len(b.Config.Targets), UntargetedMains: []string{}, Uncovered: []string{}, SharedPackages: []*SharedPackage{}}
+	mains, err := mainPackageDirs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range mains {
+		if !b.Config.targeted(dir) {
+			r.UntargetedMains = append(r.UntargetedMains, dir)
+		}
+	}
+	shared := make(map[string][]string)
+	for _, t := range b.Config.Targets {
+		deps := b.Config.repoDeps(t)
+		for _, d := range t.DepDirs {
+			if d != CleanTreePath(t.Path) {
+				deps = append(deps, d+"/")
+			}
+		}
+		if len(deps) == 0 && len(t.DepFiles) == 0 && len(t.Watches) == 0 && len(t.WatchPattern) == 0 && len(t.DependsOn) == 0 {
+			r.Uncovered = append(r.Uncovered, t.Path)
+		}
+		for _, d := range deps {
+			shared[d] = append(shared[d], t.Path)
+		}
+	}
+	for d, targets := range shared {
+		if len(targets) > 1 {
+			r.SharedPackages = append(r.SharedPackages, &SharedPackage{Package: d, Targets: targets})
+		}
+	}
+	sort.Slice(r.SharedPackages, func(i, j int) bool {
+		pi, pj := r.SharedPackages[i], r.SharedPackages[j]
+		if len(pi.Targets) != len(pj.Targets) {
+			return len(pi.Targets) > len(pj.Targets)
+		}
+		return pi.Package < pj.Package
+	})
+	if top > 0 && len(r.SharedPackages) > top {
+		r.SharedPackages = r.SharedPackages[:top]
+	}
+	if len(runs) > 0 {
+		r.Savings = b.auditSavings(runs, window, since)
+	}
+	span.SetAttributes(attribute.Int("untargeted", len(r.UntargetedMains)), attribute.Int("uncovered", len(r.Uncovered)))
+	return r, nil
+}
+
+// targeted reports whether a directory is the one of a target or under it.
+func (c *Config) targeted(dir string) bool {
+	for _, t := range c.Targets {
+		p := CleanTreePath(t.Path)
+		if p == "." || dir == p || strings.HasPrefix(dir, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// mainPackageDirs returns the sorted directories of the tracked main
+// packages, outside of vendor and testdata directories.
+func mainPackageDirs(ctx context.Context) ([]string, error) {
+	files, err := gitLines(ctx, "ls-files", "--", "*.go")
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var dirs []string
+	fset := token.NewFileSet()
+	for _, f := range files {
+		dir := path.Dir(f)
+		if seen[dir] || strings.HasSuffix(f, "_test.go") || ignoredGoDir(dir) {
+			continue
+		}
+		af, err := parser.ParseFile(fset, f, nil, parser.PackageClauseOnly)
+		if err != nil || af.Name.Name != "main" {
+			continue
+		}
+		seen[dir] = true
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// ignoredGoDir reports whether the go tool ignores the packages of a
+// directory: vendor, testdata and the directories starting with . or _.
+func ignoredGoDir(dir string) bool {
+	for _, e := range strings.Split(dir, "/") {
+		if e == "vendor" || e == "testdata" || strings.HasPrefix(e, "_") || (strings.HasPrefix(e, ".") && e != ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// auditSavings compares the builds of the runs since the start of the window
+// with building every target of the config in each of them.
+func (b *BuildContext) auditSavings(runs []*Run, window string, since time.Time) *AuditSavings {
+	s := &AuditSavings{Window: window}
+	durations := make(map[string][]time.Duration)
+	for _, r := range runs {
+		if r.Time.Before(since) {
+			continue
+		}
+		s.Runs++
+		for _, rt := range r.Targets {
+			if rt.Status == "" || rt.Status == RunCancelled {
+				continue
+			}
+			s.Built += rt.Duration
+			durations[rt.ID()] = append(durations[rt.ID()], rt.Duration)
+		}
+	}
+	var all time.Duration
+	for _, t := range b.Config.Targets {
+		d, ok := durations[t.ID()]
+		if !ok {
+			s.WithoutHistory = append(s.WithoutHistory, t.Path)
+			continue
+		}
+		all += percentile(d, 50)
+	}
+	s.BuildAll = all * time.Duration(s.Runs)
+	if s.BuildAll > s.Built {
+		s.Saved = s.BuildAll - s.Built
+		s.SavedRatio = float64(s.Saved) / float64(s.BuildAll)
+	}
+	return s
+}
+
+// Write writes the report as text.
+func (r *AuditReport) Write(w io.Writer) {
+	fmt.Fprintf(w, "%d targets\n\n", r.Targets)
+	fmt.Fprintf(w, "Main packages without a target: %d\n", len(r.UntargetedMains))
+	for _, d := range r.UntargetedMains {
+		fmt.Fprintf(w, "  %s\n", d)
+	}
+	fmt.Fprintf(w, "\nTargets only affected by their directory: %d\n", len(r.Uncovered))
+	for _, p := range r.Uncovered {
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+	fmt.Fprintf(w, "\nShared packages, by affected targets: %d\n", len(r.SharedPackages))
+	for _, p := range r.SharedPackages {
+		fmt.Fprintf(w, "  %-4d %s\n", len(p.Targets), p.Package)
+	}
+	s := r.Savings
+	if s == nil {
+		fmt.Fprintln(w, "\nNo run records to estimate the CI time saved.")
+		return
+	}
+	fmt.Fprintf(w, "\nCI time of the %d runs of the last %s: %s built, %s to build every target, %s (%.1f%%) saved\n",
+		s.Runs, s.Window, roundDuration(s.Built), roundDuration(s.BuildAll), roundDuration(s.Saved), s.SavedRatio*100)
+	if len(s.WithoutHistory) > 0 {
+		fmt.Fprintf(w, "Not counted, never built in the window: %s\n", strings.Join(s.WithoutHistory, ", "))
+	}
+}
+
+// roundDuration rounds a duration to the second, or to the millisecond under
+// a minute.
+func roundDuration(d time.Duration) time.Duration {
+	if d < time.Minute {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Second)
+}
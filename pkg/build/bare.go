@@ -0,0 +1,381 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"path"
+	"strconv"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// BareRepo reads the trees and blobs of a bare clone so that a commit range
+// can be analyzed without a checkout.
+type BareRepo struct {
+	Path string
+	Base string // Resolved base commit SHA.
+	Head string // Resolved head commit SHA.
+
+	repo     *git.Repository
+	baseTree *object.Tree
+	headTree *object.Tree
+}
+
+func openBareRepo(ctx context.Context, repoPath, commitRange string) (*BareRepo, error) {
+	_, span := tracer.Start(ctx, "openBareRepo")
+	defer span.End()
+	repo, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return nil, errors.Errorf("open bare repository %s: %v", repoPath, err)
+	}
+	r := &BareRepo{Path: repoPath, repo: repo}
+	if err := r.resolveRange(commitRange); err != nil {
+		return nil, err
+	}
+	span.SetAttributes(
+		attribute.String("base", r.Base),
+		attribute.String("head", r.Head),
+	)
+	return r, nil
+}
+
+// resolveRange resolves a `base..head`, `base...head` or a single `head`
+// revision. A single revision is compared against its first parent.
+func (r *BareRepo) resolveRange(commitRange string) error {
+	if commitRange == "" {
+		return errors.Errorf("a commit range is required when analyzing a bare repository")
+	}
+	var baseRev, headRev string
+	threeDot := false
+	switch {
+	case strings.Contains(commitRange, "..."):
+		parts := strings.SplitN(commitRange, "...", 2)
+		baseRev, headRev = parts[0], parts[1]
+		threeDot = true
+	case strings.Contains(commitRange, ".."):
+		parts := strings.SplitN(commitRange, "..", 2)
+		baseRev, headRev = parts[0], parts[1]
+	default:
+		headRev = commitRange
+	}
+	if headRev == "" {
+		headRev = "HEAD"
+	}
+	head, err := r.commit(headRev)
+	if err != nil {
+		return err
+	}
+	var base *object.Commit
+	switch {
+	case baseRev != "":
+		if base, err = r.commit(baseRev); err != nil {
+			return err
+		}
+		if threeDot {
+			bases, err := base.MergeBase(head)
+			if err != nil {
+				return errors.Errorf("merge-base %s %s: %v", baseRev, headRev, err)
+			}
+			if len(bases) == 0 {
+				return errors.Errorf("no merge base between %s and %s", baseRev, headRev)
+			}
+			base = bases[0]
+		}
+	case head.NumParents() > 0:
+		if base, err = head.Parent(0); err != nil {
+			return err
+		}
+	}
+	if r.headTree, err = head.Tree(); err != nil {
+		return err
+	}
+	r.Head = head.Hash.String()
+	if base != nil {
+		if r.baseTree, err = base.Tree(); err != nil {
+			return err
+		}
+		r.Base = base.Hash.String()
+	}
+	return nil
+}
+
+func (r *BareRepo) commit(rev string) (*object.Commit, error) {
+	h, err := r.repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, errors.Errorf("resolve revision %s: %v", rev, err)
+	}
+	return r.repo.CommitObject(*h)
+}
+
+func (r *BareRepo) Name() string { return SourceBare }
+
+// ChangedFiles returns the paths that differ between the base and head trees.
+// Both sides of a rename are reported.
+func (r *BareRepo) ChangedFiles(ctx context.Context) ([]string, error) {
+	return changeNames(r.Changes(ctx))
+}
+
+// Changes returns the changes from the base tree to the head tree.
+func (r *BareRepo) Changes(ctx context.Context) ([]FileChange, error) {
+	return treeChanges(ctx, r.repo, r.baseTree, r.headTree)
+}
+
+func (r *BareRepo) readFile(name string) ([]byte, error) {
+	f, err := r.headTree.File(CleanTreePath(name))
+	if err != nil {
+		return nil, errors.Errorf("%s@%s: %v", name, r.Head, err)
+	}
+	s, err := f.Contents()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+func (r *BareRepo) isDir(name string) bool {
+	name = CleanTreePath(name)
+	if name == "." {
+		return true
+	}
+	_, err := r.headTree.Tree(name)
+	return err == nil
+}
+
+// glob matches a pattern against every file of the head tree.
+func (r *BareRepo) glob(pattern string) ([]string, error) {
+	pattern = CleanTreePath(pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	var matches []string
+	err := r.headTree.Files().ForEach(func(f *object.File) error {
+		if ok, _ := path.Match(pattern, f.Name); ok {
+			matches = append(matches, f.Name)
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// globDirs matches a pattern against every directory of the head tree.
+func (r *BareRepo) globDirs(pattern string) ([]string, error) {
+	pattern = CleanTreePath(pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var matches []string
+	err := r.headTree.Files().ForEach(func(f *object.File) error {
+		for d := path.Dir(f.Name); d != "." && !seen[d]; d = path.Dir(d) {
+			seen[d] = true
+			if ok, _ := path.Match(pattern, d); ok {
+				matches = append(matches, d)
+			}
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// goDeps resolves the import paths of the Go package in dir, recursing into
+// imports that can be located in the head tree. It is the checkout-free
+// counterpart of `go list -json`.
+func (r *BareRepo) goDeps(dir string) ([]string, error) {
+	pkgDirs, err := r.goPackageDirs()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		deps []string
+		seen = make(map[string]bool)
+		walk func(dir string) error
+	)
+	walk = func(dir string) error {
+		imports, err := r.goImports(dir)
+		if err != nil {
+			return err
+		}
+		for _, imp := range imports {
+			if seen[imp] {
+				continue
+			}
+			seen[imp] = true
+			deps = append(deps, imp)
+			if d, ok := resolveImportDir(imp, pkgDirs); ok {
+				if err := walk(d); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(CleanTreePath(dir)); err != nil {
+		return nil, err
+	}
+	return deps, nil
+}
+
+// goPackageDirs returns the directories of the head tree with Go files.
+func (r *BareRepo) goPackageDirs() (map[string]bool, error) {
+	pkgDirs := make(map[string]bool)
+	err := r.headTree.Files().ForEach(func(f *object.File) error {
+		if strings.HasSuffix(f.Name, ".go") {
+			pkgDirs[path.Dir(f.Name)] = true
+		}
+		return nil
+	})
+	return pkgDirs, err
+}
+
+func (r *BareRepo) goImports(dir string) ([]string, error) {
+	t := r.headTree
+	if dir != "." {
+		var err error
+		if t, err = r.headTree.Tree(dir); err != nil {
+			return nil, errors.Errorf("%s@%s: %v", dir, r.Head, err)
+		}
+	}
+	var imports []string
+	fset := token.NewFileSet()
+	for _, e := range t.Entries {
+		if !e.Mode.IsFile() || !strings.HasSuffix(e.Name, ".go") || strings.HasSuffix(e.Name, "_test.go") {
+			continue
+		}
+		f, err := t.TreeEntryFile(&e)
+		if err != nil {
+			return nil, err
+		}
+		src, err := f.Contents()
+		if err != nil {
+			return nil, err
+		}
+		af, err := parser.ParseFile(fset, path.Join(dir, e.Name), src, parser.ImportsOnly)
+		if err != nil {
+			return nil, err
+		}
+		for _, is := range af.Imports {
+			imp, err := strconv.Unquote(is.Path.Value)
+			if err != nil {
+				return nil, err
+			}
+			imports = append(imports, imp)
+		}
+	}
+	return imports, nil
+}
+
+// resolveImportDir finds the tree directory of an import path, preferring the
+// vendor directory and otherwise the longest directory the import path ends with.
+func resolveImportDir(imp string, pkgDirs map[string]bool) (string, bool) {
+	if d := path.Join("vendor", imp); pkgDirs[d] {
+		return d, true
+	}
+	best := ""
+	for d := range pkgDirs {
+		if d == "." {
+			continue
+		}
+		if (imp == d || strings.HasSuffix(imp, "/"+d)) && len(d) > len(best) {
+			best = d
+		}
+	}
+	return best, best != ""
+}
+
+func CleanTreePath(p string) string {
+	return path.Clean(strings.TrimPrefix(p, "./"))
+}
+
+// NewBareBuildContext creates a BuildContext from the head commit of a bare
+// repository. The config file is read from the head tree and nothing is
+// stat'ed on disk, so the returned context can only be diffed, not built.
+func NewBareBuildContext(ctx context.Context, repoPath, configFile, commitRange string) (*BuildContext, error) {
+	ctx, span := tracer.Start(ctx, "NewBareBuildContext")
+	defer span.End()
+	r, err := openBareRepo(ctx, repoPath, commitRange)
+	if err != nil {
+		return nil, err
+	}
+	b := &BuildContext{
+		CommitRange: commitRange,
+		ConfigFile:  configFile,
+		Bare:        r,
+		Providers:   []DiffProvider{r},
+	}
+	fb, err := r.readFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if fb, err = decryptConfig(ctx, fb); err != nil {
+		return nil, err
+	}
+	fb, included, err := includeConfigs(ctx, fb, configFile, r.readFile, r.glob)
+	if err != nil {
+		return nil, err
+	}
+	b.ConfigFiles = append([]string{CleanTreePath(configFile)}, included...)
+	if err := unmarshalConfig(fb, &b.Config); err != nil {
+		return nil, locateConfigErrors(err, b.ConfigFiles, r.readFile)
+	}
+	if err := b.Config.resolveTargets(r.globDirs, r.isDir); err != nil {
+		return nil, err
+	}
+	if err := b.Config.validateTree(ctx, r); err != nil {
+		return nil, locateConfigErrors(err, b.ConfigFiles, r.readFile)
+	}
+	for _, t := range b.Config.Targets {
+		if t.Deps, err = r.goDeps(t.Path); err != nil {
+			return nil, err
+		}
+	}
+	span.SetAttributes(attribute.String("build_context", b.String()))
+	return b, nil
+}
+
+func (c *Config) validateTree(ctx context.Context, r *BareRepo) error {
+	_, span := tracer.Start(ctx, "*Config.validateTree()")
+	defer span.End()
+
+	var errs ConfigErrors
+	errs.add(c.Guardrail.validate(), "")
+	errs.add(c.Policy.validate(), "")
+	errs.add(validateConfigChange(c.ConfigChange), "")
+	for _, f := range c.DepSourceDirs {
+		if !r.isDir(f) {
+			_, err := r.readFile(f)
+			e := notDirError("dep_source_dirs", "dep_source_dir", f, err == nil, r.globDirs)
+			e.Message += " in " + r.Head
+			errs.add(e, "")
+		}
+	}
+	checkdup := make(map[string]int)
+	for _, t := range c.Targets {
+		if n, found := checkdup[CleanTreePath(t.Path)]; found {
+			checkdup[CleanTreePath(t.Path)]++
+			errs.add(&ConfigError{Message: fmt.Sprintf("target.path: %s has been used more than once", t.Path), key: "path", value: t.Path, nth: n}, "")
+			continue
+		}
+		checkdup[CleanTreePath(t.Path)]++
+		if !r.isDir(t.Path) {
+			_, err := r.readFile(t.Path)
+			e := notDirError("path", "target.path", t.Path, err == nil, r.globDirs)
+			e.Message += " in " + r.Head
+			errs.add(e, "")
+			continue
+		}
+		if err := t.BuildCommand.validate("build_command", t.Path); err != nil {
+			errs.add(err, t.Path)
+			continue
+		}
+		errs.add(validatePatterns(t), t.Path)
+	}
+	errs.add(c.validateDependsOn(), "")
+	return errs.err()
+}
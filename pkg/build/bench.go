@@ -0,0 +1,161 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BenchLayout describes the synthetic monorepo generated by mb bench-analyzer.
+type BenchLayout struct {
+	Targets         int
+	Packages        int
+	FilesPerPackage int
+	ImportsPerPkg   int
+	Changed         int
+	Seed            int64
+}
+
+const benchModule = "example.com/mbbench"
+
+// generate writes the layout into dir and returns the changed files to diff.
+func (l BenchLayout) generate(dir string) ([]string, error) {
+	r := rand.New(rand.NewSource(l.Seed))
+	write := func(name, content string) error {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(p, []byte(content), 0644)
+	}
+	if err := write("go.mod", "module "+benchModule+"\n\ngo 1.13\n"); err != nil {
+		return nil, err
+	}
+	var files []string
+	// Packages only import packages with a lower index so the graph is acyclic.
+	for p := 0; p < l.Packages; p++ {
+		imports := l.randomImports(r, p)
+		for f := 0; f < l.FilesPerPackage; f++ {
+			name := fmt.Sprintf("pkg/p%05d/f%03d.go", p, f)
+			src := fmt.Sprintf("package p%05d\n", p)
+			if f == 0 {
+				src += goImports(imports)
+			}
+			if err := write(name, src); err != nil {
+				return nil, err
+			}
+			files = append(files, name)
+		}
+	}
+	var cfg strings.Builder
+	cfg.WriteString("dep_source_dirs:\n  - pkg\ntargets:\n")
+	for t := 0; t < l.Targets; t++ {
+		path := fmt.Sprintf("cmd/t%05d", t)
+		imports := l.randomImports(r, l.Packages)
+		src := "package main\n" + goImports(imports) + "\nfunc main() {}\n"
+		if err := write(path+"/main.go", src); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&cfg, "  - path: %s\n    build_command:\n      command: \"true\"\n", path)
+	}
+	if err := write("monobuild.yaml", cfg.String()); err != nil {
+		return nil, err
+	}
+	r.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+	if l.Changed < len(files) {
+		files = files[:l.Changed]
+	}
+	return files, nil
+}
+
+// randomImports picks up to ImportsPerPkg packages with an index below max.
+func (l BenchLayout) randomImports(r *rand.Rand, max int) []string {
+	seen := make(map[int]bool)
+	var imports []string
+	for i := 0; i < l.ImportsPerPkg && max > 0; i++ {
+		p := r.Intn(max)
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		imports = append(imports, fmt.Sprintf("%s/pkg/p%05d", benchModule, p))
+	}
+	return imports
+}
+
+func goImports(imports []string) string {
+	if len(imports) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("\nimport (\n")
+	for _, i := range imports {
+		fmt.Fprintf(&sb, "\t_ %q\n", i)
+	}
+	sb.WriteString(")\n")
+	return sb.String()
+}
+
+// BenchResult holds the durations of the plan phases.
+type BenchResult struct {
+	Generate time.Duration
+	Load     time.Duration
+	Diff     time.Duration
+	Affected int
+}
+
+func RunBenchAnalyzer(ctx context.Context, l BenchLayout, keep bool) (*BenchResult, error) {
+	ctx, span := tracer.Start(ctx, "RunBenchAnalyzer")
+	defer span.End()
+	dir, err := ioutil.TempDir("", "mb-bench-")
+	if err != nil {
+		return nil, err
+	}
+	if keep {
+		fmt.Println("synthetic repository:", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		return nil, err
+	}
+
+	res := &BenchResult{}
+	start := time.Now()
+	changed, err := l.generate(dir)
+	if err != nil {
+		return nil, err
+	}
+	res.Generate = time.Since(start)
+
+	start = time.Now()
+	b, err := NewBuildContext(ctx, "monobuild.yaml", "")
+	if err != nil {
+		return nil, err
+	}
+	res.Load = time.Since(start)
+
+	b.Quiet = true
+	b.Providers = []DiffProvider{&FileList{Files: changed}}
+	start = time.Now()
+	if err := b.Diff(ctx); err != nil {
+		return nil, err
+	}
+	res.Diff = time.Since(start)
+	for _, t := range b.Config.Targets {
+		if len(t.Changes) > 0 {
+			res.Affected++
+		}
+	}
+	return res, nil
+}
@@ -1 +1,1297 @@
 package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// NewBuildContext loads and validates the config file and analyzes the
+// dependencies of its targets. The commit range is diffed with git.
+func NewBuildContext(ctx context.Context, configFile, commitRange string) (*BuildContext, error) {
+	return newBuildContext(ctx, configFile, commitRange, false)
+}
+
+// NewLazyBuildContext is like NewBuildContext, but Diff analyzes the
+// dependencies of the targets after the diff, only for the targets a changed
+// file can affect: a run without relevant changes loads no package.
+func NewLazyBuildContext(ctx context.Context, configFile, commitRange string) (*BuildContext, error) {
+	return newBuildContext(ctx, configFile, commitRange, true)
+}
+
+func newBuildContext(ctx context.Context, configFile, commitRange string, lazy bool) (*BuildContext, error) {
+	ctx, span := tracer.Start(ctx, "NewBuildContext")
+	defer span.End()
+	b := &BuildContext{
+		CommitRange: commitRange,
+		ConfigFile:  configFile,
+		Providers:   []DiffProvider{&GitDiff{CommitRange: commitRange}},
+	}
+	// Parse the config file, merged with the local override file.
+	fb, local, included, err := readConfig(ctx, b.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	b.LocalConfigFile = local
+	b.ConfigFiles = append([]string{CleanTreePath(configFile)}, included...)
+	if err := unmarshalConfig(fb, &b.Config); err != nil {
+		return nil, locateConfigErrors(err, append(b.ConfigFiles, local), ioutil.ReadFile)
+	}
+	if err := b.Config.resolveTargets(filepath.Glob, isLocalDir); err != nil {
+		return nil, err
+	}
+	// Validate the config file.
+	if err := b.Config.validate(ctx); err != nil {
+		return nil, locateConfigErrors(err, append(b.ConfigFiles, local), ioutil.ReadFile)
+	}
+	// Parse each target Go dependencies and watched files.
+	b.lazy = lazy
+	for i := range b.Config.Targets {
+		if b.Config.Targets[i].NotCheckedOut {
+			Log.Warn("the target is not checked out, analyzing it from HEAD", "target", b.Config.Targets[i].Path)
+			if err := b.Config.Targets[i].analyzeHead(ctx); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if lazy {
+			b.Config.Targets[i].NotAnalyzed = true
+		} else if err := b.Config.Targets[i].analyzeDeps(ctx); err != nil {
+			return nil, err
+		}
+		if err := b.Config.Targets[i].parseBuildSystemFiles(ctx); err != nil {
+			return nil, err
+		}
+		if err := b.Config.Targets[i].parseDepsCommand(ctx, b.Config.Policy.environ(os.Environ())); err != nil {
+			return nil, err
+		}
+		// A change of an env file changes the build of the target.
+		for _, f := range b.Config.Targets[i].EnvFiles {
+			b.Config.Targets[i].addWatch(f)
+		}
+		for _, c := range b.Config.Targets[i].commands() {
+			if c.EnvFile != "" {
+				b.Config.Targets[i].addWatch(c.EnvFile)
+			}
+		}
+	}
+	span.SetAttributes(attribute.String("build_context", b.String()))
+	return b, nil
+}
+
+// analyzeDeps analyzes the dependencies of a checked out target.
+func (t *Target) analyzeDeps(ctx context.Context) error {
+	if err := t.analyze(ctx); err != nil {
+		// The dependencies of the target may be outside of the sparse checkout.
+		if !isSparseCheckout(ctx) {
+			return err
+		}
+		Log.Warn("cannot analyze the target in the sparse checkout, analyzing it from HEAD", "target", t.Path, "error", err)
+		if err := t.analyzeHead(ctx); err != nil {
+			return err
+		}
+	}
+	t.NotAnalyzed = false
+	return nil
+}
+
+// analyzeAffectable analyzes the dependencies of the targets of a lazy
+// context that the changed files can affect. The dependencies of a Go target
+// are in the dep_source_dirs, the ones of the other analyzers anywhere.
+func (b *BuildContext) analyzeAffectable(ctx context.Context, files []*File) error {
+	ctx, span := tracer.Start(ctx, "*BuildContext.analyzeAffectable()")
+	defer span.End()
+	inDepSourceDirs := false
+	for _, f := range files {
+		for _, d := range b.Config.DepSourceDirs {
+			inDepSourceDirs = inDepSourceDirs || strings.HasPrefix(f.Name, d)
+		}
+	}
+	analyzed := 0
+	for _, t := range b.Config.Targets {
+		if !t.NotAnalyzed || len(files) == 0 {
+			continue
+		}
+		analyzer := t.Analyzer
+		if analyzer == "" {
+			analyzer = detectAnalyzer(t)
+		}
+		// The sources copied by a Dockerfile can be anywhere in the tree.
+		if (analyzer == AnalyzerGo && !inDepSourceDirs || analyzer == AnalyzerNone) && !fileExists(t.dockerfile()) {
+			Log.Debug("no changed file can be a dependency of the target, not analyzing it", "target", t.Path)
+			continue
+		}
+		if err := t.analyzeDeps(ctx); err != nil {
+			return err
+		}
+		analyzed++
+	}
+	span.SetAttributes(attribute.Int("analyzed", analyzed))
+	return nil
+}
+
+// BuildContext represents a monobuild execution context.
+type BuildContext struct {
+	Config      Config
+	Files       []*File
+	ConfigFile  string
+	CommitRange string
+	// The local override file merged over ConfigFile, e.g. monobuild.local.yaml.
+	LocalConfigFile string      `json:",omitempty"`
+	ConfigFiles     []string    `json:",omitempty"` // ConfigFile and its included fragments.
+	Bare            *BareRepo   `json:",omitempty"` // Set when analyzing a bare clone.
+	Overrides       []*Override `json:",omitempty"` // Run-time overrides of the build commands, applied to the targets.
+	Pathspecs       []string    `json:",omitempty"` // git pathspecs the changed files are restricted to, e.g. services/**.
+	CI              bool
+	Providers       []DiffProvider   `json:"-"` // Defaults to the git diff of CommitRange.
+	Quiet           bool             `json:"-"` // Silences the tool installations, for the commands whose stdout is consumed.
+	All             bool             // Build every target regardless of the changes.
+	RunsDir         string           `json:"-"` // Where the run records are written.
+	Branch          string           `json:"-"` // Branch of the run records, the checked out branch when empty.
+	Parallel        int              `json:"-"` // Overrides the parallel setting of the config when positive.
+	Deterministic   bool             `json:"-"` // Builds the targets and prints their output in path order.
+	Seed            int64            `json:"-"` // Seeds the order of the parallel builds, random when zero.
+	ResultDir       string           `json:"-"` // Overrides the result_dir of the config when not empty.
+	Renderer        Renderer         `json:"-"` // Renders the diff and the build, pretty when nil.
+	NoCache         bool             `json:"-"` // Builds the targets even when their inputs are in the build cache.
+	CacheDir        string           `json:"-"` // The directory of the build cache, DefaultCacheDir() when empty.
+	GroupBy         string           `json:"-"` // Label the summary of the run is grouped by, e.g. team.
+	MarkdownSummary string           `json:"-"` // File the markdown summary of the run is appended to, none when empty.
+	KeepGoing       bool             `json:"-"` // Builds the other targets after a failure, as parallel builds do.
+	KeyContributors []KeyContributor `json:"-"` // Add to the cache keys of the targets, after the cache_key of the config.
+	ApprovalKeys    []string         `json:"-"` // Public key files of the approvers of the protected targets, outside of the tree.
+	Metrics         MetricsConfig    `json:"-"` // Where the metrics of the run are pushed.
+	Reports         []Report         `json:"-"` // Reports of the run, e.g. JUnit XML.
+	Test            bool             `json:"-"` // The targets run their test commands, see UseTestCommands.
+
+	lazy       bool            // Diff analyzes the dependencies of the targets.
+	stanzas    map[string]bool // The targets whose definition changed, with the precise config change policy.
+	apiChanges map[string]bool // Whether the exported API of a package directory changed, with minimal_rebuild.
+}
+
+func (b *BuildContext) String() string {
+	bc, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return RedactSecrets(string(bc))
+}
+
+// Diff finds the changed files of the providers and records them in the
+// Changes of the targets they affect.
+func (b *BuildContext) Diff(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "*BuildContext.Diff()")
+	defer span.End()
+	files, err := b.changedFiles(ctx)
+	if err != nil {
+		return err
+	}
+	if b.lazy {
+		if err := b.analyzeAffectable(ctx, files); err != nil {
+			return err
+		}
+		b.lazy = false
+	}
+	for _, cf := range files {
+		f := cf.Name
+		if b.Bare == nil {
+			// Deleted files and the files outside of a sparse checkout have no
+			// FileInfo.
+			info, err := os.Stat(f)
+			if err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "changed file %s", f)
+			}
+			cf.FileInfo = info
+		}
+		for _, t := range b.Config.Targets {
+			dep := isFileDependencyOfTarget(f, t, b.Config.DepSourceDirs)
+			if dep && b.skipTransitive(ctx, f, t) {
+				dep = false
+				cf.SkippedDependents = append(cf.SkippedDependents, t.Path)
+				Log.Debug("implementation-only change of a package not imported directly, not rebuilding the target", "file", f, "target", t.Path)
+			}
+			if dep {
+				cf.DependencyOf = append(cf.DependencyOf, t.Path)
+				t.Changes = append(t.Changes, cf)
+				Log.Debug("file is a dependency of the target", "file", f, "target", t.Path)
+			}
+			if isFileWatchedByTarget(f, t) {
+				cf.WatchedBy = append(cf.WatchedBy, t.Path)
+				t.Changes = append(t.Changes, cf)
+				Log.Debug("file is watched by the target", "file", f, "target", t.Path)
+			}
+		}
+		if b.isConfigFile(f) {
+			b.configChanged(ctx, cf)
+		}
+		b.Files = append(b.Files, cf)
+		Log.Debug("changed file", "file", f, "sources", strings.Join(cf.Sources, ","), "status", cf.Status)
+	}
+	if b.Config.RebuildStaleOutputs && b.Bare == nil {
+		if err := b.staleOutputs(ctx); err != nil {
+			return err
+		}
+	}
+	span.SetAttributes(attribute.String("build_context", b.String()))
+	return nil
+}
+
+// isFileWatchedByTarget reports whether a file is one of the watched files
+// of the target, or matches one of its watch patterns.
+func isFileWatchedByTarget(f string, t *Target) bool {
+	for _, wf := range t.Watches {
+		if f == wf {
+			return true
+		}
+	}
+	return t.watchedByPattern(f)
+}
+
+func isFileDependencyOfTarget(f string, t *Target, depDirs []string) bool {
+	if isFileInDepDirs(f, t) || isFileInDepFiles(f, t) {
+		return true
+	}
+	if t.Deps == nil {
+		return false
+	}
+	fdir := filepath.Dir(f)
+	for _, depDir := range depDirs {
+		// If the changed file has a prefix of any of the defined package directory,
+		// then the changed file is identified as a dependency.
+		if strings.HasPrefix(f, depDir) {
+			// Check if any of the Target's dependency matches it.
+			for _, dep := range t.Deps {
+				if strings.Contains(dep, fdir) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// changedFiles merges the files of every diff provider, recording the
+// sources that reported each file.
+func (b *BuildContext) changedFiles(ctx context.Context) ([]*File, error) {
+	scope, err := parsePathspecs(b.Pathspecs)
+	if err != nil {
+		return nil, err
+	}
+	var files []*File
+	byName := make(map[string]*File)
+	for _, p := range b.Providers {
+		var changes []FileChange
+		if cl, ok := p.(ChangeLister); ok {
+			var err error
+			if changes, err = cl.Changes(ctx); err != nil {
+				return nil, errors.Wrapf(err, "diff source %s", p.Name())
+			}
+		} else {
+			names, err := p.ChangedFiles(ctx)
+			if err != nil {
+				return nil, errors.Wrapf(err, "diff source %s", p.Name())
+			}
+			for _, n := range names {
+				changes = append(changes, FileChange{Name: n})
+			}
+		}
+		for _, c := range changes {
+			if c.Name == "" {
+				continue
+			}
+			if !scope.match(c.Name) {
+				Log.Debug("changed file out of the pathspecs", "file", c.Name, "source", p.Name())
+				continue
+			}
+			f, ok := byName[c.Name]
+			if !ok {
+				f = &File{Name: c.Name}
+				byName[c.Name] = f
+				files = append(files, f)
+			}
+			f.Sources = append(f.Sources, p.Name())
+			if f.Status == "" {
+				f.Status, f.From = c.Status, c.From
+			}
+		}
+	}
+	return files, nil
+}
+
+// File represents a changed file reported by one or more diff providers.
+type File struct {
+	Name         string
+	Sources      []string // The diff providers that reported the file.
+	Status       string   `json:",omitempty"` // How the file changed, when a diff provider knows it.
+	From         string   `json:",omitempty"` // The previous name of a renamed file.
+	DependencyOf []string
+	WatchedBy    []string
+	// The transitive dependents not rebuilt for the file with
+	// minimal_rebuild, since the exported API of its package did not change.
+	SkippedDependents []string `json:",omitempty"`
+	// The targets rebuilt with rebuild_stale_outputs since the file is a
+	// missing or stale output of theirs, not a changed file.
+	StaleOutputOf []string `json:",omitempty"`
+	os.FileInfo   `json:"-"`
+}
+
+func (f *File) String() string {
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// Config represents the mb config file.
+type Config struct {
+	Include             []string           `yaml:"include"` // Glob patterns of the config fragments merged into the config, e.g. services/*/monobuild.yaml.
+	DepSourceDirs       []string           `yaml:"dep_source_dirs"`
+	Targets             []*Target          `yaml:"targets"`
+	TargetsGlob         []string           `yaml:"targets_glob"`          // Glob patterns of directories that are targets too, e.g. services/*.
+	DefaultBuildCommand BuildCommand       `yaml:"default_build_command"` // Build command template of the discovered targets, of {{.Path}} and {{.Name}}.
+	Directories         []*DirectoryConfig `yaml:"directories"`           // Settings inherited by the targets under each directory.
+	Approval            ApprovalConfig     `yaml:"approval"`
+	Guardrail           GuardrailConfig    `yaml:"guardrail"`
+	Policy              PolicyConfig       `yaml:"policy"`
+	Alerting            AlertingConfig     `yaml:"alerting"`
+	Parallel            int                `yaml:"parallel"`              // Maximum number of targets built at the same time. Defaults to 1.
+	ResultDir           string             `yaml:"result_dir"`            // Where the result file of every built target is written.
+	ConfigChange        string             `yaml:"config_change"`         // What a change of the config files triggers: all, precise, warn or ignore. Defaults to warn.
+	Cache               CacheConfig        `yaml:"cache"`                 // The remote build cache.
+	Locks               LockConfig         `yaml:"locks"`                 // Where the resource locks of the targets are held.
+	Tools               []*Tool            `yaml:"tools"`                 // Pinned tools installed in the tool cache and prepended to the PATH of the build commands.
+	Hooks               Hooks              `yaml:"hooks"`                 // Commands run before and after the builds of a run.
+	DefaultTimeout      string             `yaml:"default_timeout"`       // Timeout of the commands without one, e.g. 30m. None when empty.
+	CacheKey            []CacheKeyInput    `yaml:"cache_key"`             // Build-relevant state added to the cache key of every target, e.g. an external API version.
+	MinimalRebuild      bool               `yaml:"minimal_rebuild"`       // Experimental: only rebuild the direct importers of a Go package whose exported API did not change.
+	RebuildStaleOutputs bool               `yaml:"rebuild_stale_outputs"` // Rebuild the targets whose outputs are missing or older than their inputs, even without a change.
+	OutputLimit         OutputLimit        `yaml:"output_limit"`          // Limit of the captured build output of the targets without one.
+	Telemetry           TelemetryConfig    `yaml:"telemetry"`             // Opt-in anonymous usage reports.
+}
+
+func (c *Config) validate(ctx context.Context) error {
+	_, span := tracer.Start(ctx, "*Config.validate()")
+	defer span.End()
+
+	var errs ConfigErrors
+	sparse := isSparseCheckout(ctx)
+	for _, f := range c.DepSourceDirs {
+		if sparse && notCheckedOut(ctx, f) {
+			continue
+		}
+		finfo, err := os.Stat(f)
+		if err != nil || !finfo.IsDir() {
+			errs.add(notDirError("dep_source_dirs", "dep_source_dir", f, err == nil, localGlobDirs), "")
+		}
+	}
+	errs.add(c.Guardrail.validate(), "")
+	errs.add(c.Policy.validate(), "")
+	errs.add(c.Alerting.validate(), "")
+	if c.Parallel < 0 {
+		errs.add(errors.Errorf("parallel: %d must be positive", c.Parallel), "")
+	}
+	errs.add(validateConfigChange(c.ConfigChange), "")
+	errs.add(c.Cache.validate(), "")
+	errs.add(c.Locks.validate(), "")
+	if err := validateTimeout(c.DefaultTimeout); err != nil {
+		errs.add(errors.Errorf("default_timeout: %v", err), "")
+	}
+	errs.add(c.OutputLimit.validate("output_limit"), "")
+	errs.add(c.Hooks.validate(), "")
+	for i, k := range c.CacheKey {
+		errs.add(k.validate(fmt.Sprintf("cache_key[%d]", i)), "")
+		if err := c.Policy.check(BuildCommand{Command: k.Command}); err != nil {
+			errs.add(errors.Wrap(err, "cache_key"), "")
+		}
+	}
+	errs.add(c.Hooks.check(c.Policy), "")
+	tools := make(map[string]bool)
+	for _, t := range c.Tools {
+		if err := t.validate(); err != nil {
+			errs.add(err, "")
+			continue
+		}
+		if tools[t.Name] {
+			errs.add(&ConfigError{Message: fmt.Sprintf("tools.name: %s has been used more than once", t.Name), key: "name", value: t.Name, nth: 1}, "")
+		}
+		tools[t.Name] = true
+	}
+	checkdup := make(map[string]int)
+	for _, t := range c.Targets {
+		if n, found := checkdup[CleanTreePath(t.Path)]; found {
+			checkdup[CleanTreePath(t.Path)]++
+			errs.add(&ConfigError{Message: fmt.Sprintf("target.path: %s has been used more than once", t.Path), key: "path", value: t.Path, nth: n}, "")
+			continue
+		}
+		checkdup[CleanTreePath(t.Path)]++
+		// The targets outside of a sparse checkout are analyzed from HEAD.
+		t.NotCheckedOut = sparse && notCheckedOut(ctx, t.Path)
+		if !t.NotCheckedOut {
+			finfo, err := os.Stat(t.Path)
+			if err != nil || !finfo.IsDir() {
+				errs.add(notDirError("path", "target.path", t.Path, err == nil, localGlobDirs), "")
+				continue
+			}
+		}
+		errs.add(c.validateTarget(ctx, t, sparse), t.Path)
+	}
+	errs.add(c.validateNames(), "")
+	errs.add(c.validateDependsOn(), "")
+	return errs.err()
+}
+
+// validateTarget checks the settings of a target, stopping at the first
+// error.
+func (c *Config) validateTarget(ctx context.Context, t *Target, sparse bool) error {
+	if err := validateDocker(t); err != nil {
+		return err
+	}
+	if err := t.resolveDocker(ctx); err != nil {
+		return err
+	}
+	if err := t.BuildCommand.validate("build_command", t.Path); err != nil {
+		return err
+	}
+	if err := t.DepsCommand.validate("deps_command", t.Path); err != nil {
+		return err
+	}
+	if err := t.TestCommand.validate("test_command", t.Path); err != nil {
+		return err
+	}
+	if err := validateSteps(t); err != nil {
+		return err
+	}
+	if err := t.Hooks.validate(); err != nil {
+		return errors.Wrapf(err, "target %s", t.Path)
+	}
+	if err := t.Hooks.check(c.Policy); err != nil {
+		return errors.Wrapf(err, "target %s", t.Path)
+	}
+	for i, k := range t.CacheKey {
+		if err := k.validate(fmt.Sprintf("target.cache_key[%d]", i)); err != nil {
+			return errors.Wrapf(err, "target %s", t.Path)
+		}
+		if err := c.Policy.check(BuildCommand{Command: k.Command}); err != nil {
+			return errors.Wrapf(err, "target %s: cache_key", t.Path)
+		}
+	}
+	if err := validatePatterns(t); err != nil {
+		return err
+	}
+	for _, m := range t.ProblemMatchers {
+		if err := m.validate(t.Path); err != nil {
+			return err
+		}
+	}
+	if err := c.Policy.check(t.DepsCommand); err != nil {
+		return errors.Wrapf(err, "target %s: deps_command", t.Path)
+	}
+	for _, cmd := range t.commands() {
+		if err := c.Policy.check(cmd); err != nil {
+			return errors.Wrapf(err, "target %s", t.Path)
+		}
+	}
+	if err := validateAnalyzer(t); err != nil {
+		return err
+	}
+	for _, f := range t.EnvFiles {
+		if !fileExists(f) && !(sparse && notCheckedOut(ctx, f)) {
+			return errors.Errorf("target.env_files: %s of target %s does not exist", f, t.Path)
+		}
+	}
+	commands := map[string]BuildCommand{"build_command": t.BuildCommand, "deps_command": t.DepsCommand, "test_command": t.TestCommand}
+	for i, s := range t.Steps {
+		commands[fmt.Sprintf("steps[%d]", i)] = s.BuildCommand
+		for j, p := range s.Parallel {
+			commands[fmt.Sprintf("steps[%d].parallel[%d]", i, j)] = p.BuildCommand
+		}
+	}
+	for field, c := range commands {
+		if f := c.EnvFile; f != "" && !fileExists(f) && !(sparse && notCheckedOut(ctx, f)) {
+			return errors.Errorf("target.%s.env_file: %s of target %s does not exist", field, f, t.Path)
+		}
+	}
+	if err := validateFetchRefs(t); err != nil {
+		return err
+	}
+	if err := t.OutputLimit.validate("target.output_limit"); err != nil {
+		return errors.Wrapf(err, "target %s", t.Path)
+	}
+	if err := t.Ulimit.validate("target.ulimit"); err != nil {
+		return errors.Wrapf(err, "target %s", t.Path)
+	}
+	if len(t.PassEnv) > 0 && !t.CleanEnv {
+		return errors.Errorf("target.pass_env: target %s must set clean_env", t.Path)
+	}
+	if err := validateResourceLock(t); err != nil {
+		return err
+	}
+	if _, err := t.sunsetDate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Target represents the target config.
+type Target struct {
+	Path             string            `yaml:"path"`
+	Type             string            `yaml:"type"` // docker builds and tags the image of a Dockerfile instead of running a build command.
+	Name             string            `yaml:"name"` // Stable ID, e.g. payments-api. Selects the target and keys its history and cache instead of its path, so that they survive a move of its directory.
+	BuildCommand     BuildCommand      `yaml:"build_command"`
+	Steps            []*Step           `yaml:"steps"`               // Build steps run in order instead of the build_command, e.g. go generate, go test and go build.
+	Deprecated       string            `yaml:"deprecated"`          // Deprecation notice. The target is still built but a warning is emitted.
+	Sunset           string            `yaml:"sunset"`              // Date (YYYY-MM-DD) after which `mb validate` fails for this target.
+	Protected        bool              `yaml:"protected"`           // Requires an approval to be built in CI mode, or to run its protected steps when it has some.
+	Labels           map[string]string `yaml:"labels"`              // Free-form labels, e.g. team: payments.
+	NeedsFullHistory bool              `yaml:"needs_full_history"`  // The build needs an unshallow clone, e.g. to embed version info.
+	FetchRefs        []string          `yaml:"fetch_refs"`          // Full refs or globs the build needs, e.g. refs/tags/*.
+	WatchPattern     []string          `yaml:"watch_pattern"`       // Any file that are considered as a dependency of the target.
+	DepsCommand      BuildCommand      `yaml:"deps_command"`        // Prints the input files of the target, one per line.
+	TestCommand      BuildCommand      `yaml:"test_command"`        // Run by mb test instead of go test, e.g. for a target that is not a Go package.
+	Dockerfile       string            `yaml:"dockerfile"`          // Of a docker target, the Dockerfile of its directory by default.
+	Context          string            `yaml:"context"`             // Build context of a docker target, its directory by default.
+	Image            string            `yaml:"image"`               // Repository of the image of a docker target, e.g. registry.example.com/payments-api.
+	Tags             []string          `yaml:"tags"`                // Templates of the image tags of a docker target, of {{.Commit}} and {{.ShortCommit}}. Defaults to the short commit SHA.
+	Outputs          []string          `yaml:"outputs"`             // Glob patterns of the artifacts, recorded after each build.
+	Analyzer         string            `yaml:"analyzer"`            // One of go, cargo, maven, gradle or none. Detected from the build files by default.
+	DependsOn        []string          `yaml:"depends_on"`          // Paths of the targets built before this one, e.g. a library whose outputs it consumes.
+	EnvFiles         []string          `yaml:"env_files"`           // Dotenv files loaded into the build command environment, later files override earlier ones.
+	CleanEnv         bool              `yaml:"clean_env"`           // The build commands only get PATH, HOME, the locale and the pass_env variables of the environment of mb.
+	PassEnv          []string          `yaml:"pass_env"`            // Glob patterns of the variables kept with clean_env, e.g. GOPROXY or AWS_*.
+	Ulimit           Ulimit            `yaml:"ulimit"`              // Resource limits of the build commands, e.g. nofile: 1024.
+	ProblemMatchers  []ProblemMatcher  `yaml:"problem_matchers"`    // Turn the errors of the build output into problems, e.g. of the compiler.
+	ResourceLock     string            `yaml:"resource_lock"`       // Name of a lock held during the build, e.g. staging-db, to serialize the builds using a shared external system.
+	Hooks            Hooks             `yaml:"hooks"`               // Commands run before and after each build of the target.
+	CacheKey         []CacheKeyInput   `yaml:"cache_key"`           // Build-relevant state added to the cache key of the target, e.g. a database schema.
+	OutputLimit      OutputLimit       `yaml:"output_limit"`        // Limit of the captured build output, over the output_limit of the config.
+	Dir              string            `json:"Dir" yaml:"-"`        // This will be populated by go list.
+	Deps             []string          `json:"Deps" yaml:"-"`       // This will be populated by go list.
+	Imports          []string          `json:"Imports" yaml:"-"`    // This will be populated by go list.
+	DepDirs          []string          `yaml:"-"`                   // Directories whose files are dependencies, populated by the non-Go analyzers.
+	DepFiles         []string          `yaml:"-"`                   // Files and glob patterns that are dependencies, e.g. the sources copied by a Dockerfile.
+	Watches          []string          `yaml:"-"`                   // The build files of the analyzers and of the deps command.
+	Changes          []*File           `yaml:"-"`                   // This will be populated after git diff.
+	Approval         string            `json:",omitempty" yaml:"-"` // The approval decision of a protected target.
+	SideEffects      []string          `json:",omitempty" yaml:"-"` // Files modified by the build outside of its directory and outputs.
+	NotCheckedOut    bool              `json:",omitempty" yaml:"-"` // The target or its dependencies are outside of the sparse checkout.
+	CheckoutDirs     []string          `json:",omitempty" yaml:"-"` // The directories to add to the sparse checkout to build the target.
+	NotAnalyzed      bool              `json:",omitempty" yaml:"-"` // No changed file can affect the dependencies of the target, which were not analyzed.
+
+	env          []string      // The build command environment. Nil inherits the environment of mb.
+	policy       PolicyConfig  // The policy of the config, checked against the binaries the commands resolve to.
+	prefixOutput bool          // Prefix the build output lines with the target path, set for parallel builds.
+	output       *bytes.Buffer // Buffers the build output of a deterministic parallel build.
+	renderer     Renderer      // Renders the build output, pretty when nil.
+	stepRuns     []RunStep     // The results of the steps run by the last build.
+	configHooks  bool          // The pseudo target the hooks of the config run as.
+	timeout      time.Duration // The default timeout of the commands, of the config.
+	skipped      string        // Why the target was not built by the run, e.g. cached.
+	refused      bool          // The approval of the protected steps was refused.
+	outputLimit  OutputLimit   // The output limit of the config and of the target.
+	logOut       *os.File      // The full stdout of the build, nil when it cannot be written.
+	logErr       *os.File      // The full stderr of the build.
+	capturedOut  *cappedBuffer // The captured stdout of all the steps of the build.
+	capturedErr  *cappedBuffer // The captured stderr of all the steps of the build.
+	logsDir      string        // Where the full output of the build is written, DefaultLogsDir when empty.
+	inject       bool          // Fail the build without running it, see InjectFailures.
+}
+
+func (c *Config) String() string {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return RedactSecrets(string(b))
+}
+
+func (t *Target) String() string {
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return RedactSecrets(string(b))
+}
+
+// BuildCommand  represents the build_command config.
+type BuildCommand struct {
+	Dir     string            `yaml:"dir"`
+	Command string            `yaml:"command"`
+	Args    []string          `yaml:"args"`
+	Env     map[string]string `yaml:"env"`      // Variables set over the environment, e.g. GOOS: linux. The values expand ${KEY} from it.
+	EnvFile string            `yaml:"env_file"` // Dotenv file of variables set over the environment, under Env.
+	Timeout string            `yaml:"timeout"`  // Duration after which the command is killed, e.g. 10m. Defaults to the default_timeout of the config.
+	Output  string            `yaml:"-"`
+	Error   string            `yaml:"-"`
+}
+
+func (c BuildCommand) defined() bool {
+	return c.Command != ""
+}
+
+// timeout returns the timeout of the command, def when it has none.
+func (c BuildCommand) timeout(def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		return d
+	}
+	return def
+}
+
+// defaultTimeout returns the timeout of the commands without one, 0 for none.
+func (c *Config) defaultTimeout() time.Duration {
+	d, _ := time.ParseDuration(c.DefaultTimeout)
+	return d
+}
+
+var noTarget = errors.Errorf("no monobuild targets found")
+
+// MonoBuild runs the build command of the changed targets.
+func (b *BuildContext) MonoBuild(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "*BuildContext.MonoBuild()")
+	defer span.End()
+	span.SetAttributes(attribute.String("build_context", b.String()))
+	if len(b.Config.Targets) == 0 {
+		return noTarget
+	}
+	var targets []*Target
+	for _, t := range b.Config.Targets {
+		if len(t.Changes) == 0 && !b.All {
+			b.renderer().Skip(os.Stdout, t, SkipNotAffected)
+			t.skipped = SkipNotAffected
+			targetEvent(ctx, "target skipped", t, attribute.String("reason", SkipNotAffected))
+			continue
+		}
+		// Targets without a build command only exist for change detection.
+		if !t.buildable() {
+			reason := SkipNoBuildCommand
+			if b.Test {
+				reason = SkipNoTestCommand
+			}
+			b.renderer().Skip(os.Stdout, t, reason)
+			t.skipped = reason
+			targetEvent(ctx, "target skipped", t, attribute.String("reason", reason))
+			continue
+		}
+		// Built regardless of the changes, e.g. with All: its dependencies
+		// are inputs of its cache key.
+		if t.NotAnalyzed {
+			if err := t.analyzeDeps(ctx); err != nil {
+				return err
+			}
+		}
+		if !b.approve(ctx, t) {
+			return errors.Errorf("target %s: %s", t.Path, t.Approval)
+		}
+		for _, c := range t.commands() {
+			if err := b.Config.Policy.check(c); err != nil {
+				return errors.Wrapf(err, "target %s", t.Path)
+			}
+		}
+		if t.NotCheckedOut {
+			if err := t.checkout(ctx); err != nil {
+				return err
+			}
+		}
+		env, err := t.environ(b.Config.Policy)
+		if err != nil {
+			return err
+		}
+		t.env = env
+		t.policy = b.Config.Policy
+		t.renderer = b.renderer()
+		t.timeout = b.Config.defaultTimeout()
+		t.outputLimit = b.Config.OutputLimit.over(t.OutputLimit)
+		targets = append(targets, t)
+	}
+	hooksEnv := b.Config.Policy.environ(os.Environ())
+	if len(targets) > 0 && len(b.Config.Tools) > 0 {
+		dirs, err := b.InstallTools(ctx)
+		if err != nil {
+			return err
+		}
+		for _, t := range targets {
+			t.env = prependPath(t.env, dirs)
+		}
+		hooksEnv = prependPath(hooksEnv, dirs)
+	}
+	targets = b.schedule(targets)
+	run := newRun(ctx, b.Branch)
+	for _, o := range b.Overrides {
+		run.Overrides = append(run.Overrides, o.String())
+	}
+	// The daemon cancels the builds, not the recording of the run.
+	bctx, stop := cancelable(ctx, run)
+	defer stop()
+	build := func() error {
+		if parallel := b.parallel(); parallel > 1 && len(targets) > 1 {
+			return b.buildParallel(bctx, run, targets, parallel)
+		}
+		return b.buildSerial(bctx, run, targets)
+	}
+	var err error
+	if len(targets) > 0 {
+		err = b.hooksTarget(hooksEnv).withHooks(bctx, map[string]string{}, build)
+	}
+	if bctx.Err() != nil {
+		run.Cancelled = true
+		err = errors.Errorf("run %s cancelled", run.ID)
+	}
+	b.writeReports(run)
+	if serr := b.saveRun(ctx, run); serr != nil {
+		if err == nil {
+			return serr
+		}
+		b.renderer().Warn(os.Stdout, serr.Error())
+	}
+	return err
+}
+
+// buildTarget builds a target and records it in the run. The concurrent
+// targets are the ones built at the same time, whose files are not side
+// effects of the target.
+func (b *BuildContext) buildTarget(ctx context.Context, run *Run, t *Target, concurrent []*Target) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var key string
+	if b.cacheDir() != "" && !t.inject {
+		var err error
+		if key, err = b.cacheKey(ctx, t); err != nil {
+			b.renderer().Warn(t.stdout(), err.Error())
+		} else if b.restoreCache(ctx, run, t, key) {
+			outputMu.Lock()
+			b.renderer().Skip(t.stdout(), t, SkipCached)
+			outputMu.Unlock()
+			t.skipped = SkipCached
+			targetEvent(ctx, "target skipped", t, attribute.String("reason", SkipCached))
+			b.writeCached(run, t)
+			return nil
+		}
+	}
+	outputMu.Lock()
+	b.renderer().Start(t.stdout(), t)
+	outputMu.Unlock()
+	unlock, err := b.lockResource(ctx, t)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	var before treeSnapshot
+	if len(t.Outputs) > 0 {
+		var err error
+		if before, err = snapshotTree(ctx, "."); err != nil {
+			return errors.Wrap(err, "cannot snapshot the working tree")
+		}
+	}
+	tmp, err := t.prepareTmpDir()
+	if err != nil {
+		return errors.Wrapf(err, "target %s: TMPDIR", t.Path)
+	}
+	rt := run.start(t)
+	b.writeResult(run, rt, nil)
+	tmpUsage := trackDiskUsage(tmp, 2*time.Second)
+	err = t.withHooks(ctx, map[string]string{"MB_TARGET": t.Path}, func() error {
+		if t.inject {
+			return errors.Errorf("target %s: injected failure", t.Path)
+		}
+		return t.Run(ctx)
+	})
+	rt.TmpUsage = tmpUsage()
+	if len(t.Steps) > 0 {
+		rt.Steps = t.stepRuns
+	}
+	rt.finish(err)
+	rt.Problems = t.problems()
+	targetEvent(ctx, "target built", t, attribute.String("status", rt.Status), attribute.Int64("duration_ms", rt.Duration.Milliseconds()))
+	if err != nil {
+		// The TMPDIR of a failed build is kept to debug it.
+		b.renderer().Info(t.stdout(), fmt.Sprintf("TMPDIR OF %s KEPT: %s", t.Path, tmp))
+		b.renderer().Finish(t.stdout(), t, rt, err)
+		b.writeResult(run, rt, err)
+		return err
+	}
+	defer b.writeResult(run, rt, nil)
+	defer b.renderer().Finish(t.stdout(), t, rt, nil)
+	if err := os.RemoveAll(tmp); err != nil {
+		b.renderer().Warn(t.stdout(), fmt.Sprintf("cannot remove the TMPDIR of %s: %v", t.Path, err))
+	}
+	if len(t.Outputs) > 0 {
+		after, err := snapshotTree(ctx, ".")
+		if err != nil {
+			return errors.Wrap(err, "cannot snapshot the working tree")
+		}
+		t.SideEffects = t.sideEffects(before.changes(after), concurrent)
+		for _, f := range t.SideEffects {
+			b.renderer().Warn(t.stdout(), fmt.Sprintf("target %s modified %s, which is outside of its directory and outputs", t.Path, f))
+		}
+		if err := run.recordOutputs(ctx, rt, t, b.Config.DepSourceDirs); err != nil {
+			return err
+		}
+	}
+	if key != "" {
+		if err := b.storeCache(ctx, run, rt, key); err != nil {
+			b.renderer().Warn(t.stdout(), err.Error())
+		}
+	}
+	return nil
+}
+
+// saveRun records a run and pages for the targets that keep failing.
+func (b *BuildContext) saveRun(ctx context.Context, run *Run) error {
+	if b.Deterministic {
+		sort.SliceStable(run.Targets, func(i, j int) bool { return run.Targets[i].Path < run.Targets[j].Path })
+	}
+	if err := run.save(b.RunsDir); err != nil {
+		return err
+	}
+	if run.Cache != nil {
+		b.renderer().Info(os.Stdout, run.Cache.String())
+	}
+	if len(run.Targets) > 0 || run.Cache != nil {
+		b.renderer().Info(os.Stdout, "RUN RECORDED: "+run.ID)
+	}
+	if !run.Cancelled {
+		b.alert(ctx, run)
+	}
+	b.pushMetrics(ctx, run)
+	b.sendTelemetry(ctx, run)
+	return nil
+}
+
+// Warnings returns the deprecation warnings of the affected targets.
+func (b *BuildContext) Warnings() []string {
+	var warnings []string
+	for _, t := range b.Config.Targets {
+		if t.Deprecated == "" || len(t.Changes) == 0 {
+			continue
+		}
+		w := fmt.Sprintf("target %s is deprecated: %s", t.Path, t.Deprecated)
+		if t.Sunset != "" {
+			w += fmt.Sprintf(" (sunset %s)", t.Sunset)
+		}
+		warnings = append(warnings, w)
+	}
+	return append(warnings, b.configChangeWarnings()...)
+}
+
+func (t *Target) sunsetDate() (time.Time, error) {
+	if t.Sunset == "" {
+		return time.Time{}, nil
+	}
+	d, err := time.Parse("2006-01-02", t.Sunset)
+	if err != nil {
+		return time.Time{}, errors.Errorf("target.sunset: %s of target %s is not a YYYY-MM-DD date", t.Sunset, t.Path)
+	}
+	return d, nil
+}
+
+// PastSunset reports whether a deprecated target has outlived its sunset date.
+func (t *Target) PastSunset(now time.Time) bool {
+	d, err := t.sunsetDate()
+	if err != nil || d.IsZero() {
+		return false
+	}
+	return now.After(d)
+}
+
+// parseGoDeps resolves the transitive Go dependencies of the target with go
+// list -deps, restricted to the packages of its module and to the ones whose
+// sources are in the module directory, e.g. vendored or replaced by a local
+// path: the standard library and the module cache cannot change in a diff.
+func (t *Target) parseGoDeps(ctx context.Context) error {
+	_, span := tracer.Start(ctx, "*Target.parseGoDeps")
+	defer span.End()
+	// Add the dot slash prefix which is required for the `go list` command.
+	dir := t.Path
+	if !strings.HasPrefix(dir, "./") {
+		dir = "./" + dir
+	}
+	cmd := exec.Command("go", "list", "-deps", "-json", dir)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return errors.Errorf("go list -deps -json %s: %s%s", dir, string(out), stderr.String())
+	}
+	// Only the fields of the packages are decoded: the Name of the package
+	// of the target is not the one of the target.
+	type goPackage struct {
+		ImportPath string
+		Dir        string
+		Standard   bool
+		Module     *struct {
+			Path string
+			Main bool
+			Dir  string
+		}
+		Imports    []string
+		Incomplete bool
+		Error      *struct{ Err string }
+		DepsErrors []struct{ Err string }
+	}
+	// The packages are listed in dependency order, the one of the target
+	// last.
+	var pkgs []*goPackage
+	for d := json.NewDecoder(bytes.NewReader(out)); d.More(); {
+		pkg := &goPackage{}
+		if err := d.Decode(pkg); err != nil {
+			return errors.Wrapf(err, "go list -deps -json %s", dir)
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	if len(pkgs) == 0 {
+		return errors.Errorf("go list -deps -json %s: no package", dir)
+	}
+	pkg := pkgs[len(pkgs)-1]
+	moduleDir := ""
+	if pkg.Module != nil {
+		moduleDir = pkg.Module.Dir
+	}
+	deps := []string{}
+	for _, p := range pkgs[:len(pkgs)-1] {
+		inModule := p.Module == nil || p.Module.Main || (moduleDir != "" && strings.HasPrefix(p.Dir, moduleDir+string(filepath.Separator)))
+		if !p.Standard && inModule {
+			deps = append(deps, p.ImportPath)
+		}
+	}
+	sort.Strings(deps)
+	t.Dir, t.Deps, t.Imports = pkg.Dir, deps, pkg.Imports
+	// go list succeeds when dependencies are missing, e.g. outside of a
+	// sparse checkout, but the dependencies of the target are then unknown.
+	if pkg.Incomplete {
+		var errs []string
+		for _, e := range pkg.DepsErrors {
+			errs = append(errs, e.Err)
+		}
+		if pkg.Error != nil {
+			errs = append(errs, pkg.Error.Err)
+		}
+		return errors.Errorf("go list -deps -json %s: incomplete dependencies: %s", dir, strings.Join(errs, "; "))
+	}
+	span.SetAttributes(attribute.String("target", t.String()), attribute.Int("deps", len(deps)))
+	return nil
+}
+
+// Run runs the build steps of the target in order, up to the first failed
+// one. The output of each step is saved in its Output and Error, and the
+// output of all the steps in the ones of the build_command.
+func (t *Target) Run(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "*Target.Run()")
+	defer span.End()
+	defer func() {
+		span.SetAttributes(attribute.String("target", t.String()))
+	}()
+	steps := t.steps()
+	if len(steps) == 0 {
+		return errors.Errorf("target %s has no build_command", t.Path)
+	}
+	r := t.renderer
+	if r == nil {
+		r = prettyRenderer{}
+	}
+	t.stepRuns = nil
+	t.logOut, t.logErr = t.openLogs()
+	t.capturedOut = newCappedBuffer("stdout", t.outputLimit, logName(t.logOut))
+	t.capturedErr = newCappedBuffer("stderr", t.outputLimit, logName(t.logErr))
+	defer func() {
+		t.BuildCommand.Output = t.capturedOut.String()
+		t.BuildCommand.Error = t.capturedErr.String()
+		for _, f := range []*os.File{t.logOut, t.logErr} {
+			if f != nil {
+				f.Close()
+			}
+		}
+		t.logOut, t.logErr, t.capturedOut, t.capturedErr = nil, nil, nil, nil
+	}()
+	previous := 0
+	for i, s := range steps {
+		env := t.env
+		if i > 0 {
+			if env == nil {
+				env = os.Environ()
+			}
+			env = setEnv(env, map[string]string{"MB_PREVIOUS_EXIT_CODE": strconv.Itoa(previous)})
+		}
+		header := fmt.Sprintf("STEP %d/%d OF %s", i+1, len(steps), t.Path)
+		if len(s.Parallel) > 0 {
+			var err error
+			if previous, err = t.runParallel(ctx, s, env, r, header); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(t.Steps) > 0 {
+			outputMu.Lock()
+			r.Info(t.stdout(), header+": "+s.name())
+			outputMu.Unlock()
+		}
+		rs, err := t.runStep(ctx, s, env, r, nil)
+		previous = rs.ExitCode
+		t.stepRuns = append(t.stepRuns, rs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runStep runs a build step over the environment of the target, env, and
+// returns its result. Its output is written to out, or to the output of the
+// target when nil.
+func (t *Target) runStep(ctx context.Context, s *Step, env []string, r Renderer, out io.Writer) (RunStep, error) {
+	if s.Protected && t.refused {
+		return RunStep{Name: s.name(), Status: RunFailure, ExitCode: -1}, errors.Errorf("step %s: %s", s.name(), t.Approval)
+	}
+	if len(t.Steps) > 0 {
+		// The environment of the build_command is already in the one of
+		// the target.
+		var err error
+		if env, err = s.environ(env); err != nil {
+			return RunStep{Name: s.name(), Status: RunFailure, ExitCode: -1}, errors.Wrapf(err, "step %s", s.name())
+		}
+	}
+	started := time.Now()
+	err := t.runCommandTo(ctx, &s.BuildCommand, env, r, out)
+	rs := RunStep{Name: s.name(), Status: RunSuccess, Duration: time.Since(started), ExitCode: exitCode(err)}
+	switch {
+	case err != nil && len(t.Steps) > 0 && s.allows(rs.ExitCode):
+		rs.Status = StepAllowedFailure
+		msg := fmt.Sprintf("STEP %s OF %s FAILED, WHICH IS ALLOWED: %v", s.name(), t.Path, err)
+		if out != nil {
+			r.Info(out, msg)
+		} else {
+			outputMu.Lock()
+			r.Info(t.stdout(), msg)
+			outputMu.Unlock()
+		}
+		return rs, nil
+	case cancelled(err):
+		rs.Status = RunCancelled
+	case err != nil:
+		rs.Status = RunFailure
+	}
+	if err != nil && len(t.Steps) > 0 {
+		err = errors.Wrapf(err, "step %s", s.name())
+	}
+	return rs, err
+}
+
+// runParallel runs the steps of a parallel group at the same time and
+// returns the first nonzero exit code of its steps, for the next step. The
+// first failure cancels the other steps. The output of each step is written
+// after its header once the whole group is done, so that the outputs of the
+// steps never interleave.
+func (t *Target) runParallel(ctx context.Context, g *Step, env []string, r Renderer, header string) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg   sync.WaitGroup
+		outs = make([]*syncBuffer, len(g.Parallel))
+		runs = make([]RunStep, len(g.Parallel))
+		errs = make([]error, len(g.Parallel))
+	)
+	for i, s := range g.Parallel {
+		outs[i] = &syncBuffer{}
+		wg.Add(1)
+		go func(i int, s *Step) {
+			defer wg.Done()
+			if runs[i], errs[i] = t.runStep(ctx, s, env, r, outs[i]); errs[i] != nil {
+				cancel()
+			}
+		}(i, s)
+	}
+	wg.Wait()
+	outputMu.Lock()
+	for i, s := range g.Parallel {
+		r.Info(t.stdout(), header+": "+s.name())
+		t.stdout().Write(outs[i].buf.Bytes())
+	}
+	outputMu.Unlock()
+	previous := 0
+	var failed, stopped error
+	for i := range g.Parallel {
+		t.stepRuns = append(t.stepRuns, runs[i])
+		if previous == 0 {
+			previous = runs[i].ExitCode
+		}
+		switch {
+		case errs[i] == nil:
+		case runs[i].Status == RunCancelled && stopped == nil:
+			stopped = errs[i]
+		case runs[i].Status != RunCancelled && failed == nil:
+			failed = errs[i]
+		}
+	}
+	// The steps cancelled by a failure of the group are not its error.
+	if failed == nil {
+		failed = stopped
+	}
+	return previous, failed
+}
+
+// runCommand runs a command of the target with the environment env, and
+// saves its output in the Output and Error of the command.
+func (t *Target) runCommand(ctx context.Context, c *BuildCommand, env []string, r Renderer) error {
+	return t.runCommandTo(ctx, c, env, r, nil)
+}
+
+// runCommandTo is runCommand writing the output of the command to w, or to
+// the output of the target when nil.
+func (t *Target) runCommandTo(ctx context.Context, c *BuildCommand, env []string, r Renderer, w io.Writer) error {
+	timeout := c.timeout(t.timeout)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := &exec.Cmd{}
+	// The command is looked up in the PATH of the build command, e.g. in the
+	// tool cache.
+	resolved := lookPath(c.Command, env)
+	if err := t.policy.checkResolved(ctx, c.Command, resolved, c.Dir); err != nil {
+		return err
+	}
+	command, args, err := t.Ulimit.wrap(resolved, c.Args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		cmd = exec.CommandContext(ctx, command, args...)
+	} else {
+		cmd = exec.CommandContext(ctx, command)
+	}
+	// Set the command working directory.
+	if c.Dir != "" {
+		if _, err := os.Stat(c.Dir); os.IsNotExist(err) {
+			return errors.Errorf("build command error: %s", err)
+		}
+		cmd.Dir = c.Dir
+	}
+	cmd.Env = env
+	// The command and the processes it starts, e.g. the compilers of go
+	// build, are a process group, killed together.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// The captured output is limited, the full one is in the logs.
+	stdoutBuf := newCappedBuffer("stdout", t.outputLimit, logName(t.logOut))
+	stderrBuf := newCappedBuffer("stderr", t.outputLimit, logName(t.logErr))
+	stdoutIn, _ := cmd.StdoutPipe()
+	stderrIn, _ := cmd.StderrPipe()
+	var out, errOut io.Writer = os.Stdout, os.Stderr
+	switch {
+	case w != nil:
+		out, errOut = w, w
+	case t.output != nil:
+		out, errOut = t.output, t.output
+	}
+	out, errOut = r.Output(out, t, "stdout"), r.Output(errOut, t, "stderr")
+	for _, w := range []io.Writer{out, errOut} {
+		if f, ok := w.(interface{ Flush() error }); ok {
+			defer f.Flush()
+		}
+	}
+	stdout := io.MultiWriter(out, stdoutBuf, logWriter(t.logOut), captureWriter(t.capturedOut))
+	stderr := io.MultiWriter(errOut, stderrBuf, logWriter(t.logErr), captureWriter(t.capturedErr))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// The process group does not receive the interrupts of the terminal,
+	// which also cancel the run (see cancelable).
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	copied := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				// Kill the processes started by the command too, which may
+				// keep its output open, and stop reading it.
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+				stdoutIn.Close()
+				stderrIn.Close()
+				return
+			case s := <-sigs:
+				syscall.Kill(-cmd.Process.Pid, s.(syscall.Signal))
+			case <-copied:
+				return
+			}
+		}
+	}()
+
+	// A failed copy kills the command, which would block on its output.
+	var copyErrs [2]error
+	copyOutput := func(i int, w io.Writer, r io.Reader) {
+		if _, err := io.Copy(w, r); err != nil && ctx.Err() == nil {
+			copyErrs[i] = err
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		copyOutput(0, stdout, stdoutIn)
+		wg.Done()
+	}()
+
+	copyOutput(1, stderr, stderrIn)
+	wg.Wait()
+	close(copied)
+	for _, err := range copyErrs {
+		if err != nil {
+			cmd.Wait()
+			return errors.Wrapf(err, "%s: cannot copy the output", c.Command)
+		}
+	}
+
+	// Save the stdout and error for testing purposes.
+	c.Output = stdoutBuf.String()
+	c.Error = stderrBuf.String()
+
+	err = cmd.Wait()
+	if err != nil && timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+		err = errors.Errorf("%s timed out after %s", c.Command, timeout)
+		c.Error += err.Error() + "\n"
+		io.WriteString(captureWriter(t.capturedErr), err.Error()+"\n")
+	}
+	if err != nil && ctx.Err() == context.Canceled {
+		err = errors.Wrap(context.Canceled, c.Command)
+	}
+	return err
+}
+
+// stdout is where the build output of the target is written.
+func (t *Target) stdout() io.Writer {
+	if t.output != nil {
+		return t.output
+	}
+	return os.Stdout
+}
+
+// SplitList splits a comma-separated flag value, dropping blank items.
+func SplitList(s string) []string {
+	var items []string
+	for _, i := range strings.Split(s, ",") {
+		if i = strings.TrimSpace(i); i != "" {
+			items = append(items, i)
+		}
+	}
+	return items
+}
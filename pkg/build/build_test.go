@@ -0,0 +1,30 @@
+package build
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestRunCommandOutputError(t *testing.T) {
+	target := &Target{Path: "svc"}
+	c := &BuildCommand{Command: "sh", Args: []string{"-c", "echo built; sleep 10"}}
+	start := time.Now()
+	err := target.runCommandTo(context.Background(), c, os.Environ(), prettyRenderer{}, failingWriter{})
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("runCommandTo() = %v, want the error of the output", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("runCommandTo() returned after %s, want the command killed", d)
+	}
+}
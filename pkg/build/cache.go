@@ -0,0 +1,198 @@
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ResultCached is the status of the result file of a target whose build is
+// skipped because its inputs were already built successfully.
+const ResultCached = "cached"
+
+// DefaultCacheDir returns the directory of the local build cache,
+// ~/.cache/monobuild on Linux.
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "monobuild-cache")
+	}
+	return filepath.Join(dir, "monobuild")
+}
+
+// cacheEntry records a successful build of a target, keyed by the digest of
+// its inputs. The artifacts are stored next to it.
+type cacheEntry struct {
+	Path      string            `json:"path"`
+	Key       string            `json:"key"`
+	RunID     string            `json:"run_id"`
+	Time      time.Time         `json:"time"`
+	Artifacts map[string]string `json:"artifacts,omitempty"` // Artifact path to sha256.
+}
+
+// cacheDir returns the directory of the build cache, none when disabled.
+func (b *BuildContext) cacheDir() string {
+	if b.NoCache {
+		return ""
+	}
+	if b.CacheDir != "" {
+		return b.CacheDir
+	}
+	return DefaultCacheDir()
+}
+
+// cacheKey returns the key of the build of a target: the digest of its
+// ID, its build command and the content of its files, Go dependencies and
+// watched files, of the environment its commands run in and of the
+// contributions of its key contributors.
+func (b *BuildContext) cacheKey(ctx context.Context, t *Target) (string, error) {
+	inputs, err := inputDigest(ctx, t, b.Config.DepSourceDirs)
+	if err != nil {
+		return "", errors.Wrapf(err, "target %s: cache key", t.Path)
+	}
+	contributions, err := b.keyContributions(ctx, t)
+	if err != nil {
+		return "", errors.Wrapf(err, "target %s: cache key", t.Path)
+	}
+	key := t.ID() + "\n" + inputs + "\n" + b.environmentInput(t)
+	if len(contributions) > 0 {
+		key += "\n" + strings.Join(contributions, "\n")
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key))), nil
+}
+
+func (b *BuildContext) cacheEntryDir(key string) string {
+	return filepath.Join(b.cacheDir(), key[:2], key)
+}
+
+// restoreCache looks up the build of a target in the cache and restores its
+// artifacts. It reports whether the build can be skipped.
+func (b *BuildContext) restoreCache(ctx context.Context, run *Run, t *Target, key string) bool {
+	ctx, span := tracer.Start(ctx, "*BuildContext.restoreCache()")
+	defer span.End()
+	dir := b.cacheEntryDir(key)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "entry.json"))
+	remote := false
+	if err != nil && b.downloadCache(ctx, key) {
+		remote = true
+		data, err = ioutil.ReadFile(filepath.Join(dir, "entry.json"))
+	}
+	if err != nil || !b.restoreEntry(t, dir, key, data) {
+		run.countCache(func(s *CacheStats) { s.Misses++ })
+		return false
+	}
+	run.countCache(func(s *CacheStats) {
+		s.Hits++
+		if remote {
+			s.RemoteHits++
+		}
+	})
+	span.SetAttributes(attribute.String("key", key), attribute.Bool("remote", remote))
+	return true
+}
+
+// restoreEntry restores the artifacts of a cache entry. The entry may come
+// from a remote cache: an artifact outside of the repository is not read
+// nor written, and misses the cache.
+func (b *BuildContext) restoreEntry(t *Target, dir, key string, data []byte) bool {
+	var e cacheEntry
+	if err := json.Unmarshal(data, &e); err != nil || e.Key != key {
+		return false
+	}
+	for name, sum := range e.Artifacts {
+		if !repositoryPath(name) || !repositoryPath(relocate(name, e.Path, t.Path)) {
+			b.renderer().Warn(t.stdout(), fmt.Sprintf("target %s: invalid cache entry file %s", t.Path, name))
+			return false
+		}
+		src := filepath.Join(dir, "files", filepath.FromSlash(name))
+		if got, err := fileDigest(src); err != nil || got != sum {
+			return false
+		}
+		// The entry of a named target may be of its previous directory.
+		name = relocate(name, e.Path, t.Path)
+		if got, err := fileDigest(filepath.FromSlash(name)); err == nil && got == sum {
+			continue
+		}
+		if err := copyFile(src, filepath.FromSlash(name)); err != nil {
+			b.renderer().Warn(t.stdout(), fmt.Sprintf("target %s: cannot restore %s from the cache: %v", t.Path, name, err))
+			return false
+		}
+	}
+	return true
+}
+
+// storeCache stores a successful build of a target and its artifacts in the
+// local cache, and uploads them to the remote cache.
+func (b *BuildContext) storeCache(ctx context.Context, run *Run, rt *RunTarget, key string) error {
+	dir := b.cacheEntryDir(key)
+	for name := range rt.Artifacts {
+		if err := copyFile(filepath.FromSlash(name), filepath.Join(dir, "files", filepath.FromSlash(name))); err != nil {
+			return errors.Wrapf(err, "target %s: cache", rt.Path)
+		}
+	}
+	e := &cacheEntry{Path: rt.Path, Key: key, RunID: run.ID, Time: time.Now().UTC(), Artifacts: rt.Artifacts}
+	if err := writeFileAtomic(filepath.Join(dir, "entry.json"), e); err != nil {
+		return errors.Wrapf(err, "target %s: cache", rt.Path)
+	}
+	uploaded, err := b.uploadCache(ctx, key)
+	if err != nil {
+		return errors.Wrapf(err, "target %s: remote cache", rt.Path)
+	}
+	if uploaded {
+		run.countCache(func(s *CacheStats) { s.Uploads++ })
+	}
+	return nil
+}
+
+// writeCached writes the result file of a target restored from the cache.
+func (b *BuildContext) writeCached(run *Run, t *Target) {
+	b.saveResult(&TargetResult{
+		Path:   t.Path,
+		Name:   t.Name,
+		Status: ResultCached,
+		RunID:  run.ID,
+		Commit: run.Commit,
+	})
+}
+
+// repositoryPath reports whether name is a clean slash-separated path in the
+// repository, e.g. bin/server of an artifact.
+func repositoryPath(name string) bool {
+	return name != "" && name != "." && path.Clean(name) == name && !path.IsAbs(name) &&
+		name != ".." && !strings.HasPrefix(name, "../") && !strings.ContainsAny(name, `\:`)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
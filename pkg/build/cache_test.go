@@ -0,0 +1,360 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+type testContributor string
+
+func (c testContributor) KeyContribution(ctx context.Context, t *Target) (string, error) {
+	return string(c), nil
+}
+
+// testRepo creates a git repository of files in a temporary directory, which
+// becomes the working directory, and returns a func to remove it.
+func testRepo(t *testing.T, files map[string]string) func() {
+	dir, err := ioutil.TempDir("", "monobuild-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+	if out, err := exec.Command("git", "init", "-q").CombinedOutput(); err != nil {
+		cleanup()
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+	for name, content := range files {
+		writeTestFile(t, name, content)
+	}
+	gitAdd(t)
+	return cleanup
+}
+
+func writeTestFile(t *testing.T, name, content string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func gitAdd(t *testing.T) {
+	if out, err := exec.Command("git", "add", "-A").CombinedOutput(); err != nil {
+		t.Fatalf("git add: %v: %s", err, out)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, b *BuildContext, target *Target)
+		same   bool // Whether the key is the same after the change.
+	}{
+		{
+			name:   "no change",
+			change: func(t *testing.T, b *BuildContext, target *Target) {},
+			same:   true,
+		},
+		{
+			name: "file of the target",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				writeTestFile(t, "svc/main.go", "package main // changed")
+			},
+		},
+		{
+			name: "untracked file of the target",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				writeTestFile(t, "svc/notes.txt", "untracked")
+			},
+			same: true,
+		},
+		{
+			name: "new file of the target",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				writeTestFile(t, "svc/util.go", "package main")
+				gitAdd(t)
+			},
+		},
+		{
+			name: "deleted file of the target",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				os.Remove("svc/README")
+			},
+		},
+		{
+			name: "watched file",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				writeTestFile(t, "lib/lib.go", "package lib // changed")
+			},
+		},
+		{
+			name: "file of another target",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				writeTestFile(t, "other/main.go", "package main // changed")
+			},
+			same: true,
+		},
+		{
+			name: "build command args",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				target.BuildCommand.Args = []string{"build", "-race", "."}
+			},
+		},
+		{
+			name: "build command env",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				target.BuildCommand.Env = map[string]string{"GOOS": "darwin"}
+			},
+		},
+		{
+			name: "steps",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				target.Steps = []*Step{{BuildCommand: BuildCommand{Command: "go", Args: []string{"vet", "./..."}}}, {BuildCommand: target.BuildCommand}}
+			},
+		},
+		{
+			name: "name",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				target.Name = "server"
+			},
+		},
+		{
+			name: "output of a previous build",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				target.BuildCommand.Output, target.BuildCommand.Error = "ok", "warning"
+			},
+			same: true,
+		},
+		{
+			name: "cache_key env of the config",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				b.Config.CacheKey = []CacheKeyInput{{Env: "API_VERSION"}}
+				target.env = []string{"API_VERSION=2"}
+			},
+		},
+		{
+			name: "cache_key file of the target",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				target.CacheKey = []CacheKeyInput{{File: "db/*.sql"}}
+			},
+		},
+		{
+			name: "tool version",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				b.Config.Tools[0].Version = "1.22.1"
+			},
+		},
+		{
+			name: "tool checksum",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				b.Config.Tools[0].Checksums = map[string]string{"linux_amd64": "5c3f"}
+			},
+		},
+		{
+			name: "hook of the config",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				b.Config.Hooks.Before = []BuildCommand{{Command: "make", Args: []string{"login"}}}
+			},
+		},
+		{
+			name: "hook of the target",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				target.Hooks.After = []BuildCommand{{Command: "make", Args: []string{"notify"}}}
+			},
+		},
+		{
+			name: "output of a previous hook",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				target.Hooks.Before = []BuildCommand{{Command: "make", Args: []string{"login"}}}
+				before, err := b.cacheKey(context.Background(), target)
+				if err != nil {
+					t.Fatal(err)
+				}
+				target.Hooks.Before[0].Output = "ok"
+				if after, err := b.cacheKey(context.Background(), target); err != nil || after != before {
+					t.Errorf("the output of a previous hook changed the key: %s, then %s, %v", before, after, err)
+				}
+			},
+		},
+		{
+			name: "clean_env",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				target.CleanEnv = true
+			},
+		},
+		{
+			name: "pass_env",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				target.CleanEnv, target.PassEnv = true, []string{"GOPROXY"}
+			},
+		},
+		{
+			name: "pass_env of the policy",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				b.Config.Policy.PassEnv = []string{"GO*"}
+			},
+		},
+		{
+			name: "ulimit",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				target.Ulimit.NoFile = 1024
+			},
+		},
+		{
+			name: "key contributor",
+			change: func(t *testing.T, b *BuildContext, target *Target) {
+				b.KeyContributors = []KeyContributor{testContributor("v2")}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer testRepo(t, map[string]string{
+				"svc/main.go":   "package main",
+				"svc/README":    "svc",
+				"lib/lib.go":    "package lib",
+				"other/main.go": "package main",
+				"db/schema.sql": "create table t (id int);",
+			})()
+			target := &Target{Path: "svc", WatchPattern: []string{"lib/*.go"}, BuildCommand: BuildCommand{Command: "go", Args: []string{"build", "."}}}
+			b := &BuildContext{Config: Config{Targets: []*Target{target}, Tools: []*Tool{{Name: "go", Version: "1.22.0", Go: "golang.org/dl/go1.22.0"}}}}
+			ctx := context.Background()
+			before, err := b.cacheKey(ctx, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.change(t, b, target)
+			after, err := b.cacheKey(ctx, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (before == after) != tt.same {
+				t.Errorf("key %s, then %s, want the same key %v", before, after, tt.same)
+			}
+		})
+	}
+}
+
+func TestCacheKeyNamedTargetMove(t *testing.T) {
+	defer testRepo(t, map[string]string{"svc/main.go": "package main"})()
+	target := &Target{Name: "server", Path: "svc", BuildCommand: BuildCommand{Command: "go", Args: []string{"build", "."}}}
+	b := &BuildContext{Config: Config{Targets: []*Target{target}}}
+	ctx := context.Background()
+	before, err := b.cacheKey(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename("svc", "server"); err != nil {
+		t.Fatal(err)
+	}
+	gitAdd(t)
+	target.Path = "server"
+	after, err := b.cacheKey(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != after {
+		t.Errorf("the key of a named target changed with its directory: %s, then %s", before, after)
+	}
+}
+
+func TestCacheKeyStepOutput(t *testing.T) {
+	defer testRepo(t, map[string]string{"svc/main.go": "package main"})()
+	vet := &Step{BuildCommand: BuildCommand{Command: "go", Args: []string{"vet", "./..."}}}
+	target := &Target{Path: "svc", Steps: []*Step{{Parallel: []*Step{vet}}}}
+	b := &BuildContext{Config: Config{Targets: []*Target{target}}}
+	ctx := context.Background()
+	before, err := b.cacheKey(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vet.Output, vet.Error = "ok", "warning"
+	after, err := b.cacheKey(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != after {
+		t.Errorf("the output of a previous build of a step changed the key: %s, then %s", before, after)
+	}
+	if vet.Output != "ok" {
+		t.Errorf("the key cleared the output of the step")
+	}
+}
+
+func TestRestoreEntry(t *testing.T) {
+	outside, err := ioutil.TempDir("", "monobuild-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	tests := []struct {
+		name  string
+		entry string // The path of the target of the entry.
+		file  string // The artifact, $outside the temporary directory outside of the repository.
+		valid bool
+	}{
+		{name: "artifact", entry: "svc", file: "svc/bin/server", valid: true},
+		{name: "artifact of a moved target", entry: "old", file: "old/bin/server", valid: true},
+		{name: "absolute", entry: "svc", file: "$outside/server"},
+		{name: "parent", entry: "svc", file: "../$base/server"},
+		{name: "parent of a subdir", entry: "svc", file: "svc/../../$base/server"},
+		{name: "dot segment", entry: "svc", file: "./svc/bin/server"},
+		{name: "relocated out of the repository", entry: "../$base", file: "../$base/server"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer testRepo(t, map[string]string{"svc/main.go": "package main"})()
+			defer os.Remove(filepath.Join(outside, "server"))
+			expand := func(s string) string {
+				return os.Expand(s, func(k string) string {
+					if k == "base" {
+						return filepath.Base(outside)
+					}
+					return filepath.ToSlash(outside)
+				})
+			}
+			file := expand(tt.file)
+			dir, err := ioutil.TempDir("", "monobuild-entry")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			writeTestFile(t, filepath.Join(dir, "files", filepath.FromSlash(file)), "poisoned")
+			sum, err := fileDigest(filepath.Join(dir, "files", filepath.FromSlash(file)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := json.Marshal(&cacheEntry{Path: expand(tt.entry), Key: "key", Artifacts: map[string]string{file: sum}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := &BuildContext{}
+			target := &Target{Name: "server", Path: "svc"}
+			if got := b.restoreEntry(target, dir, "key", data); got != tt.valid {
+				t.Errorf("restoreEntry(%s) = %v, want %v", file, got, tt.valid)
+			}
+			if fileExists(filepath.Join(outside, "server")) {
+				t.Errorf("restoreEntry(%s) wrote outside of the repository", file)
+			}
+			if tt.valid && !fileExists(filepath.FromSlash("svc/bin/server")) {
+				t.Errorf("restoreEntry(%s) did not restore svc/bin/server", file)
+			}
+		})
+	}
+}
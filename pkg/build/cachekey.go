@@ -0,0 +1,151 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// KeyContributor contributes the build-relevant state mb cannot infer from
+// the files of a target to its cache key, e.g. the version of an external
+// API. A program embedding the build package adds its own to the
+// KeyContributors of the BuildContext.
+type KeyContributor interface {
+	// KeyContribution returns the contribution to the cache key of the
+	// target, empty for none. A different contribution is a cache miss.
+	KeyContribution(ctx context.Context, t *Target) (string, error)
+}
+
+// CacheKeyInput is a contribution of the config to the cache keys of the
+// targets: the content of files, the value of a variable or the output of a
+// command.
+type CacheKeyInput struct {
+	File    string   `yaml:"file"`    // Glob pattern of the files whose content is hashed, e.g. db/schema.sql.
+	Env     string   `yaml:"env"`     // Variable whose value is hashed, e.g. API_VERSION.
+	Command string   `yaml:"command"` // Command whose output is hashed, e.g. a script printing the version of an external API.
+	Args    []string `yaml:"args"`
+}
+
+func (c CacheKeyInput) validate(field string) error {
+	set := 0
+	for _, s := range []string{c.File, c.Env, c.Command} {
+		if s != "" {
+			set++
+		}
+	}
+	switch {
+	case set != 1:
+		return errors.Errorf("%s: set one of file, env or command", field)
+	case len(c.Args) > 0 && c.Command == "":
+		return errors.Errorf("%s: args without a command", field)
+	case c.Env != "" && !envKeyRe.MatchString(c.Env):
+		return errors.Errorf("%s.env: %q is not a valid variable name", field, c.Env)
+	}
+	if _, err := filepath.Match(c.File, ""); err != nil {
+		return errors.Errorf("%s.file: %q is not a valid glob pattern", field, c.File)
+	}
+	return nil
+}
+
+// KeyContribution hashes the files, the variable or the output of the
+// command of the input. The command runs with the environment of the build
+// of the target.
+func (c CacheKeyInput) KeyContribution(ctx context.Context, t *Target) (string, error) {
+	switch {
+	case c.File != "":
+		files, err := filepath.Glob(c.File)
+		if err != nil {
+			return "", err
+		}
+		sort.Strings(files)
+		parts := []string{"file " + c.File}
+		for _, f := range files {
+			sum, err := fileDigest(f)
+			if err != nil {
+				return "", errors.Wrapf(err, "cache_key file %s", f)
+			}
+			parts = append(parts, filepath.ToSlash(f)+" "+sum)
+		}
+		return strings.Join(parts, "\n"), nil
+	case c.Env != "":
+		env := t.env
+		if env == nil {
+			env = os.Environ()
+		}
+		v, ok := envMap(env)[c.Env]
+		if !ok {
+			return "env " + c.Env + " unset", nil
+		}
+		return fmt.Sprintf("env %s %x", c.Env, sha256.Sum256([]byte(v))), nil
+	}
+	resolved := lookPath(c.Command, t.env)
+	if err := t.policy.checkResolved(ctx, c.Command, resolved, ""); err != nil {
+		return "", errors.Wrap(err, "cache_key")
+	}
+	cmd := exec.CommandContext(ctx, resolved, c.Args...)
+	cmd.Env = t.env
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			err = errors.Errorf("%v: %s", err, msg)
+		}
+		return "", errors.Wrapf(err, "cache_key command %s", c.Command)
+	}
+	return fmt.Sprintf("command %s %q %x", c.Command, c.Args, sha256.Sum256(out)), nil
+}
+
+// environmentInput returns the digest of the settings of the config and of
+// the target that change what the build commands run with: the pinned tools
+// and their checksums, the hooks, the passed variables and the limits.
+func (b *BuildContext) environmentInput(t *Target) string {
+	env := struct {
+		Tools       []*Tool
+		Hooks       Hooks
+		TargetHooks Hooks
+		PolicyEnv   []string
+		CleanEnv    bool
+		PassEnv     []string
+		Ulimit      Ulimit
+	}{b.Config.Tools, b.Config.Hooks.input(), t.Hooks.input(), b.Config.Policy.PassEnv, t.CleanEnv, t.PassEnv, t.Ulimit}
+	data, _ := json.Marshal(env)
+	return fmt.Sprintf("environment %x", sha256.Sum256(data))
+}
+
+// keyContributors returns the contributors to the cache key of a target: the
+// cache_key of the config, of the target, then the ones of the program.
+func (b *BuildContext) keyContributors(t *Target) []KeyContributor {
+	var contributors []KeyContributor
+	for _, c := range b.Config.CacheKey {
+		contributors = append(contributors, c)
+	}
+	for _, c := range t.CacheKey {
+		contributors = append(contributors, c)
+	}
+	return append(contributors, b.KeyContributors...)
+}
+
+// keyContributions returns the contributions to the cache key of a target.
+func (b *BuildContext) keyContributions(ctx context.Context, t *Target) ([]string, error) {
+	var contributions []string
+	for _, c := range b.keyContributors(t) {
+		s, err := c.KeyContribution(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+		if s != "" {
+			contributions = append(contributions, s)
+		}
+	}
+	return contributions, nil
+}
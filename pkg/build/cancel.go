@@ -0,0 +1,171 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ActiveRun is a run of the repository in progress, registered with the
+// daemon so that it can be cancelled.
+type ActiveRun struct {
+	ID      string    `json:"id"`
+	PID     int       `json:"pid"`
+	Branch  string    `json:"branch,omitempty"`
+	Commit  string    `json:"commit,omitempty"`
+	Started time.Time `json:"started"`
+}
+
+// CancelRequest cancels the active run of the ID.
+type CancelRequest struct {
+	ID string `json:"id"`
+}
+
+// watchResponse answers the registration of a run once it is cancelled.
+type watchResponse struct {
+	Cancelled bool `json:"cancelled"`
+}
+
+// activeRun is a registered run and the channel closed to cancel it.
+type activeRun struct {
+	ActiveRun
+	cancel chan struct{}
+}
+
+// handleRuns registers the endpoints of the active runs:
+//
+//	POST /runs          lists the active runs.
+//	POST /runs/watch    registers an ActiveRun until it ends, and answers
+//	                    when it is cancelled.
+//	POST /runs/cancel   cancels the run of a CancelRequest.
+func (d *Daemon) handleRuns(mux *http.ServeMux) {
+	mux.HandleFunc("/runs", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(d.Runs())
+	})
+	mux.HandleFunc("/runs/watch", func(w http.ResponseWriter, r *http.Request) {
+		run := &ActiveRun{}
+		if err := json.NewDecoder(r.Body).Decode(run); err != nil || run.ID == "" {
+			http.Error(w, "a run ID is required", http.StatusBadRequest)
+			return
+		}
+		ar := &activeRun{ActiveRun: *run, cancel: make(chan struct{})}
+		d.runsMu.Lock()
+		if d.runs == nil {
+			d.runs = make(map[string]*activeRun)
+		}
+		d.runs[run.ID] = ar
+		d.runsMu.Unlock()
+		defer func() {
+			d.runsMu.Lock()
+			delete(d.runs, run.ID)
+			d.runsMu.Unlock()
+		}()
+		// The CLI closes the request when the run ends.
+		select {
+		case <-ar.cancel:
+			json.NewEncoder(w).Encode(&watchResponse{Cancelled: true})
+		case <-r.Context().Done():
+		case <-d.shutdown:
+		}
+	})
+	mux.HandleFunc("/runs/cancel", func(w http.ResponseWriter, r *http.Request) {
+		req := &CancelRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := d.Cancel(req.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(req)
+	})
+}
+
+// Runs returns the active runs, the oldest first.
+func (d *Daemon) Runs() []*ActiveRun {
+	d.runsMu.Lock()
+	defer d.runsMu.Unlock()
+	runs := []*ActiveRun{}
+	for _, ar := range d.runs {
+		run := ar.ActiveRun
+		runs = append(runs, &run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Started.Before(runs[j].Started) })
+	return runs
+}
+
+// Cancel cancels an active run: the CLI running it cancels the context of
+// its builds, which kills their commands, and records the run as cancelled.
+func (d *Daemon) Cancel(id string) error {
+	d.runsMu.Lock()
+	defer d.runsMu.Unlock()
+	ar, ok := d.runs[id]
+	if !ok {
+		return errors.Errorf("no active run %s", id)
+	}
+	select {
+	case <-ar.cancel:
+	default:
+		close(ar.cancel)
+	}
+	return nil
+}
+
+// Runs returns the active runs of the daemon.
+func (c *DaemonClient) Runs(ctx context.Context) ([]*ActiveRun, error) {
+	var runs []*ActiveRun
+	err := c.Do(ctx, "/runs", nil, &runs)
+	return runs, err
+}
+
+// Cancel cancels an active run of the daemon.
+func (c *DaemonClient) Cancel(ctx context.Context, id string) error {
+	return c.Do(ctx, "/runs/cancel", &CancelRequest{ID: id}, nil)
+}
+
+// cancelable registers the run with the daemon of the working directory,
+// when one is running, and returns a context cancelled when the daemon
+// cancels the run or mb is interrupted, so that no further target starts.
+// stop unregisters the run.
+func cancelable(ctx context.Context, run *Run) (_ context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	// The build commands forward the interrupts to their process group.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case s := <-sigs:
+			Log.Warn("the run is interrupted", "run", run.ID, "signal", s.String())
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if !fileExists(DaemonSocket) {
+		return ctx, func() {
+			signal.Stop(sigs)
+			cancel()
+		}
+	}
+	wctx, unregister := context.WithCancel(context.Background())
+	go func() {
+		resp := &watchResponse{}
+		req := &ActiveRun{ID: run.ID, PID: os.Getpid(), Branch: run.Branch, Commit: run.Commit, Started: run.Time}
+		if err := NewDaemonClient().Do(wctx, "/runs/watch", req, resp); err == nil && resp.Cancelled {
+			Log.Warn("the run is cancelled", "run", run.ID)
+			cancel()
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(sigs)
+		unregister()
+		cancel()
+	}
+}
@@ -0,0 +1,193 @@
+package build
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// cargoAnalyzer follows the path dependencies of a Cargo crate, including the
+// workspace dependencies with a path.
+type cargoAnalyzer struct{}
+
+func (cargoAnalyzer) Analyze(ctx context.Context, t *Target) error {
+	root := cargoWorkspaceRoot(t.Path)
+	var wsDeps map[string]string
+	if root != "" {
+		m, err := parseCargoManifest(filepath.Join(root, "Cargo.toml"))
+		if err != nil {
+			return err
+		}
+		wsDeps = m.workspaceDeps
+		t.addWatch(filepath.Join(root, "Cargo.toml"))
+		t.addWatch(filepath.Join(root, "Cargo.lock"))
+	} else {
+		t.addWatch(filepath.Join(t.Path, "Cargo.lock"))
+	}
+	seen := make(map[string]bool)
+	var visit func(dir string) error
+	visit = func(dir string) error {
+		dir = filepath.Clean(dir)
+		if seen[dir] || strings.HasPrefix(dir, "..") {
+			return nil
+		}
+		seen[dir] = true
+		t.addDepDir(dir)
+		m, err := parseCargoManifest(filepath.Join(dir, "Cargo.toml"))
+		if err != nil {
+			return err
+		}
+		for _, d := range m.deps {
+			switch {
+			case d.path != "":
+				err = visit(filepath.Join(dir, d.path))
+			case d.workspace && wsDeps[d.name] != "":
+				err = visit(filepath.Join(root, wsDeps[d.name]))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(t.Path); err != nil {
+		return errors.Wrapf(err, "target %s", t.Path)
+	}
+	return nil
+}
+
+// cargoWorkspaceRoot returns the nearest directory above the crate, the crate
+// included, whose Cargo.toml has a [workspace] section.
+func cargoWorkspaceRoot(dir string) string {
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if m, err := parseCargoManifest(filepath.Join(d, "Cargo.toml")); err == nil && m.workspace {
+			return d
+		}
+		if d == "." || d == filepath.Dir(d) {
+			return ""
+		}
+	}
+}
+
+type cargoDep struct {
+	name      string
+	path      string
+	workspace bool // Inherited from [workspace.dependencies].
+}
+
+type cargoManifest struct {
+	workspace     bool
+	deps          []*cargoDep
+	workspaceDeps map[string]string // Name to path, relative to the workspace root.
+}
+
+var (
+	cargoPathRe      = regexp.MustCompile(`\bpath\s*=\s*["']([^"']+)["']`)
+	cargoWorkspaceRe = regexp.MustCompile(`\bworkspace\s*=\s*true\b`)
+)
+
+// parseCargoManifest is a line-based reader of the dependency tables of a
+// Cargo.toml, enough to find path and workspace dependencies.
+func parseCargoManifest(name string) (*cargoManifest, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := &cargoManifest{workspaceDeps: make(map[string]string)}
+	var (
+		section string
+		current *cargoDep // Set in a [dependencies.<name>] table.
+		wsDep   string    // Set in a [workspace.dependencies.<name>] table.
+	)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[] ")
+			current, wsDep = nil, ""
+			if section == "workspace" || strings.HasPrefix(section, "workspace.") {
+				m.workspace = true
+			}
+			if table, dep := cargoDepTable(section); table != "" && dep != "" {
+				if table == "workspace.dependencies" {
+					wsDep = dep
+				} else {
+					current = &cargoDep{name: dep}
+					m.deps = append(m.deps, current)
+				}
+			}
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.Trim(strings.TrimSpace(kv[0]), `"'`), strings.TrimSpace(kv[1])
+		if wsDep != "" {
+			if key == "path" {
+				m.workspaceDeps[wsDep] = strings.Trim(value, `"'`)
+			}
+			continue
+		}
+		if current != nil {
+			if key == "path" {
+				current.path = strings.Trim(value, `"'`)
+			} else if key == "workspace" && value == "true" {
+				current.workspace = true
+			}
+			continue
+		}
+		if table, _ := cargoDepTable(section); table == "" {
+			continue
+		}
+		var path string
+		if sm := cargoPathRe.FindStringSubmatch(value); sm != nil {
+			path = sm[1]
+		}
+		if section == "workspace.dependencies" {
+			if path != "" {
+				m.workspaceDeps[key] = path
+			}
+			continue
+		}
+		m.deps = append(m.deps, &cargoDep{name: key, path: path, workspace: cargoWorkspaceRe.MatchString(value)})
+	}
+	return m, s.Err()
+}
+
+// cargoDepTable splits a section name into its dependency table and, for
+// [dependencies.<name>] tables, the dependency name. The table is "" when
+// the section is not a dependency table.
+func cargoDepTable(section string) (table, dep string) {
+	for _, t := range []string{"dependencies", "dev-dependencies", "build-dependencies"} {
+		for _, prefix := range []string{"", "workspace."} {
+			name := prefix + t
+			if prefix == "workspace." && t != "dependencies" {
+				continue
+			}
+			switch {
+			case section == name:
+				return name, ""
+			case strings.HasPrefix(section, name+"."):
+				return name, strings.Trim(strings.TrimPrefix(section, name+"."), `"'`)
+			}
+		}
+		// Platform specific tables, e.g. [target.'cfg(unix)'.dependencies].
+		if strings.HasPrefix(section, "target.") && strings.HasSuffix(section, "."+t) {
+			return t, ""
+		}
+	}
+	return "", ""
+}
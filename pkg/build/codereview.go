@@ -0,0 +1,178 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Code review diff source names accepted by the -diff-sources flag.
+const (
+	SourceGerrit    = "gerrit"
+	SourceBitbucket = "bitbucket"
+)
+
+// GerritChange lists the files of a Gerrit change revision using the Gerrit REST API.
+type GerritChange struct {
+	URL      string
+	Change   string // Change number or ID.
+	Revision string // Defaults to "current".
+	User     string // With a user, the authenticated /a/ endpoints are used.
+	Password string
+}
+
+func (g *GerritChange) Name() string { return SourceGerrit }
+
+func (g *GerritChange) ChangedFiles(ctx context.Context) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "*GerritChange.ChangedFiles()")
+	defer span.End()
+	if g.URL == "" || g.Change == "" {
+		return nil, errors.Errorf("the gerrit diff source requires a URL and a change")
+	}
+	rev := g.Revision
+	if rev == "" {
+		rev = "current"
+	}
+	prefix := ""
+	h := http.Header{}
+	if g.User != "" {
+		prefix = "/a"
+		h.Set("Authorization", basicAuth(g.User, g.Password))
+	}
+	u := fmt.Sprintf("%s%s/changes/%s/revisions/%s/files/", strings.TrimSuffix(g.URL, "/"), prefix,
+		url.PathEscape(g.Change), url.PathEscape(rev))
+	body, err := doRequest(ctx, http.MethodGet, u, h, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Gerrit prefixes its JSON responses to prevent XSSI.
+	body = bytes.TrimPrefix(body, []byte(")]}'"))
+	var files map[string]struct {
+		OldPath string `json:"old_path"`
+	}
+	if err := json.Unmarshal(body, &files); err != nil {
+		return nil, err
+	}
+	var names []string
+	for name, f := range files {
+		// Magic files such as /COMMIT_MSG are not part of the tree.
+		if strings.HasPrefix(name, "/") {
+			continue
+		}
+		names = append(names, name)
+		if f.OldPath != "" {
+			names = append(names, f.OldPath)
+		}
+	}
+	return names, nil
+}
+
+// BitbucketPR lists the files of a Bitbucket pull request. Bitbucket Cloud is
+// used when URL is api.bitbucket.org, otherwise URL is a Bitbucket Server.
+type BitbucketPR struct {
+	URL   string
+	Repo  string // workspace/repo on Bitbucket Cloud, PROJECT/repo on Bitbucket Server.
+	PR    int
+	User  string // With a user, Token is used as the password of a basic auth.
+	Token string
+}
+
+func (b *BitbucketPR) Name() string { return SourceBitbucket }
+
+func (b *BitbucketPR) ChangedFiles(ctx context.Context) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "*BitbucketPR.ChangedFiles()")
+	defer span.End()
+	parts := strings.SplitN(b.Repo, "/", 2)
+	if len(parts) != 2 || b.PR == 0 {
+		return nil, errors.Errorf("the bitbucket diff source requires a repo (owner/name) and a pull request")
+	}
+	base := strings.TrimSuffix(b.URL, "/")
+	if base == "" {
+		base = "https://api.bitbucket.org"
+	}
+	h := http.Header{}
+	switch {
+	case b.User != "":
+		h.Set("Authorization", basicAuth(b.User, b.Token))
+	case b.Token != "":
+		h.Set("Authorization", "Bearer "+b.Token)
+	}
+	if strings.Contains(base, "api.bitbucket.org") {
+		return b.cloudFiles(ctx, fmt.Sprintf("%s/2.0/repositories/%s/%s/pullrequests/%d/diffstat", base, parts[0], parts[1], b.PR), h)
+	}
+	return b.serverFiles(ctx, fmt.Sprintf("%s/rest/api/1.0/projects/%s/repos/%s/pull-requests/%d/changes", base, parts[0], parts[1], b.PR), h)
+}
+
+func (b *BitbucketPR) cloudFiles(ctx context.Context, u string, h http.Header) ([]string, error) {
+	type path struct {
+		Path string `json:"path"`
+	}
+	var names []string
+	for u != "" {
+		var page struct {
+			Values []struct {
+				Old *path `json:"old"`
+				New *path `json:"new"`
+			} `json:"values"`
+			Next string `json:"next"`
+		}
+		if err := doJSON(ctx, http.MethodGet, u, h, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, v := range page.Values {
+			if v.New != nil {
+				names = append(names, v.New.Path)
+			}
+			if v.Old != nil && (v.New == nil || v.Old.Path != v.New.Path) {
+				names = append(names, v.Old.Path)
+			}
+		}
+		u = page.Next
+	}
+	return names, nil
+}
+
+func (b *BitbucketPR) serverFiles(ctx context.Context, u string, h http.Header) ([]string, error) {
+	type path struct {
+		ToString string `json:"toString"`
+	}
+	var names []string
+	start := 0
+	for {
+		var page struct {
+			Values []struct {
+				Path    *path `json:"path"`
+				SrcPath *path `json:"srcPath"`
+			} `json:"values"`
+			IsLastPage    bool `json:"isLastPage"`
+			NextPageStart int  `json:"nextPageStart"`
+		}
+		if err := doJSON(ctx, http.MethodGet, fmt.Sprintf("%s?start=%d&limit=500", u, start), h, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, v := range page.Values {
+			if v.Path != nil {
+				names = append(names, v.Path.ToString)
+			}
+			if v.SrcPath != nil {
+				names = append(names, v.SrcPath.ToString)
+			}
+		}
+		if page.IsLastPage || len(page.Values) == 0 {
+			return names, nil
+		}
+		start = page.NextPageStart
+	}
+}
+
+func basicAuth(user, password string) string {
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth(user, password)
+	return req.Header.Get("Authorization")
+}
@@ -0,0 +1,59 @@
+package build
+
+import (
+	"io"
+	"os"
+)
+
+// NoColor is set by -no-color. Otherwise the pretty output is colored when
+// it is written to a terminal and NO_COLOR is not set.
+var NoColor bool
+
+// The ANSI escape sequences of the colors of the pretty output.
+const (
+	ansiReset   = "\x1b[0m"
+	ansiBold    = "\x1b[1m"
+	ansiDim     = "\x1b[2m"
+	ansiRed     = "\x1b[31m"
+	ansiGreen   = "\x1b[32m"
+	ansiYellow  = "\x1b[33m"
+	ansiBlue    = "\x1b[34m"
+	ansiMagenta = "\x1b[35m"
+	ansiCyan    = "\x1b[36m"
+)
+
+// palette colors text, or leaves it as is when it is disabled.
+type palette bool
+
+// colors returns the palette of a writer, enabled for a terminal.
+func colors(w io.Writer) palette {
+	if NoColor || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (p palette) paint(s, code string) string {
+	if !p || s == "" {
+		return s
+	}
+	return code + s + ansiReset
+}
+
+// status colors the status of a changed file.
+func (p palette) status(s string) string {
+	switch s {
+	case StatusAdded:
+		return p.paint(s, ansiGreen)
+	case StatusDeleted:
+		return p.paint(s, ansiRed)
+	case StatusRenamed:
+		return p.paint(s, ansiBlue)
+	}
+	return p.paint(s, ansiYellow)
+}
@@ -0,0 +1,26 @@
+package build
+
+import (
+	"context"
+	"path/filepath"
+)
+
+// EffectiveConfig returns the config as the targets are built with it: with
+// the !secret values decrypted, merged with the local override file and with
+// the directory settings applied to the targets.
+func EffectiveConfig(ctx context.Context, configFile string) (*Config, string, error) {
+	ctx, span := tracer.Start(ctx, "EffectiveConfig")
+	defer span.End()
+	fb, local, err := ReadConfig(ctx, configFile)
+	if err != nil {
+		return nil, "", err
+	}
+	c := &Config{}
+	if err := unmarshalConfig(fb, c); err != nil {
+		return nil, "", err
+	}
+	if err := c.resolveTargets(filepath.Glob, isLocalDir); err != nil {
+		return nil, "", err
+	}
+	return c, local, nil
+}
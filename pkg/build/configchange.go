@@ -0,0 +1,80 @@
+package build
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Policies of a change of the config files.
+const (
+	ConfigChangeAll     = "all"
+	ConfigChangePrecise = "precise"
+	ConfigChangeWarn    = "warn"
+	ConfigChangeIgnore  = "ignore"
+)
+
+func validateConfigChange(policy string) error {
+	switch policy {
+	case "", ConfigChangeAll, ConfigChangePrecise, ConfigChangeWarn, ConfigChangeIgnore:
+		return nil
+	}
+	return errors.Errorf("config_change: %s must be one of all, precise, warn or ignore", policy)
+}
+
+func (c Config) configChange() string {
+	if c.ConfigChange == "" {
+		return ConfigChangeWarn
+	}
+	return c.ConfigChange
+}
+
+// isConfigFile reports whether a file is the config file or one of its
+// included fragments.
+func (b *BuildContext) isConfigFile(f string) bool {
+	return contains(b.ConfigFiles, f)
+}
+
+// configChanged applies the config change policy to a changed config file:
+// with all, the file is watched by every target, and with precise by the
+// targets whose definition changed since the base revision.
+func (b *BuildContext) configChanged(ctx context.Context, cf *File) {
+	policy := b.Config.configChange()
+	if policy != ConfigChangeAll && policy != ConfigChangePrecise {
+		return
+	}
+	if policy == ConfigChangePrecise && b.stanzas == nil {
+		var err error
+		if b.stanzas, err = b.changedStanzas(ctx); err != nil {
+			Log.Warn("cannot diff the config with the base revision, rebuilding every target", "error", err)
+			policy = ConfigChangeAll
+		}
+	}
+	for _, t := range b.Config.Targets {
+		if contains(cf.WatchedBy, t.Path) {
+			continue
+		}
+		if policy == ConfigChangePrecise && !b.stanzas[CleanTreePath(t.Path)] {
+			continue
+		}
+		cf.WatchedBy = append(cf.WatchedBy, t.Path)
+		t.Changes = append(t.Changes, cf)
+		Log.Debug("config file is watched by the target", "file", cf.Name, "target", t.Path)
+	}
+}
+
+// configChangeWarnings warns about the changed config files that affect no
+// target, with the warn policy.
+func (b *BuildContext) configChangeWarnings() []string {
+	if b.Config.configChange() != ConfigChangeWarn {
+		return nil
+	}
+	var warnings []string
+	for _, f := range b.Files {
+		if b.isConfigFile(f.Name) && len(f.WatchedBy) == 0 && len(f.DependencyOf) == 0 {
+			warnings = append(warnings, fmt.Sprintf("config file %s changed but no target is rebuilt for it, set config_change to all to rebuild every target", f.Name))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,177 @@
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// stanza is the part of a target definition that changes its build.
+type stanza struct {
+	BuildCommand BuildCommand
+	Steps        []*Step
+	WatchPattern []string
+	DepsCommand  BuildCommand
+	Outputs      []string
+	Analyzer     string
+	DependsOn    []string
+	EnvFiles     []string
+	Type         string
+	Dockerfile   string
+	Context      string
+	Image        string
+	Tags         []string
+}
+
+func stanzaOf(t *Target) stanza {
+	return stanza{
+		BuildCommand: t.BuildCommand,
+		Steps:        t.Steps,
+		WatchPattern: t.WatchPattern,
+		DepsCommand:  t.DepsCommand,
+		Outputs:      t.Outputs,
+		Analyzer:     t.Analyzer,
+		DependsOn:    t.DependsOn,
+		EnvFiles:     t.EnvFiles,
+		Type:         t.Type,
+		Dockerfile:   t.Dockerfile,
+		Context:      t.Context,
+		Image:        t.Image,
+		Tags:         t.Tags,
+	}
+}
+
+// changedStanzas returns the paths of the targets whose definition differs
+// from the config of the base revision, or that are new. Every target
+// changed when the dependency directories or the env policy changed.
+func (b *BuildContext) changedStanzas(ctx context.Context) (map[string]bool, error) {
+	ctx, span := tracer.Start(ctx, "*BuildContext.changedStanzas()")
+	defer span.End()
+	head, err := b.headConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	base, err := b.baseConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	old := make(map[string]stanza)
+	for _, t := range base.Targets {
+		old[CleanTreePath(t.Path)] = stanzaOf(t)
+	}
+	all := !reflect.DeepEqual(base.DepSourceDirs, head.DepSourceDirs) ||
+		!reflect.DeepEqual(base.Policy.PassEnv, head.Policy.PassEnv)
+	changed := make(map[string]bool)
+	for _, t := range head.Targets {
+		s, ok := old[CleanTreePath(t.Path)]
+		if all || !ok || !reflect.DeepEqual(s, stanzaOf(t)) {
+			changed[CleanTreePath(t.Path)] = true
+		}
+	}
+	return changed, nil
+}
+
+// headConfig reads the config of the head of the diff: of the head tree of
+// a bare repository, or of the working tree without the local override file,
+// which the base revision does not have.
+func (b *BuildContext) headConfig(ctx context.Context) (*Config, error) {
+	if b.Bare != nil {
+		return treeConfig(ctx, b.Bare, b.ConfigFile)
+	}
+	fb, err := ioutil.ReadFile(b.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(ctx, fb, b.ConfigFile, ioutil.ReadFile, filepath.Glob, filepath.Glob, isLocalDir)
+}
+
+// baseConfig reads the config of the base revision of the diff, an empty
+// config when it has none.
+func (b *BuildContext) baseConfig(ctx context.Context) (*Config, error) {
+	tree, err := b.baseTree()
+	if err != nil {
+		return nil, err
+	}
+	if tree == nil {
+		return &Config{}, nil
+	}
+	// The base tree is read as the head of a bare repository.
+	base := &BareRepo{headTree: tree}
+	if _, err := base.readFile(b.ConfigFile); err != nil {
+		return &Config{}, nil
+	}
+	return treeConfig(ctx, base, b.ConfigFile)
+}
+
+// baseTree returns the tree of the base revision of the diff, nil when it
+// has none, e.g. the diff of a root commit.
+func (b *BuildContext) baseTree() (*object.Tree, error) {
+	var tree *object.Tree
+	if b.Bare != nil {
+		tree = b.Bare.baseTree
+	} else {
+		repo, err := openRepo()
+		if err != nil {
+			return nil, err
+		}
+		r := &BareRepo{Path: ".", repo: repo}
+		switch {
+		case b.CommitRange == "":
+			c, err := r.commit("HEAD")
+			if err != nil {
+				return nil, err
+			}
+			tree, err = c.Tree()
+			if err != nil {
+				return nil, err
+			}
+		case strings.Contains(b.CommitRange, ".."):
+			if err := r.resolveRange(b.CommitRange); err != nil {
+				return nil, err
+			}
+			tree = r.baseTree
+		default:
+			c, err := r.commit(b.CommitRange)
+			if err != nil {
+				return nil, err
+			}
+			if tree, err = c.Tree(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tree, nil
+}
+
+// treeConfig reads the config of the head tree of a bare repository.
+func treeConfig(ctx context.Context, r *BareRepo, configFile string) (*Config, error) {
+	fb, err := r.readFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(ctx, fb, configFile, r.readFile, r.glob, r.globDirs, r.isDir)
+}
+
+// parseConfig decrypts a config, merges its includes and resolves its
+// targets.
+func parseConfig(ctx context.Context, fb []byte, configFile string, readFile func(string) ([]byte, error), glob, globDirs func(string) ([]string, error), isDir func(string) bool) (*Config, error) {
+	fb, err := decryptConfig(ctx, fb)
+	if err != nil {
+		return nil, err
+	}
+	if fb, _, err = includeConfigs(ctx, fb, configFile, readFile, glob); err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := unmarshalConfig(fb, c); err != nil {
+		return nil, err
+	}
+	if err := c.resolveTargets(globDirs, isDir); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
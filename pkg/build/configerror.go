@@ -0,0 +1,332 @@
+package build
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// A ConfigError is an invalid setting of the config, located at the line of
+// the config file or of the included fragment that sets it.
+type ConfigError struct {
+	File        string   `json:"file,omitempty"`
+	Line        int      `json:"line,omitempty"`
+	Message     string   `json:"message"` // e.g. target.path: cmd/sever does not exist
+	Suggestions []string `json:"suggestions,omitempty"`
+	// The setting the error is located at: the value of a key, the nth
+	// value when it is set more than once, or the key alone for an unknown
+	// field.
+	key, value string
+	nth        int
+}
+
+func (e *ConfigError) Error() string {
+	s := e.Message + didYouMean(e.Suggestions)
+	switch {
+	case e.File != "" && e.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, s)
+	case e.File != "":
+		return e.File + ": " + s
+	case e.Line > 0:
+		return fmt.Sprintf("line %d: %s", e.Line, s)
+	}
+	return s
+}
+
+// ConfigErrors are all the errors of a config, reported at once so that
+// they can be fixed in one pass.
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+	lines := []string{fmt.Sprintf("%d config errors:", len(errs))}
+	for _, e := range errs {
+		lines = append(lines, "  "+e.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// add appends an error of the config, located at the path of the target
+// unless it is a ConfigError, or at its own setting.
+func (errs *ConfigErrors) add(err error, target string) {
+	switch e := errors.Cause(err).(type) {
+	case nil:
+	case *ConfigError:
+		*errs = append(*errs, e)
+	case ConfigErrors:
+		*errs = append(*errs, e...)
+	default:
+		ce := &ConfigError{Message: err.Error()}
+		if target != "" {
+			ce.key, ce.value = "path", target
+		}
+		*errs = append(*errs, ce)
+	}
+}
+
+func (errs ConfigErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// locateConfigErrors locates the config errors of err in the config files,
+// read with read. A file that cannot be read is skipped.
+func locateConfigErrors(err error, files []string, read func(string) ([]byte, error)) error {
+	var errs ConfigErrors
+	switch e := err.(type) {
+	case *ConfigError:
+		errs = ConfigErrors{e}
+	case ConfigErrors:
+		errs = e
+	default:
+		return err
+	}
+	var contents [][]byte
+	var names []string
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		b, err := read(f)
+		if err != nil {
+			Log.Debug("cannot read the config file to locate the errors", "file", f, "error", err)
+			continue
+		}
+		names = append(names, f)
+		contents = append(contents, b)
+	}
+	for _, e := range errs {
+		if e.value == "" && e.key == "" {
+			continue
+		}
+		n := 0
+		for i, b := range contents {
+			for j, l := range strings.Split(string(b), "\n") {
+				if !e.setBy(l) {
+					continue
+				}
+				if n == e.nth {
+					e.File, e.Line = names[i], j+1
+					break
+				}
+				n++
+			}
+			if e.File != "" {
+				break
+			}
+		}
+	}
+	return err
+}
+
+// setBy reports whether a line of YAML sets the setting of the error: a
+// key: value pair, or a value of a list, of its key.
+func (e *ConfigError) setBy(line string) bool {
+	l := strings.TrimSpace(line)
+	if i := strings.Index(l, " #"); i >= 0 {
+		l = strings.TrimSpace(l[:i])
+	}
+	item := false
+	if l == "-" || strings.HasPrefix(l, "- ") {
+		l, item = strings.TrimSpace(strings.TrimPrefix(l, "-")), true
+	}
+	k, v := "", l
+	if i := strings.Index(l, ":"); i > 0 && (i == len(l)-1 || l[i+1] == ' ') {
+		k, v = l[:i], strings.TrimSpace(l[i+1:])
+	} else if !item {
+		return false
+	}
+	if e.value == "" {
+		return k == e.key
+	}
+	if k != "" && e.key != "" && k != e.key {
+		return false
+	}
+	values := []string{v}
+	if strings.HasPrefix(v, "[") && strings.HasSuffix(v, "]") {
+		values = strings.Split(strings.Trim(v, "[]"), ",")
+	}
+	for _, v := range values {
+		v = strings.Trim(strings.TrimSpace(v), `"'`)
+		if v == e.value || CleanTreePath(v) == CleanTreePath(e.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownFieldRe matches the errors of yaml.UnmarshalStrict for an unknown
+// key, e.g. line 5: field buid_command not found in type build.Target.
+var unknownFieldRe = regexp.MustCompile(`^line (\d+): field (\S+) not found in type (\S+)$`)
+
+// unknownFieldErrors converts the unknown keys of a strict decoding into
+// config errors with the nearest keys of their type, or returns nil when
+// the decoding failed for another reason.
+func unknownFieldErrors(err error) ConfigErrors {
+	te, ok := err.(*yaml.TypeError)
+	if !ok {
+		return nil
+	}
+	keys := make(map[string][]string)
+	yamlKeys(reflect.TypeOf(Config{}), keys)
+	var errs ConfigErrors
+	for _, m := range te.Errors {
+		sm := unknownFieldRe.FindStringSubmatch(m)
+		if sm == nil {
+			return nil
+		}
+		e := &ConfigError{Message: fmt.Sprintf("invalid config: field %s not found in type %s", sm[2], sm[3]), key: sm[2], Suggestions: suggest(sm[2], keys[sm[3]])}
+		// The line of the merged config, replaced when the key is found in
+		// the config files.
+		e.Line, _ = strconv.Atoi(sm[1])
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// yamlKeys adds the YAML keys of the struct types reachable from t, by the
+// type names of the decoding errors, e.g. build.Target.
+func yamlKeys(t reflect.Type, keys map[string][]string) {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		yamlKeys(t.Elem(), keys)
+		return
+	case reflect.Struct:
+	default:
+		return
+	}
+	if _, ok := keys[t.String()]; ok {
+		return
+	}
+	keys[t.String()] = nil
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		switch {
+		case tag[0] == "-" || f.PkgPath != "":
+			continue
+		case len(tag) > 1 && tag[1] == "inline":
+			yamlKeys(f.Type, keys)
+			keys[t.String()] = append(keys[t.String()], keys[f.Type.String()]...)
+			continue
+		case tag[0] != "":
+			keys[t.String()] = append(keys[t.String()], tag[0])
+		default:
+			keys[t.String()] = append(keys[t.String()], strings.ToLower(f.Name))
+		}
+		yamlKeys(f.Type, keys)
+	}
+}
+
+// suggest returns the candidates nearest to a misspelled value by edit
+// distance, at most three, none when all are too far to be a typo.
+func suggest(value string, candidates []string) []string {
+	best := len(value) / 4
+	if best < 1 {
+		best = 1
+	}
+	var near []string
+	for _, c := range candidates {
+		if c == value || contains(near, c) {
+			continue
+		}
+		switch d := editDistance(value, c); {
+		case d < best:
+			best, near = d, []string{c}
+		case d == best:
+			near = append(near, c)
+		}
+	}
+	if len(near) > 3 {
+		near = near[:3]
+	}
+	return near
+}
+
+// didYouMean returns the suffix of an error message with the suggestions,
+// empty without any.
+func didYouMean(suggestions []string) string {
+	if len(suggestions) == 0 {
+		return ""
+	}
+	return ", did you mean " + strings.Join(suggestions, " or ") + "?"
+}
+
+// editDistance is the Levenshtein distance of two strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// dirSuggestions returns the directories next to a directory that does not
+// exist that are nearest to it, listed with globDirs.
+func dirSuggestions(dir string, globDirs func(string) ([]string, error)) []string {
+	dir = CleanTreePath(dir)
+	dirs, err := globDirs(path.Join(path.Dir(dir), "*"))
+	if err != nil {
+		return nil
+	}
+	for i, d := range dirs {
+		dirs[i] = CleanTreePath(filepath.ToSlash(d))
+	}
+	return suggest(dir, dirs)
+}
+
+// localGlobDirs returns the directories of the working tree matching a
+// pattern.
+func localGlobDirs(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, m := range matches {
+		if isLocalDir(m) {
+			dirs = append(dirs, m)
+		}
+	}
+	return dirs, nil
+}
+
+// notDirError is the config error of a path of a setting that is not a
+// directory of the tree, with the nearest directories.
+func notDirError(key, field, dir string, exists bool, globDirs func(string) ([]string, error)) *ConfigError {
+	e := &ConfigError{Message: fmt.Sprintf("%s: %s is not a directory", field, dir), key: key, value: dir}
+	if !exists {
+		e.Message = fmt.Sprintf("%s: %s does not exist", field, dir)
+		e.Suggestions = dirSuggestions(dir, globDirs)
+	}
+	return e
+}
@@ -0,0 +1,104 @@
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// treeSnapshot maps the files of the working tree to their size and
+// modification time.
+type treeSnapshot map[string]fileStamp
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+}
+
+// snapshotTree records the files under root, except the .git and .monobuild
+// directories.
+func snapshotTree(ctx context.Context, root string) (treeSnapshot, error) {
+	_, span := tracer.Start(ctx, "snapshotTree")
+	defer span.End()
+	s := make(treeSnapshot)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // Removed while walking.
+			}
+			return err
+		}
+		if info.IsDir() {
+			if name := info.Name(); p != root && (name == ".git" || name == ".monobuild") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		s[filepath.ToSlash(rel)] = fileStamp{size: info.Size(), modTime: info.ModTime(), mode: info.Mode()}
+		return nil
+	})
+	return s, err
+}
+
+// changes returns the files created, modified or deleted since the snapshot.
+func (s treeSnapshot) changes(after treeSnapshot) []string {
+	var changed []string
+	for p, st := range after {
+		if before, ok := s[p]; !ok || before != st {
+			changed = append(changed, p)
+		}
+	}
+	for p := range s {
+		if _, ok := after[p]; !ok {
+			changed = append(changed, p)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// sideEffects returns the changed files that are neither under the target
+// directory nor declared as outputs of the target. The files of the targets
+// built concurrently are not side effects of the target either.
+func (t *Target) sideEffects(changed []string, concurrent []*Target) []string {
+	var undeclared []string
+	for _, p := range changed {
+		owned := t.owns(p)
+		for _, c := range concurrent {
+			owned = owned || c.owns(p)
+		}
+		if !owned {
+			undeclared = append(undeclared, p)
+		}
+	}
+	return undeclared
+}
+
+// owns reports whether a file is under the target directory or one of its
+// outputs.
+func (t *Target) owns(p string) bool {
+	dir := CleanTreePath(t.Path)
+	return dir == "." || strings.HasPrefix(p, dir+"/") || t.isOutput(p)
+}
+
+// isOutput reports whether a file matches an output pattern, or is under a
+// directory matching one.
+func (t *Target) isOutput(p string) bool {
+	for _, pattern := range t.Outputs {
+		pattern = CleanTreePath(pattern)
+		for q := p; q != "." && q != "/"; q = filepath.ToSlash(filepath.Dir(q)) {
+			if ok, _ := filepath.Match(pattern, q); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
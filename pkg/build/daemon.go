@@ -0,0 +1,316 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The daemon of a repository listens on a unix socket in its root directory.
+// The CLI delegates the plan computation to it when the socket exists.
+const (
+	DaemonSocket = ".monobuild/daemon.sock"
+	daemonLog    = ".monobuild/daemon.log"
+)
+
+// PlanRequest is what the CLI sends to the daemon to compute a plan.
+type PlanRequest struct {
+	Dir         string // Working directory of the CLI, which must be the daemon's.
+	ConfigFile  string
+	DiffSources string
+	Options     DiffOptions
+}
+
+// PlanResponse is the diffed BuildContext computed by the daemon.
+type PlanResponse struct {
+	BuildContext *BuildContext
+	Secrets      []string // Decrypted !secret values, to redact them in the CLI.
+}
+
+// DaemonStatus is reported by `mb daemon status`.
+type DaemonStatus struct {
+	PID       int
+	Dir       string
+	Started   time.Time
+	Plans     int
+	CacheHits int
+}
+
+// Daemon keeps the loaded config and the Go dependencies of the targets warm
+// between plans. The cache is invalidated when the config, HEAD or the
+// status of the working tree changes.
+type Daemon struct {
+	mu       sync.Mutex
+	status   DaemonStatus
+	cacheKey string
+	cached   []byte // JSON of the BuildContext before Diff.
+	secrets  []string
+	shutdown chan struct{}
+	stopOnce sync.Once             // Closes shutdown, once for concurrent stop requests.
+	runsMu   sync.Mutex            // Guards runs, apart from mu so that a plan does not delay a cancellation.
+	runs     map[string]*activeRun // The active runs by ID.
+}
+
+// NewDaemon creates the daemon of the repository in dir, the working
+// directory it is started from.
+func NewDaemon(dir string) *Daemon {
+	return &Daemon{
+		status:   DaemonStatus{PID: os.Getpid(), Dir: dir, Started: time.Now()},
+		shutdown: make(chan struct{}),
+	}
+}
+
+// stop shuts the server of the daemon down.
+func (d *Daemon) stop() {
+	d.stopOnce.Do(func() { close(d.shutdown) })
+}
+
+func (d *Daemon) plan(ctx context.Context, req *PlanRequest) (*PlanResponse, error) {
+	ctx, span := tracer.Start(ctx, "*Daemon.plan()")
+	defer span.End()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if req.Dir != d.status.Dir {
+		return nil, errors.Errorf("the daemon serves %s, not %s", d.status.Dir, req.Dir)
+	}
+	d.status.Plans++
+	key, err := stateKey(ctx, req.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	if key == d.cacheKey {
+		d.status.CacheHits++
+	} else {
+		secretValues = nil
+		b, err := NewBuildContext(ctx, req.ConfigFile, req.Options.CommitRange)
+		if err != nil {
+			return nil, err
+		}
+		if d.cached, err = json.Marshal(b); err != nil {
+			return nil, err
+		}
+		d.cacheKey, d.secrets = key, secretValues
+	}
+	b := &BuildContext{}
+	if err := json.Unmarshal(d.cached, b); err != nil {
+		return nil, err
+	}
+	b.Quiet = true
+	b.CommitRange = req.Options.CommitRange
+	b.Pathspecs = req.Options.Pathspecs
+	if b.Providers, err = NewDiffProviders(req.DiffSources, req.Options); err != nil {
+		return nil, err
+	}
+	if err := b.Diff(ctx); err != nil {
+		return nil, err
+	}
+	return &PlanResponse{BuildContext: b, Secrets: d.secrets}, nil
+}
+
+// stateKey identifies the state of the repository that the loaded config
+// depends on: the config and local override content, HEAD and the modified
+// and untracked files.
+func stateKey(ctx context.Context, configFile string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintln(h, configFile)
+	fb, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return "", err
+	}
+	h.Write(fb)
+	// The local override file is usually ignored by git.
+	if lb, err := ioutil.ReadFile(localConfigFile(configFile)); err == nil {
+		h.Write(lb)
+	}
+	head, err := gitOutput(ctx, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintln(h, head)
+	status, err := gitLines(ctx, "status", "--porcelain", "--untracked-files=all")
+	if err != nil {
+		return "", err
+	}
+	for _, l := range status {
+		fmt.Fprintln(h, l)
+		if len(l) > 3 {
+			if fi, err := os.Stat(strings.TrimSpace(l[3:])); err == nil {
+				fmt.Fprintln(h, fi.ModTime().UnixNano(), fi.Size())
+			}
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Serve listens on DaemonSocket until the daemon is stopped.
+func (d *Daemon) Serve(ctx context.Context) error {
+	if c := NewDaemonClient(); c.Status(ctx) == nil {
+		return errors.Errorf("a daemon is already running on %s", DaemonSocket)
+	}
+	os.Remove(DaemonSocket)
+	if err := os.MkdirAll(filepath.Dir(DaemonSocket), 0755); err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", DaemonSocket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(DaemonSocket)
+	if err := os.Chmod(DaemonSocket, 0600); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/plan", func(w http.ResponseWriter, r *http.Request) {
+		req := &PlanRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := d.plan(r.Context(), req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		json.NewEncoder(w).Encode(d.status)
+	})
+	d.handleRuns(mux)
+	mux.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "stopping")
+		d.stop()
+	})
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-d.shutdown
+		srv.Close()
+	}()
+	fmt.Printf("mb daemon %d listening on %s\n", os.Getpid(), DaemonSocket)
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// DaemonClient talks HTTP to the daemon over its unix socket.
+type DaemonClient struct {
+	*http.Client
+}
+
+// NewDaemonClient returns a client of the daemon of the working directory.
+func NewDaemonClient() *DaemonClient {
+	return &DaemonClient{&http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", DaemonSocket)
+			},
+		},
+	}}
+}
+
+// Do sends a JSON request to a path of the daemon and decodes the JSON
+// response into out, which may be nil.
+func (c *DaemonClient) Do(ctx context.Context, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://mb"+path, &body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	rb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s", strings.TrimSpace(string(rb)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(rb, out)
+}
+
+// Status returns an error when the daemon does not answer.
+func (c *DaemonClient) Status(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	return c.Do(ctx, "/status", nil, &DaemonStatus{})
+}
+
+// DelegatePlan computes the plan with the daemon of the working directory.
+func DelegatePlan(ctx context.Context, req *PlanRequest) (*BuildContext, error) {
+	ctx, span := tracer.Start(ctx, "DelegatePlan")
+	defer span.End()
+	resp := &PlanResponse{}
+	if err := NewDaemonClient().Do(ctx, "/plan", req, resp); err != nil {
+		return nil, err
+	}
+	if resp.BuildContext == nil {
+		return nil, errors.Errorf("empty plan")
+	}
+	secretValues = append(secretValues, resp.Secrets...)
+	return resp.BuildContext, nil
+}
+
+// StartDaemon runs `mb daemon run` in the background, detached from the
+// terminal, and waits until it answers.
+func StartDaemon(ctx context.Context, args []string) error {
+	c := NewDaemonClient()
+	if c.Status(ctx) == nil {
+		fmt.Println("the daemon is already running")
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(daemonLog), 0755); err != nil {
+		return err
+	}
+	logf, err := os.OpenFile(daemonLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logf.Close()
+	cmd := exec.Command(exe, append([]string{"daemon", "run"}, args...)...)
+	cmd.Stdout, cmd.Stderr = logf, logf
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	for i := 0; i < 100; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if c.Status(ctx) == nil {
+			fmt.Printf("mb daemon %d started\n", cmd.Process.Pid)
+			return cmd.Process.Release()
+		}
+	}
+	return errors.Errorf("the daemon did not start, see %s", daemonLog)
+}
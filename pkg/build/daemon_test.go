@@ -0,0 +1,24 @@
+package build
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestDaemonStop(t *testing.T) {
+	d := NewDaemon(".")
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.stop()
+		}()
+	}
+	wg.Wait()
+	select {
+	case <-d.shutdown:
+	default:
+		t.Error("the daemon is not shut down")
+	}
+}
@@ -0,0 +1,115 @@
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// validateDependsOn checks that the depends_on targets exist and that the
+// dependencies between the targets have no cycle.
+func (c *Config) validateDependsOn() error {
+	byPath := make(map[string]*Target)
+	var paths []string
+	for _, t := range c.Targets {
+		byPath[CleanTreePath(t.Path)] = t
+		paths = append(paths, CleanTreePath(t.Path))
+	}
+	var errs ConfigErrors
+	for _, t := range c.Targets {
+		for _, d := range t.DependsOn {
+			if _, ok := byPath[CleanTreePath(d)]; !ok {
+				errs.add(&ConfigError{
+					Message:     fmt.Sprintf("target.depends_on: target %s depends on %s, which is not a target", t.Path, d),
+					Suggestions: suggest(CleanTreePath(d), paths),
+					key:         "depends_on",
+					value:       d,
+				}, "")
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[*Target]int)
+	var stack []string
+	var visit func(t *Target) error
+	visit = func(t *Target) error {
+		switch state[t] {
+		case visited:
+			return nil
+		case visiting:
+			// The cycle is the part of the stack from the first visit of t.
+			i := len(stack) - 1
+			for stack[i] != CleanTreePath(t.Path) {
+				i--
+			}
+			cycle := append(append([]string{}, stack[i:]...), CleanTreePath(t.Path))
+			return errors.Errorf("target.depends_on: dependency cycle %s", strings.Join(cycle, " -> "))
+		}
+		state[t] = visiting
+		stack = append(stack, CleanTreePath(t.Path))
+		for _, d := range t.DependsOn {
+			if err := visit(byPath[CleanTreePath(d)]); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[t] = visited
+		return nil
+	}
+	for _, t := range c.Targets {
+		if err := visit(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dependencyIndexes returns, for every target, the indexes of the targets of
+// the slice it depends on. The dependencies that are not in the slice, i.e.
+// that are not built, are ignored.
+func dependencyIndexes(targets []*Target) [][]int {
+	index := make(map[string]int)
+	for i, t := range targets {
+		index[CleanTreePath(t.Path)] = i
+	}
+	deps := make([][]int, len(targets))
+	for i, t := range targets {
+		for _, d := range t.DependsOn {
+			if j, ok := index[CleanTreePath(d)]; ok {
+				deps[i] = append(deps[i], j)
+			}
+		}
+	}
+	return deps
+}
+
+// buildOrder sorts the targets so that every target comes after the targets
+// it depends on, keeping the config order otherwise. The dependencies must
+// have no cycle.
+func buildOrder(targets []*Target) []*Target {
+	deps := dependencyIndexes(targets)
+	done := make([]bool, len(targets))
+	var ordered []*Target
+	var visit func(i int)
+	visit = func(i int) {
+		if done[i] {
+			return
+		}
+		done[i] = true
+		for _, j := range deps[i] {
+			visit(j)
+		}
+		ordered = append(ordered, targets[i])
+	}
+	for i := range targets {
+		visit(i)
+	}
+	return ordered
+}
@@ -0,0 +1,73 @@
+package build
+
+import (
+	"strings"
+	"testing"
+)
+
+// testTargets returns the targets of a list of "path:dep,dep" specs.
+func testTargets(specs ...string) []*Target {
+	var targets []*Target
+	for _, s := range specs {
+		t := &Target{Path: s}
+		if i := strings.Index(s, ":"); i >= 0 {
+			t.Path, t.DependsOn = s[:i], strings.Split(s[i+1:], ",")
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+func TestValidateDependsOn(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []string
+		err     string // A part of the error, none when valid.
+	}{
+		{"no dependencies", []string{"a", "b"}, ""},
+		{"chain", []string{"a:b", "b:c", "c"}, ""},
+		{"diamond", []string{"a:b,c", "b:d", "c:d", "d"}, ""},
+		{"dependency path is cleaned", []string{"a:./b/", "b"}, ""},
+		{"unknown target", []string{"a:lib", "libs"}, "target a depends on lib, which is not a target"},
+		{"self", []string{"a:a"}, "dependency cycle a -> a"},
+		{"two targets", []string{"a:b", "b:a"}, "dependency cycle a -> b -> a"},
+		{"cycle after the first target", []string{"a:b", "b:c", "c:d", "d:b"}, "dependency cycle b -> c -> d -> b"},
+		{"cycle of a later target", []string{"a", "b:c", "c:b"}, "dependency cycle b -> c -> b"},
+		{"cycle of cleaned paths", []string{"a:./b", "b:a/"}, "dependency cycle a -> b -> a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Targets: testTargets(tt.targets...)}
+			err := c.validateDependsOn()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("validateDependsOn(%q) = %v, want valid", tt.targets, err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("validateDependsOn(%q) = %v, want %q", tt.targets, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestBuildOrder(t *testing.T) {
+	tests := []struct {
+		targets []string
+		want    string
+	}{
+		{[]string{"a", "b", "c"}, "a b c"},
+		{[]string{"a:b", "b"}, "b a"},
+		{[]string{"a:c", "b", "c"}, "c a b"},
+		{[]string{"a:b,c", "b:d", "c:d", "d"}, "d b c a"},
+		// The dependencies that are not built are ignored.
+		{[]string{"a:lib", "b"}, "a b"},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, t := range buildOrder(testTargets(tt.targets...)) {
+			got = append(got, t.Path)
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("buildOrder(%q) = %q, want %q", tt.targets, got, tt.want)
+		}
+	}
+}
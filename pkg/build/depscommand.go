@@ -0,0 +1,129 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// depsCacheDir is where the files listed by the deps commands are cached.
+const depsCacheDir = ".monobuild/deps"
+
+// depsCache is the cached output of a deps command, with the digests of the
+// listed files. It is reused until one of them changes.
+type depsCache struct {
+	Files   []string          `json:"files"`
+	Digests map[string]string `json:"digests"`
+}
+
+// parseDepsCommand runs the deps command of the target, whose stdout lists
+// the input files of the target one per line, and watches them. Paths are
+// relative to the directory of the command.
+func (t *Target) parseDepsCommand(ctx context.Context, env []string) error {
+	ctx, span := tracer.Start(ctx, "*Target.parseDepsCommand")
+	defer span.End()
+	if !t.DepsCommand.defined() {
+		return nil
+	}
+	key, _ := json.Marshal(struct {
+		Path    string
+		Command BuildCommand
+	}{t.Path, t.DepsCommand})
+	cacheFile := filepath.Join(depsCacheDir, fmt.Sprintf("%x.json", sha256.Sum256(key)))
+	files, fresh := readDepsCache(cacheFile)
+	if !fresh {
+		env, err := t.DepsCommand.environ(env)
+		if err != nil {
+			return errors.Wrapf(err, "target %s: deps_command", t.Path)
+		}
+		if files, err = runDepsCommand(ctx, t.DepsCommand, env); err != nil {
+			return errors.Wrapf(err, "target %s: deps_command", t.Path)
+		}
+		if err := writeDepsCache(cacheFile, files); err != nil {
+			return errors.Wrapf(err, "target %s: deps_command cache", t.Path)
+		}
+	}
+	for _, f := range files {
+		if !contains(t.Watches, f) {
+			t.Watches = append(t.Watches, f)
+		}
+	}
+	span.SetAttributes(
+		attribute.Bool("cached", fresh),
+		attribute.String("files", strings.Join(files, ",")),
+	)
+	return nil
+}
+
+func runDepsCommand(ctx context.Context, c BuildCommand, env []string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, c.Command, c.Args...)
+	cmd.Dir = c.Dir
+	cmd.Env = env
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Errorf("%s: %v: %s", c.Command, err, strings.TrimSpace(stderr.String()))
+	}
+	var files []string
+	for _, l := range strings.Split(string(out), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		if !filepath.IsAbs(l) {
+			l = filepath.Join(c.Dir, l)
+		}
+		if !contains(files, filepath.Clean(l)) {
+			files = append(files, filepath.Clean(l))
+		}
+	}
+	return files, nil
+}
+
+// readDepsCache returns the cached files, and whether none of them changed.
+func readDepsCache(name string) ([]string, bool) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, false
+	}
+	c := &depsCache{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, false
+	}
+	for _, f := range c.Files {
+		if sum, err := fileDigest(f); err != nil || sum != c.Digests[f] {
+			return nil, false
+		}
+	}
+	return c.Files, true
+}
+
+func writeDepsCache(name string, files []string) error {
+	c := &depsCache{Files: files, Digests: make(map[string]string)}
+	for _, f := range files {
+		// Listed files that do not exist are recorded without a digest, so
+		// that their creation refreshes the cache.
+		if sum, err := fileDigest(f); err == nil {
+			c.Digests[f] = sum
+		}
+	}
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, b, 0644)
+}
@@ -0,0 +1,130 @@
+package build
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// DiffProvider lists the changed files of one diff source. The results of
+// every provider of a BuildContext are merged, and each File records the
+// providers that reported it.
+type DiffProvider interface {
+	Name() string
+	ChangedFiles(ctx context.Context) ([]string, error)
+}
+
+// Git diff source names accepted by the -diff-sources flag.
+const (
+	SourceGit       = "git"
+	SourceUntracked = "untracked"
+	SourceStaged    = "staged"
+	SourceFiles     = "files"
+	SourceBare      = "bare"
+)
+
+// DiffOptions configures the diff providers created by NewDiffProviders.
+type DiffOptions struct {
+	CommitRange string
+	Files       []string
+	Gerrit      GerritChange
+	Bitbucket   BitbucketPR
+	Pathspecs   []string // git pathspecs scoping the changed files, e.g. services/** and :!docs.
+}
+
+// NewDiffProviders builds the providers of the given comma-separated sources.
+// The files source is added automatically when o.Files is not empty.
+func NewDiffProviders(sources string, o DiffOptions) ([]DiffProvider, error) {
+	var providers []DiffProvider
+	seen := make(map[string]bool)
+	for _, s := range strings.Split(sources, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" || seen[s] {
+			continue
+		}
+		seen[s] = true
+		switch s {
+		case SourceGit:
+			providers = append(providers, &GitDiff{CommitRange: o.CommitRange})
+		case SourceUntracked:
+			providers = append(providers, &GitUntracked{})
+		case SourceStaged:
+			providers = append(providers, &GitStaged{})
+		case SourceFiles:
+			providers = append(providers, &FileList{Files: o.Files})
+		case SourceGerrit:
+			g := o.Gerrit
+			providers = append(providers, &g)
+		case SourceBitbucket:
+			bb := o.Bitbucket
+			providers = append(providers, &bb)
+		default:
+			return nil, errors.Errorf("unknown diff source %q", s)
+		}
+	}
+	if len(o.Files) > 0 && !seen[SourceFiles] {
+		providers = append(providers, &FileList{Files: o.Files})
+	}
+	if len(providers) == 0 {
+		return nil, errors.Errorf("no diff source configured")
+	}
+	return providers, nil
+}
+
+// FileList is an explicit list of changed files, e.g. provided by a CI system.
+type FileList struct {
+	Files []string
+}
+
+func (l *FileList) Name() string { return SourceFiles }
+
+func (l *FileList) ChangedFiles(ctx context.Context) ([]string, error) {
+	return l.Files, nil
+}
+
+func gitLines(ctx context.Context, args ...string) ([]string, error) {
+	_, span := tracer.Start(ctx, "gitLines")
+	defer span.End()
+	span.SetAttributes(attribute.String("args", strings.Join(args, " ")))
+	out, err := exec.CommandContext(ctx, "git", args...).CombinedOutput()
+	if err != nil {
+		return nil, errors.Errorf(string(out))
+	}
+	var lines []string
+	for _, l := range strings.Split(string(out), "\n") {
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines, nil
+}
+
+// ReadFileList reads a newline-separated list of files. "-" reads stdin.
+func ReadFileList(name string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if name == "-" && NonInteractive {
+		return nil, errors.Wrap(ErrStdinNonInteractive, "-files-from -")
+	}
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var files []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if l := strings.TrimSpace(s.Text()); l != "" {
+			files = append(files, l)
+		}
+	}
+	return files, s.Err()
+}
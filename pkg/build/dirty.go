@@ -0,0 +1,92 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Modes of the -dirty-check of the working tree before a build.
+const (
+	DirtyIgnore = "ignore"
+	DirtyWarn   = "warn"
+	DirtyFail   = "fail"
+)
+
+// CheckDirty checks that the working tree has no uncommitted change to the
+// inputs of the affected targets before they are built from a commit range:
+// the build would mix the committed changes with the local edits. It warns,
+// fails or does nothing depending on the mode. An empty commit range diffs
+// the working tree itself and is not checked.
+func (b *BuildContext) CheckDirty(ctx context.Context, mode string) error {
+	_, span := tracer.Start(ctx, "*BuildContext.CheckDirty()")
+	defer span.End()
+	switch mode {
+	case DirtyIgnore:
+		return nil
+	case DirtyWarn, DirtyFail:
+	default:
+		return errors.Errorf("unknown dirty check %q, must be one of ignore, warn or fail", mode)
+	}
+	if b.CommitRange == "" || b.Bare != nil {
+		return nil
+	}
+	repo, err := openRepo()
+	if err != nil {
+		return err
+	}
+	status, err := worktreeStatus(repo)
+	if err != nil {
+		return err
+	}
+	var dirty []string
+	for _, t := range b.Config.Targets {
+		if (len(t.Changes) == 0 && !b.All) || !t.buildable() {
+			continue
+		}
+		var files []string
+		for _, name := range sortedStatusNames(status) {
+			s := status[name]
+			if s.Worktree == git.Unmodified && s.Staging == git.Unmodified {
+				continue
+			}
+			if isFileInput(name, t, b.Config.DepSourceDirs) {
+				files = append(files, fmt.Sprintf("%s (%s)", name, dirtyStatus(s)))
+			}
+		}
+		if len(files) > 0 {
+			dirty = append(dirty, t.Path)
+			Log.Warn("the target has uncommitted changes to its inputs", "target", t.Path, "files", strings.Join(files, ", "))
+		}
+	}
+	span.SetAttributes(attribute.String("dirty", strings.Join(dirty, ",")))
+	if len(dirty) > 0 && mode == DirtyFail {
+		return errors.Errorf("the working tree has uncommitted changes to the inputs of %s: commit or stash them, or use -dirty-check=warn", strings.Join(dirty, ", "))
+	}
+	return nil
+}
+
+// isFileInput reports whether a file is under the directory of a target or
+// is one of its dependencies or watched files.
+func isFileInput(f string, t *Target, depDirs []string) bool {
+	dir := CleanTreePath(t.Path)
+	return dir == "." || strings.HasPrefix(f, dir+"/") ||
+		isFileDependencyOfTarget(f, t, depDirs) ||
+		isFileWatchedByTarget(f, t)
+}
+
+func dirtyStatus(s *git.FileStatus) string {
+	switch {
+	case s.Worktree == git.Untracked:
+		return "untracked"
+	case s.Worktree == git.Deleted || s.Staging == git.Deleted:
+		return "deleted"
+	case s.Worktree == git.Unmodified:
+		return "staged"
+	}
+	return "modified"
+}
@@ -0,0 +1,118 @@
+package build
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// templateData is the data of the default_build_command templates of a
+// discovered target.
+type templateData struct {
+	Path string // The target path, e.g. services/billing.
+	Name string // The base name of the path, e.g. billing.
+}
+
+// resolveTargets adds the directories matching targets_glob to the targets,
+// applies the directory settings and renders the default build command of
+// the discovered targets without one. glob and isDir read the working tree
+// or the tree of a bare repository.
+func (c *Config) resolveTargets(glob func(string) ([]string, error), isDir func(string) bool) error {
+	known := make(map[string]bool)
+	for _, t := range c.Targets {
+		known[CleanTreePath(t.Path)] = true
+	}
+	var discovered []*Target
+	for _, p := range c.TargetsGlob {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.Errorf("targets_glob: %q is not a valid glob pattern", p)
+		}
+		matches, err := glob(p)
+		if err != nil {
+			return errors.Wrapf(err, "targets_glob: %s", p)
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			m = filepath.ToSlash(m)
+			// The explicit targets win, and a directory matched twice is one target.
+			if known[CleanTreePath(m)] || !isDir(m) || skipScaffoldDir(path.Base(m)) {
+				continue
+			}
+			known[CleanTreePath(m)] = true
+			t := &Target{Path: m}
+			c.Targets = append(c.Targets, t)
+			discovered = append(discovered, t)
+		}
+	}
+	c.applyDirectories()
+	for _, t := range discovered {
+		if t.buildable() {
+			continue
+		}
+		cmd, err := c.DefaultBuildCommand.render(templateData{Path: t.Path, Name: path.Base(t.Path)})
+		if err != nil {
+			return errors.Wrapf(err, "default_build_command: target %s", t.Path)
+		}
+		t.BuildCommand = cmd
+	}
+	return nil
+}
+
+// render executes the command, dir and args of a command as templates.
+func (c BuildCommand) render(data templateData) (BuildCommand, error) {
+	var err error
+	r := BuildCommand{}
+	if r.Command, err = renderTemplate(c.Command, data); err != nil {
+		return r, err
+	}
+	if r.Dir, err = renderTemplate(c.Dir, data); err != nil {
+		return r, err
+	}
+	for _, a := range c.Args {
+		s, err := renderTemplate(a, data)
+		if err != nil {
+			return r, err
+		}
+		r.Args = append(r.Args, s)
+	}
+	if r.EnvFile, err = renderTemplate(c.EnvFile, data); err != nil {
+		return r, err
+	}
+	if r.Timeout, err = renderTemplate(c.Timeout, data); err != nil {
+		return r, err
+	}
+	for k, v := range c.Env {
+		s, err := renderTemplate(v, data)
+		if err != nil {
+			return r, err
+		}
+		if r.Env == nil {
+			r.Env = make(map[string]string)
+		}
+		r.Env[k] = s
+	}
+	return r, nil
+}
+
+func renderTemplate(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// isLocalDir reports whether name is a directory of the working tree.
+func isLocalDir(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.IsDir()
+}
@@ -0,0 +1,220 @@
+package build
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// TargetDocker is the type of the targets that build a container image.
+const TargetDocker = "docker"
+
+// dockerTagData is the data of the templates of the tags of a docker target.
+type dockerTagData struct {
+	Commit      string // The SHA of HEAD.
+	ShortCommit string // Its first 7 characters.
+}
+
+// defaultDockerTags tag the image with the commit it is built from.
+var defaultDockerTags = []string{"{{.ShortCommit}}"}
+
+// dockerfile returns the Dockerfile of a docker target, the Dockerfile of
+// its directory by default.
+func (t *Target) dockerfile() string {
+	if t.Dockerfile != "" {
+		return CleanTreePath(t.Dockerfile)
+	}
+	return path.Join(CleanTreePath(t.Path), "Dockerfile")
+}
+
+// dockerContext returns the build context of a docker target, its directory
+// by default.
+func (t *Target) dockerContext() string {
+	if t.Context != "" {
+		return CleanTreePath(t.Context)
+	}
+	return CleanTreePath(t.Path)
+}
+
+// validateDocker checks the type of a target and the fields of a docker
+// target.
+func validateDocker(t *Target) error {
+	switch t.Type {
+	case "":
+		// The dockerfile and context of another target only feed the
+		// dependency analysis.
+		if t.Image != "" || len(t.Tags) > 0 {
+			return errors.Errorf("target.type: target %s has an image or tags but is not of type docker", t.Path)
+		}
+		return nil
+	case TargetDocker:
+	default:
+		return errors.Errorf("target.type: %s of target %s must be docker", t.Type, t.Path)
+	}
+	if t.Image == "" {
+		return errors.Errorf("target.image: the docker target %s needs an image", t.Path)
+	}
+	if strings.Contains(path.Base(t.Image), ":") || strings.Contains(t.Image, "@") {
+		return errors.Errorf("target.image: %s of target %s must not have a tag, set its tags", t.Image, t.Path)
+	}
+	if t.BuildCommand.defined() || len(t.Steps) > 0 {
+		return errors.Errorf("target.type: the docker target %s builds its image, it cannot have a build_command or steps", t.Path)
+	}
+	for _, tag := range t.Tags {
+		if _, err := template.New("").Parse(tag); err != nil {
+			return errors.Wrapf(err, "target.tags: %s of target %s", tag, t.Path)
+		}
+	}
+	return nil
+}
+
+// resolveDocker sets the build command of a docker target: the docker build
+// of its image, tagged with its tags rendered for HEAD.
+func (t *Target) resolveDocker(ctx context.Context) error {
+	if t.Type != TargetDocker {
+		return nil
+	}
+	commit, err := gitOutput(ctx, "rev-parse", "HEAD")
+	if err != nil {
+		return errors.Wrapf(err, "target %s: image tags", t.Path)
+	}
+	data := dockerTagData{Commit: commit, ShortCommit: commit}
+	if len(commit) > 7 {
+		data.ShortCommit = commit[:7]
+	}
+	tags := t.Tags
+	if len(tags) == 0 {
+		tags = defaultDockerTags
+	}
+	args := []string{"build", "-f", t.dockerfile()}
+	for _, tag := range tags {
+		s, err := renderTemplate(tag, data)
+		if err != nil {
+			return errors.Wrapf(err, "target.tags: %s of target %s", tag, t.Path)
+		}
+		args = append(args, "-t", t.Image+":"+s)
+	}
+	t.BuildCommand = BuildCommand{Command: "docker", Args: append(args, t.dockerContext())}
+	return nil
+}
+
+// dockerAnalyzer is the analyzer of the docker targets: the directory of the
+// target and the sources that the Dockerfile copies from the build context
+// are dependencies of the image, and the Dockerfile is watched.
+type dockerAnalyzer struct{}
+
+func (dockerAnalyzer) Analyze(ctx context.Context, t *Target) error {
+	t.addDepDir(t.Path)
+	return t.analyzeDockerfile()
+}
+
+// analyzeDockerfile adds the sources of the COPY and ADD instructions of the
+// Dockerfile of the target to its dependencies: the directories to DepDirs,
+// the files and the glob patterns to DepFiles. Without a Dockerfile, the
+// whole build context is a dependency of a docker target.
+func (t *Target) analyzeDockerfile() error {
+	name := t.dockerfile()
+	f, err := os.Open(name)
+	if os.IsNotExist(err) && t.Type == TargetDocker {
+		t.addDepDir(t.dockerContext())
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "target %s: dockerfile", t.Path)
+	}
+	defer f.Close()
+	sources, err := dockerfileSources(f)
+	if err != nil {
+		return errors.Wrapf(err, "target %s: %s", t.Path, name)
+	}
+	t.addWatch(name)
+	for _, s := range sources {
+		p := path.Join(t.dockerContext(), s)
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			t.addDepDir(p)
+		} else if !contains(t.DepFiles, p) {
+			t.DepFiles = append(t.DepFiles, p)
+		}
+	}
+	return nil
+}
+
+// dockerfileSources returns the sources of the COPY and ADD instructions of
+// a Dockerfile, relative to the build context. The copies from another stage
+// or image, --from, and the remote sources of ADD are not in the context.
+func dockerfileSources(r io.Reader) ([]string, error) {
+	var sources []string
+	var line string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		l := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(l, "#") {
+			continue
+		}
+		// An instruction continues on the next line after a backslash.
+		if strings.HasSuffix(l, "\\") {
+			line += strings.TrimSuffix(l, "\\") + " "
+			continue
+		}
+		line += l
+		fields := strings.Fields(line)
+		line = ""
+		if len(fields) < 3 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "COPY", "ADD":
+		default:
+			continue
+		}
+		args, from := fields[1:], false
+		for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+			from = from || strings.HasPrefix(args[0], "--from=")
+			args = args[1:]
+		}
+		if from {
+			continue
+		}
+		if rest := strings.Join(args, " "); strings.HasPrefix(rest, "[") {
+			// The exec form: ["src", ..., "dest"].
+			args = nil
+			if err := json.Unmarshal([]byte(rest), &args); err != nil {
+				return nil, errors.Wrapf(err, "%s", fields[0])
+			}
+		}
+		if len(args) < 2 {
+			continue
+		}
+		for _, s := range args[:len(args)-1] {
+			switch {
+			case strings.Contains(s, "://"), strings.HasPrefix(s, "git@"), strings.HasPrefix(s, "<<"):
+				// A remote source, or a heredoc.
+			case strings.Contains(s, "$"):
+				// A build argument or a variable may be any path of the
+				// context.
+				sources = append(sources, ".")
+			default:
+				sources = append(sources, CleanTreePath(strings.TrimPrefix(s, "/")))
+			}
+		}
+	}
+	return sources, sc.Err()
+}
+
+// isFileInDepFiles reports whether a file is one of the dependency files of
+// the target, or matches one of its dependency patterns.
+func isFileInDepFiles(f string, t *Target) bool {
+	for _, p := range t.DepFiles {
+		if matchWatchPattern(p, f) {
+			return true
+		}
+	}
+	return false
+}
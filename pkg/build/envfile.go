@@ -0,0 +1,200 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var envKeyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseEnvFile parses a dotenv file: KEY=value lines, optionally prefixed by
+// export, with # comments. Single-quoted values are literal, double-quoted
+// values support the \n, \t, \" and \\ escapes, and ${KEY} or $KEY
+// references are expanded from fixed, then from the previous keys of the
+// file, then from defaults.
+func parseEnvFile(b []byte, fixed, defaults map[string]string) (map[string]string, error) {
+	vars := make(map[string]string)
+	expand := func(k string) string {
+		if v, ok := fixed[k]; ok {
+			return v
+		}
+		if v, ok := vars[k]; ok {
+			return v
+		}
+		return defaults[k]
+	}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		kv := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || !envKeyRe.MatchString(key) {
+			return nil, errors.Errorf("line %d: expected KEY=value", n)
+		}
+		value := strings.TrimSpace(kv[1])
+		switch {
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(value[1:], "'")
+			if end < 0 {
+				return nil, errors.Errorf("line %d: unterminated single quote", n)
+			}
+			value = value[1 : end+1]
+		case strings.HasPrefix(value, `"`):
+			var sb strings.Builder
+			closed := false
+			for i := 1; i < len(value) && !closed; i++ {
+				c := value[i]
+				switch {
+				case c == '"':
+					closed = true
+				case c == '\\' && i+1 < len(value):
+					i++
+					switch value[i] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(value[i])
+					}
+				default:
+					sb.WriteByte(c)
+				}
+			}
+			if !closed {
+				return nil, errors.Errorf("line %d: unterminated double quote", n)
+			}
+			value = os.Expand(sb.String(), expand)
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+			value = os.Expand(value, expand)
+		}
+		vars[key] = value
+	}
+	return vars, s.Err()
+}
+
+// cleanEnvDefaults are the variables a target with clean_env keeps from the
+// environment of mb, besides its pass_env.
+var cleanEnvDefaults = []string{"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TERM", "TZ", "LANG", "LC_*", "TMPDIR"}
+
+// cleanEnviron returns the variables of env that a target with clean_env
+// keeps: the defaults and the ones of its pass_env.
+func (t *Target) cleanEnviron(env []string) []string {
+	patterns := append(append([]string{}, cleanEnvDefaults...), t.PassEnv...)
+	clean := []string{}
+	for _, kv := range env {
+		if matchAny(patterns, strings.SplitN(kv, "=", 2)[0]) {
+			clean = append(clean, kv)
+		}
+	}
+	return clean
+}
+
+// environ returns the environment of the build command of the target: the
+// environment of mb filtered by the policy, and by the target with
+// clean_env, over the variables of the env_files of the target. The later env
+// files override the earlier ones, and the environment of mb overrides them
+// all, so that CI can override the settings committed next to a service.
+//
+// The env_file and the env of the build command are then set over it.
+func (t *Target) environ(p PolicyConfig) ([]string, error) {
+	base := p.environ(os.Environ())
+	if t.CleanEnv {
+		if base == nil {
+			base = os.Environ()
+		}
+		base = t.cleanEnviron(base)
+	}
+	if len(t.EnvFiles) == 0 {
+		return t.BuildCommand.environ(base)
+	}
+	if base == nil {
+		base = os.Environ()
+	}
+	env := envMap(base)
+	merged := make(map[string]string)
+	for _, f := range t.EnvFiles {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "target %s: env_files", t.Path)
+		}
+		// References resolve to the values the build command gets.
+		vars, err := parseEnvFile(b, env, merged)
+		if err != nil {
+			return nil, errors.Wrapf(err, "target %s: env file %s", t.Path, f)
+		}
+		for k, v := range vars {
+			merged[k] = v
+		}
+	}
+	environ := append([]string{}, base...)
+	for k, v := range merged {
+		if _, ok := env[k]; !ok {
+			environ = append(environ, k+"="+v)
+		}
+	}
+	return t.BuildCommand.environ(environ)
+}
+
+// environ returns env, nil for the environment of mb, with the variables of
+// the env_file of the command set over it, then the variables of its env.
+// Unlike the env_files of a target, they override the environment. The
+// ${KEY} and $KEY references of the values expand from env, and the ones of
+// the env values from the env_file too.
+func (c BuildCommand) environ(env []string) ([]string, error) {
+	if len(c.Env) == 0 && c.EnvFile == "" {
+		return env, nil
+	}
+	if env == nil {
+		env = os.Environ()
+	}
+	parent := envMap(env)
+	vars := make(map[string]string)
+	if c.EnvFile != "" {
+		b, err := ioutil.ReadFile(c.EnvFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "env_file")
+		}
+		if vars, err = parseEnvFile(b, nil, parent); err != nil {
+			return nil, errors.Wrapf(err, "env_file %s", c.EnvFile)
+		}
+	}
+	lookup := func(k string) string {
+		if v, ok := vars[k]; ok {
+			return v
+		}
+		return parent[k]
+	}
+	expanded := make(map[string]string, len(c.Env))
+	for k, v := range c.Env {
+		expanded[k] = os.Expand(v, lookup)
+	}
+	for k, v := range expanded {
+		vars[k] = v
+	}
+	return setEnv(env, vars), nil
+}
+
+// envMap returns the variables of an environment by name.
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, kv := range env {
+		if kv := strings.SplitN(kv, "=", 2); len(kv) == 2 {
+			m[kv[0]] = kv[1]
+		}
+	}
+	return m
+}
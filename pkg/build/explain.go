@@ -0,0 +1,205 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// explainMarker identifies the PR comment that mb explain keeps up to date.
+const explainMarker = "<!-- monobuild:explain -->"
+
+// reasons returns why each changed file affects the target.
+func (t *Target) reasons() []string {
+	var reasons []string
+	seen := make(map[string]bool)
+	for _, f := range t.Changes {
+		if seen[f.Name] {
+			continue
+		}
+		seen[f.Name] = true
+		var why []string
+		if contains(f.DependencyOf, t.Path) {
+			why = append(why, "is a Go dependency")
+		}
+		if contains(f.WatchedBy, t.Path) {
+			why = append(why, "is watched")
+		}
+		switch {
+		case !contains(f.StaleOutputOf, t.Path):
+		case f.Status == OutputMissing:
+			why = append(why, "is a missing output")
+		default:
+			why = append(why, "is an output older than the inputs")
+		}
+		reasons = append(reasons, fmt.Sprintf("`%s` %s", f.Name, strings.Join(why, " and ")))
+	}
+	return reasons
+}
+
+// changedPackages returns the dependencies of the target that the changed
+// files touch, sorted: the Go packages of its closure and its dependency
+// directories, with a trailing slash.
+func (t *Target) changedPackages() []string {
+	var pkgs []string
+	for _, f := range t.Changes {
+		if !contains(f.DependencyOf, t.Path) {
+			continue
+		}
+		if p := t.dependency(f.Name); !contains(pkgs, p) {
+			pkgs = append(pkgs, p)
+		}
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+// dependency returns the dependency of the target that a file is in: one of
+// its dependency directories, else the Go package of its directory.
+func (t *Target) dependency(f string) string {
+	for _, d := range t.DepDirs {
+		if d == "." || strings.HasPrefix(f, d+"/") {
+			return d + "/"
+		}
+	}
+	dir := path.Dir(f)
+	for _, dep := range t.Deps {
+		if dep == dir || strings.HasSuffix(dep, "/"+dir) {
+			return dep
+		}
+	}
+	return dir
+}
+
+// Explain renders a summary of the affected targets and why they are
+// affected. The markdown format is meant for PR comments.
+func (b *BuildContext) Explain(format string) (string, error) {
+	var affected, skipped []*Target
+	for _, t := range b.Config.Targets {
+		if len(t.Changes) > 0 || b.All {
+			affected = append(affected, t)
+		} else {
+			skipped = append(skipped, t)
+		}
+	}
+	var sb strings.Builder
+	switch format {
+	case "markdown":
+		sb.WriteString(explainMarker + "\n")
+		fmt.Fprintf(&sb, "### monobuild: %d of %d targets will be rebuilt\n\n", len(affected), len(b.Config.Targets))
+		switch len(affected) {
+		case 0:
+		case 1:
+			sb.WriteString("This target will be rebuilt because:\n\n")
+		default:
+			fmt.Fprintf(&sb, "These %d targets will be rebuilt because:\n\n", len(affected))
+		}
+		for _, t := range affected {
+			fmt.Fprintf(&sb, "- **%s**\n", t.Path)
+			if b.All && len(t.Changes) == 0 {
+				sb.WriteString("  - all targets are built\n")
+			}
+			for _, r := range t.reasons() {
+				fmt.Fprintf(&sb, "  - %s\n", r)
+			}
+			if pkgs := t.changedPackages(); len(pkgs) > 0 {
+				fmt.Fprintf(&sb, "  - changed dependencies: `%s`\n", strings.Join(pkgs, "`, `"))
+			}
+		}
+		if len(skipped) > 0 {
+			sb.WriteString("\n<details><summary>Unaffected targets</summary>\n\n")
+			for _, t := range skipped {
+				fmt.Fprintf(&sb, "- %s\n", t.Path)
+			}
+			sb.WriteString("\n</details>\n")
+		}
+		for _, w := range b.Warnings() {
+			fmt.Fprintf(&sb, "\n> :warning: %s\n", w)
+		}
+	case "text":
+		fmt.Fprintf(&sb, "%d of %d targets will be rebuilt\n", len(affected), len(b.Config.Targets))
+		for _, t := range affected {
+			fmt.Fprintf(&sb, "%s\n", t.Path)
+			for _, r := range t.reasons() {
+				fmt.Fprintf(&sb, "  %s\n", strings.Replace(r, "`", "", -1))
+			}
+			if pkgs := t.changedPackages(); len(pkgs) > 0 {
+				fmt.Fprintf(&sb, "  changed dependencies: %s\n", strings.Join(pkgs, ", "))
+			}
+		}
+		for _, w := range b.Warnings() {
+			fmt.Fprintf(&sb, "WARNING: %s\n", w)
+		}
+	default:
+		return "", errors.Errorf("unknown explain format %q", format)
+	}
+	return sb.String(), nil
+}
+
+// PostGitHubComment creates or updates the mb explain comment of a pull request.
+func PostGitHubComment(ctx context.Context, apiURL, repo, token string, pr int, body string) error {
+	ctx, span := tracer.Start(ctx, "PostGitHubComment")
+	defer span.End()
+	if apiURL == "" {
+		apiURL = "https://api.github.com"
+	}
+	h := http.Header{}
+	h.Set("Accept", "application/vnd.github.v3+json")
+	h.Set("Authorization", "token "+token)
+	var comments []struct {
+		ID   int64  `json:"id"`
+		Body string `json:"body"`
+	}
+	issueURL := fmt.Sprintf("%s/repos/%s/issues/%d/comments", apiURL, repo, pr)
+	if err := doJSON(ctx, http.MethodGet, issueURL+"?per_page=100", h, nil, &comments); err != nil {
+		return err
+	}
+	in := map[string]string{"body": body}
+	for _, c := range comments {
+		if strings.Contains(c.Body, explainMarker) {
+			return doJSON(ctx, http.MethodPatch, fmt.Sprintf("%s/repos/%s/issues/comments/%d", apiURL, repo, c.ID), h, in, nil)
+		}
+	}
+	return doJSON(ctx, http.MethodPost, issueURL, h, in, nil)
+}
+
+// PostGitLabNote creates or updates the mb explain note of a merge request.
+func PostGitLabNote(ctx context.Context, baseURL, project, token string, mr int, body string) error {
+	ctx, span := tracer.Start(ctx, "PostGitLabNote")
+	defer span.End()
+	if baseURL == "" {
+		baseURL = "https://gitlab.com"
+	}
+	h := http.Header{}
+	h.Set("PRIVATE-TOKEN", token)
+	var notes []struct {
+		ID   int64  `json:"id"`
+		Body string `json:"body"`
+	}
+	notesURL := fmt.Sprintf("%s/api/v4/projects/%s/merge_requests/%d/notes", strings.TrimSuffix(baseURL, "/"), url.PathEscape(project), mr)
+	if err := doJSON(ctx, http.MethodGet, notesURL+"?per_page=100", h, nil, &notes); err != nil {
+		return err
+	}
+	in := map[string]string{"body": body}
+	for _, n := range notes {
+		if strings.Contains(n.Body, explainMarker) {
+			return doJSON(ctx, http.MethodPut, fmt.Sprintf("%s/%d", notesURL, n.ID), h, in, nil)
+		}
+	}
+	return doJSON(ctx, http.MethodPost, notesURL, h, in, nil)
+}
+
+func contains(items []string, s string) bool {
+	for _, i := range items {
+		if i == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,318 @@
+package build
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Change statuses of the files reported by the git diff sources.
+const (
+	StatusAdded    = "added"
+	StatusModified = "modified"
+	StatusDeleted  = "deleted"
+	StatusRenamed  = "renamed"
+)
+
+// FileChange is a changed file and how it changed.
+type FileChange struct {
+	Name   string
+	Status string
+	From   string // The previous name of a renamed file.
+}
+
+// ChangeLister is implemented by the diff providers that know how the files
+// changed. Both names of a renamed file are reported: the new one as
+// renamed, the previous one as deleted.
+type ChangeLister interface {
+	Changes(ctx context.Context) ([]FileChange, error)
+}
+
+// GitDiff lists the files changed in a commit range, as
+// `git diff --name-only` would without the git CLI. A `base..head` or
+// `base...head` range compares two commits, a single revision compares
+// the revision with the working tree and an empty range lists the unstaged
+// changes of the working tree.
+type GitDiff struct {
+	CommitRange string
+}
+
+func (g *GitDiff) Name() string { return SourceGit }
+
+func (g *GitDiff) ChangedFiles(ctx context.Context) ([]string, error) {
+	return changeNames(g.Changes(ctx))
+}
+
+func (g *GitDiff) Changes(ctx context.Context) ([]FileChange, error) {
+	ctx, span := tracer.Start(ctx, "*GitDiff.Changes()")
+	defer span.End()
+	span.SetAttributes(attribute.String("commit_range", g.CommitRange))
+	repo, err := openRepo()
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(g.CommitRange, "..") {
+		r := &BareRepo{Path: ".", repo: repo}
+		if err := r.resolveRange(g.CommitRange); err != nil {
+			return nil, err
+		}
+		return treeChanges(ctx, repo, r.baseTree, r.headTree)
+	}
+	if g.CommitRange == "" {
+		return worktreeChanges(repo, false)
+	}
+	// A single revision is compared with the working tree: the changes of
+	// the index and the working tree, then the changes from the revision to
+	// HEAD.
+	r := &BareRepo{Path: ".", repo: repo}
+	base, err := r.commit(g.CommitRange)
+	if err != nil {
+		return nil, err
+	}
+	head, err := r.commit("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	baseTree, err := base.Tree()
+	if err != nil {
+		return nil, err
+	}
+	headTree, err := head.Tree()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := treeChanges(ctx, repo, baseTree, headTree)
+	if err != nil {
+		return nil, err
+	}
+	local, err := worktreeChanges(repo, true)
+	if err != nil {
+		return nil, err
+	}
+	changes = mergeChanges(local, changes)
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes, nil
+}
+
+// GitUntracked lists the untracked files that are not ignored.
+type GitUntracked struct{}
+
+func (g *GitUntracked) Name() string { return SourceUntracked }
+
+func (g *GitUntracked) ChangedFiles(ctx context.Context) ([]string, error) {
+	return changeNames(g.Changes(ctx))
+}
+
+func (g *GitUntracked) Changes(ctx context.Context) ([]FileChange, error) {
+	_, span := tracer.Start(ctx, "*GitUntracked.Changes()")
+	defer span.End()
+	repo, err := openRepo()
+	if err != nil {
+		return nil, err
+	}
+	status, err := worktreeStatus(repo)
+	if err != nil {
+		return nil, err
+	}
+	var changes []FileChange
+	for _, name := range sortedStatusNames(status) {
+		if status[name].Worktree == git.Untracked {
+			changes = append(changes, FileChange{Name: name, Status: StatusAdded})
+		}
+	}
+	return changes, nil
+}
+
+// GitStaged lists the changes staged in the index, from HEAD, e.g. the new
+// files added with git add, that no range of the git source reports.
+type GitStaged struct{}
+
+func (g *GitStaged) Name() string { return SourceStaged }
+
+func (g *GitStaged) ChangedFiles(ctx context.Context) ([]string, error) {
+	return changeNames(g.Changes(ctx))
+}
+
+func (g *GitStaged) Changes(ctx context.Context) ([]FileChange, error) {
+	_, span := tracer.Start(ctx, "*GitStaged.Changes()")
+	defer span.End()
+	repo, err := openRepo()
+	if err != nil {
+		return nil, err
+	}
+	status, err := worktreeStatus(repo)
+	if err != nil {
+		return nil, err
+	}
+	var changes []FileChange
+	for _, name := range sortedStatusNames(status) {
+		s := status[name]
+		if s.Staging == git.Untracked {
+			continue
+		}
+		if c, ok := statusChange(name, s.Staging, s.Extra); ok {
+			changes = append(changes, c)
+		}
+	}
+	return changes, nil
+}
+
+// openRepo opens the repository of the working directory.
+func openRepo() (*git.Repository, error) {
+	repo, err := git.PlainOpenWithOptions(".", &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, errors.Errorf("open git repository: %v", err)
+	}
+	return repo, nil
+}
+
+// treeChanges returns the changes from one tree to another, nil for an empty
+// tree. Only the renames of identical files are detected in a partial clone,
+// whose blobs may be missing.
+func treeChanges(ctx context.Context, repo *git.Repository, from, to *object.Tree) ([]FileChange, error) {
+	opts := *object.DefaultDiffTreeOptions
+	opts.OnlyExactRenames = partialCloneConfig(repo)
+	diff, err := object.DiffTreeWithOptions(ctx, from, to, &opts)
+	if err != nil {
+		return nil, errors.Errorf("diff trees: %v", err)
+	}
+	var changes []FileChange
+	for _, c := range diff {
+		switch {
+		case c.From.Name == "":
+			changes = append(changes, FileChange{Name: c.To.Name, Status: StatusAdded})
+		case c.To.Name == "":
+			changes = append(changes, FileChange{Name: c.From.Name, Status: StatusDeleted})
+		case c.From.Name != c.To.Name:
+			changes = append(changes,
+				FileChange{Name: c.To.Name, Status: StatusRenamed, From: c.From.Name},
+				FileChange{Name: c.From.Name, Status: StatusDeleted},
+			)
+		default:
+			changes = append(changes, FileChange{Name: c.To.Name, Status: StatusModified})
+		}
+	}
+	return changes, nil
+}
+
+// worktreeChanges returns the unstaged changes of the working tree, and the
+// staged ones too when staged is set. Untracked files are not changes.
+func worktreeChanges(repo *git.Repository, staged bool) ([]FileChange, error) {
+	status, err := worktreeStatus(repo)
+	if err != nil {
+		return nil, err
+	}
+	var changes []FileChange
+	for _, name := range sortedStatusNames(status) {
+		s := status[name]
+		if s.Worktree == git.Untracked {
+			continue
+		}
+		code := s.Worktree
+		if staged && code == git.Unmodified {
+			code = s.Staging
+		}
+		if c, ok := statusChange(name, code, s.Extra); ok {
+			changes = append(changes, c)
+		}
+	}
+	return changes, nil
+}
+
+// statusChange returns the change of a file of a git status code, none when
+// the file is unmodified. from is the previous name of a renamed file.
+func statusChange(name string, code git.StatusCode, from string) (FileChange, bool) {
+	switch code {
+	case git.Unmodified:
+		return FileChange{}, false
+	case git.Added, git.Copied:
+		return FileChange{Name: name, Status: StatusAdded}, true
+	case git.Deleted:
+		return FileChange{Name: name, Status: StatusDeleted}, true
+	case git.Renamed:
+		return FileChange{Name: name, Status: StatusRenamed, From: from}, true
+	}
+	return FileChange{Name: name, Status: StatusModified}, true
+}
+
+// worktreeStatus returns the status of the working tree. The files outside of
+// a sparse checkout are not reported as deleted.
+func worktreeStatus(repo *git.Repository) (git.Status, error) {
+	w, err := repo.Worktree()
+	if err != nil {
+		return nil, errors.Errorf("git worktree: %v", err)
+	}
+	status, err := w.Status()
+	if err != nil {
+		return nil, errors.Errorf("git status: %v", err)
+	}
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, errors.Errorf("git index: %v", err)
+	}
+	for _, e := range idx.Entries {
+		if e.SkipWorktree {
+			if s, ok := status[e.Name]; ok && s.Worktree == git.Deleted {
+				s.Worktree = git.Unmodified
+			}
+		}
+	}
+	return status, nil
+}
+
+func sortedStatusNames(status git.Status) []string {
+	names := make([]string, 0, len(status))
+	for name := range status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// partialCloneConfig reports whether the repository is a partial clone.
+func partialCloneConfig(repo *git.Repository) bool {
+	cfg, err := repo.Config()
+	if err != nil {
+		return false
+	}
+	if cfg.Raw.Section("extensions").Option("partialClone") != "" {
+		return true
+	}
+	for _, s := range cfg.Raw.Section("remote").Subsections {
+		if s.Option("promisor") == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeChanges appends the changes of b to a, the changes of a taking
+// precedence for the same file.
+func mergeChanges(a, b []FileChange) []FileChange {
+	seen := make(map[string]bool)
+	for _, c := range a {
+		seen[c.Name] = true
+	}
+	for _, c := range b {
+		if !seen[c.Name] {
+			a = append(a, c)
+		}
+	}
+	return a
+}
+
+func changeNames(changes []FileChange, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(changes))
+	for _, c := range changes {
+		names = append(names, c.Name)
+	}
+	return names, nil
+}
@@ -0,0 +1,222 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GitHubEvent is the part of the event payload of a GitHub Actions workflow,
+// at GITHUB_EVENT_PATH, that gives the commits of a push or a pull request.
+type GitHubEvent struct {
+	Before      string `json:"before"` // Of a push.
+	After       string `json:"after"`
+	PullRequest *struct {
+		Base struct {
+			SHA string `json:"sha"`
+			Ref string `json:"ref"`
+		} `json:"base"`
+		Head struct {
+			SHA string `json:"sha"`
+		} `json:"head"`
+	} `json:"pull_request"`
+}
+
+// zeroSHA is the before commit of the push of a new branch.
+const zeroSHA = "0000000000000000000000000000000000000000"
+
+// GitHubActionRange returns the commit range of a GitHub Actions workflow
+// from its environment: the commits of the pull request, or of the push.
+// all is true when there is no range to compare, e.g. for a new branch or a
+// scheduled workflow, and every target is affected.
+func GitHubActionRange(getenv func(string) string) (commitRange string, all bool, err error) {
+	ev := &GitHubEvent{}
+	if name := getenv("GITHUB_EVENT_PATH"); name != "" {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", false, errors.Wrap(err, "GITHUB_EVENT_PATH")
+		}
+		if err := json.Unmarshal(b, ev); err != nil {
+			return "", false, errors.Wrapf(err, "GITHUB_EVENT_PATH %s", name)
+		}
+	}
+	switch {
+	case ev.PullRequest != nil && ev.PullRequest.Base.SHA != "" && ev.PullRequest.Head.SHA != "":
+		return ev.PullRequest.Base.SHA + "..." + ev.PullRequest.Head.SHA, false, nil
+	case getenv("GITHUB_BASE_REF") != "" && getenv("GITHUB_SHA") != "":
+		return "origin/" + getenv("GITHUB_BASE_REF") + "..." + getenv("GITHUB_SHA"), false, nil
+	case ev.Before != "" && ev.Before != zeroSHA && ev.After != "":
+		return ev.Before + ".." + ev.After, false, nil
+	}
+	return "", true, nil
+}
+
+// FetchRangeBase fetches the base commit of a commit range when it is not
+// in the clone, e.g. a shallow checkout of actions/checkout. The merge base
+// of a base...head range needs the history of both commits.
+func FetchRangeBase(ctx context.Context, commitRange string) error {
+	base := commitRange
+	if i := strings.Index(base, ".."); i >= 0 {
+		base = base[:i]
+	}
+	if base == "" {
+		return nil
+	}
+	if _, err := gitOutput(ctx, "rev-parse", "--verify", "--quiet", base+"^{commit}"); err == nil {
+		return nil
+	}
+	refspec := base
+	if strings.HasPrefix(base, "origin/") {
+		refspec = strings.TrimPrefix(base, "origin/") + ":refs/remotes/" + base
+	}
+	Log.Info("fetching the base commit of the range", "commit", base)
+	if _, err := gitOutput(ctx, "fetch", "--no-tags", "origin", refspec); err != nil {
+		return errors.Wrapf(err, "cannot fetch %s, use fetch-depth: 0 with actions/checkout", base)
+	}
+	return nil
+}
+
+// WriteGitHubOutputs appends the outputs of a step to the GITHUB_OUTPUT
+// file, in the delimited form that allows multiline values.
+func WriteGitHubOutputs(name string, outputs map[string]string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for k := range outputs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(f, "%s<<MB_EOF\n%s\nMB_EOF\n", k, outputs[k])
+	}
+	return f.Close()
+}
+
+// GitHubActionOutputs returns the outputs of mb action: the affected targets
+// as a JSON array of paths and of names, their count, whether there is any
+// and the commit range.
+func GitHubActionOutputs(affected []*AffectedTarget, commitRange string) map[string]string {
+	paths, names := []string{}, []string{}
+	for _, t := range affected {
+		paths = append(paths, t.Path)
+		if t.Name != "" {
+			names = append(names, t.Name)
+		} else {
+			names = append(names, t.Path)
+		}
+	}
+	pb, _ := json.Marshal(paths)
+	nb, _ := json.Marshal(names)
+	return map[string]string{
+		"targets":      string(pb),
+		"names":        string(nb),
+		"count":        fmt.Sprint(len(affected)),
+		"any":          fmt.Sprint(len(affected) > 0),
+		"commit_range": commitRange,
+	}
+}
+
+// WriteGitHubActionSummary writes the affected targets, and the changed
+// files affecting them, as the markdown of a step summary.
+func WriteGitHubActionSummary(w io.Writer, affected []*AffectedTarget, commitRange string) {
+	scope := "every target"
+	if commitRange != "" {
+		scope = "`" + commitRange + "`"
+	}
+	fmt.Fprintf(w, "### mb: %d affected targets\n\nChanges of %s.\n\n", len(affected), scope)
+	if len(affected) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "| Target | Build | Changed files |")
+	fmt.Fprintln(w, "| --- | --- | --- |")
+	for _, t := range affected {
+		build := "no build command"
+		if t.Build {
+			build = "yes"
+		}
+		fmt.Fprintf(w, "| `%s` | %s | %s |\n", t.Path, build, strings.Join(t.Reasons, "<br>"))
+	}
+	fmt.Fprintln(w)
+}
+
+// GitHubMatrix is a matrix of a GitHub Actions job, for strategy.matrix with
+// fromJSON, with a job per affected target.
+type GitHubMatrix struct {
+	Include []*GitHubMatrixTarget `json:"include"`
+}
+
+// GitHubMatrixTarget is an affected target of a GitHubMatrix.
+type GitHubMatrixTarget struct {
+	Path    string `json:"path"`
+	Name    string `json:"name"`              // The ID of the target: its name, else its path.
+	Command string `json:"command,omitempty"` // Shell command line of the build command, or of the steps joined by &&, in their dirs.
+	Dir     string `json:"dir,omitempty"`
+}
+
+// GitHubMatrix returns the matrix of the affected targets, in config order,
+// only the buildable ones when buildable is set.
+func (b *BuildContext) GitHubMatrix(buildable bool) *GitHubMatrix {
+	m := &GitHubMatrix{Include: []*GitHubMatrixTarget{}}
+	affected := make(map[string]bool)
+	for _, at := range b.Affected(buildable) {
+		affected[at.Path] = true
+	}
+	for _, t := range b.Config.Targets {
+		if !affected[t.Path] {
+			continue
+		}
+		m.Include = append(m.Include, &GitHubMatrixTarget{Path: t.Path, Name: t.ID(), Command: t.commandLine(), Dir: t.BuildCommand.Dir})
+	}
+	return m
+}
+
+// commandLine returns the shell command line that builds the target outside
+// of mb: its build command, to run in its dir, or its steps joined by &&,
+// each in its dir, the steps of the parallel groups one after the other. It
+// is empty for a target without either.
+func (t *Target) commandLine() string {
+	if len(t.Steps) > 0 {
+		var lines []string
+		for _, s := range t.commandSteps() {
+			line := s.BuildCommand.commandLine()
+			if s.Dir != "" {
+				line = "(cd " + shellQuote(s.Dir) + " && " + line + ")"
+			}
+			lines = append(lines, line)
+		}
+		return strings.Join(lines, " && ")
+	}
+	if !t.BuildCommand.defined() {
+		return ""
+	}
+	return t.BuildCommand.commandLine()
+}
+
+// commandLine returns the command and its args as a shell command line.
+func (c BuildCommand) commandLine() string {
+	words := []string{shellQuote(c.Command)}
+	for _, a := range c.Args {
+		words = append(words, shellQuote(a))
+	}
+	return strings.Join(words, " ")
+}
+
+var shellSafeRe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes a word for a POSIX shell, when it needs it.
+func shellQuote(s string) string {
+	if shellSafeRe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
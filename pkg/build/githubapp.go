@@ -0,0 +1,432 @@
+package build
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// GitHubApp is a daemon that authenticates as a GitHub App, receives
+// check_suite webhooks, computes the affected targets of the head SHA
+// against a bare clone and creates one check run per target.
+type GitHubApp struct {
+	AppID         string
+	PrivateKey    *rsa.PrivateKey
+	WebhookSecret []byte // Required: the webhooks without a valid signature are rejected.
+	APIURL        string
+	ReposDir      string      // Bare clones are kept in ReposDir/<owner>/<repo>.git.
+	ConfigFile    string      // The config file path inside the repositories.
+	Queue         *BuildQueue // Runs the check suites, or nil to run them all at once.
+
+	mu    sync.Mutex
+	repos map[string]*sync.Mutex // Serializes the fetches of one repository.
+}
+
+// checkSuiteEvent is the subset of the check_suite webhook payload used by mb.
+type checkSuiteEvent struct {
+	Action     string `json:"action"`
+	CheckSuite struct {
+		HeadSHA    string `json:"head_sha"`
+		HeadBranch string `json:"head_branch"`
+		Before     string `json:"before"`
+	} `json:"check_suite"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Installation struct {
+		ID int64 `json:"id"`
+	} `json:"installation"`
+}
+
+func (a *GitHubApp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !a.validSignature(body, r.Header.Get("X-Hub-Signature-256")) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("X-GitHub-Event") != "check_suite" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var ev checkSuiteEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validRepository(ev.Repository.FullName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ev.Action != "requested" && ev.Action != "rerequested" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	if a.Queue == nil {
+		go func() {
+			if err := a.handleCheckSuite(context.Background(), &ev); err != nil {
+				log.Printf("check_suite %s@%s: %v", ev.Repository.FullName, ev.CheckSuite.HeadSHA, err)
+			}
+		}()
+		return
+	}
+	a.Queue.Submit(ev.Repository.FullName, ev.CheckSuite.HeadBranch, ev.CheckSuite.HeadSHA, QueueSourceWebhook, func(ctx context.Context) error {
+		return a.handleCheckSuite(ctx, &ev)
+	})
+}
+
+// BuildRequest is the body of a POST to the builds API of the app. An
+// empty SHA is the head of the branch when the build is started.
+type BuildRequest struct {
+	Repository string `json:"repository"`
+	Branch     string `json:"branch"`
+	SHA        string `json:"sha"`
+}
+
+// ServeAPI queues the check suites requested with POST and reports the
+// queue with GET. The API has no authentication of its own and is served
+// on a private address, apart from the webhooks.
+func (a *GitHubApp) ServeAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if a.Queue == nil {
+			http.Error(w, "no build queue", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(a.Queue.Status())
+	case http.MethodPost:
+		var req BuildRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Repository == "" || (req.Branch == "" && req.SHA == "") {
+			http.Error(w, "repository and branch or sha are required", http.StatusBadRequest)
+			return
+		}
+		if err := validRepository(req.Repository); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		a.request(QueueSourceAPI, req)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Schedule requests a check suite of the head of a branch every interval
+// until ctx is done.
+func (a *GitHubApp) Schedule(ctx context.Context, repository, branch string, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			a.request(QueueSourceSchedule, BuildRequest{Repository: repository, Branch: branch})
+		}
+	}
+}
+
+// request queues the check suite of a build request that did not come
+// from a webhook: the installation and head SHA are looked up with the API
+// when the build is started.
+func (a *GitHubApp) request(source string, req BuildRequest) {
+	run := func(ctx context.Context) error {
+		ev, err := a.checkSuite(ctx, req)
+		if err != nil {
+			return err
+		}
+		return a.handleCheckSuite(ctx, ev)
+	}
+	if a.Queue == nil {
+		go func() {
+			if err := run(context.Background()); err != nil {
+				log.Printf("%s %s@%s: %v", source, req.Repository, req.Branch, err)
+			}
+		}()
+		return
+	}
+	a.Queue.Submit(req.Repository, req.Branch, req.SHA, source, run)
+}
+
+// checkSuite returns the check_suite event equivalent to a build request.
+func (a *GitHubApp) checkSuite(ctx context.Context, req BuildRequest) (*checkSuiteEvent, error) {
+	jwt, err := a.jwt(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var installation struct {
+		ID int64 `json:"id"`
+	}
+	u := fmt.Sprintf("%s/repos/%s/installation", a.APIURL, req.Repository)
+	if err := doJSON(ctx, http.MethodGet, u, a.header("Bearer "+jwt), nil, &installation); err != nil {
+		return nil, err
+	}
+	token, err := a.installationToken(ctx, installation.ID)
+	if err != nil {
+		return nil, err
+	}
+	sha := req.SHA
+	if sha == "" {
+		var commit struct {
+			SHA string `json:"sha"`
+		}
+		u = fmt.Sprintf("%s/repos/%s/commits/%s", a.APIURL, req.Repository, req.Branch)
+		if err := doJSON(ctx, http.MethodGet, u, a.header("token "+token), nil, &commit); err != nil {
+			return nil, err
+		}
+		sha = commit.SHA
+	}
+	ev := &checkSuiteEvent{Action: "requested"}
+	ev.CheckSuite.HeadSHA = sha
+	ev.CheckSuite.HeadBranch = req.Branch
+	ev.Repository.FullName = req.Repository
+	ev.Installation.ID = installation.ID
+	return ev, nil
+}
+
+// validSignature checks the HMAC of a webhook payload. Without a secret,
+// no payload is valid.
+func (a *GitHubApp) validSignature(body []byte, signature string) bool {
+	if len(a.WebhookSecret) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, a.WebhookSecret)
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+func (a *GitHubApp) handleCheckSuite(ctx context.Context, ev *checkSuiteEvent) error {
+	ctx, span := tracer.Start(ctx, "*GitHubApp.handleCheckSuite()")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("repository", ev.Repository.FullName),
+		attribute.String("head_sha", ev.CheckSuite.HeadSHA),
+	)
+	if err := validRepository(ev.Repository.FullName); err != nil {
+		return err
+	}
+	token, err := a.installationToken(ctx, ev.Installation.ID)
+	if err != nil {
+		return err
+	}
+	// The clone URL comes from the API, never from the payload: the
+	// installation token is only sent to the GitHub host.
+	cloneURL, err := a.cloneURL(ctx, ev.Repository.FullName, token)
+	if err != nil {
+		return err
+	}
+	repoPath, err := a.fetch(ctx, ev.Repository.FullName, cloneURL, token)
+	if err != nil {
+		return err
+	}
+	commitRange := ev.CheckSuite.HeadSHA
+	if ev.CheckSuite.Before != "" && strings.Trim(ev.CheckSuite.Before, "0") != "" {
+		commitRange = ev.CheckSuite.Before + "..." + ev.CheckSuite.HeadSHA
+	}
+	b, err := NewBareBuildContext(ctx, repoPath, a.ConfigFile, commitRange)
+	if err != nil {
+		return err
+	}
+	b.Quiet = true
+	if err := b.Diff(ctx); err != nil {
+		return err
+	}
+	for _, t := range b.Config.Targets {
+		if err := a.createCheckRun(ctx, token, ev.Repository.FullName, ev.CheckSuite.HeadSHA, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repositoryRe matches the full name of a repository, owner/repo.
+var repositoryRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+
+// validRepository checks the full name of a repository before it is joined
+// into an API URL or the path of its bare clone.
+func validRepository(fullName string) error {
+	owner, repo := path.Split(fullName)
+	if !repositoryRe.MatchString(fullName) || strings.Trim(owner, "./") == "" || strings.Trim(repo, ".") == "" {
+		return errors.Errorf("invalid repository %q, must be owner/repo", fullName)
+	}
+	return nil
+}
+
+// cloneURL returns the HTTPS clone URL of a repository, looked up with the
+// API.
+func (a *GitHubApp) cloneURL(ctx context.Context, fullName, token string) (string, error) {
+	var repo struct {
+		CloneURL string `json:"clone_url"`
+	}
+	u := fmt.Sprintf("%s/repos/%s", a.APIURL, fullName)
+	if err := doJSON(ctx, http.MethodGet, u, a.header("token "+token), nil, &repo); err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(repo.CloneURL, "https://") {
+		return "", errors.Errorf("repository %s: unexpected clone URL %q", fullName, repo.CloneURL)
+	}
+	return repo.CloneURL, nil
+}
+
+// fetch updates the bare clone of a repository and returns its path.
+func (a *GitHubApp) fetch(ctx context.Context, fullName, cloneURL, token string) (string, error) {
+	ctx, span := tracer.Start(ctx, "*GitHubApp.fetch()")
+	defer span.End()
+	a.mu.Lock()
+	if a.repos == nil {
+		a.repos = make(map[string]*sync.Mutex)
+	}
+	m, ok := a.repos[fullName]
+	if !ok {
+		m = &sync.Mutex{}
+		a.repos[fullName] = m
+	}
+	a.mu.Unlock()
+	m.Lock()
+	defer m.Unlock()
+
+	repoPath := filepath.Join(a.ReposDir, fullName+".git")
+	repo, err := git.PlainOpen(repoPath)
+	if err == git.ErrRepositoryNotExists {
+		if repo, err = git.PlainInit(repoPath, true); err != nil {
+			return "", err
+		}
+		_, err = repo.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{cloneURL}})
+	}
+	if err != nil {
+		return "", err
+	}
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []gitconfig.RefSpec{"+refs/heads/*:refs/heads/*"},
+		Auth:       &githttp.BasicAuth{Username: "x-access-token", Password: token},
+		Force:      true,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return "", errors.Errorf("fetch %s: %v", fullName, err)
+	}
+	return repoPath, nil
+}
+
+func (a *GitHubApp) createCheckRun(ctx context.Context, token, repo, headSHA string, t *Target) error {
+	run := map[string]interface{}{
+		"name":     "monobuild: " + t.Path,
+		"head_sha": headSHA,
+		"status":   "completed",
+	}
+	if reasons := t.reasons(); len(reasons) > 0 {
+		run["conclusion"] = "neutral"
+		run["output"] = map[string]string{
+			"title":   fmt.Sprintf("%s is affected", t.Path),
+			"summary": "- " + strings.Join(reasons, "\n- "),
+		}
+	} else {
+		run["conclusion"] = "skipped"
+		run["output"] = map[string]string{
+			"title":   fmt.Sprintf("%s is not affected", t.Path),
+			"summary": "No changed file affects this target.",
+		}
+	}
+	h := a.header("token " + token)
+	return doJSON(ctx, http.MethodPost, fmt.Sprintf("%s/repos/%s/check-runs", a.APIURL, repo), h, run, nil)
+}
+
+// installationToken exchanges the app JWT for an installation access token.
+func (a *GitHubApp) installationToken(ctx context.Context, installationID int64) (string, error) {
+	jwt, err := a.jwt(time.Now())
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		Token string `json:"token"`
+	}
+	u := fmt.Sprintf("%s/app/installations/%d/access_tokens", a.APIURL, installationID)
+	if err := doJSON(ctx, http.MethodPost, u, a.header("Bearer "+jwt), nil, &out); err != nil {
+		return "", err
+	}
+	return out.Token, nil
+}
+
+// jwt returns the RS256 JSON Web Token that authenticates the app.
+func (a *GitHubApp) jwt(now time.Time) (string, error) {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.AppID,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.PrivateKey, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+func (a *GitHubApp) header(authorization string) http.Header {
+	h := http.Header{}
+	h.Set("Accept", "application/vnd.github.v3+json")
+	h.Set("Authorization", authorization)
+	return h
+}
+
+func ParseRSAPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.Errorf("no PEM block found in the private key")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rk, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("the private key is not an RSA key")
+	}
+	return rk, nil
+}
@@ -0,0 +1,128 @@
+package build
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DefaultGitLabJobName is the name of the job of a target in a generated
+// GitLab child pipeline.
+const DefaultGitLabJobName = "build {{.Name}}"
+
+// DefaultGitLabJobTemplate is the job of a target in a generated GitLab
+// child pipeline.
+const DefaultGitLabJobTemplate = `stage: build
+script:
+  - "{{if .Dir}}cd {{.Dir}} && {{end}}{{.Command}}"
+`
+
+// gitLabJobData is the data of the templates of a GitLab job.
+type gitLabJobData struct {
+	Path    string // The target path, e.g. services/billing.
+	Name    string // The ID of the target: its name, else its path.
+	Command string // Shell command line of the build command, or of the steps.
+	Dir     string // Dir of the build command, empty for the root of the repository.
+}
+
+// noAffectedJob is the only job of a child pipeline without affected target,
+// as GitLab fails a pipeline without jobs.
+const noAffectedJob = "mb: no affected targets"
+
+// GitLabPipeline returns a GitLab CI config with a job per affected target,
+// for a child pipeline triggered by the parent one. The job is the YAML
+// mapping of jobTemplate, whose strings, like the job name, are templates of
+// the path, name, command and dir of the target. Only the buildable targets
+// have jobs when buildable is set.
+func (b *BuildContext) GitLabPipeline(jobName, jobTemplate string, buildable bool) ([]byte, error) {
+	tmpl := yaml.MapSlice{}
+	if err := yaml.Unmarshal([]byte(jobTemplate), &tmpl); err != nil {
+		return nil, errors.Wrap(err, "job template")
+	}
+	affected := make(map[string]bool)
+	for _, at := range b.Affected(buildable) {
+		affected[at.Path] = true
+	}
+	pipeline := yaml.MapSlice{}
+	names := make(map[string]string)
+	for _, t := range b.Config.Targets {
+		if !affected[t.Path] {
+			continue
+		}
+		data := gitLabJobData{Path: t.Path, Name: t.ID(), Command: t.commandLine(), Dir: t.BuildCommand.Dir}
+		name, err := renderTemplate(jobName, data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "job name: target %s", t.Path)
+		}
+		if other, ok := names[name]; ok {
+			return nil, errors.Errorf("job name: targets %s and %s have the same job %q", other, t.Path, name)
+		}
+		names[name] = t.Path
+		job, err := renderYAML(tmpl, data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "job template: target %s", t.Path)
+		}
+		pipeline = append(pipeline, yaml.MapItem{Key: name, Value: job})
+	}
+	if len(pipeline) == 0 {
+		pipeline = append(pipeline, yaml.MapItem{Key: noAffectedJob, Value: yaml.MapSlice{
+			{Key: "script", Value: []string{"echo No affected targets"}},
+		}})
+	}
+	return yaml.Marshal(pipeline)
+}
+
+// renderYAML executes the strings of a YAML value as templates.
+func renderYAML(v interface{}, data interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return renderTemplate(v, data)
+	case []interface{}:
+		r := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if r[i], err = renderYAML(item, data); err != nil {
+				return nil, err
+			}
+		}
+		return r, nil
+	case map[interface{}]interface{}:
+		r := make(map[interface{}]interface{}, len(v))
+		for k, item := range v {
+			rv, err := renderYAML(item, data)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%v", k)
+			}
+			r[k] = rv
+		}
+		return r, nil
+	case yaml.MapSlice:
+		r := make(yaml.MapSlice, len(v))
+		for i, item := range v {
+			rv, err := renderYAML(item.Value, data)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%v", item.Key)
+			}
+			r[i] = yaml.MapItem{Key: item.Key, Value: rv}
+		}
+		return r, nil
+	}
+	return v, nil
+}
+
+// GitLabCIRange returns the commit range of a GitLab CI pipeline from its
+// environment: the changes of the merge request, or of the push. all is true
+// when there is no range to compare, e.g. for a new branch or a scheduled
+// pipeline, and every target is affected.
+func GitLabCIRange(getenv func(string) string) (commitRange string, all bool) {
+	sha := getenv("CI_COMMIT_SHA")
+	switch {
+	case sha == "":
+	case getenv("CI_MERGE_REQUEST_DIFF_BASE_SHA") != "":
+		return fmt.Sprintf("%s...%s", getenv("CI_MERGE_REQUEST_DIFF_BASE_SHA"), sha), false
+	case getenv("CI_COMMIT_BEFORE_SHA") != "" && getenv("CI_COMMIT_BEFORE_SHA") != zeroSHA:
+		return fmt.Sprintf("%s..%s", getenv("CI_COMMIT_BEFORE_SHA"), sha), false
+	}
+	return "", true
+}
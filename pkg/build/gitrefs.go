@@ -0,0 +1,114 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PrepareGit verifies that the git history and refs required by the affected
+// targets are available, fetching them when fetch is true. Every missing
+// requirement is reported at once, before any target is built.
+func (b *BuildContext) PrepareGit(ctx context.Context, fetch bool) error {
+	ctx, span := tracer.Start(ctx, "*BuildContext.PrepareGit()")
+	defer span.End()
+	var problems []string
+	unshallowed := false
+	for _, t := range b.Config.Targets {
+		if len(t.Changes) == 0 && !b.All {
+			continue
+		}
+		if t.NeedsFullHistory && !unshallowed {
+			shallow, err := gitOutput(ctx, "rev-parse", "--is-shallow-repository")
+			if err != nil {
+				return err
+			}
+			if shallow == "true" {
+				if !fetch {
+					problems = append(problems, fmt.Sprintf("target %s needs the full git history but the clone is shallow", t.Path))
+				} else if _, err := gitOutput(ctx, "fetch", "--unshallow"); err != nil {
+					problems = append(problems, fmt.Sprintf("target %s: git fetch --unshallow: %v", t.Path, err))
+				} else {
+					unshallowed = true
+				}
+			}
+		}
+		for _, ref := range t.FetchRefs {
+			if refExists(ctx, ref) {
+				continue
+			}
+			if !fetch {
+				problems = append(problems, fmt.Sprintf("target %s needs the missing ref %s", t.Path, ref))
+				continue
+			}
+			if _, err := gitOutput(ctx, "fetch", "origin", "+"+ref+":"+ref); err != nil {
+				problems = append(problems, fmt.Sprintf("target %s: cannot fetch ref %s: %v", t.Path, ref, err))
+			} else if !refExists(ctx, ref) {
+				problems = append(problems, fmt.Sprintf("target %s: ref %s does not exist on origin", t.Path, ref))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("missing git history:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// BaseRange returns the commit range of the changes of HEAD since it forked
+// from a branch of origin, as the origin/<branch>...HEAD of a pull request:
+// <merge base>..HEAD, which does not walk the history of a shallow clone
+// again. It fetches the branch when it is missing, and the history of a
+// shallow clone when the merge base is not in it.
+func BaseRange(ctx context.Context, branch string) (string, error) {
+	ctx, span := tracer.Start(ctx, "BaseRange")
+	defer span.End()
+	branch = strings.TrimPrefix(branch, "origin/")
+	remote := "origin/" + branch
+	if !refExists(ctx, "refs/remotes/"+remote) {
+		Log.Info("fetching the base branch", "branch", remote)
+		if _, err := gitOutput(ctx, "fetch", "--no-tags", "origin", "+"+branch+":refs/remotes/"+remote); err != nil {
+			return "", errors.Wrapf(err, "cannot fetch the base branch %s", branch)
+		}
+	}
+	base, err := gitOutput(ctx, "merge-base", "HEAD", remote)
+	if err != nil {
+		if shallow, _ := gitOutput(ctx, "rev-parse", "--is-shallow-repository"); shallow != "true" {
+			return "", errors.Errorf("HEAD has no merge base with %s", remote)
+		}
+		Log.Info("fetching the history of the shallow clone to find the merge base", "branch", remote)
+		if _, err := gitOutput(ctx, "fetch", "--no-tags", "--unshallow", "origin", "+"+branch+":refs/remotes/"+remote); err != nil {
+			return "", errors.Wrap(err, "cannot fetch the history of the shallow clone")
+		}
+		if base, err = gitOutput(ctx, "merge-base", "HEAD", remote); err != nil {
+			return "", errors.Errorf("HEAD has no merge base with %s", remote)
+		}
+	}
+	Log.Debug("merge base", "branch", remote, "commit", base)
+	return base + "..HEAD", nil
+}
+
+// refExists reports whether a ref, or at least one ref matching a glob, exists.
+func refExists(ctx context.Context, ref string) bool {
+	out, err := gitOutput(ctx, "for-each-ref", "--count=1", ref)
+	return err == nil && out != ""
+}
+
+func gitOutput(ctx context.Context, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, "git", args...).CombinedOutput()
+	if err != nil {
+		return "", errors.Errorf("git %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func validateFetchRefs(t *Target) error {
+	for _, ref := range t.FetchRefs {
+		if !strings.HasPrefix(ref, "refs/") {
+			return errors.Errorf("target.fetch_refs: %s of target %s must be a full ref, e.g. refs/tags/*", ref, t.Path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// WriteGraph writes the Graphviz DOT graph of the dependencies of the
+// targets: the Go packages, the dependency directories, the watched files
+// and the watch patterns of every target, and the targets it depends on. An edge goes from a
+// dependency to the target it affects, the direction in which a change
+// propagates.
+func (b *BuildContext) WriteGraph(w io.Writer) error {
+	g := &dotGraph{nodes: make(map[string]bool)}
+	for _, t := range b.Config.Targets {
+		target := "target:" + CleanTreePath(t.Path)
+		g.node(target, t.Path, "box", "bold")
+		for _, d := range b.Config.repoDeps(t) {
+			g.node("package:"+d, d, "ellipse", "")
+			g.edge("package:"+d, target, "")
+		}
+		for _, d := range t.DepDirs {
+			if d == CleanTreePath(t.Path) {
+				continue
+			}
+			g.node("dir:"+d, d+"/", "folder", "")
+			g.edge("dir:"+d, target, "")
+		}
+		for _, f := range t.Watches {
+			f = CleanTreePath(f)
+			g.node("file:"+f, f, "note", "")
+			g.edge("file:"+f, target, "")
+		}
+		for _, f := range t.DepFiles {
+			g.node("file:"+f, f, "note", "")
+			g.edge("file:"+f, target, "")
+		}
+		for _, p := range t.WatchPattern {
+			p = CleanTreePath(p)
+			g.node("pattern:"+p, p, "note", "")
+			g.edge("pattern:"+p, target, "")
+		}
+		for _, d := range t.DependsOn {
+			g.edge("target:"+CleanTreePath(d), target, "dashed")
+		}
+	}
+	_, err := fmt.Fprintf(w, "digraph monobuild {\n\trankdir=LR;\n%s}\n", g.b.String())
+	return err
+}
+
+// repoDeps returns the sorted Go dependencies of a target that are in the
+// repository: the ones under the dep_source_dirs, or every dependency
+// outside of the standard library when there is none.
+func (c *Config) repoDeps(t *Target) []string {
+	var deps []string
+	for _, d := range t.Deps {
+		if len(c.DepSourceDirs) == 0 {
+			if strings.Contains(strings.SplitN(d, "/", 2)[0], ".") {
+				deps = append(deps, d)
+			}
+			continue
+		}
+		for _, dir := range c.DepSourceDirs {
+			if strings.Contains(d, CleanTreePath(dir)) {
+				deps = append(deps, d)
+				break
+			}
+		}
+	}
+	sort.Strings(deps)
+	return deps
+}
+
+type dotGraph struct {
+	b     strings.Builder
+	nodes map[string]bool
+}
+
+func (g *dotGraph) node(id, label, shape, style string) {
+	if g.nodes[id] {
+		return
+	}
+	g.nodes[id] = true
+	fmt.Fprintf(&g.b, "\t%q [label=%q, shape=%s", id, label, shape)
+	if style != "" {
+		fmt.Fprintf(&g.b, ", style=%s", style)
+	}
+	g.b.WriteString("];\n")
+}
+
+func (g *dotGraph) edge(from, to, style string) {
+	fmt.Fprintf(&g.b, "\t%q -> %q", from, to)
+	if style != "" {
+		fmt.Fprintf(&g.b, " [style=%s]", style)
+	}
+	g.b.WriteString(";\n")
+}
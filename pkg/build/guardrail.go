@@ -0,0 +1,96 @@
+package build
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Guardrail actions taken when a diff exceeds the configured thresholds.
+const (
+	GuardrailWarn    = "warn"    // Print a warning and build the affected targets.
+	GuardrailAll     = "all"     // Build every target, as with -all.
+	GuardrailConfirm = "confirm" // Ask for a confirmation on stdin.
+	GuardrailFail    = "fail"    // Abort the build.
+)
+
+// GuardrailConfig represents the guardrail config that protects CI from
+// pathological commit ranges, e.g. a vendored tree update.
+type GuardrailConfig struct {
+	MaxFiles   int    `yaml:"max_files"`   // 0 disables the check.
+	MaxTargets int    `yaml:"max_targets"` // 0 disables the check.
+	Action     string `yaml:"action"`      // One of warn, all, confirm or fail. Defaults to warn.
+}
+
+func (g GuardrailConfig) validate() error {
+	switch g.Action {
+	case "", GuardrailWarn, GuardrailAll, GuardrailConfirm, GuardrailFail:
+		return nil
+	}
+	return errors.Errorf("guardrail.action: %s must be one of warn, all, confirm or fail", g.Action)
+}
+
+// exceeded returns why the diff exceeds the thresholds, or an empty string.
+func (g GuardrailConfig) exceeded(files, targets int) string {
+	var reasons []string
+	if g.MaxFiles > 0 && files > g.MaxFiles {
+		reasons = append(reasons, fmt.Sprintf("%d changed files exceed max_files %d", files, g.MaxFiles))
+	}
+	if g.MaxTargets > 0 && targets > g.MaxTargets {
+		reasons = append(reasons, fmt.Sprintf("%d affected targets exceed max_targets %d", targets, g.MaxTargets))
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// ApplyGuardrail applies the guardrail policy after Diff.
+func (b *BuildContext) ApplyGuardrail(ctx context.Context) error {
+	_, span := tracer.Start(ctx, "*BuildContext.ApplyGuardrail()")
+	defer span.End()
+	g := b.Config.Guardrail
+	affected := 0
+	for _, t := range b.Config.Targets {
+		if len(t.Changes) > 0 {
+			affected++
+		}
+	}
+	reason := g.exceeded(len(b.Files), affected)
+	if reason == "" {
+		return nil
+	}
+	span.SetAttributes(attribute.String("guardrail", reason))
+	switch g.Action {
+	case GuardrailAll:
+		Log.Warn("guardrail: building all targets", "reason", reason)
+		b.All = true
+	case GuardrailConfirm:
+		if !confirm(fmt.Sprintf("guardrail: %s. Continue?", reason)) {
+			return errors.Errorf("guardrail: %s, not confirmed", reason)
+		}
+	case GuardrailFail:
+		return errors.Errorf("guardrail: %s", reason)
+	default:
+		Log.Warn("guardrail", "reason", reason)
+	}
+	return nil
+}
+
+// confirm asks a yes/no question on stdin. It answers no when stdin is not a
+// terminal or in non-interactive mode.
+func confirm(question string) bool {
+	if NonInteractive {
+		fmt.Printf("%s [y/N] no (non-interactive)\n", question)
+		return false
+	}
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,206 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CompareOptions are the thresholds of CompareRuns.
+type CompareOptions struct {
+	SlowThreshold float64       // Relative duration increase over which a build is newly slow, e.g. 0.5 for 50%.
+	MinSlowdown   time.Duration // Absolute duration increase under which a build is never newly slow.
+}
+
+// TargetChange is a target whose build changed between two runs.
+type TargetChange struct {
+	Path             string        `json:"path"`
+	Name             string        `json:"name,omitempty"`
+	Status           string        `json:"status"`
+	PreviousStatus   string        `json:"previous_status"`
+	Duration         time.Duration `json:"duration"`
+	PreviousDuration time.Duration `json:"previous_duration"`
+	PreviousRun      string        `json:"previous_run"`
+	Error            string        `json:"error,omitempty"`
+}
+
+// RunComparison is the regressions of a run against the previous builds of
+// its targets on the same branch.
+type RunComparison struct {
+	Run      string `json:"run"`
+	Branch   string `json:"branch,omitempty"`
+	Previous string `json:"previous,omitempty"` // The previous run of the branch.
+	// Failed while their previous build succeeded, with different inputs.
+	NewlyFailing []*TargetChange `json:"newly_failing"`
+	// Changed outcome with the same inputs or on the same commit.
+	NewlyFlaky []*TargetChange `json:"newly_flaky"`
+	// Succeeded both times but took longer than the thresholds allow.
+	NewlySlow []*TargetChange `json:"newly_slow"`
+	// Succeeded while their previous build failed.
+	Fixed []*TargetChange `json:"fixed"`
+}
+
+// Regressed reports whether a target is newly failing, flaky or slow.
+func (c *RunComparison) Regressed() bool {
+	return len(c.NewlyFailing)+len(c.NewlyFlaky)+len(c.NewlySlow) > 0
+}
+
+// LatestRun returns the latest run of the branch, of any branch when empty.
+func LatestRun(runs []*Run, branch string) (*Run, error) {
+	var latest *Run
+	for _, r := range runs {
+		if branch != "" && r.Branch != branch {
+			continue
+		}
+		if latest == nil || r.Time.After(latest.Time) {
+			latest = r
+		}
+	}
+	if latest == nil {
+		if branch != "" {
+			return nil, errors.Errorf("no run of branch %s", branch)
+		}
+		return nil, errors.Errorf("no run recorded")
+	}
+	return latest, nil
+}
+
+// CompareRuns compares the targets of a run with their previous build on
+// the same branch: the build of the latest earlier run of the branch that
+// built the target, since a run only builds the affected targets.
+func CompareRuns(runs []*Run, run *Run, opts CompareOptions) *RunComparison {
+	c := &RunComparison{Run: run.ID, Branch: run.Branch}
+	var earlier []*Run
+	for _, r := range runs {
+		if r.ID != run.ID && r.Branch == run.Branch && r.Time.Before(run.Time) {
+			earlier = append(earlier, r)
+		}
+	}
+	// Latest first.
+	sort.Slice(earlier, func(i, j int) bool { return earlier[i].Time.After(earlier[j].Time) })
+	if len(earlier) > 0 {
+		c.Previous = earlier[0].ID
+	}
+	for _, rt := range run.Targets {
+		if rt.Status == "" || rt.Status == RunCancelled {
+			continue // Interrupted.
+		}
+		prev, prevRun := previousBuild(earlier, rt.ID())
+		if prev == nil {
+			continue
+		}
+		tc := &TargetChange{
+			Path:             rt.Path,
+			Name:             rt.Name,
+			Status:           rt.Status,
+			PreviousStatus:   prev.Status,
+			Duration:         rt.Duration,
+			PreviousDuration: prev.Duration,
+			PreviousRun:      prevRun.ID,
+			Error:            rt.Error,
+		}
+		sameInputs := (rt.Inputs != "" && rt.Inputs == prev.Inputs) || (run.Commit != "" && run.Commit == prevRun.Commit)
+		switch {
+		case rt.Status != prev.Status && sameInputs:
+			c.NewlyFlaky = append(c.NewlyFlaky, tc)
+		case rt.Status == RunFailure && prev.Status == RunSuccess:
+			c.NewlyFailing = append(c.NewlyFailing, tc)
+		case rt.Status == RunSuccess && prev.Status == RunFailure:
+			c.Fixed = append(c.Fixed, tc)
+		case rt.Status == RunSuccess && prev.Status == RunSuccess && slower(rt.Duration, prev.Duration, opts):
+			c.NewlySlow = append(c.NewlySlow, tc)
+		}
+	}
+	return c
+}
+
+// previousBuild returns the latest finished build of a target, by ID, in the
+// runs, latest first.
+func previousBuild(runs []*Run, id string) (*RunTarget, *Run) {
+	for _, r := range runs {
+		for _, rt := range r.Targets {
+			if rt.ID() == id && rt.Status != "" && rt.Status != RunCancelled {
+				return rt, r
+			}
+		}
+	}
+	return nil, nil
+}
+
+func slower(d, prev time.Duration, opts CompareOptions) bool {
+	if prev <= 0 || d-prev < opts.MinSlowdown {
+		return false
+	}
+	return float64(d-prev)/float64(prev) > opts.SlowThreshold
+}
+
+// Write renders the comparison as text, json or markdown, the latter for PR
+// comments.
+func (c *RunComparison) Write(w io.Writer, format string) error {
+	sections := []struct {
+		title   string
+		changes []*TargetChange
+	}{
+		{"Newly failing", c.NewlyFailing},
+		{"Newly flaky", c.NewlyFlaky},
+		{"Newly slow", c.NewlySlow},
+		{"Fixed", c.Fixed},
+	}
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	case "text":
+		fmt.Fprintf(w, "run %s compared with the previous builds of branch %s\n", c.Run, c.Branch)
+		for _, s := range sections {
+			if len(s.changes) == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "%s:\n", strings.ToUpper(s.title))
+			for _, tc := range s.changes {
+				fmt.Fprintf(w, "  %s\n", tc.describe())
+			}
+		}
+		if !c.Regressed() {
+			fmt.Fprintln(w, "no regression")
+		}
+		return nil
+	case "markdown":
+		fmt.Fprintf(w, "### monobuild: run `%s` compared with the previous builds of `%s`\n\n", c.Run, c.Branch)
+		for _, s := range sections {
+			if len(s.changes) == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "**%s**\n\n", s.title)
+			for _, tc := range s.changes {
+				fmt.Fprintf(w, "- %s\n", tc.describe())
+			}
+			fmt.Fprintln(w)
+		}
+		if !c.Regressed() {
+			fmt.Fprintln(w, ":white_check_mark: No regression.")
+		}
+		return nil
+	}
+	return errors.Errorf("unknown format %q", format)
+}
+
+// describe returns a line of the change, e.g. "cmd/server: success in
+// 1m2s, was success in 30s (run ...)".
+func (tc *TargetChange) describe() string {
+	s := fmt.Sprintf("%s: %s in %s, was %s in %s (run %s)", tc.Path,
+		tc.Status, tc.Duration.Round(time.Millisecond), tc.PreviousStatus, tc.PreviousDuration.Round(time.Millisecond), tc.PreviousRun)
+	if tc.Error != "" {
+		s += ": " + tc.Error
+	}
+	return s
+}
@@ -0,0 +1,153 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The stages of the hooks.
+const (
+	HookBefore    = "before"
+	HookAfter     = "after"
+	HookOnFailure = "on_failure"
+)
+
+// Hooks represents the commands run around a build, e.g. to log in to a
+// registry, to warm up a cache or to send a notification. The hooks of the
+// config run once per run, the ones of a target around each of its builds.
+//
+// The hooks run with the environment of the build, MB_STATUS set to success
+// or failure for the after and on_failure hooks, and MB_TARGET set to the
+// path of the target for the hooks of a target.
+type Hooks struct {
+	Before    []BuildCommand `yaml:"before"`     // Run before the build. A failed hook fails the build.
+	After     []BuildCommand `yaml:"after"`      // Run after the build, whether it failed or not.
+	OnFailure []BuildCommand `yaml:"on_failure"` // Run after a failed build, before the after hooks.
+}
+
+// stages returns the hooks by stage, in the order they run.
+func (h Hooks) stages() [][]BuildCommand {
+	return [][]BuildCommand{h.Before, h.OnFailure, h.After}
+}
+
+func (h Hooks) validate() error {
+	for i, hooks := range h.stages() {
+		stage := []string{HookBefore, HookOnFailure, HookAfter}[i]
+		for j, c := range hooks {
+			if strings.TrimSpace(c.Command) == "" {
+				return errors.Errorf("hooks.%s: hook %d has no command", stage, j+1)
+			}
+			if err := validateTimeout(c.Timeout); err != nil {
+				return errors.Errorf("hooks.%s.timeout: hook %s: %v", stage, c.Command, err)
+			}
+			for k := range c.Env {
+				if !envKeyRe.MatchString(k) {
+					return errors.Errorf("hooks.%s.env: %q of hook %s is not a valid variable name", stage, k, c.Command)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// check returns an error if the policy forbids a hook.
+func (h Hooks) check(p PolicyConfig) error {
+	for _, hooks := range h.stages() {
+		for _, c := range hooks {
+			if err := p.check(c); err != nil {
+				return errors.Wrap(err, "hooks")
+			}
+		}
+	}
+	return nil
+}
+
+// runHooks runs the hooks of a stage of the target in order, up to the first
+// failed one. Their output is rendered as the build output of the target.
+func (t *Target) runHooks(ctx context.Context, stage string, hooks []BuildCommand, vars map[string]string) error {
+	r := t.renderer
+	if r == nil {
+		r = prettyRenderer{}
+	}
+	base := t.env
+	if base == nil {
+		base = os.Environ()
+	}
+	base = setEnv(base, vars)
+	for _, c := range hooks {
+		env, err := c.environ(base)
+		if err != nil {
+			return errors.Wrapf(err, "%s hook %s", stage, c.Command)
+		}
+		msg := fmt.Sprintf("HOOK %s OF %s: %s", stage, t.Path, c.Command)
+		if t.configHooks {
+			msg = fmt.Sprintf("HOOK %s: %s", stage, c.Command)
+		}
+		outputMu.Lock()
+		r.Info(t.stdout(), msg)
+		outputMu.Unlock()
+		if err := t.runCommand(ctx, &c, env, r); err != nil {
+			return errors.Wrapf(err, "%s hook %s", stage, c.Command)
+		}
+	}
+	return nil
+}
+
+// hookStatus returns the MB_STATUS of the after and on_failure hooks.
+func hookStatus(err error) string {
+	switch {
+	case cancelled(err):
+		return RunCancelled
+	case err != nil:
+		return RunFailure
+	}
+	return RunSuccess
+}
+
+// withHooks runs build between the hooks of the target, with vars set in
+// their environment: build is only called when the before hooks succeed. A
+// failed after or on_failure hook is a warning, it does not change the
+// result of the build. The after and on_failure hooks of a cancelled build
+// still run, e.g. to clean up.
+func (t *Target) withHooks(ctx context.Context, vars map[string]string, build func() error) error {
+	h := t.Hooks
+	err := t.runHooks(ctx, HookBefore, h.Before, vars)
+	if err == nil {
+		err = build()
+	}
+	if cancelled(err) {
+		ctx = context.Background()
+	}
+	vars["MB_STATUS"] = hookStatus(err)
+	if err != nil {
+		if herr := t.runHooks(ctx, HookOnFailure, h.OnFailure, vars); herr != nil {
+			t.warn(herr.Error())
+		}
+	}
+	if herr := t.runHooks(ctx, HookAfter, h.After, vars); herr != nil {
+		t.warn(herr.Error())
+	}
+	return err
+}
+
+// warn renders a warning in the build output of the target.
+func (t *Target) warn(msg string) {
+	r := t.renderer
+	if r == nil {
+		r = prettyRenderer{}
+	}
+	if !t.configHooks {
+		msg = fmt.Sprintf("target %s: %s", t.Path, msg)
+	}
+	r.Warn(t.stdout(), msg)
+}
+
+// hooksTarget returns the pseudo target the hooks of the config run as,
+// whose output is rendered as the build output of a target named hooks.
+func (b *BuildContext) hooksTarget(env []string) *Target {
+	return &Target{Path: "hooks", Hooks: b.Config.Hooks, env: env, policy: b.Config.Policy, renderer: b.renderer(), configHooks: true, timeout: b.Config.defaultTimeout(), outputLimit: b.Config.OutputLimit}
+}
@@ -0,0 +1,267 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// ImportedTarget is a target converted from the path filter of a CI system.
+// It has no analyzer: the patterns of the filter are its watch patterns.
+type ImportedTarget struct {
+	Path         string            `yaml:"path"`
+	Analyzer     string            `yaml:"analyzer"`
+	Labels       map[string]string `yaml:"labels,omitempty"`
+	WatchPattern []string          `yaml:"watch_pattern"`
+	BuildCommand *ImportedCommand  `yaml:"build_command,omitempty"`
+}
+
+// ImportedCommand is the build command of an imported target.
+type ImportedCommand struct {
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args,omitempty"`
+}
+
+// Import is the result of the conversion of CI path filters.
+type Import struct {
+	Targets  []*ImportedTarget `yaml:"targets"`
+	Warnings []string          `yaml:"-"` // The patterns that could not be converted exactly.
+}
+
+// ImportGitHubPathsFilter converts the path filters of a GitHub Actions
+// workflow into targets: the `paths` of its push and pull_request triggers,
+// and the filters of its dorny/paths-filter steps.
+func ImportGitHubPathsFilter(workflow string) (*Import, error) {
+	b, err := ioutil.ReadFile(workflow)
+	if err != nil {
+		return nil, err
+	}
+	var wf struct {
+		On   interface{} `yaml:"on"`
+		Jobs map[string]struct {
+			Steps []struct {
+				Uses string                 `yaml:"uses"`
+				With map[string]interface{} `yaml:"with"`
+			} `yaml:"steps"`
+		} `yaml:"jobs"`
+	}
+	if err := yaml.Unmarshal(b, &wf); err != nil {
+		return nil, errors.Errorf("%s: %v", workflow, err)
+	}
+	imp := &Import{}
+	name := strings.TrimSuffix(filepath.Base(workflow), filepath.Ext(workflow))
+	if on, ok := wf.On.(map[interface{}]interface{}); ok {
+		var patterns []string
+		for _, event := range []string{"push", "pull_request"} {
+			if e, ok := on[event].(map[interface{}]interface{}); ok {
+				patterns = append(patterns, stringList(e["paths"])...)
+			}
+		}
+		imp.add("workflow", name, patterns, nil)
+	}
+	jobs := make([]string, 0, len(wf.Jobs))
+	for j := range wf.Jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Strings(jobs)
+	for _, j := range jobs {
+		for _, s := range wf.Jobs[j].Steps {
+			if !strings.HasPrefix(s.Uses, "dorny/paths-filter@") {
+				continue
+			}
+			filters, _ := s.With["filters"].(string)
+			// The filters are inline YAML or the path of a YAML file.
+			if f := strings.TrimSpace(filters); !strings.Contains(f, "\n") && (strings.HasSuffix(f, ".yml") || strings.HasSuffix(f, ".yaml")) {
+				fb, err := ioutil.ReadFile(f)
+				if err != nil {
+					return nil, errors.Errorf("%s: job %s: %v", workflow, j, err)
+				}
+				filters = string(fb)
+			}
+			fm := yaml.MapSlice{}
+			if err := yaml.Unmarshal([]byte(filters), &fm); err != nil {
+				return nil, errors.Errorf("%s: job %s: paths-filter filters: %v", workflow, j, err)
+			}
+			for _, f := range fm {
+				imp.add("paths_filter", fmt.Sprint(f.Key), stringList(f.Value), nil)
+			}
+		}
+	}
+	return imp, nil
+}
+
+// ImportGitLabRules converts the jobs of a GitLab CI config that run on
+// `rules:changes` or `only:changes` into targets, built by the job script.
+func ImportGitLabRules(config string) (*Import, error) {
+	b, err := ioutil.ReadFile(config)
+	if err != nil {
+		return nil, err
+	}
+	jobs := yaml.MapSlice{}
+	if err := yaml.Unmarshal(b, &jobs); err != nil {
+		return nil, errors.Errorf("%s: %v", config, err)
+	}
+	imp := &Import{}
+	for _, item := range jobs {
+		name := fmt.Sprint(item.Key)
+		var job struct {
+			Script interface{} `yaml:"script"`
+			Rules  []struct {
+				Changes interface{} `yaml:"changes"`
+			} `yaml:"rules"`
+			Only struct {
+				Changes interface{} `yaml:"changes"`
+			} `yaml:"only"`
+		}
+		// The global keywords and the hidden jobs are not jobs.
+		jb, err := yaml.Marshal(item.Value)
+		if err != nil || strings.HasPrefix(name, ".") || yaml.Unmarshal(jb, &job) != nil {
+			continue
+		}
+		var patterns []string
+		for _, r := range job.Rules {
+			patterns = append(patterns, changesPatterns(r.Changes)...)
+		}
+		patterns = append(patterns, changesPatterns(job.Only.Changes)...)
+		var cmd *ImportedCommand
+		if script := stringList(job.Script); len(script) > 0 {
+			cmd = &ImportedCommand{Command: "sh", Args: []string{"-c", strings.Join(script, "\n")}}
+		}
+		imp.add("ci_job", name, patterns, cmd)
+	}
+	return imp, nil
+}
+
+// changesPatterns returns the patterns of a GitLab `changes`, either a list
+// or a map with `paths`.
+func changesPatterns(changes interface{}) []string {
+	if m, ok := changes.(map[interface{}]interface{}); ok {
+		return stringList(m["paths"])
+	}
+	return stringList(changes)
+}
+
+// stringList returns the strings of a YAML list, flattening the nested lists
+// and the values of the maps, e.g. the `added: pattern` of paths-filter.
+func stringList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var items []string
+		for _, i := range v {
+			items = append(items, stringList(i)...)
+		}
+		return items
+	case map[interface{}]interface{}:
+		var items []string
+		for _, i := range v {
+			items = append(items, stringList(i)...)
+		}
+		sort.Strings(items)
+		return items
+	case yaml.MapSlice:
+		var items []string
+		for _, i := range v {
+			items = append(items, stringList(i.Value)...)
+		}
+		return items
+	}
+	return nil
+}
+
+// add converts the patterns of a filter into a target, labeled with the name
+// of the filter and merged with the imported target of the same path. The
+// path of the target is the directory of the first pattern named like the
+// filter, or of the first pattern.
+func (imp *Import) add(label, name string, patterns []string, cmd *ImportedCommand) {
+	from := label + " " + name
+	var watches []string
+	for _, p := range patterns {
+		negated := strings.HasPrefix(p, "!")
+		if negated && len(watches) == 0 {
+			imp.Warnings = append(imp.Warnings, fmt.Sprintf("%s: the negated pattern %s excludes no file, it is ignored", from, p))
+			continue
+		}
+		w, warning := watchPattern(strings.TrimPrefix(p, "!"))
+		if warning != "" {
+			imp.Warnings = append(imp.Warnings, from+": "+warning)
+		}
+		if negated {
+			w = "!" + w
+		}
+		watches = append(watches, w)
+	}
+	if len(watches) == 0 {
+		return
+	}
+	dir := staticDir(watches[0])
+	for _, w := range watches {
+		if d := staticDir(w); path.Base(d) == name && !strings.HasPrefix(w, "!") {
+			dir = d
+			break
+		}
+	}
+	for _, t := range imp.Targets {
+		if t.Path != dir {
+			continue
+		}
+		imp.Warnings = append(imp.Warnings, fmt.Sprintf("%s: merged into the target %s", from, dir))
+		if t.Labels[label] != "" {
+			name = t.Labels[label] + "," + name
+		}
+		t.Labels[label] = name
+		for _, w := range watches {
+			if !contains(t.WatchPattern, w) {
+				t.WatchPattern = append(t.WatchPattern, w)
+			}
+		}
+		if t.BuildCommand == nil {
+			t.BuildCommand = cmd
+		}
+		return
+	}
+	imp.Targets = append(imp.Targets, &ImportedTarget{
+		Path:         dir,
+		Analyzer:     AnalyzerNone,
+		Labels:       map[string]string{label: name},
+		WatchPattern: watches,
+		BuildCommand: cmd,
+	})
+}
+
+// staticDir returns the directory of a pattern before its first wildcard,
+// "." when the pattern starts with one.
+func staticDir(pattern string) string {
+	var dirs []string
+	parts := strings.Split(pattern, "/")
+	for i, p := range parts {
+		if strings.ContainsAny(p, "*?[{") || i == len(parts)-1 {
+			break
+		}
+		dirs = append(dirs, p)
+	}
+	if len(dirs) == 0 {
+		return "."
+	}
+	return path.Join(dirs...)
+}
+
+// watchPattern converts a path filter pattern into a watch pattern. The
+// warning explains an inexact conversion.
+func watchPattern(pattern string) (string, string) {
+	pattern = strings.TrimPrefix(pattern, "./")
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+	if strings.Contains(pattern, "{") {
+		return pattern, fmt.Sprintf("the braces of %s are not supported by watch_pattern", pattern)
+	}
+	return pattern, ""
+}
@@ -0,0 +1,189 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// includeConfigs merges the config fragments matching the include patterns
+// of a config file into it, recursively. The patterns and paths of the
+// fragments are relative to the repository root, like those of the config
+// file, but a target of a fragment without a path is the directory of the
+// fragment, e.g. services/foo/monobuild.yaml. The lists are concatenated and
+// a target, a directory or a setting defined twice is an error. It returns
+// the merged config and the names of the fragments.
+func includeConfigs(ctx context.Context, fb []byte, configFile string, readFile func(string) ([]byte, error), glob func(string) ([]string, error)) ([]byte, []string, error) {
+	var doc map[interface{}]interface{}
+	if err := yaml.Unmarshal(fb, &doc); err != nil {
+		return nil, nil, errors.Wrap(err, configFile)
+	}
+	if _, ok := doc["include"]; !ok {
+		return fb, nil, nil
+	}
+	m := &configMerge{
+		doc:      doc,
+		origin:   make(map[string]string),
+		visited:  map[string]bool{CleanTreePath(configFile): true},
+		readFile: readFile,
+		glob:     glob,
+	}
+	m.record(doc, configFile)
+	if err := m.include(ctx, doc, configFile); err != nil {
+		return nil, nil, err
+	}
+	merged, err := yaml.Marshal(m.doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return merged, m.files, nil
+}
+
+type configMerge struct {
+	doc      map[interface{}]interface{}
+	origin   map[string]string // The file defining a setting, a target or a directory.
+	visited  map[string]bool
+	files    []string
+	readFile func(string) ([]byte, error)
+	glob     func(string) ([]string, error)
+}
+
+// include merges the fragments included by a config file or a fragment.
+func (m *configMerge) include(ctx context.Context, doc map[interface{}]interface{}, file string) error {
+	for _, p := range stringList(doc["include"]) {
+		names, err := m.glob(p)
+		if err != nil {
+			return errors.Wrapf(err, "%s: include %s", file, p)
+		}
+		if len(names) == 0 && !hasMeta(p) {
+			return errors.Errorf("%s: include %s: no such file", file, p)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			name = CleanTreePath(name)
+			if m.visited[name] {
+				continue
+			}
+			m.visited[name] = true
+			if err := m.merge(ctx, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// merge merges a fragment, then the fragments it includes.
+func (m *configMerge) merge(ctx context.Context, name string) error {
+	b, err := m.readFile(name)
+	if err != nil {
+		return err
+	}
+	if b, err = decryptConfig(ctx, b); err != nil {
+		return errors.Wrap(err, name)
+	}
+	var frag map[interface{}]interface{}
+	if err := yaml.Unmarshal(b, &frag); err != nil {
+		return errors.Wrap(err, name)
+	}
+	m.files = append(m.files, name)
+	if targets, ok := frag["targets"].([]interface{}); ok {
+		for _, t := range targets {
+			if tm, ok := t.(map[interface{}]interface{}); ok && tm["path"] == nil {
+				tm["path"] = path.Dir(name)
+			}
+		}
+	}
+	if err := m.check(frag, name); err != nil {
+		return err
+	}
+	m.record(frag, name)
+	for k, v := range frag {
+		if k == "include" {
+			continue
+		}
+		switch v := v.(type) {
+		case []interface{}:
+			l, _ := m.doc[k].([]interface{})
+			for _, item := range v {
+				if !containsItem(l, item) {
+					l = append(l, item)
+				}
+			}
+			m.doc[k] = l
+		default:
+			m.doc[k] = v
+		}
+	}
+	return m.include(ctx, frag, name)
+}
+
+// check detects the targets, directories and settings of a fragment that
+// are already defined.
+func (m *configMerge) check(frag map[interface{}]interface{}, name string) error {
+	for k, v := range frag {
+		if k == "include" {
+			continue
+		}
+		if l, ok := v.([]interface{}); ok {
+			for _, item := range l {
+				key := fmt.Sprintf("%v %v", k, itemPath(item))
+				if itemPath(item) == nil {
+					continue
+				}
+				if o, ok := m.origin[key]; ok {
+					return errors.Errorf("%s: %s: %v is already defined in %s", name, k, itemPath(item), o)
+				}
+			}
+			continue
+		}
+		key := fmt.Sprint(k)
+		if o, ok := m.origin[key]; ok && !reflect.DeepEqual(m.doc[k], v) {
+			return errors.Errorf("%s: %s is already set in %s", name, k, o)
+		}
+	}
+	return nil
+}
+
+// record records the file defining the items with a path and the other
+// settings of a config.
+func (m *configMerge) record(doc map[interface{}]interface{}, name string) {
+	for k, v := range doc {
+		if l, ok := v.([]interface{}); ok {
+			for _, item := range l {
+				if itemPath(item) != nil {
+					m.origin[fmt.Sprintf("%v %v", k, itemPath(item))] = name
+				}
+			}
+			continue
+		}
+		if _, ok := m.origin[fmt.Sprint(k)]; !ok {
+			m.origin[fmt.Sprint(k)] = name
+		}
+	}
+}
+
+func containsItem(l []interface{}, item interface{}) bool {
+	for _, i := range l {
+		if reflect.DeepEqual(i, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMeta reports whether a path is a glob pattern.
+func hasMeta(p string) bool {
+	for _, c := range p {
+		switch c {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
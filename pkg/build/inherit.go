@@ -0,0 +1,120 @@
+package build
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// DirectoryConfig represents the settings shared by every target under a
+// directory, e.g. services/. Targets inherit them unless they override them.
+type DirectoryConfig struct {
+	Path         string            `yaml:"path"`
+	BuildCommand BuildCommand      `yaml:"build_command"` // Inherited when the target has no build command nor steps.
+	Steps        []*Step           `yaml:"steps"`         // Inherited when the target has no build command nor steps.
+	Env          map[string]string `yaml:"env"`           // Merged under the env of the target commands, which wins.
+	EnvFiles     []string          `yaml:"env_files"`     // Prepended to the target env files, which override them.
+	WatchPattern []string          `yaml:"watch_pattern"` // Prepended to the target watch patterns.
+	Labels       map[string]string `yaml:"labels"`        // Merged, the target labels win.
+	Protected    bool              `yaml:"protected"`     // Protects every target under the directory.
+}
+
+// contains reports whether the target path is under the directory.
+func (d *DirectoryConfig) contains(targetPath string) bool {
+	dir := CleanTreePath(d.Path)
+	p := CleanTreePath(targetPath)
+	return dir == "." || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// applyDirectories merges the directory settings into the targets, from the
+// outermost directory to the innermost one, before the target's own settings.
+func (c *Config) applyDirectories() {
+	if len(c.Directories) == 0 {
+		return
+	}
+	dirs := make([]*DirectoryConfig, len(c.Directories))
+	copy(dirs, c.Directories)
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return depth(dirs[i].Path) < depth(dirs[j].Path)
+	})
+	for _, t := range c.Targets {
+		var (
+			cmd      BuildCommand
+			steps    []*Step
+			watches  []string
+			envFiles []string
+			env      = make(map[string]string)
+			labels   = make(map[string]string)
+		)
+		for _, d := range dirs {
+			if !d.contains(t.Path) {
+				continue
+			}
+			// The innermost build command or steps win.
+			if len(d.Steps) > 0 {
+				cmd, steps = BuildCommand{}, d.Steps
+			} else if d.BuildCommand.defined() {
+				cmd, steps = d.BuildCommand, nil
+			}
+			envFiles = append(envFiles, d.EnvFiles...)
+			watches = append(watches, d.WatchPattern...)
+			for k, v := range d.Env {
+				env[k] = v
+			}
+			for k, v := range d.Labels {
+				labels[k] = v
+			}
+			t.Protected = t.Protected || d.Protected
+		}
+		if !t.buildable() {
+			t.BuildCommand = cmd
+			// Each target gets its own steps, which are modified by the
+			// overrides and the env of the directories.
+			for _, s := range steps {
+				t.Steps = append(t.Steps, s.clone())
+			}
+		}
+		if len(env) > 0 {
+			for _, c := range []*BuildCommand{&t.BuildCommand, &t.TestCommand} {
+				if c.defined() {
+					c.Env = mergeEnv(env, c.Env)
+				}
+			}
+			if len(t.Steps) > 0 {
+				for _, s := range t.commandSteps() {
+					s.Env = mergeEnv(env, s.Env)
+				}
+			}
+		}
+		if len(envFiles) > 0 {
+			t.EnvFiles = append(envFiles, t.EnvFiles...)
+		}
+		t.WatchPattern = append(watches, t.WatchPattern...)
+		for k, v := range t.Labels {
+			labels[k] = v
+		}
+		if len(labels) > 0 {
+			t.Labels = labels
+		}
+	}
+}
+
+// mergeEnv returns the variables of env, over the ones of the directories.
+func mergeEnv(dirs, env map[string]string) map[string]string {
+	merged := make(map[string]string, len(dirs)+len(env))
+	for k, v := range dirs {
+		merged[k] = v
+	}
+	for k, v := range env {
+		merged[k] = v
+	}
+	return merged
+}
+
+func depth(p string) int {
+	p = CleanTreePath(p)
+	if p == "." {
+		return 0
+	}
+	return strings.Count(path.Clean(p), "/") + 1
+}
@@ -0,0 +1,53 @@
+package build
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// InjectFailures makes the builds of affected targets fail without running
+// them, for the platform teams to test how their pipelines handle failures,
+// e.g. the notifications, the retries and the summaries, without breaking a
+// service. A target fails when one of the selectors, target=<name or path>,
+// selects it, or at random with the probability rate. The hooks of a target
+// still run, and its failure is recorded as any other.
+func (b *BuildContext) InjectFailures(selectors []string, rate float64) error {
+	if rate < 0 || rate > 1 {
+		return errors.Errorf("inject-failure-rate: %v is not between 0 and 1", rate)
+	}
+	for _, s := range selectors {
+		if !strings.HasPrefix(s, "target=") {
+			return errors.Errorf("inject-failure: %q is not target=<name or path>", s)
+		}
+		sel := strings.TrimPrefix(s, "target=")
+		t := b.Config.Target(sel)
+		if t == nil {
+			return b.Config.noTarget("inject-failure", sel)
+		}
+		if len(t.Changes) == 0 && !b.All {
+			Log.Warn("the target is not affected, no failure is injected", "target", t.Path)
+		}
+		t.inject = true
+	}
+	if rate > 0 {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for _, t := range b.Config.Targets {
+			if r.Float64() < rate {
+				t.inject = true
+			}
+		}
+	}
+	var injected []string
+	for _, t := range b.Config.Targets {
+		if t.inject && (len(t.Changes) > 0 || b.All) {
+			injected = append(injected, t.Path)
+		}
+	}
+	if len(injected) > 0 {
+		Log.Warn("injecting failures", "targets", strings.Join(injected, ","))
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package build
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReportJUnit is the format of the JUnit XML report of a run, which CI
+// systems such as Jenkins, GitLab and CircleCI show as test results.
+const ReportJUnit = "junit"
+
+// Report is a report of the run written to a file.
+type Report struct {
+	Format string // junit.
+	Path   string
+}
+
+// ParseReport parses <format>=<path>, e.g. junit=mb-report.xml.
+func ParseReport(s string) (Report, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return Report{}, errors.Errorf("report %q: must be <format>=<path>, e.g. junit=mb-report.xml", s)
+	}
+	if kv[0] != ReportJUnit {
+		return Report{}, errors.Errorf("report %q: unknown format %s, must be junit", s, kv[0])
+	}
+	return Report{Format: kv[0], Path: kv[1]}, nil
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name          `xml:"testsuites"`
+	Name     string            `xml:"name,attr"`
+	Tests    int               `xml:"tests,attr"`
+	Failures int               `xml:"failures,attr"`
+	Skipped  int               `xml:"skipped,attr"`
+	Time     string            `xml:"time,attr"`
+	Suites   []*junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string           `xml:"name,attr"`
+	Tests     int              `xml:"tests,attr"`
+	Failures  int              `xml:"failures,attr"`
+	Skipped   int              `xml:"skipped,attr"`
+	Time      string           `xml:"time,attr"`
+	Timestamp string           `xml:"timestamp,attr"`
+	Cases     []*junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemErr *junitText    `xml:"system-err,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",cdata"`
+}
+
+type junitText struct {
+	Text string `xml:",cdata"`
+}
+
+// junitReport returns the JUnit report of a run: a test case per target of
+// the config, by ID, failed, skipped with the reason, or passed, with the
+// duration and the stderr of its build.
+func (b *BuildContext) junitReport(run *Run) *junitTestSuites {
+	built := make(map[string]*RunTarget)
+	for _, rt := range run.Targets {
+		built[rt.Path] = rt
+	}
+	suite := &junitTestSuite{Name: "monobuild", Timestamp: run.Time.Format(time.RFC3339)}
+	var total time.Duration
+	for _, t := range b.Config.Targets {
+		tc := &junitTestCase{Name: t.ID(), Classname: "monobuild", Time: "0"}
+		rt, ok := built[t.Path]
+		switch {
+		case !ok:
+			reason := t.skipped
+			if reason == "" {
+				reason = "not built: the run stopped before"
+			}
+			tc.Skipped = &junitMessage{Message: reason}
+		case rt.Status == RunCancelled:
+			tc.Skipped = &junitMessage{Message: RunCancelled}
+		case rt.Status == RunFailure:
+			tc.Failure = &junitMessage{Message: rt.Error, Text: t.BuildCommand.Error}
+		}
+		if ok {
+			tc.Time = junitSeconds(rt.Duration)
+			if t.BuildCommand.Error != "" {
+				tc.SystemErr = &junitText{Text: t.BuildCommand.Error}
+			}
+			total += rt.Duration
+		}
+		switch {
+		case tc.Failure != nil:
+			suite.Failures++
+		case tc.Skipped != nil:
+			suite.Skipped++
+		}
+		suite.Tests++
+		suite.Cases = append(suite.Cases, tc)
+	}
+	suite.Time = junitSeconds(total)
+	return &junitTestSuites{
+		Name:     "monobuild",
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Skipped:  suite.Skipped,
+		Time:     suite.Time,
+		Suites:   []*junitTestSuite{suite},
+	}
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// writeReports writes the reports of a run. A failure to write one is a
+// warning, as for the markdown summary.
+func (b *BuildContext) writeReports(run *Run) {
+	for _, r := range b.Reports {
+		out, err := xml.MarshalIndent(b.junitReport(run), "", "  ")
+		if err == nil {
+			if err = os.MkdirAll(filepath.Dir(r.Path), 0755); err == nil {
+				err = ioutil.WriteFile(r.Path, append([]byte(xml.Header), append(out, '\n')...), 0644)
+			}
+		}
+		if err != nil {
+			b.renderer().Warn(os.Stdout, fmt.Sprintf("cannot write the %s report %s: %v", r.Format, r.Path, err))
+		}
+	}
+}
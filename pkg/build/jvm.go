@@ -0,0 +1,262 @@
+package build
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// mavenAnalyzer follows the dependencies of a Maven module on the other
+// modules of its reactor, the outermost directory with a pom.xml above it.
+type mavenAnalyzer struct{}
+
+type pomProject struct {
+	GroupID    string `xml:"groupId"`
+	ArtifactID string `xml:"artifactId"`
+	Parent     struct {
+		GroupID      string  `xml:"groupId"`
+		RelativePath *string `xml:"relativePath"`
+	} `xml:"parent"`
+	Modules      []string `xml:"modules>module"`
+	Dependencies []pomDep `xml:"dependencies>dependency"`
+	Profiles     []struct {
+		Modules      []string `xml:"modules>module"`
+		Dependencies []pomDep `xml:"dependencies>dependency"`
+	} `xml:"profiles>profile"`
+}
+
+type pomDep struct {
+	GroupID    string `xml:"groupId"`
+	ArtifactID string `xml:"artifactId"`
+}
+
+func (p *pomProject) groupID() string {
+	if p.GroupID != "" {
+		return p.GroupID
+	}
+	return p.Parent.GroupID
+}
+
+func (p *pomProject) modules() []string {
+	modules := p.Modules
+	for _, pr := range p.Profiles {
+		modules = append(modules, pr.Modules...)
+	}
+	return modules
+}
+
+func (p *pomProject) dependencies() []string {
+	deps := p.Dependencies
+	for _, pr := range p.Profiles {
+		deps = append(deps, pr.Dependencies...)
+	}
+	var coords []string
+	for _, d := range deps {
+		g := strings.NewReplacer("${project.groupId}", p.groupID(), "${project.parent.groupId}", p.Parent.GroupID).Replace(d.GroupID)
+		coords = append(coords, g+":"+d.ArtifactID)
+	}
+	return coords
+}
+
+func readPom(dir string) (*pomProject, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "pom.xml"))
+	if err != nil {
+		return nil, err
+	}
+	p := &pomProject{}
+	if err := xml.Unmarshal(b, p); err != nil {
+		return nil, errors.Errorf("%s: %v", filepath.Join(dir, "pom.xml"), err)
+	}
+	return p, nil
+}
+
+func (mavenAnalyzer) Analyze(ctx context.Context, t *Target) error {
+	root := filepath.Clean(t.Path)
+	for root != "." && fileExists(filepath.Join(filepath.Dir(root), "pom.xml")) {
+		root = filepath.Dir(root)
+	}
+	poms := make(map[string]*pomProject) // Module directory to pom.
+	modules := make(map[string]string)   // groupId:artifactId to module directory.
+	var load func(dir string) error
+	load = func(dir string) error {
+		dir = filepath.Clean(dir)
+		if _, ok := poms[dir]; ok {
+			return nil
+		}
+		p, err := readPom(dir)
+		if err != nil {
+			return err
+		}
+		poms[dir] = p
+		modules[p.groupID()+":"+p.ArtifactID] = dir
+		for _, m := range p.modules() {
+			if strings.HasSuffix(m, ".xml") {
+				m = filepath.Dir(m)
+			}
+			if err := load(filepath.Join(dir, m)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := load(root); err != nil {
+		return errors.Wrapf(err, "target %s", t.Path)
+	}
+	if err := load(t.Path); err != nil {
+		return errors.Wrapf(err, "target %s", t.Path)
+	}
+	seen := make(map[string]bool)
+	var visit func(dir string)
+	visit = func(dir string) {
+		if seen[dir] {
+			return
+		}
+		seen[dir] = true
+		t.addDepDir(dir)
+		p := poms[dir]
+		// The parent poms are inherited by the module.
+		parent := "../pom.xml"
+		if p.Parent.RelativePath != nil {
+			parent = *p.Parent.RelativePath
+		}
+		if parent != "" {
+			if !strings.HasSuffix(parent, ".xml") {
+				parent = filepath.Join(parent, "pom.xml")
+			}
+			t.addWatch(filepath.Join(dir, parent))
+		}
+		for _, c := range p.dependencies() {
+			if m, ok := modules[c]; ok {
+				visit(m)
+			}
+		}
+	}
+	visit(filepath.Clean(t.Path))
+	return nil
+}
+
+// gradleAnalyzer follows the project dependencies of a Gradle project on the
+// other projects of its build, defined by the nearest settings file.
+type gradleAnalyzer struct{}
+
+var (
+	gradleIncludeRe    = regexp.MustCompile(`\binclude\s*\(?((?:\s*["'][^"']+["']\s*,?)+)`)
+	gradleQuotedRe     = regexp.MustCompile(`["']([^"']+)["']`)
+	gradleProjectDirRe = regexp.MustCompile(`project\(\s*["'](:[^"']+)["']\s*\)\.projectDir\s*=\s*(?:file\(\s*)?(?:new File\([^,]*,\s*)?["']([^"']+)["']`)
+	gradleProjectRe    = regexp.MustCompile(`\bproject\(\s*(?:path\s*[:=]\s*)?["'](:[^"']*)["']`)
+	gradleAccessorRe   = regexp.MustCompile(`\bprojects\.([A-Za-z0-9_.]+)`)
+)
+
+func (gradleAnalyzer) Analyze(ctx context.Context, t *Target) error {
+	root := findUp(t.Path, "settings.gradle", "settings.gradle.kts")
+	if root == "" {
+		t.addDepDir(t.Path)
+		return nil
+	}
+	for _, f := range []string{"settings.gradle", "settings.gradle.kts", "build.gradle", "build.gradle.kts", "gradle.properties", filepath.Join("gradle", "libs.versions.toml")} {
+		t.addWatch(filepath.Join(root, f))
+	}
+	projects, err := gradleProjects(root)
+	if err != nil {
+		return errors.Wrapf(err, "target %s", t.Path)
+	}
+	seen := make(map[string]bool)
+	var visit func(dir string) error
+	visit = func(dir string) error {
+		dir = filepath.Clean(dir)
+		if seen[dir] {
+			return nil
+		}
+		seen[dir] = true
+		t.addDepDir(dir)
+		script, err := gradleBuildScript(dir)
+		if err != nil {
+			return err
+		}
+		var deps []string
+		for _, sm := range gradleProjectRe.FindAllStringSubmatch(script, -1) {
+			deps = append(deps, sm[1])
+		}
+		for _, sm := range gradleAccessorRe.FindAllStringSubmatch(script, -1) {
+			if p := gradleAccessorProject(projects, sm[1]); p != "" {
+				deps = append(deps, p)
+			}
+		}
+		for _, d := range deps {
+			if pd, ok := projects[d]; ok {
+				if err := visit(pd); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := visit(t.Path); err != nil {
+		return errors.Wrapf(err, "target %s", t.Path)
+	}
+	return nil
+}
+
+// gradleProjects maps the project paths of a settings file, e.g. :libs:core,
+// to their directories.
+func gradleProjects(root string) (map[string]string, error) {
+	var settings []byte
+	for _, name := range []string{"settings.gradle", "settings.gradle.kts"} {
+		b, err := ioutil.ReadFile(filepath.Join(root, name))
+		if err == nil {
+			settings = b
+			break
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	projects := map[string]string{":": root}
+	for _, sm := range gradleIncludeRe.FindAllStringSubmatch(string(settings), -1) {
+		for _, q := range gradleQuotedRe.FindAllStringSubmatch(sm[1], -1) {
+			p := q[1]
+			if !strings.HasPrefix(p, ":") {
+				p = ":" + p
+			}
+			projects[p] = filepath.Join(root, filepath.FromSlash(strings.Replace(strings.TrimPrefix(p, ":"), ":", "/", -1)))
+		}
+	}
+	for _, sm := range gradleProjectDirRe.FindAllStringSubmatch(string(settings), -1) {
+		projects[sm[1]] = filepath.Join(root, sm[2])
+	}
+	return projects, nil
+}
+
+func gradleBuildScript(dir string) (string, error) {
+	for _, name := range []string{"build.gradle", "build.gradle.kts"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return string(b), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// gradleAccessorProject resolves a type-safe project accessor, e.g.
+// projects.libs.fooBar, to the project path :libs:foo-bar.
+func gradleAccessorProject(projects map[string]string, accessor string) string {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.NewReplacer("-", "", "_", "", ":", ".").Replace(s))
+	}
+	want := "." + normalize(accessor)
+	for p := range projects {
+		if normalize(p) == want {
+			return p
+		}
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AffectedTarget is an affected target and why it is affected, for the CI
+// pipelines that fan out their own jobs.
+type AffectedTarget struct {
+	Path    string   `json:"path"`
+	Name    string   `json:"name,omitempty"`
+	Build   bool     `json:"build"` // Whether the target has a build command or steps.
+	Reasons []string `json:"reasons"`
+	// The Go packages and dependency directories that the changed files touch.
+	Packages []string `json:"packages,omitempty"`
+}
+
+// Affected returns the affected targets in config order, only the ones mb
+// builds when buildable is set.
+func (b *BuildContext) Affected(buildable bool) []*AffectedTarget {
+	affected := []*AffectedTarget{}
+	for _, t := range b.Config.Targets {
+		if len(t.Changes) == 0 && !b.All {
+			continue
+		}
+		if buildable && !t.buildable() {
+			continue
+		}
+		at := &AffectedTarget{Path: t.Path, Name: t.Name, Build: t.buildable(), Reasons: []string{}, Packages: t.changedPackages()}
+		if b.All && len(t.Changes) == 0 {
+			at.Reasons = append(at.Reasons, "all targets are built")
+		}
+		for _, r := range t.reasons() {
+			at.Reasons = append(at.Reasons, strings.Replace(r, "`", "", -1))
+		}
+		affected = append(affected, at)
+	}
+	return affected
+}
+
+// NothingToDo reports whether the run builds no target: none is affected,
+// or only the ones without a build command.
+func (b *BuildContext) NothingToDo() bool {
+	return len(b.Affected(true)) == 0
+}
+
+// WriteAffected writes the affected targets as text, one path per line, or
+// as json with their reasons.
+func WriteAffected(w io.Writer, affected []*AffectedTarget, format string) error {
+	switch format {
+	case "text":
+		for _, at := range affected {
+			if _, err := fmt.Fprintln(w, at.Path); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		b, err := json.MarshalIndent(affected, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+	return errors.Errorf("unknown list format %q", format)
+}
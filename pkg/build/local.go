@@ -0,0 +1,133 @@
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// localConfigFile returns the name of the local override file of a config
+// file, e.g. monobuild.local.yaml for monobuild.yaml.
+func localConfigFile(configFile string) string {
+	ext := filepath.Ext(configFile)
+	return strings.TrimSuffix(configFile, ext) + ".local" + ext
+}
+
+// ReadConfig reads and decrypts a config file, merged with its included
+// fragments and with its local override file when it exists. It returns the
+// name of the local file that was merged, if any.
+func ReadConfig(ctx context.Context, configFile string) ([]byte, string, error) {
+	fb, local, _, err := readConfig(ctx, configFile)
+	return fb, local, err
+}
+
+// readConfig is ReadConfig, also returning the names of the included
+// fragments.
+func readConfig(ctx context.Context, configFile string) ([]byte, string, []string, error) {
+	ctx, span := tracer.Start(ctx, "ReadConfig")
+	defer span.End()
+	fb, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if fb, err = decryptConfig(ctx, fb); err != nil {
+		return nil, "", nil, err
+	}
+	fb, included, err := includeConfigs(ctx, fb, configFile, ioutil.ReadFile, filepath.Glob)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	span.SetAttributes(attribute.String("included", strings.Join(included, ",")))
+	local := localConfigFile(configFile)
+	lb, err := ioutil.ReadFile(local)
+	if os.IsNotExist(err) {
+		return fb, "", included, nil
+	}
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if lb, err = decryptConfig(ctx, lb); err != nil {
+		return nil, "", nil, errors.Wrap(err, local)
+	}
+	var base, override interface{}
+	if err := yaml.Unmarshal(fb, &base); err != nil {
+		return nil, "", nil, errors.Wrap(err, configFile)
+	}
+	if err := yaml.Unmarshal(lb, &override); err != nil {
+		return nil, "", nil, errors.Wrap(err, local)
+	}
+	if err := exec.CommandContext(ctx, "git", "check-ignore", "-q", local).Run(); err != nil {
+		Log.Warn("the local config file is not ignored by git, add it to .gitignore", "file", local)
+	}
+	span.SetAttributes(attribute.String("local", local))
+	merged, err := yaml.Marshal(mergeYAML(base, override))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return merged, local, included, nil
+}
+
+// mergeYAML merges an override document over a base document. Maps are merged
+// recursively and lists of items with a path, such as targets and
+// directories, are merged item by item. Any other value is replaced.
+func mergeYAML(base, override interface{}) interface{} {
+	switch o := override.(type) {
+	case map[interface{}]interface{}:
+		b, ok := base.(map[interface{}]interface{})
+		if !ok {
+			return o
+		}
+		merged := make(map[interface{}]interface{}, len(b))
+		for k, v := range b {
+			merged[k] = v
+		}
+		for k, v := range o {
+			merged[k] = mergeYAML(b[k], v)
+		}
+		return merged
+	case []interface{}:
+		b, ok := base.([]interface{})
+		if !ok || !itemsHavePath(b) || !itemsHavePath(o) {
+			return o
+		}
+		merged := make([]interface{}, len(b))
+		copy(merged, b)
+		byPath := make(map[interface{}]int)
+		for i, item := range b {
+			byPath[itemPath(item)] = i
+		}
+		for _, item := range o {
+			if i, ok := byPath[itemPath(item)]; ok {
+				merged[i] = mergeYAML(merged[i], item)
+			} else {
+				merged = append(merged, item)
+			}
+		}
+		return merged
+	}
+	return override
+}
+
+func itemsHavePath(items []interface{}) bool {
+	for _, item := range items {
+		if itemPath(item) == nil {
+			return false
+		}
+	}
+	return len(items) > 0
+}
+
+func itemPath(item interface{}) interface{} {
+	m, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	return m["path"]
+}
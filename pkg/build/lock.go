@@ -0,0 +1,539 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Providers of the resource locks.
+const (
+	LockFile     = "file"
+	LockRedis    = "redis"
+	LockDynamoDB = "dynamodb"
+)
+
+const defaultLockTTL = 10 * time.Minute
+
+// LockConfig represents the locks config: where the resource locks of the
+// targets are held, so that the builds of different CI agents serialize
+// their access to a shared external system.
+type LockConfig struct {
+	Provider string `yaml:"provider"` // file, redis or dynamodb. Defaults to file.
+	Dir      string `yaml:"dir"`      // The directory of the file provider, e.g. on a shared volume. Defaults to <tmp>/monobuild-locks.
+	Address  string `yaml:"address"`  // The host:port of the redis provider. The password is read from REDIS_PASSWORD.
+	Table    string `yaml:"table"`    // The table of the dynamodb provider, of string partition key "name".
+	Region   string `yaml:"region"`   // The region of the dynamodb provider. Defaults to AWS_REGION, then us-east-1.
+	Endpoint string `yaml:"endpoint"` // The URL of a DynamoDB compatible endpoint.
+	TTL      string `yaml:"ttl"`      // How long a lock outlives a crashed build, e.g. 10m. Held locks are refreshed.
+}
+
+func (c LockConfig) validate() error {
+	switch c.Provider {
+	case "", LockFile:
+	case LockRedis:
+		if c.Address == "" {
+			return errors.Errorf("locks.address: the redis provider needs an address")
+		}
+	case LockDynamoDB:
+		if c.Table == "" {
+			return errors.Errorf("locks.table: the dynamodb provider needs a table")
+		}
+	default:
+		return errors.Errorf("locks.provider: %s must be one of file, redis or dynamodb", c.Provider)
+	}
+	if c.TTL != "" {
+		if d, err := time.ParseDuration(c.TTL); err != nil || d < 10*time.Second {
+			return errors.Errorf("locks.ttl: %s must be a duration of at least 10s", c.TTL)
+		}
+	}
+	return nil
+}
+
+func (c LockConfig) ttl() time.Duration {
+	if d, err := time.ParseDuration(c.TTL); err == nil {
+		return d
+	}
+	return defaultLockTTL
+}
+
+var lockNameRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+func validateResourceLock(t *Target) error {
+	if t.ResourceLock != "" && !lockNameRegexp.MatchString(t.ResourceLock) {
+		return errors.Errorf("target.resource_lock: %q of target %s must only have letters, digits, '.', '_' and '-'", t.ResourceLock, t.Path)
+	}
+	return nil
+}
+
+// LockProvider holds named locks shared by the builds of every agent. A lock
+// expires after its ttl unless it is refreshed, so that a crashed build does
+// not hold it forever.
+type LockProvider interface {
+	// TryLock acquires the lock for owner, or returns the owner holding it.
+	TryLock(ctx context.Context, name, owner string, ttl time.Duration) (holder string, err error)
+	// Refresh extends the lock held by owner.
+	Refresh(ctx context.Context, name, owner string, ttl time.Duration) error
+	// Unlock releases the lock if owner holds it.
+	Unlock(ctx context.Context, name, owner string) error
+}
+
+func newLockProvider(c LockConfig) LockProvider {
+	switch c.Provider {
+	case LockRedis:
+		return &redisLocks{addr: c.Address, password: os.Getenv("REDIS_PASSWORD")}
+	case LockDynamoDB:
+		return &dynamoLocks{c: c}
+	}
+	dir := c.Dir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "monobuild-locks")
+	}
+	return &fileLocks{dir: dir}
+}
+
+// lockResource waits for the resource lock of a target and holds it, with
+// refreshes, until the returned release function is called.
+func (b *BuildContext) lockResource(ctx context.Context, t *Target) (func(), error) {
+	if t.ResourceLock == "" {
+		return func() {}, nil
+	}
+	ctx, span := tracer.Start(ctx, "*BuildContext.lockResource()")
+	defer span.End()
+	span.SetAttributes(attribute.String("lock", t.ResourceLock))
+	p := newLockProvider(b.Config.Locks)
+	ttl := b.Config.Locks.ttl()
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%d:%s", host, os.Getpid(), CleanTreePath(t.Path))
+	wait, waited := time.Second, false
+	for {
+		holder, err := p.TryLock(ctx, t.ResourceLock, owner, ttl)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resource lock %s", t.ResourceLock)
+		}
+		if holder == "" {
+			break
+		}
+		if !waited {
+			b.renderer().Info(t.stdout(), fmt.Sprintf("WAITING FOR RESOURCE LOCK %s HELD BY %s", t.ResourceLock, holder))
+			waited = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > 10*time.Second {
+			wait = 10 * time.Second
+		}
+	}
+	stop := make(chan struct{})
+	go func() {
+		tick := time.NewTicker(ttl / 3)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+				if err := p.Refresh(context.Background(), t.ResourceLock, owner, ttl); err != nil {
+					b.renderer().Warn(t.stdout(), fmt.Sprintf("cannot refresh the resource lock %s: %v", t.ResourceLock, err))
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		if err := p.Unlock(context.Background(), t.ResourceLock, owner); err != nil {
+			b.renderer().Warn(t.stdout(), fmt.Sprintf("cannot release the resource lock %s: %v", t.ResourceLock, err))
+		}
+	}, nil
+}
+
+// fileLocks holds the locks as files of a directory. The changes of a lock
+// file are serialized by an flock of its .mutex file, so that an expired
+// lock is taken over by one build only.
+type fileLocks struct {
+	dir string
+}
+
+type fileLock struct {
+	Owner   string
+	Expires time.Time
+}
+
+func (f *fileLocks) path(name string) string {
+	return filepath.Join(f.dir, name+".lock")
+}
+
+func (f *fileLocks) read(name string) (*fileLock, error) {
+	fb, err := ioutil.ReadFile(f.path(name))
+	if err != nil {
+		return nil, err
+	}
+	l := &fileLock{}
+	if err := json.Unmarshal(fb, l); err != nil {
+		// A lock being written is held.
+		return &fileLock{Owner: "unknown", Expires: time.Now().Add(time.Minute)}, nil
+	}
+	return l, nil
+}
+
+// write replaces the lock file with the lock of owner.
+func (f *fileLocks) write(name, owner string, ttl time.Duration) error {
+	fb, err := json.Marshal(&fileLock{Owner: owner, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(f.dir, name+".lock.*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(fb)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path(name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// mutex flocks the mutex file of a lock, for the builds of every process
+// using the directory, and returns a func to release it.
+func (f *fileLocks) mutex(name string) (func(), error) {
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return nil, err
+	}
+	mf, err := os.OpenFile(f.path(name)+".mutex", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(mf.Fd()), syscall.LOCK_EX); err != nil {
+		mf.Close()
+		return nil, errors.Wrapf(err, "lock %s", name)
+	}
+	// Closing the file releases the flock.
+	return func() { mf.Close() }, nil
+}
+
+func (f *fileLocks) TryLock(ctx context.Context, name, owner string, ttl time.Duration) (string, error) {
+	unlock, err := f.mutex(name)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	l, err := f.read(name)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return "", err
+	case l.Owner != owner && time.Now().Before(l.Expires):
+		return l.Owner, nil
+	}
+	// The lock is free, already held by owner or the one of a crashed build,
+	// which expired.
+	return "", f.write(name, owner, ttl)
+}
+
+func (f *fileLocks) Refresh(ctx context.Context, name, owner string, ttl time.Duration) error {
+	unlock, err := f.mutex(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	l, err := f.read(name)
+	if err != nil {
+		return err
+	}
+	if l.Owner != owner {
+		return errors.Errorf("the lock is held by %s", l.Owner)
+	}
+	return f.write(name, owner, ttl)
+}
+
+func (f *fileLocks) Unlock(ctx context.Context, name, owner string) error {
+	unlock, err := f.mutex(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	l, err := f.read(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if l.Owner != owner {
+		return nil
+	}
+	return os.Remove(f.path(name))
+}
+
+// redisLocks holds the locks as keys of a Redis server, set with NX and a
+// time to live, and released by their owner only.
+type redisLocks struct {
+	addr     string
+	password string
+}
+
+const (
+	redisRefresh = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+	redisUnlock  = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+)
+
+func redisKey(name string) string { return "monobuild:lock:" + name }
+
+func (r *redisLocks) TryLock(ctx context.Context, name, owner string, ttl time.Duration) (string, error) {
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	reply, err := r.do(ctx, "SET", redisKey(name), owner, "NX", "PX", ms)
+	if err != nil || reply != nil {
+		return "", err
+	}
+	holder, err := r.do(ctx, "GET", redisKey(name))
+	if err != nil {
+		return "", err
+	}
+	switch holder {
+	case nil:
+		// Released in between.
+		return r.TryLock(ctx, name, owner, ttl)
+	case owner:
+		return "", r.Refresh(ctx, name, owner, ttl)
+	}
+	return fmt.Sprint(holder), nil
+}
+
+func (r *redisLocks) Refresh(ctx context.Context, name, owner string, ttl time.Duration) error {
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	reply, err := r.do(ctx, "EVAL", redisRefresh, "1", redisKey(name), owner, ms)
+	if err != nil {
+		return err
+	}
+	if reply != int64(1) {
+		return errors.Errorf("the lock is not held by %s", owner)
+	}
+	return nil
+}
+
+func (r *redisLocks) Unlock(ctx context.Context, name, owner string) error {
+	_, err := r.do(ctx, "EVAL", redisUnlock, "1", redisKey(name), owner)
+	return err
+}
+
+// do sends a command on a new connection and returns its reply: a string,
+// an int64 or nil.
+func (r *redisLocks) do(ctx context.Context, args ...string) (interface{}, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+	rd := bufio.NewReader(conn)
+	if r.password != "" {
+		if _, err := redisCommand(conn, rd, "AUTH", r.password); err != nil {
+			return nil, err
+		}
+	}
+	return redisCommand(conn, rd, args...)
+}
+
+func redisCommand(conn net.Conn, rd *bufio.Reader, args ...string) (interface{}, error) {
+	var cmd bytes.Buffer
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := conn.Write(cmd.Bytes()); err != nil {
+		return nil, err
+	}
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	}
+	return nil, errors.Errorf("redis: unexpected reply %q", line)
+}
+
+// dynamoLocks holds the locks as items of a DynamoDB table, put with a
+// condition on their expiry and owner.
+type dynamoLocks struct {
+	c LockConfig
+}
+
+// errConditionFailed is returned by dynamoLocks.call when the condition of
+// the request is not met.
+var errConditionFailed = errors.New("the condition is not met")
+
+func (d *dynamoLocks) url() string {
+	if d.c.Endpoint != "" {
+		return d.c.Endpoint
+	}
+	return fmt.Sprintf("https://dynamodb.%s.amazonaws.com/", awsRegion(d.c.Region))
+}
+
+func (d *dynamoLocks) call(ctx context.Context, op string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(d.url())
+	if err != nil {
+		return err
+	}
+	h := http.Header{}
+	h.Set("Content-Type", "application/x-amz-json-1.0")
+	h.Set("X-Amz-Target", "DynamoDB_20120810."+op)
+	if h, err = awsSign("dynamodb", awsRegion(d.c.Region), http.MethodPost, u, body, h, time.Now().UTC()); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = h
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	rb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(rb, &e)
+		if strings.HasSuffix(e.Type, "ConditionalCheckFailedException") {
+			return errConditionFailed
+		}
+		return errors.Errorf("dynamodb %s: %s: %s", op, resp.Status, bytes.TrimSpace(rb))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(rb, out)
+}
+
+func (d *dynamoLocks) TryLock(ctx context.Context, name, owner string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	err := d.call(ctx, "PutItem", map[string]interface{}{
+		"TableName": d.c.Table,
+		"Item": map[string]interface{}{
+			"name":    map[string]string{"S": name},
+			"owner":   map[string]string{"S": owner},
+			"expires": map[string]string{"N": strconv.FormatInt(now.Add(ttl).Unix(), 10)},
+		},
+		"ConditionExpression":      "attribute_not_exists(#n) OR #e < :now OR #o = :o",
+		"ExpressionAttributeNames": map[string]string{"#n": "name", "#e": "expires", "#o": "owner"},
+		"ExpressionAttributeValues": map[string]interface{}{
+			":now": map[string]string{"N": strconv.FormatInt(now.Unix(), 10)},
+			":o":   map[string]string{"S": owner},
+		},
+	}, nil)
+	if err != errConditionFailed {
+		return "", err
+	}
+	var out struct {
+		Item struct {
+			Owner struct {
+				S string
+			} `json:"owner"`
+		}
+	}
+	err = d.call(ctx, "GetItem", map[string]interface{}{
+		"TableName":      d.c.Table,
+		"Key":            map[string]interface{}{"name": map[string]string{"S": name}},
+		"ConsistentRead": true,
+	}, &out)
+	if err != nil {
+		return "", err
+	}
+	if out.Item.Owner.S == "" {
+		return "unknown", nil
+	}
+	return out.Item.Owner.S, nil
+}
+
+func (d *dynamoLocks) Refresh(ctx context.Context, name, owner string, ttl time.Duration) error {
+	err := d.call(ctx, "UpdateItem", map[string]interface{}{
+		"TableName":                d.c.Table,
+		"Key":                      map[string]interface{}{"name": map[string]string{"S": name}},
+		"UpdateExpression":         "SET #e = :e",
+		"ConditionExpression":      "#o = :o",
+		"ExpressionAttributeNames": map[string]string{"#e": "expires", "#o": "owner"},
+		"ExpressionAttributeValues": map[string]interface{}{
+			":e": map[string]string{"N": strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)},
+			":o": map[string]string{"S": owner},
+		},
+	}, nil)
+	if err == errConditionFailed {
+		return errors.Errorf("the lock is not held by %s", owner)
+	}
+	return err
+}
+
+func (d *dynamoLocks) Unlock(ctx context.Context, name, owner string) error {
+	err := d.call(ctx, "DeleteItem", map[string]interface{}{
+		"TableName":                 d.c.Table,
+		"Key":                       map[string]interface{}{"name": map[string]string{"S": name}},
+		"ConditionExpression":       "#o = :o",
+		"ExpressionAttributeNames":  map[string]string{"#o": "owner"},
+		"ExpressionAttributeValues": map[string]interface{}{":o": map[string]string{"S": owner}},
+	}, nil)
+	if err == errConditionFailed {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileLocks(t *testing.T) {
+	type op struct {
+		do, owner string
+		ttl       time.Duration
+		holder    string // The holder reported by a lock, empty when acquired.
+		err       bool
+	}
+	tests := []struct {
+		name string
+		ops  []op
+	}{
+		{
+			name: "lock is exclusive",
+			ops: []op{
+				{do: "lock", owner: "a", ttl: time.Minute},
+				{do: "lock", owner: "b", ttl: time.Minute, holder: "a"},
+			},
+		},
+		{
+			name: "owner locks again",
+			ops: []op{
+				{do: "lock", owner: "a", ttl: time.Minute},
+				{do: "lock", owner: "a", ttl: time.Minute},
+				{do: "lock", owner: "b", ttl: time.Minute, holder: "a"},
+			},
+		},
+		{
+			name: "expired lock is taken over",
+			ops: []op{
+				{do: "lock", owner: "a", ttl: -time.Second},
+				{do: "lock", owner: "b", ttl: time.Minute},
+				{do: "lock", owner: "a", ttl: time.Minute, holder: "b"},
+			},
+		},
+		{
+			name: "refresh extends the lock",
+			ops: []op{
+				{do: "lock", owner: "a", ttl: -time.Second},
+				{do: "refresh", owner: "a", ttl: time.Minute},
+				{do: "lock", owner: "b", ttl: time.Minute, holder: "a"},
+			},
+		},
+		{
+			name: "refresh of another owner fails",
+			ops: []op{
+				{do: "lock", owner: "a", ttl: time.Minute},
+				{do: "refresh", owner: "b", ttl: time.Minute, err: true},
+				{do: "lock", owner: "b", ttl: time.Minute, holder: "a"},
+			},
+		},
+		{
+			name: "refresh of a released lock fails",
+			ops: []op{
+				{do: "lock", owner: "a", ttl: time.Minute},
+				{do: "unlock", owner: "a"},
+				{do: "refresh", owner: "a", ttl: time.Minute, err: true},
+			},
+		},
+		{
+			name: "unlock by another owner keeps the lock",
+			ops: []op{
+				{do: "lock", owner: "a", ttl: time.Minute},
+				{do: "unlock", owner: "b"},
+				{do: "lock", owner: "b", ttl: time.Minute, holder: "a"},
+				{do: "unlock", owner: "a"},
+				{do: "lock", owner: "b", ttl: time.Minute},
+			},
+		},
+		{
+			name: "unlock of a free lock",
+			ops: []op{
+				{do: "unlock", owner: "a"},
+				{do: "lock", owner: "a", ttl: time.Minute},
+			},
+		},
+	}
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "monobuild-locks")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			f := &fileLocks{dir: dir}
+			for i, o := range tt.ops {
+				var holder string
+				switch o.do {
+				case "lock":
+					holder, err = f.TryLock(ctx, "db", o.owner, o.ttl)
+				case "refresh":
+					err = f.Refresh(ctx, "db", o.owner, o.ttl)
+				case "unlock":
+					err = f.Unlock(ctx, "db", o.owner)
+				}
+				if (err != nil) != o.err {
+					t.Fatalf("%d: %s by %s: error %v, want error %v", i, o.do, o.owner, err, o.err)
+				}
+				if holder != o.holder {
+					t.Fatalf("%d: %s by %s: held by %q, want %q", i, o.do, o.owner, holder, o.holder)
+				}
+			}
+		})
+	}
+}
+
+func TestFileLocksPartialWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monobuild-locks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := &fileLocks{dir: dir}
+	// A lock file being written by another build is held.
+	if err := ioutil.WriteFile(f.path("db"), []byte(`{"Owner":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	holder, err := f.TryLock(context.Background(), "db", "a", time.Minute)
+	if err != nil || holder != "unknown" {
+		t.Errorf("TryLock() = %q, %v, want held by unknown", holder, err)
+	}
+}
+
+func TestFileLocksTakeover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monobuild-locks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The agents race on every CPU count.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	ctx := context.Background()
+	for round := 0; round < 50; round++ {
+		// The lock of a crashed build expired.
+		if _, err := (&fileLocks{dir: dir}).TryLock(ctx, "db", "crashed", -time.Second); err != nil {
+			t.Fatal(err)
+		}
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			acquired []string
+		)
+		start := make(chan bool)
+		for i := 0; i < 20; i++ {
+			owner := fmt.Sprintf("agent-%d", i)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				// Each agent has its own locks, as another process would.
+				holder, err := (&fileLocks{dir: dir}).TryLock(ctx, "db", owner, time.Minute)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if holder == "" {
+					mu.Lock()
+					acquired = append(acquired, owner)
+					mu.Unlock()
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+		if len(acquired) != 1 {
+			t.Fatalf("round %d: the expired lock was taken over by %q, want one agent", round, acquired)
+		}
+		f := &fileLocks{dir: dir}
+		if l, err := f.read("db"); err != nil || l.Owner != acquired[0] {
+			t.Fatalf("round %d: the lock is held by %v, %v, want %s", round, l, err, acquired[0])
+		}
+		if err := f.Unlock(ctx, "db", acquired[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
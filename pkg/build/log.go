@@ -0,0 +1,122 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The levels of the log messages, from the most verbose.
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warning", "error"}
+
+// The formats of the log messages.
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// Logger writes the log messages of mb at or above its level, as text or as
+// a JSON object per line. Each message has key-value fields, e.g. the file
+// and the target of a change.
+type Logger struct {
+	Level  int
+	Format string
+	W      io.Writer
+
+	mu sync.Mutex
+}
+
+// Log is the logger of mb, set by -verbose, -quiet and -log-format. It
+// writes the info messages and above to stderr, so that stdout is only the
+// build output.
+var Log = &Logger{Level: LevelInfo, Format: LogText, W: os.Stderr}
+
+// SetFormat sets the format of the logger, text or json.
+func (l *Logger) SetFormat(format string) error {
+	if format != LogText && format != LogJSON {
+		return errors.Errorf("unknown log format %q, must be text or json", format)
+	}
+	l.Format = format
+	return nil
+}
+
+// Enabled reports whether the messages of a level are written.
+func (l *Logger) Enabled(level int) bool { return level >= l.Level }
+
+// Debug logs the details of a decision, e.g. why a file affects a target.
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+
+// Info logs a step of the run, e.g. the installation of a tool.
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(LevelInfo, msg, kv) }
+
+// Warn logs a failure that does not fail the run, e.g. of an alert.
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(LevelWarn, msg, kv) }
+
+// Error logs a failure of the run.
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// log writes a message with the fields of kv, key-value pairs. A value that
+// is not a string is formatted with %v, e.g. an error.
+func (l *Logger) log(level int, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	var keys []string
+	values := make(map[string]string)
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		value := "(missing)"
+		if i+1 < len(kv) {
+			value = fmt.Sprint(kv[i+1])
+		}
+		keys = append(keys, key)
+		values[key] = value
+	}
+	var line string
+	switch l.Format {
+	case LogJSON:
+		fields := map[string]interface{}{
+			"time":  time.Now().UTC(),
+			"level": levelNames[level],
+			"msg":   msg,
+		}
+		for _, k := range keys {
+			fields[k] = values[k]
+		}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			return
+		}
+		line = string(b)
+	default:
+		var sb strings.Builder
+		if level != LevelInfo {
+			sb.WriteString(strings.ToUpper(levelNames[level]) + ": ")
+		}
+		sb.WriteString(msg)
+		for _, k := range keys {
+			v := values[k]
+			if strings.ContainsAny(v, " \t\n\"") {
+				v = fmt.Sprintf("%q", v)
+			}
+			fmt.Fprintf(&sb, " %s=%s", k, v)
+		}
+		line = sb.String()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(l.W, line)
+}
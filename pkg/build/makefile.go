@@ -0,0 +1,253 @@
+package build
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// parseBuildSystemFiles adds the files referenced by the Makefile or
+// magefile that the build command runs to the watched files of the target,
+// so that editing them rebuilds the target.
+func (t *Target) parseBuildSystemFiles(ctx context.Context) error {
+	_, span := tracer.Start(ctx, "*Target.parseBuildSystemFiles")
+	defer span.End()
+	var files []string
+	var err error
+	switch filepath.Base(t.BuildCommand.Command) {
+	case "make", "gmake":
+		files, err = makeInputs(t.BuildCommand)
+	case "mage":
+		files, err = mageInputs(t.BuildCommand)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !contains(t.Watches, f) {
+			t.Watches = append(t.Watches, f)
+		}
+	}
+	span.SetAttributes(attribute.String("files", strings.Join(files, ",")))
+	return nil
+}
+
+// makeInputs returns the makefiles, their includes and the prerequisite files
+// of the goals run by a make build command.
+func makeInputs(c BuildCommand) ([]string, error) {
+	dir := c.Dir
+	if dir == "" {
+		dir = "."
+	}
+	makefile := ""
+	var goals []string
+	for i := 0; i < len(c.Args); i++ {
+		a := c.Args[i]
+		switch {
+		case (a == "-f" || a == "--file" || a == "--makefile") && i+1 < len(c.Args):
+			i++
+			makefile = c.Args[i]
+		case strings.HasPrefix(a, "-f") && len(a) > 2:
+			makefile = a[2:]
+		case a == "-C" && i+1 < len(c.Args):
+			i++
+			dir = filepath.Join(dir, c.Args[i])
+		case strings.HasPrefix(a, "-") || strings.Contains(a, "="):
+		default:
+			goals = append(goals, a)
+		}
+	}
+	if makefile == "" {
+		for _, name := range []string{"GNUmakefile", "makefile", "Makefile"} {
+			if fileExists(filepath.Join(dir, name)) {
+				makefile = name
+				break
+			}
+		}
+		if makefile == "" {
+			return nil, nil
+		}
+	}
+	m := &makefileRules{rules: make(map[string][]string), dir: dir}
+	if err := m.parse(filepath.Join(dir, makefile)); err != nil {
+		return nil, err
+	}
+	if len(goals) == 0 && m.defaultGoal != "" {
+		goals = []string{m.defaultGoal}
+	}
+	seen := make(map[string]bool)
+	for _, g := range goals {
+		m.collect(g, seen)
+	}
+	return m.files, nil
+}
+
+// makefileRules is a best-effort parser of the rules of a Makefile. Variables
+// are not expanded, except for $(wildcard ...) in prerequisites.
+type makefileRules struct {
+	dir         string
+	rules       map[string][]string // Target to prerequisites.
+	defaultGoal string
+	files       []string
+}
+
+var (
+	makeIncludeRe  = regexp.MustCompile(`^-?s?include\s+(.+)$`)
+	makeWildcardRe = regexp.MustCompile(`\$\(wildcard\s+([^)]+)\)`)
+)
+
+func (m *makefileRules) parse(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	m.addFile(name)
+	var logical string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasSuffix(line, "\\") {
+			logical += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		line, logical = logical+line, ""
+		if strings.HasPrefix(line, "\t") {
+			continue // Recipe.
+		}
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if sm := makeIncludeRe.FindStringSubmatch(line); sm != nil {
+			for _, inc := range strings.Fields(sm[1]) {
+				if strings.Contains(inc, "$") {
+					continue
+				}
+				// Missing includes are allowed with -include.
+				if p := filepath.Join(m.dir, inc); fileExists(p) {
+					if err := m.parse(p); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 || strings.HasPrefix(line[i:], ":=") || strings.ContainsAny(line[:i], "=") {
+			continue
+		}
+		prereqs := strings.TrimLeft(line[i+1:], ":")
+		if j := strings.Index(prereqs, ";"); j >= 0 {
+			prereqs = prereqs[:j]
+		}
+		prereqs = strings.Replace(prereqs, "|", " ", -1)
+		var deps []string
+		for _, w := range makeWildcardRe.FindAllStringSubmatch(prereqs, -1) {
+			deps = append(deps, strings.Fields(w[1])...)
+		}
+		for _, p := range strings.Fields(makeWildcardRe.ReplaceAllString(prereqs, "")) {
+			if !strings.Contains(p, "$") && !strings.Contains(p, "%") {
+				deps = append(deps, p)
+			}
+		}
+		for _, target := range strings.Fields(line[:i]) {
+			if m.defaultGoal == "" && !strings.HasPrefix(target, ".") && !strings.Contains(target, "%") {
+				m.defaultGoal = target
+			}
+			m.rules[target] = append(m.rules[target], deps...)
+		}
+	}
+	return s.Err()
+}
+
+// collect adds the prerequisite files of a goal, recursing into the rules.
+func (m *makefileRules) collect(goal string, seen map[string]bool) {
+	if seen[goal] {
+		return
+	}
+	seen[goal] = true
+	for _, p := range m.rules[goal] {
+		if _, isRule := m.rules[p]; isRule {
+			m.collect(p, seen)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(m.dir, p))
+		if err != nil {
+			continue
+		}
+		for _, match := range matches {
+			if fi, err := os.Stat(match); err == nil && !fi.IsDir() {
+				m.addFile(match)
+			}
+		}
+	}
+}
+
+func (m *makefileRules) addFile(name string) {
+	name = filepath.Clean(name)
+	if !contains(m.files, name) {
+		m.files = append(m.files, name)
+	}
+}
+
+// mageInputs returns the magefiles of a mage build command: the Go files of
+// the magefiles directory, or the Go files with the mage build tag.
+func mageInputs(c BuildCommand) ([]string, error) {
+	dir := c.Dir
+	if dir == "" {
+		dir = "."
+	}
+	for i, a := range c.Args {
+		if (a == "-d" || a == "-w") && i+1 < len(c.Args) {
+			dir = filepath.Join(dir, c.Args[i+1])
+		}
+	}
+	if files, err := filepath.Glob(filepath.Join(dir, "magefiles", "*.go")); err != nil || len(files) > 0 {
+		return cleanPaths(files), err
+	}
+	candidates, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, f := range candidates {
+		if hasMageTag(f) {
+			files = append(files, f)
+		}
+	}
+	return cleanPaths(files), nil
+}
+
+func hasMageTag(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "package ") {
+			return false
+		}
+		if (strings.HasPrefix(line, "//go:build") || strings.HasPrefix(line, "// +build")) && strings.Contains(line, "mage") {
+			return true
+		}
+	}
+	return false
+}
+
+func cleanPaths(paths []string) []string {
+	for i := range paths {
+		paths[i] = filepath.Clean(paths[i])
+	}
+	return paths
+}
@@ -0,0 +1,243 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"gopkg.in/yaml.v2"
+)
+
+// MetaConfig is the config of mb meta: the repositories an orchestrator
+// builds with mb, each with its own config.
+type MetaConfig struct {
+	Parallel int         `yaml:"parallel"` // Maximum number of repositories built at the same time, 1 when 0.
+	Repos    []*MetaRepo `yaml:"repos"`
+}
+
+// MetaRepo is a repository of the meta config.
+type MetaRepo struct {
+	Name        string   `yaml:"name"`         // Prefixes the output of the repository. Defaults to its directory.
+	Dir         string   `yaml:"dir"`          // Checkout of the repository, relative to the meta config.
+	Config      string   `yaml:"config"`       // mb config file, relative to the checkout. Defaults to monobuild.yaml.
+	CommitRange string   `yaml:"commit_range"` // Overrides the commit range of mb meta.
+	Args        []string `yaml:"args"`         // Additional flags of mb, e.g. [-parallel, "4"].
+}
+
+// ReadMetaConfig reads and validates a meta config. The directories of the
+// repositories are resolved against the directory of the file.
+func ReadMetaConfig(name string) (*MetaConfig, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	mc := &MetaConfig{}
+	if err := yaml.UnmarshalStrict(b, mc); err != nil {
+		return nil, errors.Wrapf(err, "meta config %s", name)
+	}
+	if len(mc.Repos) == 0 {
+		return nil, errors.Errorf("meta config %s: no repos", name)
+	}
+	names := make(map[string]bool)
+	for i, r := range mc.Repos {
+		if r.Dir == "" {
+			return nil, errors.Errorf("meta config %s: repos[%d] has no dir", name, i)
+		}
+		if !filepath.IsAbs(r.Dir) {
+			r.Dir = filepath.Join(filepath.Dir(name), r.Dir)
+		}
+		if info, err := os.Stat(r.Dir); err != nil || !info.IsDir() {
+			return nil, errors.Errorf("meta config %s: dir %s of repos[%d] is not a directory", name, r.Dir, i)
+		}
+		if r.Name == "" {
+			r.Name = filepath.Base(filepath.Clean(r.Dir))
+		}
+		if r.Config == "" {
+			r.Config = "monobuild.yaml"
+		}
+		if names[r.Name] {
+			return nil, errors.Errorf("meta config %s: more than one repo named %s", name, r.Name)
+		}
+		names[r.Name] = true
+	}
+	return mc, nil
+}
+
+// MetaOptions are the options of RunMeta.
+type MetaOptions struct {
+	Executable  string   // The mb binary run in each repository.
+	CommitRange string   // Commit range of the repositories without one.
+	Args        []string // Flags of mb for every repository.
+	Parallel    int      // Overrides the parallel setting of the meta config when positive.
+}
+
+// MetaResult is the outcome of the build of a repository.
+type MetaResult struct {
+	Repo     string          `json:"repo"`
+	Targets  []*TargetResult `json:"targets"`
+	Duration time.Duration   `json:"duration"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// RunMeta computes and executes the plan of every repository of the meta
+// config, up to Parallel at the same time, with an mb process per
+// repository. The output lines of each repository are prefixed with its
+// name, and the result files of its targets make its result.
+func RunMeta(ctx context.Context, mc *MetaConfig, opts MetaOptions, w io.Writer) []*MetaResult {
+	ctx, span := tracer.Start(ctx, "RunMeta")
+	defer span.End()
+	parallel := opts.Parallel
+	if parallel <= 0 {
+		parallel = mc.Parallel
+	}
+	if parallel <= 0 {
+		parallel = 1
+	}
+	span.SetAttributes(attribute.Int64("parallel", int64(parallel)))
+	results := make([]*MetaResult, len(mc.Repos))
+	var mu sync.Mutex // Guards w.
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	for i, r := range mc.Repos {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, r *MetaRepo) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = runMetaRepo(ctx, r, opts, &mu, w)
+		}(i, r)
+	}
+	wg.Wait()
+	return results
+}
+
+// runMetaRepo runs mb in a repository, with a temporary result directory.
+func runMetaRepo(ctx context.Context, r *MetaRepo, opts MetaOptions, mu *sync.Mutex, w io.Writer) *MetaResult {
+	res := &MetaResult{Repo: r.Name, Targets: []*TargetResult{}}
+	results, err := ioutil.TempDir("", "mb-meta-")
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer os.RemoveAll(results)
+	commitRange := r.CommitRange
+	if commitRange == "" {
+		commitRange = opts.CommitRange
+	}
+	args := []string{"-config", r.Config, "-commit-range", commitRange, "-result-dir", results}
+	args = append(append(args, opts.Args...), r.Args...)
+	out := &lineWriter{line: func(l string) {
+		mu.Lock()
+		fmt.Fprintf(w, "[%s] %s\n", r.Name, l)
+		mu.Unlock()
+	}}
+	cmd := exec.CommandContext(ctx, opts.Executable, args...)
+	cmd.Dir = r.Dir
+	cmd.Stdout = out
+	cmd.Stderr = out
+	start := time.Now()
+	err = cmd.Run()
+	out.Flush()
+	res.Duration = time.Since(start)
+	if err != nil {
+		res.Error = "mb: " + err.Error()
+	}
+	if res.Targets, err = readResults(results); err != nil && res.Error == "" {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// readResults reads the result files of a result directory, in path order.
+func readResults(dir string) ([]*TargetResult, error) {
+	results := []*TargetResult{}
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Name() != "result.json" {
+			return err
+		}
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		r := &TargetResult{}
+		if err := json.Unmarshal(b, r); err != nil {
+			return errors.Wrapf(err, "result file %s", name)
+		}
+		results = append(results, r)
+		return nil
+	})
+	sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
+	return results, err
+}
+
+// Failed reports whether the build of the repository failed.
+func (r *MetaResult) Failed() bool {
+	if r.Error != "" {
+		return true
+	}
+	for _, t := range r.Targets {
+		if t.Status == RunFailure || t.Status == ResultSkipped || t.Status == ResultRunning {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteMetaSummary writes the results of the repositories as text or json,
+// and returns an error listing the failed repositories.
+func WriteMetaSummary(w io.Writer, results []*MetaResult, format string) error {
+	var failed []string
+	for _, r := range results {
+		if r.Failed() {
+			failed = append(failed, r.Repo)
+		}
+	}
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(b))
+	case "text":
+		fmt.Fprintln(w, "-------------------------------")
+		for _, r := range results {
+			counts := make(map[string]int)
+			for _, t := range r.Targets {
+				counts[t.Status]++
+			}
+			status := "SUCCEEDED"
+			if r.Failed() {
+				status = "FAILED"
+			}
+			fmt.Fprintf(w, "%s: %s in %s: %d built, %d cached, %d failed, %d skipped\n", status, r.Repo, r.Duration.Round(time.Second),
+				counts[RunSuccess]+counts[RunFailure], counts[ResultCached], counts[RunFailure], counts[ResultSkipped])
+			for _, t := range r.Targets {
+				if t.Status == RunFailure || t.Status == ResultSkipped {
+					fmt.Fprintf(w, "  %s %s: %s\n", strings.ToUpper(t.Status), t.Path, t.Error)
+				}
+			}
+			if r.Error != "" {
+				fmt.Fprintf(w, "  %s\n", r.Error)
+			}
+		}
+		fmt.Fprintln(w, "-------------------------------")
+	default:
+		return errors.Errorf("unknown meta summary format %q", format)
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("%d of %d repositories failed: %s", len(failed), len(results), strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MetricsConfig is where the metrics of the runs are pushed, none when both
+// endpoints are empty.
+type MetricsConfig struct {
+	Pushgateway string // URL of a Prometheus Pushgateway, e.g. http://pushgateway:9091.
+	Statsd      string // Address of a statsd server, e.g. localhost:8125.
+	Prefix      string // Prefix of the metric names, mb when empty.
+}
+
+func (m MetricsConfig) prefix() string {
+	if m.Prefix == "" {
+		return "mb"
+	}
+	return m.Prefix
+}
+
+// RunMetrics are the metrics of a run.
+type RunMetrics struct {
+	Branch          string
+	ChangedFiles    int
+	AffectedTargets int
+	Duration        time.Duration
+	Cache           CacheStats
+	Failures        int
+	Targets         []*TargetMetrics // The built targets, in ID order.
+}
+
+// TargetMetrics are the metrics of a built target.
+type TargetMetrics struct {
+	ID       string
+	Status   string
+	Duration time.Duration
+}
+
+// runMetrics returns the metrics of a recorded run.
+func (b *BuildContext) runMetrics(run *Run) *RunMetrics {
+	m := &RunMetrics{Branch: run.Branch, ChangedFiles: len(b.Files), Duration: time.Since(run.Time)}
+	for _, t := range b.Config.Targets {
+		if len(t.Changes) > 0 || b.All {
+			m.AffectedTargets++
+		}
+	}
+	if run.Cache != nil {
+		m.Cache = *run.Cache
+	}
+	for _, rt := range run.Targets {
+		if rt.Status == "" {
+			continue // Interrupted.
+		}
+		if rt.Status == RunFailure {
+			m.Failures++
+		}
+		m.Targets = append(m.Targets, &TargetMetrics{ID: rt.ID(), Status: rt.Status, Duration: rt.Duration})
+	}
+	sort.Slice(m.Targets, func(i, j int) bool { return m.Targets[i].ID < m.Targets[j].ID })
+	return m
+}
+
+// pushMetrics pushes the metrics of a recorded run to the Pushgateway and
+// the statsd server of the metrics config. Failures to push are only
+// warnings, as for the alerts.
+func (b *BuildContext) pushMetrics(ctx context.Context, run *Run) {
+	if b.Metrics.Pushgateway == "" && b.Metrics.Statsd == "" {
+		return
+	}
+	ctx, span := tracer.Start(ctx, "*BuildContext.pushMetrics()")
+	defer span.End()
+	m := b.runMetrics(run)
+	if b.Metrics.Pushgateway != "" {
+		span.SetAttributes(attribute.String("pushgateway", b.Metrics.Pushgateway))
+		if err := pushPrometheus(ctx, b.Metrics.Pushgateway, b.Metrics.prefix(), m); err != nil {
+			Log.Warn("cannot push the metrics", "pushgateway", b.Metrics.Pushgateway, "error", err)
+		}
+	}
+	if b.Metrics.Statsd != "" {
+		span.SetAttributes(attribute.String("statsd", b.Metrics.Statsd))
+		if err := sendStatsd(b.Metrics.Statsd, b.Metrics.prefix(), m); err != nil {
+			Log.Warn("cannot send the metrics", "statsd", b.Metrics.Statsd, "error", err)
+		}
+	}
+}
+
+// writePrometheus writes the metrics in the Prometheus text format.
+func writePrometheus(w *bytes.Buffer, prefix string, m *RunMetrics) {
+	gauge := func(name, help string, v interface{}) {
+		fmt.Fprintf(w, "# HELP %s_%s %s\n# TYPE %s_%s gauge\n%s_%s %v\n", prefix, name, help, prefix, name, prefix, name, v)
+	}
+	gauge("changed_files", "Number of changed files of the last run.", m.ChangedFiles)
+	gauge("affected_targets", "Number of affected targets of the last run.", m.AffectedTargets)
+	gauge("failed_targets", "Number of failed targets of the last run.", m.Failures)
+	gauge("cache_hits", "Number of build cache hits of the last run.", m.Cache.Hits)
+	gauge("cache_misses", "Number of build cache misses of the last run.", m.Cache.Misses)
+	gauge("run_duration_seconds", "Duration of the last run.", m.Duration.Seconds())
+	gauge("run_timestamp_seconds", "End of the last run, in Unix time.", time.Now().Unix())
+	if len(m.Targets) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s_target_duration_seconds Build duration of the targets of the last run.\n# TYPE %s_target_duration_seconds gauge\n", prefix, prefix)
+	for _, t := range m.Targets {
+		fmt.Fprintf(w, "%s_target_duration_seconds{target=%q,status=%q} %v\n", prefix, t.ID, t.Status, t.Duration.Seconds())
+	}
+}
+
+// pushPrometheus replaces the metrics of the group of the branch, under the
+// job of the prefix, in a Pushgateway.
+func pushPrometheus(ctx context.Context, gateway, prefix string, m *RunMetrics) error {
+	var body bytes.Buffer
+	writePrometheus(&body, prefix, m)
+	// The branches with a slash are base64 encoded in the grouping key.
+	url := strings.TrimSuffix(gateway, "/") + "/metrics/job/" + prefix + "/branch"
+	if m.Branch == "" || strings.Contains(m.Branch, "/") {
+		url += "@base64/" + base64.URLEncoding.EncodeToString([]byte(m.Branch))
+	} else {
+		url += "/" + m.Branch
+	}
+	req, err := http.NewRequest(http.MethodPut, url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		rb, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("PUT %s: %s: %s", url, resp.Status, bytes.TrimSpace(rb))
+	}
+	return nil
+}
+
+var statsdNameRe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// writeStatsd writes the metrics as statsd lines: gauges of the run and a
+// timer and a counter of the status of every target.
+func writeStatsd(w *bytes.Buffer, prefix string, m *RunMetrics) {
+	fmt.Fprintf(w, "%s.changed_files:%d|g\n", prefix, m.ChangedFiles)
+	fmt.Fprintf(w, "%s.affected_targets:%d|g\n", prefix, m.AffectedTargets)
+	fmt.Fprintf(w, "%s.failed_targets:%d|g\n", prefix, m.Failures)
+	fmt.Fprintf(w, "%s.cache.hits:%d|c\n", prefix, m.Cache.Hits)
+	fmt.Fprintf(w, "%s.cache.misses:%d|c\n", prefix, m.Cache.Misses)
+	fmt.Fprintf(w, "%s.run.duration:%d|ms\n", prefix, m.Duration.Milliseconds())
+	for _, t := range m.Targets {
+		name := prefix + ".target." + statsdNameRe.ReplaceAllString(t.ID, "_")
+		fmt.Fprintf(w, "%s.duration:%d|ms\n", name, t.Duration.Milliseconds())
+		fmt.Fprintf(w, "%s.%s:1|c\n", name, t.Status)
+	}
+}
+
+// sendStatsd sends the metrics to a statsd server over UDP, a line per
+// packet.
+func sendStatsd(addr, prefix string, m *RunMetrics) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var lines bytes.Buffer
+	writeStatsd(&lines, prefix, m)
+	for _, l := range strings.Split(strings.TrimSpace(lines.String()), "\n") {
+		if _, err := conn.Write([]byte(l)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultLogsDir is where the full build output of every target is written,
+// in <dir>/<target>/stdout.log and stderr.log.
+const DefaultLogsDir = ".monobuild/logs"
+
+// Parts of a build output larger than its limit that are kept.
+const (
+	OutputKeepBoth = "both" // The head and the tail.
+	OutputKeepHead = "head"
+	OutputKeepTail = "tail"
+)
+
+// defaultOutputLimit is the maximum size of a captured output without one.
+const defaultOutputLimit = 1 << 20
+
+// OutputLimit limits the build output that mb keeps in memory, and records
+// in the summaries, the reports, the history and the traces. The output is
+// still streamed in full, and written to the logs dir.
+type OutputLimit struct {
+	MaxSize string `yaml:"max_size"` // Maximum size of the captured stdout, and of the captured stderr, e.g. 512KB. Defaults to 1MB.
+	Keep    string `yaml:"keep"`     // Part of a larger output kept: both, the head and the tail, head or tail. Defaults to both.
+}
+
+func (l OutputLimit) validate(field string) error {
+	if l.MaxSize != "" {
+		if n, err := parseSize(l.MaxSize); err != nil || n <= 0 {
+			return errors.Errorf("%s.max_size: %q is not a size, e.g. 512KB", field, l.MaxSize)
+		}
+	}
+	switch l.Keep {
+	case "", OutputKeepBoth, OutputKeepHead, OutputKeepTail:
+		return nil
+	}
+	return errors.Errorf("%s.keep: %q must be both, head or tail", field, l.Keep)
+}
+
+// over returns the limit with the settings of o over the ones of l.
+func (l OutputLimit) over(o OutputLimit) OutputLimit {
+	if o.MaxSize != "" {
+		l.MaxSize = o.MaxSize
+	}
+	if o.Keep != "" {
+		l.Keep = o.Keep
+	}
+	return l
+}
+
+func (l OutputLimit) size() int {
+	n, err := parseSize(l.MaxSize)
+	if err != nil || n <= 0 {
+		return defaultOutputLimit
+	}
+	return n
+}
+
+var sizeRe = regexp.MustCompile(`^(\d+)\s*([KMG]i?B?|B)?$`)
+
+// parseSize parses a size in bytes, with an optional KB, MB or GB unit of
+// 1024, 1024² or 1024³ bytes.
+func parseSize(s string) (int, error) {
+	m := sizeRe.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, errors.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, err
+	}
+	switch strings.TrimSuffix(strings.TrimSuffix(m[2], "B"), "I") {
+	case "K":
+		n <<= 10
+	case "M":
+		n <<= 20
+	case "G":
+		n <<= 30
+	}
+	return n, nil
+}
+
+// cappedBuffer captures an output up to a limit, keeping its head, its tail
+// or both, and counts the bytes it drops.
+type cappedBuffer struct {
+	name    string // stdout or stderr.
+	headCap int
+	tailCap int
+	head    []byte
+	tail    []byte
+	total   int
+	log     string // The file of the full output, if any.
+
+	mu sync.Mutex // Written by the steps of a parallel group at the same time.
+}
+
+func newCappedBuffer(name string, l OutputLimit, log string) *cappedBuffer {
+	b := &cappedBuffer{name: name, log: log}
+	switch size := l.size(); l.Keep {
+	case OutputKeepHead:
+		b.headCap = size
+	case OutputKeepTail:
+		b.tailCap = size
+	default:
+		b.headCap = size / 2
+		b.tailCap = size - b.headCap
+	}
+	return b
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(p)
+	b.total += n
+	if room := b.headCap - len(b.head); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		b.head = append(b.head, p[:room]...)
+		p = p[room:]
+	}
+	if b.tailCap > 0 && len(p) > 0 {
+		b.tail = append(b.tail, p...)
+		// Trimmed when twice the cap, to copy the tail once in a while only.
+		if len(b.tail) > 2*b.tailCap {
+			b.tail = append([]byte(nil), b.tail[len(b.tail)-b.tailCap:]...)
+		}
+	}
+	return n, nil
+}
+
+// String returns the captured output, with a marker where it was truncated.
+func (b *cappedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tail := b.tail
+	if len(tail) > b.tailCap {
+		tail = tail[len(tail)-b.tailCap:]
+	}
+	dropped := b.total - len(b.head) - len(tail)
+	if dropped <= 0 {
+		return string(b.head) + string(tail)
+	}
+	marker := fmt.Sprintf("\n[mb: %d bytes of %s truncated", dropped, b.name)
+	if b.log != "" {
+		marker += ", the full output is in " + b.log
+	}
+	return string(b.head) + marker + "]\n" + string(tail)
+}
+
+// openLogs creates the files of the full build output of the target, in the
+// logs dir. A failure is only a warning: the build does not need them.
+func (t *Target) openLogs() (stdout, stderr *os.File) {
+	if t.configHooks {
+		return nil, nil
+	}
+	logs := t.logsDir
+	if logs == "" {
+		logs = DefaultLogsDir
+	}
+	dir := filepath.Join(logs, filepath.FromSlash(CleanTreePath(t.Path)))
+	var err error
+	if err = os.MkdirAll(dir, 0755); err == nil {
+		if stdout, err = os.Create(filepath.Join(dir, "stdout.log")); err == nil {
+			if stderr, err = os.Create(filepath.Join(dir, "stderr.log")); err != nil {
+				stdout.Close()
+				stdout = nil
+			}
+		}
+	}
+	if err != nil {
+		Log.Warn("cannot write the full build output", "target", t.Path, "error", err)
+	}
+	return stdout, stderr
+}
+
+// logWriter returns the writer of a log file, which discards when nil.
+func logWriter(f *os.File) io.Writer {
+	if f == nil {
+		return ioutil.Discard
+	}
+	return f
+}
+
+// captureWriter returns the writer of a captured output, which discards
+// when nil, e.g. for the hooks run outside of a build.
+func captureWriter(b *cappedBuffer) io.Writer {
+	if b == nil {
+		return ioutil.Discard
+	}
+	return b
+}
+
+// logName returns the name of a log file, empty when nil.
+func logName(f *os.File) string {
+	if f == nil {
+		return ""
+	}
+	return filepath.ToSlash(f.Name())
+}
@@ -0,0 +1,265 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The statuses of an output file.
+const (
+	OutputOK       = "ok"
+	OutputMissing  = "missing"  // Declared, recorded or matched by no file.
+	OutputStale    = "stale"    // Older than an input of the target.
+	OutputModified = "modified" // Changed since the last recorded build.
+)
+
+// outputsSource is the source of the outputs recorded in the Changes of the
+// targets whose outputs are stale.
+const outputsSource = "outputs"
+
+// TargetOutputs are the declared outputs of a target, their files and the
+// digests recorded by its last successful build.
+type TargetOutputs struct {
+	Path    string        `json:"path"`
+	Name    string        `json:"name,omitempty"`
+	Outputs []string      `json:"outputs"`       // The declared glob patterns.
+	Run     string        `json:"run,omitempty"` // The run of the last successful build that recorded the artifacts.
+	Files   []*OutputFile `json:"files"`
+}
+
+// OutputFile is a file of the outputs of a target.
+type OutputFile struct {
+	Path     string    `json:"path"`
+	Status   string    `json:"status"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Recorded string    `json:"recorded,omitempty"` // The sha256 recorded by the last build.
+	ModTime  time.Time `json:"-"`
+}
+
+// Outputs returns the outputs of the targets that declare some, with the
+// artifacts recorded by the runs of runsDir.
+func (b *BuildContext) Outputs(ctx context.Context, runsDir string) ([]*TargetOutputs, error) {
+	ctx, span := tracer.Start(ctx, "*BuildContext.Outputs()")
+	defer span.End()
+	runs, err := ReadRuns(runsDir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Time.After(runs[j].Time) })
+	outputs := []*TargetOutputs{}
+	for _, t := range b.Config.Targets {
+		if len(t.Outputs) == 0 {
+			continue
+		}
+		to := &TargetOutputs{Path: t.Path, Name: t.Name, Outputs: t.Outputs, Files: []*OutputFile{}}
+		recorded := make(map[string]string)
+		if rt, r := lastOutputs(runs, t); rt != nil {
+			to.Run, recorded = r.ID, rt.Artifacts
+		}
+		newest, err := newestInput(ctx, t, b.Config.DepSourceDirs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "target %s", t.Path)
+		}
+		files, err := outputFiles(t.Outputs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "target %s", t.Path)
+		}
+		seen := make(map[string]bool)
+		for _, p := range t.Outputs {
+			if len(files[p]) == 0 {
+				seen[p] = true
+				to.Files = append(to.Files, &OutputFile{Path: p, Status: OutputMissing, Recorded: recorded[p]})
+			}
+		}
+		for _, p := range t.Outputs {
+			for _, f := range files[p] {
+				if seen[f.Path] {
+					continue
+				}
+				seen[f.Path] = true
+				if f.SHA256, err = fileDigest(f.Path); err != nil {
+					return nil, errors.Wrapf(err, "target %s", t.Path)
+				}
+				f.Recorded = recorded[f.Path]
+				switch {
+				case f.ModTime.Before(newest):
+					f.Status = OutputStale
+				case f.Recorded != "" && f.Recorded != f.SHA256:
+					f.Status = OutputModified
+				}
+				to.Files = append(to.Files, f)
+			}
+		}
+		// The recorded artifacts that the outputs no longer match.
+		var gone []string
+		for name := range recorded {
+			if !seen[name] {
+				gone = append(gone, name)
+			}
+		}
+		sort.Strings(gone)
+		for _, name := range gone {
+			to.Files = append(to.Files, &OutputFile{Path: name, Status: OutputMissing, Recorded: recorded[name]})
+		}
+		outputs = append(outputs, to)
+	}
+	span.SetAttributes(attribute.Int("targets", len(outputs)))
+	return outputs, nil
+}
+
+// lastOutputs returns the record of the last successful build of the target
+// that recorded its artifacts, of the runs sorted newest first.
+func lastOutputs(runs []*Run, t *Target) (*RunTarget, *Run) {
+	for _, r := range runs {
+		for _, rt := range r.Targets {
+			if rt.Status != RunSuccess || rt.Artifacts == nil {
+				continue
+			}
+			if rt.Path == t.Path || (t.Name != "" && rt.Name == t.Name) {
+				return rt, r
+			}
+		}
+	}
+	return nil, nil
+}
+
+// outputFiles returns the files matching each output pattern, the files of
+// the matched directories included, with their modification time.
+func outputFiles(patterns []string) (map[string][]*OutputFile, error) {
+	files := make(map[string][]*OutputFile)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.Errorf("invalid output pattern %s: %v", pattern, err)
+		}
+		for _, m := range matches {
+			err := filepath.Walk(m, func(p string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				files[pattern] = append(files[pattern], &OutputFile{Path: filepath.ToSlash(p), Status: OutputOK, ModTime: info.ModTime()})
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// newestInput returns the modification time of the newest input file of the
+// target.
+func newestInput(ctx context.Context, t *Target, depDirs []string) (time.Time, error) {
+	var newest time.Time
+	files, err := inputFiles(ctx, t, depDirs)
+	if err != nil {
+		return newest, err
+	}
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if os.IsNotExist(err) {
+			continue // Deleted in the working tree.
+		}
+		if err != nil {
+			return newest, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// staleOutputs records a change in the targets that declare outputs and are
+// not affected by the diff, when an output is missing or older than an
+// input of the target: the build that produced them did not see the working
+// tree as it is.
+func (b *BuildContext) staleOutputs(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "*BuildContext.staleOutputs()")
+	defer span.End()
+	stale := 0
+	for _, t := range b.Config.Targets {
+		if len(t.Outputs) == 0 || len(t.Changes) > 0 || !t.buildable() || t.NotCheckedOut {
+			continue
+		}
+		if t.NotAnalyzed {
+			if err := t.analyzeDeps(ctx); err != nil {
+				return err
+			}
+		}
+		files, err := outputFiles(t.Outputs)
+		if err != nil {
+			return errors.Wrapf(err, "target %s", t.Path)
+		}
+		var f *File
+		for _, p := range t.Outputs {
+			if len(files[p]) == 0 {
+				f = &File{Name: p, Status: OutputMissing}
+				break
+			}
+		}
+		if f == nil {
+			newest, err := newestInput(ctx, t, b.Config.DepSourceDirs)
+			if err != nil {
+				return errors.Wrapf(err, "target %s", t.Path)
+			}
+			for _, p := range t.Outputs {
+				for _, of := range files[p] {
+					if of.ModTime.Before(newest) {
+						f = &File{Name: of.Path, Status: OutputStale}
+						break
+					}
+				}
+				if f != nil {
+					break
+				}
+			}
+		}
+		if f == nil {
+			continue
+		}
+		f.Sources, f.StaleOutputOf = []string{outputsSource}, []string{t.Path}
+		t.Changes = append(t.Changes, f)
+		stale++
+		Log.Debug("output of the target is stale", "file", f.Name, "status", f.Status, "target", t.Path)
+	}
+	span.SetAttributes(attribute.Int("stale", stale))
+	return nil
+}
+
+// WriteOutputs writes the outputs of the targets as text, one line per file
+// with its status and sha256, or as json.
+func WriteOutputs(w io.Writer, outputs []*TargetOutputs, format string) error {
+	switch format {
+	case "text":
+		for _, to := range outputs {
+			fmt.Fprintf(w, "%s\n", to.Path)
+			for _, f := range to.Files {
+				sum := f.SHA256
+				if sum == "" {
+					sum = "-"
+				}
+				fmt.Fprintf(w, "  %-9s %.12s %s\n", f.Status, sum, f.Path)
+			}
+		}
+		return nil
+	case "json":
+		b, err := json.MarshalIndent(outputs, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+	return errors.Errorf("unknown outputs format %q", format)
+}
@@ -0,0 +1,107 @@
+package build
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Override is a run-time override of the build command of a target, e.g.
+// target.services/foo.args=[--fast], so that a one-off experiment does not
+// require a change of the config.
+type Override struct {
+	Target string `json:"target"` // Name or path of the target.
+	Field  string `json:"field"`  // One of command, args, dir, timeout or env.<KEY>.
+	Value  string `json:"value"`  // YAML list of the args, else a string.
+}
+
+func (o *Override) String() string {
+	return fmt.Sprintf("target.%s.%s=%s", o.Target, o.Field, o.Value)
+}
+
+// ParseOverride parses target.<name or path>.<field>=<value>. The path of
+// the target may have dots: the field is after the last one, or after
+// .env. for a variable.
+func ParseOverride(s string) (*Override, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || !strings.HasPrefix(kv[0], "target.") {
+		return nil, errors.Errorf("override %q: must be target.<name or path>.<field>=<value>", s)
+	}
+	key := strings.TrimPrefix(kv[0], "target.")
+	o := &Override{Value: kv[1]}
+	if i := strings.LastIndex(key, ".env."); i > 0 {
+		o.Target, o.Field = key[:i], key[i+1:]
+		if !envKeyRe.MatchString(strings.TrimPrefix(o.Field, "env.")) {
+			return nil, errors.Errorf("override %q: %q is not a valid variable name", s, strings.TrimPrefix(o.Field, "env."))
+		}
+		return o, nil
+	}
+	i := strings.LastIndex(key, ".")
+	if i <= 0 {
+		return nil, errors.Errorf("override %q: must be target.<name or path>.<field>=<value>", s)
+	}
+	o.Target, o.Field = key[:i], key[i+1:]
+	switch o.Field {
+	case "command", "dir":
+	case "args":
+		if _, err := o.args(); err != nil {
+			return nil, errors.Wrapf(err, "override %q", s)
+		}
+	case "timeout":
+		if _, err := time.ParseDuration(o.Value); err != nil {
+			return nil, errors.Errorf("override %q: %q is not a duration", s, o.Value)
+		}
+	default:
+		return nil, errors.Errorf("override %q: unknown field %s, must be command, args, dir, timeout or env.<KEY>", s, o.Field)
+	}
+	return o, nil
+}
+
+// args parses the value of an args override: a YAML list, e.g. [-v, ./...],
+// or a single argument.
+func (o *Override) args() ([]string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(o.Value), "[") {
+		return []string{o.Value}, nil
+	}
+	var args []string
+	if err := yaml.UnmarshalStrict([]byte(o.Value), &args); err != nil {
+		return nil, errors.Errorf("args %q is not a YAML list", o.Value)
+	}
+	return args, nil
+}
+
+// ApplyOverrides applies the overrides to the build commands of the targets
+// and records them in the plan. They apply before the build command policy
+// is checked, and change the cache keys of the targets.
+func (b *BuildContext) ApplyOverrides(overrides []*Override) error {
+	for _, o := range overrides {
+		t := b.Config.Target(o.Target)
+		if t == nil {
+			return b.Config.noTarget("override "+o.String(), o.Target)
+		}
+		if len(t.Steps) > 0 {
+			return errors.Errorf("override %s: target %s has steps, its build_command is not run", o, t.Path)
+		}
+		c := &t.BuildCommand
+		switch {
+		case o.Field == "command":
+			c.Command = o.Value
+		case o.Field == "args":
+			c.Args, _ = o.args()
+		case o.Field == "dir":
+			c.Dir = o.Value
+		case o.Field == "timeout":
+			c.Timeout = o.Value
+		case strings.HasPrefix(o.Field, "env."):
+			if c.Env == nil {
+				c.Env = make(map[string]string)
+			}
+			c.Env[strings.TrimPrefix(o.Field, "env.")] = o.Value
+		}
+		b.Overrides = append(b.Overrides, o)
+	}
+	return nil
+}
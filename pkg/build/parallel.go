@@ -0,0 +1,197 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// parallel returns the maximum number of targets built at the same time.
+func (b *BuildContext) parallel() int {
+	if b.Parallel > 0 {
+		return b.Parallel
+	}
+	if b.Config.Parallel > 0 {
+		return b.Config.Parallel
+	}
+	return 1
+}
+
+// buildParallel builds the targets with a pool of workers. A target is
+// started once the targets it depends on are built, and is skipped when one of
+// them failed. Of the ready targets, the one of the lowest priority rank is
+// started first. A failed target does not stop the other builds: every target
+// that can be built is built and the failures are reported together.
+func (b *BuildContext) buildParallel(ctx context.Context, run *Run, targets []*Target, workers int) error {
+	ctx, span := tracer.Start(ctx, "*BuildContext.buildParallel()")
+	defer span.End()
+	span.SetAttributes(attribute.Int64("workers", int64(workers)))
+	if workers > len(targets) {
+		workers = len(targets)
+	}
+	for _, t := range targets {
+		t.prefixOutput = true
+	}
+	deps := dependencyIndexes(targets)
+	pending := make([]int, len(targets)) // Number of dependencies not built yet.
+	dependents := make([][]int, len(targets))
+	for i := range targets {
+		pending[i] = len(deps[i])
+		for _, j := range deps[i] {
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+
+	rank := b.priorities(run, targets)
+	if !b.Deterministic {
+		b.renderer().Info(os.Stdout, fmt.Sprintf("SCHEDULING SEED: %d", run.Seed))
+	}
+	// A deterministic build prints the buffered output of the targets in
+	// order, each once it and the targets before it are built.
+	printed := 0
+	done := make([]bool, len(targets))
+	if b.Deterministic {
+		for _, t := range targets {
+			t.output = &bytes.Buffer{}
+		}
+	}
+	flush := func() {
+		for ; printed < len(targets) && done[printed]; printed++ {
+			if t := targets[printed]; t.output != nil {
+				os.Stdout.Write(t.output.Bytes())
+				t.output = nil
+			}
+		}
+	}
+
+	errs := make([]error, len(targets))
+	skipped := make([]bool, len(targets))
+	var ready []int
+	built := make(chan int)
+	running := 0
+	// start builds the ready targets of the lowest rank while a worker is
+	// free.
+	start := func() {
+		for running < workers && len(ready) > 0 {
+			next := 0
+			for k := range ready {
+				if rank[ready[k]] < rank[ready[next]] {
+					next = k
+				}
+			}
+			i := ready[next]
+			ready = append(ready[:next], ready[next+1:]...)
+			running++
+			go func() {
+				errs[i] = b.buildTarget(ctx, run, targets[i], concurrentTargets(targets, i))
+				built <- i
+			}()
+		}
+	}
+	remaining := len(targets)
+	// complete releases the dependents of a finished target, or skips them
+	// when the target failed or was skipped.
+	var complete func(i int)
+	complete = func(i int) {
+		remaining--
+		done[i] = true
+		for _, d := range dependents[i] {
+			if skipped[d] {
+				continue
+			}
+			if errs[i] != nil {
+				skipped[d] = true
+				errs[d] = errors.Errorf("dependency %s failed", targets[i].Path)
+				b.writeSkipped(ctx, run, targets[d], errs[d])
+				complete(d)
+				continue
+			}
+			if pending[d]--; pending[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+	for i := range targets {
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	for remaining > 0 {
+		start()
+		i := <-built
+		running--
+		complete(i)
+		flush()
+	}
+
+	var failed []string
+	results := make([]*TargetOutcome, len(targets))
+	for i, t := range targets {
+		results[i] = run.outcome(t.Path, errs[i])
+		if skipped[i] {
+			results[i].Status = ResultSkipped
+		}
+		if skipped[i] || errs[i] != nil {
+			failed = append(failed, t.Path)
+		}
+	}
+	b.summary(results)
+	if len(failed) > 0 {
+		return errors.Errorf("%d of %d targets failed or were skipped: %s", len(failed), len(targets), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// buildSerial builds the targets one at a time, up to the first failure. With
+// KeepGoing, every target is built but the dependents of a failed target,
+// which are skipped, and the failures are reported together.
+func (b *BuildContext) buildSerial(ctx context.Context, run *Run, targets []*Target) error {
+	deps := dependencyIndexes(targets)
+	errs := make([]error, len(targets))
+	var results []*TargetOutcome
+	var failed []string
+	for i, t := range targets {
+		for _, j := range deps[i] {
+			if errs[j] != nil {
+				errs[i] = errors.Errorf("dependency %s failed", targets[j].Path)
+				break
+			}
+		}
+		if errs[i] != nil {
+			b.writeSkipped(ctx, run, t, errs[i])
+			o := run.outcome(t.Path, errs[i])
+			o.Status = ResultSkipped
+			results = append(results, o)
+			failed = append(failed, t.Path)
+			continue
+		}
+		errs[i] = b.buildTarget(ctx, run, t, nil)
+		results = append(results, run.outcome(t.Path, errs[i]))
+		if errs[i] == nil {
+			continue
+		}
+		if !b.KeepGoing || cancelled(errs[i]) {
+			b.summary(results)
+			return errs[i]
+		}
+		failed = append(failed, t.Path)
+	}
+	b.summary(results)
+	if len(failed) > 0 {
+		return errors.Errorf("%d of %d targets failed or were skipped: %s", len(failed), len(targets), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// concurrentTargets returns the targets other than targets[i]. Any of them
+// may be built while targets[i] is.
+func concurrentTargets(targets []*Target, i int) []*Target {
+	others := make([]*Target, 0, len(targets)-1)
+	others = append(others, targets[:i]...)
+	return append(others, targets[i+1:]...)
+}
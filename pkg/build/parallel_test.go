@@ -0,0 +1,152 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testBuild builds the targets of testTargets in a temporary directory, the
+// ones of fail failing, and returns the targets built, in order, and the
+// targets skipped.
+func testBuild(t *testing.T, build func(b *BuildContext, targets []*Target) error, specs []string, fail string) (built, skipped []string, err error) {
+	dir, err := ioutil.TempDir("", "monobuild-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The logs and the TMPDIR of the targets are relative to the working
+	// directory.
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	order := filepath.Join(dir, "order")
+	targets := testTargets(specs...)
+	failing := make(map[string]bool)
+	for _, p := range strings.Fields(fail) {
+		failing[p] = true
+	}
+	for _, target := range targets {
+		code := 0
+		if failing[target.Path] {
+			code = 1
+		}
+		target.BuildCommand = BuildCommand{Command: "sh", Args: []string{"-c", fmt.Sprintf("echo %s >> %s; exit %d", target.Path, order, code)}}
+	}
+	b := &BuildContext{Config: Config{Targets: targets}, NoCache: true, Deterministic: true}
+	err = build(b, targets)
+	if data, rerr := ioutil.ReadFile(order); rerr == nil {
+		built = strings.Fields(string(data))
+	}
+	for _, target := range targets {
+		if target.skipped != "" {
+			skipped = append(skipped, target.Path)
+		}
+	}
+	return built, skipped, err
+}
+
+func TestBuildSerial(t *testing.T) {
+	tests := []struct {
+		name      string
+		targets   []string // In build order.
+		fail      string
+		keepGoing bool
+		built     string
+		skipped   string
+		err       string // A part of the error, none when the build succeeds.
+	}{
+		{name: "all built", targets: []string{"b", "a:b", "c"}, built: "b a c"},
+		{name: "stop at the first failure", targets: []string{"a", "b", "c"}, fail: "b", built: "a b", err: "exit status 1"},
+		{name: "keep going", targets: []string{"a", "b", "c"}, fail: "a b", keepGoing: true, built: "a b c", err: "2 of 3 targets failed or were skipped: a, b"},
+		{name: "skip the dependents", targets: []string{"b", "a:b", "d:a", "c"}, fail: "b", keepGoing: true, built: "b c", skipped: "a d", err: "3 of 4 targets failed or were skipped: b, a, d"},
+		{name: "dependency not built", targets: []string{"a:lib", "b"}, built: "a b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			built, skipped, err := testBuild(t, func(b *BuildContext, targets []*Target) error {
+				b.KeepGoing = tt.keepGoing
+				return b.buildSerial(context.Background(), &Run{ID: "test"}, targets)
+			}, tt.targets, tt.fail)
+			if got := strings.Join(built, " "); got != tt.built {
+				t.Errorf("built %q, want %q", got, tt.built)
+			}
+			if got := strings.Join(skipped, " "); got != tt.skipped {
+				t.Errorf("skipped %q, want %q", got, tt.skipped)
+			}
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("buildSerial() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestBuildParallel(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []string
+		fail    string
+		workers int
+		built   string // In order with a single worker, sorted otherwise.
+		skipped string
+		err     string
+	}{
+		{name: "config order", targets: []string{"a", "b", "c"}, workers: 1, built: "a b c"},
+		{name: "dependency first", targets: []string{"a:c", "b", "c"}, workers: 1, built: "b c a"},
+		{name: "diamond", targets: []string{"a:b,c", "b:d", "c:d", "d"}, workers: 1, built: "d b c a"},
+		{name: "failure does not stop the others", targets: []string{"a", "b", "c"}, fail: "a", workers: 1, built: "a b c", err: "1 of 3 targets failed or were skipped: a"},
+		{name: "skip the dependents", targets: []string{"a:b", "b", "c:a", "d"}, fail: "b", workers: 1, built: "b d", skipped: "a c", err: "3 of 4 targets failed or were skipped: a, b, c"},
+		{name: "skip a dependent once", targets: []string{"a:b,c", "b", "c"}, fail: "b c", workers: 1, built: "b c", skipped: "a", err: "3 of 3 targets failed or were skipped: a, b, c"},
+		{name: "dependency not built", targets: []string{"a:lib", "b"}, workers: 1, built: "a b"},
+		{name: "workers", targets: []string{"a:b", "b", "c:a", "d", "e"}, workers: 3, built: "a b c d e"},
+		{name: "workers skip the dependents", targets: []string{"a:b", "b", "c:a", "d", "e"}, fail: "b", workers: 3, built: "b d e", skipped: "a c", err: "3 of 5 targets failed or were skipped: a, b, c"},
+		{name: "more workers than targets", targets: []string{"a", "b"}, workers: 8, built: "a b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			built, skipped, err := testBuild(t, func(b *BuildContext, targets []*Target) error {
+				return b.buildParallel(context.Background(), &Run{ID: "test"}, targets, tt.workers)
+			}, tt.targets, tt.fail)
+			if tt.workers > 1 {
+				sort.Strings(built)
+			}
+			if got := strings.Join(built, " "); got != tt.built {
+				t.Errorf("built %q, want %q", got, tt.built)
+			}
+			if got := strings.Join(skipped, " "); got != tt.skipped {
+				t.Errorf("skipped %q, want %q", got, tt.skipped)
+			}
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("buildParallel() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestBuildParallelDependencyOrder(t *testing.T) {
+	built, _, err := testBuild(t, func(b *BuildContext, targets []*Target) error {
+		return b.buildParallel(context.Background(), &Run{ID: "test"}, targets, 4)
+	}, []string{"a:b", "b:c", "c", "d:c", "e"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := make(map[string]int)
+	for i, p := range built {
+		index[p] = i
+	}
+	for _, dep := range [][2]string{{"a", "b"}, {"b", "c"}, {"d", "c"}} {
+		if index[dep[0]] < index[dep[1]] {
+			t.Errorf("%s built before its dependency %s: %q", dep[0], dep[1], built)
+		}
+	}
+}
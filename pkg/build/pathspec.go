@@ -0,0 +1,132 @@
+package build
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// pathspec is a parsed git pathspec, e.g. services/** or :!docs.
+type pathspec struct {
+	exclude bool
+	prefix  string         // A pathspec without wildcards matches the path and the files under it.
+	re      *regexp.Regexp // A pathspec with wildcards, which match '/' as in git.
+}
+
+// parsePathspec parses a git pathspec, with the exclude (! or ^), top (/),
+// glob, literal and icase magic. The paths of mb are relative to the top of
+// the repository, so the top magic is implied.
+func parsePathspec(s string) (*pathspec, error) {
+	p := &pathspec{}
+	spec := s
+	literal, icase := false, false
+	if strings.HasPrefix(spec, ":(") {
+		end := strings.Index(spec, ")")
+		if end < 0 {
+			return nil, errors.Errorf("pathspec %q: unterminated magic", s)
+		}
+		for _, m := range strings.Split(spec[2:end], ",") {
+			switch strings.TrimSpace(m) {
+			case "exclude":
+				p.exclude = true
+			case "top", "glob":
+			case "literal":
+				literal = true
+			case "icase":
+				icase = true
+			default:
+				return nil, errors.Errorf("pathspec %q: unsupported magic %q", s, m)
+			}
+		}
+		spec = spec[end+1:]
+	} else if strings.HasPrefix(spec, ":") {
+		spec = spec[1:]
+		for len(spec) > 0 && strings.ContainsRune("!^/", rune(spec[0])) {
+			if spec[0] != '/' {
+				p.exclude = true
+			}
+			spec = spec[1:]
+		}
+		spec = strings.TrimPrefix(spec, ":")
+	}
+	spec = strings.TrimSuffix(CleanTreePath(spec), "/")
+	if spec == "" || spec == "." {
+		spec = ""
+	}
+	if literal || !strings.ContainsAny(spec, "*?[") {
+		p.prefix = spec
+		if icase {
+			p.re = regexp.MustCompile("(?i)^" + regexp.QuoteMeta(spec) + "(/|$)")
+		}
+		return p, nil
+	}
+	var re strings.Builder
+	if icase {
+		re.WriteString("(?i)")
+	}
+	re.WriteString("^")
+	for i := 0; i < len(spec); i++ {
+		switch c := spec[i]; c {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString(".")
+		case '[':
+			end := strings.IndexByte(spec[i:], ']')
+			if end < 0 {
+				return nil, errors.Errorf("pathspec %q: unterminated [", s)
+			}
+			re.WriteString(spec[i : i+end+1])
+			i += end
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("(/.*)?$")
+	var err error
+	if p.re, err = regexp.Compile(re.String()); err != nil {
+		return nil, errors.Errorf("pathspec %q: %v", s, err)
+	}
+	return p, nil
+}
+
+func (p *pathspec) match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	return p.prefix == "" || name == p.prefix || strings.HasPrefix(name, p.prefix+"/")
+}
+
+// pathspecFilter reports whether a changed file is in the scope of the
+// pathspecs, as git diff -- <pathspec>... would: it matches one of the
+// pathspecs, or there are only exclude ones, and matches no exclude one.
+type pathspecFilter []*pathspec
+
+// parsePathspecs parses the pathspecs of a diff, none matching every file.
+func parsePathspecs(specs []string) (pathspecFilter, error) {
+	var f pathspecFilter
+	for _, s := range specs {
+		p, err := parsePathspec(s)
+		if err != nil {
+			return nil, err
+		}
+		f = append(f, p)
+	}
+	return f, nil
+}
+
+func (f pathspecFilter) match(name string) bool {
+	included, includes := false, false
+	for _, p := range f {
+		if p.exclude {
+			if p.match(name) {
+				return false
+			}
+			continue
+		}
+		includes = true
+		included = included || p.match(name)
+	}
+	return included || !includes
+}
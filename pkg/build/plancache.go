@@ -0,0 +1,143 @@
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// planCacheVersion is part of the plan cache keys, to invalidate the cached
+// plans when their format changes.
+const planCacheVersion = "v3"
+
+// PlanCache stores the diffed BuildContexts of commit ranges, keyed by the
+// base and head SHAs and the config, in a local directory and optionally in
+// a remote HTTP store that supports GET and PUT.
+type PlanCache struct {
+	Dir string
+	URL string
+}
+
+func DefaultPlanCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "monobuild", "plans")
+}
+
+// PlanKey returns the cache key of the plan of a commit range, restricted to
+// the pathspecs, and false when the plan cannot be cached: the range is not
+// between two commits, the tracked files are modified or the config has
+// !secret values.
+func PlanKey(ctx context.Context, configFile, commitRange string, pathspecs ...string) (string, bool) {
+	ctx, span := tracer.Start(ctx, "PlanKey")
+	defer span.End()
+	base, head, ok := resolveCommitRange(ctx, commitRange)
+	if !ok {
+		return "", false
+	}
+	if dirty, err := gitOutput(ctx, "status", "--porcelain", "--untracked-files=no"); err != nil || dirty != "" {
+		return "", false
+	}
+	before := len(secretValues)
+	fb, _, err := ReadConfig(ctx, configFile)
+	if err != nil || len(secretValues) > before {
+		return "", false
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", planCacheVersion, base, head)
+	for _, p := range pathspecs {
+		fmt.Fprintf(h, "pathspec %s\n", p)
+	}
+	h.Write(fb)
+	return fmt.Sprintf("%x", h.Sum(nil)), true
+}
+
+// resolveCommitRange resolves a..b and a...b ranges to the SHAs that
+// `git diff` compares.
+func resolveCommitRange(ctx context.Context, commitRange string) (string, string, bool) {
+	var base, head string
+	var err error
+	switch {
+	case strings.Contains(commitRange, "..."):
+		revs := strings.SplitN(commitRange, "...", 2)
+		if base, err = gitOutput(ctx, "merge-base", revs[0], revs[1]); err != nil {
+			return "", "", false
+		}
+		head = revs[1]
+	case strings.Contains(commitRange, ".."):
+		revs := strings.SplitN(commitRange, "..", 2)
+		base, head = revs[0], revs[1]
+	default:
+		// A single revision is compared against the working tree.
+		return "", "", false
+	}
+	shas, err := gitLines(ctx, "rev-parse", base+"^{commit}", head+"^{commit}")
+	if err != nil || len(shas) != 2 {
+		return "", "", false
+	}
+	return shas[0], shas[1], true
+}
+
+// get returns the cached plan, from the local directory first.
+func (c *PlanCache) Get(ctx context.Context, key string) (*BuildContext, bool) {
+	ctx, span := tracer.Start(ctx, "*PlanCache.Get()")
+	defer span.End()
+	name := filepath.Join(c.Dir, key+".json")
+	b, err := ioutil.ReadFile(name)
+	if err != nil && c.URL != "" {
+		if b, err = doRequest(ctx, http.MethodGet, c.url(key), nil, nil); err == nil {
+			c.writeLocal(name, b)
+		}
+	}
+	if err != nil {
+		return nil, false
+	}
+	bc := &BuildContext{}
+	if err := json.Unmarshal(b, bc); err != nil {
+		return nil, false
+	}
+	return bc, true
+}
+
+// put stores a plan locally and remotely. Failures are only warnings, the
+// plan cache is an optimization.
+func (c *PlanCache) Put(ctx context.Context, key string, bc *BuildContext) {
+	ctx, span := tracer.Start(ctx, "*PlanCache.Put()")
+	defer span.End()
+	b, err := json.Marshal(bc)
+	if err != nil {
+		return
+	}
+	if err := c.writeLocal(filepath.Join(c.Dir, key+".json"), b); err != nil {
+		Log.Warn("cannot write the plan cache", "dir", c.Dir, "error", err)
+	}
+	if c.URL != "" {
+		if _, err := doRequest(ctx, http.MethodPut, c.url(key), nil, json.RawMessage(b)); err != nil {
+			Log.Warn("cannot upload the plan to the plan cache", "url", c.URL, "error", err)
+		}
+	}
+}
+
+func (c *PlanCache) writeLocal(name string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	// Write then rename, so that concurrent readers never see a partial plan.
+	tmp := fmt.Sprintf("%s.%d.tmp", name, os.Getpid())
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (c *PlanCache) url(key string) string {
+	return strings.TrimSuffix(c.URL, "/") + "/" + key + ".json"
+}
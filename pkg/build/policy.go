@@ -0,0 +1,134 @@
+package build
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PolicyConfig represents the security policy applied to every build command.
+// It is useful when the config is maintained by many teams in one repository.
+type PolicyConfig struct {
+	AllowCommands []string `yaml:"allow_commands"` // Glob patterns of the binaries build commands may invoke, found in the PATH, or their exact paths. Empty allows all.
+	DenyCommands  []string `yaml:"deny_commands"`  // Glob patterns of the binaries build commands may not invoke.
+	PassEnv       []string `yaml:"pass_env"`       // Glob patterns of the env vars passed to build commands. Empty passes all.
+}
+
+func (p PolicyConfig) validate() error {
+	for _, patterns := range [][]string{p.AllowCommands, p.DenyCommands, p.PassEnv} {
+		for _, pattern := range patterns {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return errors.Errorf("policy: invalid pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// check returns an error if the policy forbids the command.
+//
+// A command with a path, e.g. ./scripts/go, is not the binary of its base
+// name found in the PATH: it is allowed only when its path is listed.
+func (p PolicyConfig) check(c BuildCommand) error {
+	if !c.defined() {
+		return nil
+	}
+	bin := filepath.Base(c.Command)
+	if matchAny(p.DenyCommands, bin) || matchAny(p.DenyCommands, c.Command) {
+		return errors.Errorf("policy: command %s is denied", c.Command)
+	}
+	if len(p.AllowCommands) == 0 {
+		return nil
+	}
+	allowed := matchAny(p.AllowCommands, c.Command)
+	if strings.ContainsRune(c.Command, '/') || strings.ContainsRune(c.Command, filepath.Separator) {
+		allowed = allowed || matchAny(p.AllowCommands, filepath.Clean(c.Command))
+	}
+	if !allowed {
+		return errors.Errorf("policy: command %s is not in allow_commands", c.Command)
+	}
+	return nil
+}
+
+// checkResolved returns an error if the policy forbids the binary a command
+// without a path resolved to in the PATH of its environment, which the env
+// and the env files of a target may set. A binary of the repository, e.g. of
+// a PATH set to a directory of the change being built, is allowed only when
+// its path is listed, as a command with a path, or when it is a tool mb
+// installed, which the change cannot commit.
+func (p PolicyConfig) checkResolved(ctx context.Context, command, resolved, dir string) error {
+	if len(p.AllowCommands) == 0 || resolved == command {
+		return nil
+	}
+	if dir == "" {
+		dir = "."
+	}
+	if !filepath.IsAbs(resolved) {
+		// A relative path is run from the directory of the command.
+		resolved = filepath.Join(dir, resolved)
+	}
+	top, rel, err := inRepository(ctx, dir, resolved)
+	if err != nil {
+		return err
+	}
+	if top == "" || matchAny(p.AllowCommands, rel) || matchAny(p.AllowCommands, "./"+rel) {
+		return nil
+	}
+	if strings.HasPrefix(rel, ToolsDir+"/") {
+		if tracked, err := gitLines(ctx, "-C", top, "ls-files", "--", rel); err == nil && len(tracked) == 0 {
+			return nil
+		}
+	}
+	return errors.Errorf("policy: command %s resolves to %s of the repository, which is not in allow_commands", command, rel)
+}
+
+// inRepository returns the top directory of the repository of dir and the
+// slash-separated path of name relative to it, after resolving the symlinks
+// of both, when name is in the repository. top is empty otherwise.
+func inRepository(ctx context.Context, dir, name string) (top, rel string, err error) {
+	if top, err = gitOutput(ctx, "-C", dir, "rev-parse", "--show-toplevel"); err != nil {
+		if top, err = filepath.Abs(dir); err != nil {
+			return "", "", err
+		}
+	}
+	if name, err = filepath.Abs(name); err != nil {
+		return "", "", err
+	}
+	if p, err := filepath.EvalSymlinks(name); err == nil {
+		name = p
+	}
+	if t, err := filepath.EvalSymlinks(top); err == nil {
+		top = t
+	}
+	rel, err = filepath.Rel(top, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", "", nil
+	}
+	return top, filepath.ToSlash(rel), nil
+}
+
+// environ filters the KEY=value pairs of env down to the pass_env patterns.
+// It returns nil, which inherits the whole environment, when pass_env is empty.
+func (p PolicyConfig) environ(env []string) []string {
+	if len(p.PassEnv) == 0 {
+		return nil
+	}
+	filtered := []string{}
+	for _, kv := range env {
+		if matchAny(p.PassEnv, strings.SplitN(kv, "=", 2)[0]) {
+			filtered = append(filtered, kv)
+		}
+	}
+	return filtered
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
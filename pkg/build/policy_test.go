@@ -0,0 +1,69 @@
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyCheckResolved(t *testing.T) {
+	outside, err := ioutil.TempDir("", "monobuild-path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	tests := []struct {
+		name  string
+		allow []string
+		path  string // The PATH of the command, relative to the repository.
+		dir   string
+		valid bool
+	}{
+		{name: "no allow_commands", path: "bin", valid: true},
+		{name: "PATH of the repository", allow: []string{"go"}, path: "bin"},
+		{name: "absolute PATH of the repository", allow: []string{"go"}, path: "$repo/bin"},
+		{name: "PATH relative to the command dir", allow: []string{"go"}, path: "bin", dir: "svc"},
+		{name: "binary of the repository listed", allow: []string{"go", "bin/go"}, path: "bin", valid: true},
+		{name: "binary of the repository listed with ./", allow: []string{"go", "./bin/go"}, path: "bin", valid: true},
+		{name: "PATH outside of the repository", allow: []string{"go"}, path: outside, valid: true},
+		{name: "installed tool", allow: []string{"go"}, path: ToolsDir + "/go/1.22/bin", valid: true},
+		{name: "committed tool", allow: []string{"go"}, path: ToolsDir + "/go/1.21/bin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer testRepo(t, map[string]string{
+				"bin/go":                     "#!/bin/sh\n: > ran\n",
+				"svc/bin/go":                 "#!/bin/sh\n: > ran\n",
+				ToolsDir + "/go/1.21/bin/go": "#!/bin/sh\n: > ran\n",
+			})()
+			// An installed tool is not tracked.
+			writeTestFile(t, ToolsDir+"/go/1.22/bin/go", "#!/bin/sh\n: > ran\n")
+			writeTestFile(t, filepath.Join(outside, "go"), "#!/bin/sh\n: > ran\n")
+			for _, f := range []string{"bin/go", "svc/bin/go", ToolsDir + "/go/1.21/bin/go", ToolsDir + "/go/1.22/bin/go", filepath.Join(outside, "go")} {
+				if err := os.Chmod(f, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			repo, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := os.Expand(tt.path, func(string) string { return repo })
+			target := &Target{Path: "svc", policy: PolicyConfig{AllowCommands: tt.allow}}
+			c := &BuildCommand{Command: "go", Dir: tt.dir, Env: map[string]string{"PATH": path}}
+			env, err := c.environ(os.Environ())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = target.runCommand(context.Background(), c, env, prettyRenderer{})
+			if (err == nil) != tt.valid {
+				t.Errorf("PATH %s: runCommand() = %v, want valid %v", tt.path, err, tt.valid)
+			}
+			if ran := fileExists(filepath.Join(tt.dir, "ran")); ran != tt.valid {
+				t.Errorf("PATH %s: the binary ran %v, want %v", tt.path, ran, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package build
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ProblemMatcher turns the lines of the build output into problems, with the
+// fields of a GitHub Actions problem matcher: the patterns match consecutive
+// lines and the last one can loop over the following lines.
+type ProblemMatcher struct {
+	Owner    string           `yaml:"owner"`
+	Severity string           `yaml:"severity"` // error, warning or notice, when not captured. Defaults to error.
+	Pattern  []ProblemPattern `yaml:"pattern"`
+}
+
+// ProblemPattern is a regexp and the groups of the fields of the problem it
+// captures, 0 when not captured.
+type ProblemPattern struct {
+	Regexp   string `yaml:"regexp"`
+	File     int    `yaml:"file"`
+	Line     int    `yaml:"line"`
+	Column   int    `yaml:"column"`
+	Severity int    `yaml:"severity"`
+	Code     int    `yaml:"code"`
+	Message  int    `yaml:"message"`
+	Loop     bool   `yaml:"loop"`
+}
+
+// Problem is a compiler or linter error of the build output of a target.
+type Problem struct {
+	Owner    string `json:"owner,omitempty"`
+	Severity string `json:"severity"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Code     string `json:"code,omitempty"`
+	Message  string `json:"message"`
+}
+
+// String formats a problem as file:line:column: message.
+func (p Problem) String() string {
+	var loc []string
+	for _, s := range []string{p.File, itoa(p.Line), itoa(p.Column)} {
+		if s != "" {
+			loc = append(loc, s)
+		}
+	}
+	if len(loc) == 0 {
+		return p.Message
+	}
+	return strings.Join(loc, ":") + ": " + p.Message
+}
+
+func (m ProblemMatcher) validate(target string) error {
+	switch m.Severity {
+	case "", "error", "warning", "notice":
+	default:
+		return errors.Errorf("target.problem_matchers: %s of target %s has an unknown severity %q, must be one of error, warning or notice", m.Owner, target, m.Severity)
+	}
+	if len(m.Pattern) == 0 {
+		return errors.Errorf("target.problem_matchers: %s of target %s has no pattern", m.Owner, target)
+	}
+	message := false
+	for i, p := range m.Pattern {
+		re, err := regexp.Compile(p.Regexp)
+		if err != nil {
+			return errors.Wrapf(err, "target.problem_matchers: %s of target %s", m.Owner, target)
+		}
+		for _, g := range []int{p.File, p.Line, p.Column, p.Severity, p.Code, p.Message} {
+			if g < 0 || g > re.NumSubexp() {
+				return errors.Errorf("target.problem_matchers: %s of target %s has no group %d in %s", m.Owner, target, g, p.Regexp)
+			}
+		}
+		if p.Loop && i != len(m.Pattern)-1 {
+			return errors.Errorf("target.problem_matchers: %s of target %s can only loop over its last pattern", m.Owner, target)
+		}
+		message = message || p.Message > 0
+	}
+	if !message {
+		return errors.Errorf("target.problem_matchers: %s of target %s captures no message", m.Owner, target)
+	}
+	return nil
+}
+
+// match returns the problems of the lines of an output.
+func (m ProblemMatcher) match(lines []string) []Problem {
+	res := make([]*regexp.Regexp, len(m.Pattern))
+	for i, p := range m.Pattern {
+		res[i] = regexp.MustCompile(p.Regexp)
+	}
+	var (
+		problems []Problem
+		cur      Problem // The fields captured by the patterns before the last one.
+		next     int
+	)
+	for _, l := range lines {
+		groups := res[next].FindStringSubmatch(l)
+		if groups == nil && next > 0 {
+			// The sequence is broken, the line may start another one.
+			cur, next = Problem{}, 0
+			groups = res[0].FindStringSubmatch(l)
+		}
+		if groups == nil {
+			continue
+		}
+		if next < len(m.Pattern)-1 {
+			m.Pattern[next].capture(&cur, groups)
+			next++
+			continue
+		}
+		p := cur
+		m.Pattern[next].capture(&p, groups)
+		problems = append(problems, m.problem(p))
+		// A looping pattern matches the next lines, with the fields captured
+		// before it.
+		if !m.Pattern[next].Loop {
+			cur, next = Problem{}, 0
+		}
+	}
+	return problems
+}
+
+func (p ProblemPattern) capture(pr *Problem, groups []string) {
+	group := func(i int) string {
+		if i <= 0 || i >= len(groups) {
+			return ""
+		}
+		return strings.TrimSpace(groups[i])
+	}
+	if s := group(p.File); s != "" {
+		pr.File = s
+	}
+	if n, err := strconv.Atoi(group(p.Line)); err == nil {
+		pr.Line = n
+	}
+	if n, err := strconv.Atoi(group(p.Column)); err == nil {
+		pr.Column = n
+	}
+	if s := group(p.Severity); s != "" {
+		pr.Severity = strings.ToLower(s)
+	}
+	if s := group(p.Code); s != "" {
+		pr.Code = s
+	}
+	if s := group(p.Message); s != "" {
+		pr.Message = s
+	}
+}
+
+func (m ProblemMatcher) problem(p Problem) Problem {
+	p.Owner = m.Owner
+	switch {
+	case strings.HasPrefix(p.Severity, "warn"):
+		p.Severity = "warning"
+	case p.Severity == "notice" || p.Severity == "info":
+		p.Severity = "notice"
+	case p.Severity == "" && m.Severity != "":
+		p.Severity = m.Severity
+	default:
+		p.Severity = "error"
+	}
+	return p
+}
+
+// problems returns the problems of the build output of a target, matched by
+// its problem matchers.
+func (t *Target) problems() []Problem {
+	var problems []Problem
+	for _, m := range t.ProblemMatchers {
+		for _, out := range []string{t.BuildCommand.Output, t.BuildCommand.Error} {
+			problems = append(problems, m.match(strings.Split(out, "\n"))...)
+		}
+	}
+	return problems
+}
@@ -0,0 +1,292 @@
+package build
+
+import (
+	"context"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The sources of the build requests of a BuildQueue.
+const (
+	QueueSourceWebhook  = "webhook"
+	QueueSourceAPI      = "api"
+	QueueSourceSchedule = "schedule"
+)
+
+// BranchPriority is the priority of the builds of the branches matching
+// Pattern. The builds of the lowest priority are started first.
+type BranchPriority struct {
+	Pattern  string
+	Priority int
+}
+
+// ParseBranchPriorities parses a comma-separated list of branch patterns,
+// optionally followed by =<priority>. A pattern without a priority has the
+// priority of its position in the list, so that "main,release/*" starts the
+// builds of main before the builds of the release branches, and both before
+// the builds of the other branches.
+func ParseBranchPriorities(s string) ([]BranchPriority, error) {
+	var priorities []BranchPriority
+	for i, item := range SplitList(s) {
+		p := BranchPriority{Pattern: item, Priority: i}
+		if eq := strings.LastIndex(item, "="); eq >= 0 {
+			n, err := strconv.Atoi(item[eq+1:])
+			if err != nil {
+				return nil, errors.Errorf("branch priority %q: %v", item, err)
+			}
+			p = BranchPriority{Pattern: item[:eq], Priority: n}
+		}
+		if _, err := path.Match(p.Pattern, ""); err != nil {
+			return nil, errors.Errorf("branch priority %q: %v", item, err)
+		}
+		priorities = append(priorities, p)
+	}
+	return priorities, nil
+}
+
+// QueuedBuild is a build request of a BuildQueue.
+type QueuedBuild struct {
+	Repo     string
+	Branch   string
+	SHA      string
+	Source   string
+	Priority int
+	Queued   time.Time
+	Started  time.Time
+	Replaced int `json:",omitempty"` // Number of requests of the same branch this one replaced.
+
+	run func(ctx context.Context) error
+}
+
+// QueueStatus is a snapshot of a BuildQueue.
+type QueueStatus struct {
+	MaxInFlight int
+	InFlight    []QueuedBuild
+	Queued      []QueuedBuild
+	Done        int
+	Failed      int
+	Replaced    int
+}
+
+// BuildQueue runs the build requests of a daemon, at most MaxInFlight at a
+// time, so that a burst of pushes does not overwhelm the host.
+//
+// Of the queued requests, the one of the lowest branch priority is started
+// first. Between requests of the same priority, the repository with the
+// fewest builds in flight, then the one whose last build started the
+// longest ago, goes first, so that a busy repository does not starve the
+// others. A request replaces the queued request of the same repository
+// and branch: only the latest push of a branch is built.
+type BuildQueue struct {
+	MaxInFlight int
+	Branches    []BranchPriority
+
+	mu          sync.Mutex
+	queued      []*QueuedBuild
+	inFlight    []*QueuedBuild
+	repoRunning map[string]int
+	repoStarted map[string]time.Time
+	done        int
+	failed      int
+	replaced    int
+}
+
+// NewBuildQueue creates a queue running at most maxInFlight builds at a time.
+func NewBuildQueue(maxInFlight int, branches []BranchPriority) *BuildQueue {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	return &BuildQueue{
+		MaxInFlight: maxInFlight,
+		Branches:    branches,
+		repoRunning: make(map[string]int),
+		repoStarted: make(map[string]time.Time),
+	}
+}
+
+// priority returns the priority of the builds of a branch: the priority of
+// the first matching pattern, or one more than the highest priority when
+// no pattern matches.
+func (q *BuildQueue) priority(branch string) int {
+	lowest := 0
+	for _, p := range q.Branches {
+		if ok, _ := path.Match(p.Pattern, branch); ok {
+			return p.Priority
+		}
+		if p.Priority >= lowest {
+			lowest = p.Priority + 1
+		}
+	}
+	return lowest
+}
+
+// Submit queues a build request. run is called without the lock of the
+// queue once the request is started.
+func (q *BuildQueue) Submit(repo, branch, sha, source string, run func(ctx context.Context) error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	qb := &QueuedBuild{
+		Repo:     repo,
+		Branch:   branch,
+		SHA:      sha,
+		Source:   source,
+		Priority: q.priority(branch),
+		Queued:   time.Now(),
+		run:      run,
+	}
+	for i, old := range q.queued {
+		if old.Repo == repo && old.Branch == branch && branch != "" {
+			// Keep the place of the replaced request in the queue.
+			qb.Queued = old.Queued
+			qb.Replaced = old.Replaced + 1
+			q.queued[i] = qb
+			q.replaced++
+			log.Printf("queue: %s@%s replaces %s on %s", repo, sha, old.SHA, branch)
+			return
+		}
+	}
+	q.queued = append(q.queued, qb)
+	q.dispatch()
+}
+
+// next returns the index of the queued request to start next.
+func (q *BuildQueue) next() int {
+	best := 0
+	for i := 1; i < len(q.queued); i++ {
+		a, b := q.queued[i], q.queued[best]
+		switch {
+		case a.Priority != b.Priority:
+			if a.Priority < b.Priority {
+				best = i
+			}
+		case q.repoRunning[a.Repo] != q.repoRunning[b.Repo]:
+			if q.repoRunning[a.Repo] < q.repoRunning[b.Repo] {
+				best = i
+			}
+		case !q.repoStarted[a.Repo].Equal(q.repoStarted[b.Repo]):
+			if q.repoStarted[a.Repo].Before(q.repoStarted[b.Repo]) {
+				best = i
+			}
+		case a.Queued.Before(b.Queued):
+			best = i
+		}
+	}
+	return best
+}
+
+// dispatch starts queued requests while fewer than MaxInFlight are
+// running. It is called with the lock held.
+func (q *BuildQueue) dispatch() {
+	for len(q.inFlight) < q.MaxInFlight && len(q.queued) > 0 {
+		i := q.next()
+		qb := q.queued[i]
+		q.queued = append(q.queued[:i], q.queued[i+1:]...)
+		qb.Started = time.Now()
+		q.inFlight = append(q.inFlight, qb)
+		q.repoRunning[qb.Repo]++
+		q.repoStarted[qb.Repo] = qb.Started
+		go q.run(qb)
+	}
+}
+
+func (q *BuildQueue) run(qb *QueuedBuild) {
+	ctx, span := tracer.Start(context.Background(), "*BuildQueue.run()")
+	span.SetAttributes(
+		attribute.String("repository", qb.Repo),
+		attribute.String("branch", qb.Branch),
+		attribute.String("sha", qb.SHA),
+		attribute.String("source", qb.Source),
+		attribute.Int64("wait_ms", int64(qb.Started.Sub(qb.Queued)/time.Millisecond)),
+	)
+	err := qb.run(ctx)
+	span.End()
+	if err != nil {
+		log.Printf("%s %s@%s: %v", qb.Source, qb.Repo, qb.SHA, err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, f := range q.inFlight {
+		if f == qb {
+			q.inFlight = append(q.inFlight[:i], q.inFlight[i+1:]...)
+			break
+		}
+	}
+	if q.repoRunning[qb.Repo]--; q.repoRunning[qb.Repo] == 0 {
+		delete(q.repoRunning, qb.Repo)
+	}
+	q.done++
+	if err != nil {
+		q.failed++
+	}
+	q.dispatch()
+}
+
+// Status returns a snapshot of the queue, the queued requests in the order
+// they are started if no other request comes in and no slot is added.
+func (q *BuildQueue) Status() *QueueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := &QueueStatus{
+		MaxInFlight: q.MaxInFlight,
+		Done:        q.done,
+		Failed:      q.failed,
+		Replaced:    q.replaced,
+	}
+	for _, qb := range q.inFlight {
+		s.InFlight = append(s.InFlight, *qb)
+	}
+	// Simulate the dispatch order on a copy of the queue.
+	running := make(map[string]int)
+	started := make(map[string]time.Time)
+	for k, v := range q.repoRunning {
+		running[k] = v
+	}
+	for k, v := range q.repoStarted {
+		started[k] = v
+	}
+	sim := &BuildQueue{queued: append([]*QueuedBuild{}, q.queued...), repoRunning: running, repoStarted: started}
+	for len(sim.queued) > 0 {
+		i := sim.next()
+		qb := sim.queued[i]
+		sim.queued = append(sim.queued[:i], sim.queued[i+1:]...)
+		s.Queued = append(s.Queued, *qb)
+		sim.repoRunning[qb.Repo]++
+		sim.repoStarted[qb.Repo] = time.Now().Add(time.Duration(len(s.Queued)))
+	}
+	return s
+}
+
+// QueueSchedule is a branch whose head is built every Every.
+type QueueSchedule struct {
+	Repository string
+	Branch     string
+	Every      time.Duration
+}
+
+// ParseSchedules parses a comma-separated list of <owner>/<repo>@<branch>=<interval>.
+func ParseSchedules(s string) ([]QueueSchedule, error) {
+	var schedules []QueueSchedule
+	for _, item := range SplitList(s) {
+		at, eq := strings.Index(item, "@"), strings.LastIndex(item, "=")
+		if at <= 0 || eq < at+2 {
+			return nil, errors.Errorf("schedule %q: want <owner>/<repo>@<branch>=<interval>", item)
+		}
+		every, err := time.ParseDuration(item[eq+1:])
+		if err != nil {
+			return nil, errors.Errorf("schedule %q: %v", item, err)
+		}
+		if every < time.Minute {
+			return nil, errors.Errorf("schedule %q: the interval must be at least 1m", item)
+		}
+		schedules = append(schedules, QueueSchedule{Repository: item[:at], Branch: item[at+1 : eq], Every: every})
+	}
+	return schedules, nil
+}
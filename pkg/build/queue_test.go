@@ -0,0 +1,191 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBranchPriorities(t *testing.T) {
+	tests := []struct {
+		s     string
+		want  []BranchPriority
+		valid bool
+	}{
+		{"", nil, true},
+		{"main", []BranchPriority{{"main", 0}}, true},
+		{"main,release/*", []BranchPriority{{"main", 0}, {"release/*", 1}}, true},
+		{"main=5, release/*", []BranchPriority{{"main", 5}, {"release/*", 1}}, true},
+		{"hotfix/*=-1", []BranchPriority{{"hotfix/*", -1}}, true},
+		{"main=high", nil, false},
+		{"release/[a", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseBranchPriorities(tt.s)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseBranchPriorities(%q) = %v, want valid %v", tt.s, err, tt.valid)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseBranchPriorities(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestQueuePriority(t *testing.T) {
+	q := NewBuildQueue(1, []BranchPriority{{"main", 0}, {"release/*", 3}, {"hotfix/*", 1}})
+	tests := []struct {
+		branch string
+		want   int
+	}{
+		{"main", 0},
+		{"release/1.2", 3},
+		{"hotfix/crash", 1},
+		{"feature/x", 4},
+		{"release/1.2/rc", 4},
+		{"", 4},
+	}
+	for _, tt := range tests {
+		if got := q.priority(tt.branch); got != tt.want {
+			t.Errorf("priority(%q) = %d, want %d", tt.branch, got, tt.want)
+		}
+	}
+}
+
+func TestQueueNext(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		queued  []*QueuedBuild
+		running map[string]int
+		started map[string]time.Time
+		want    int
+	}{
+		{
+			name:   "lowest priority",
+			queued: []*QueuedBuild{{Repo: "a", Priority: 2, Queued: now}, {Repo: "b", Priority: 0, Queued: now.Add(time.Second)}},
+			want:   1,
+		},
+		{
+			name:    "priority before fairness",
+			queued:  []*QueuedBuild{{Repo: "a", Priority: 1, Queued: now}, {Repo: "b", Priority: 0, Queued: now}},
+			running: map[string]int{"b": 3},
+			want:    1,
+		},
+		{
+			name:    "fewest builds in flight",
+			queued:  []*QueuedBuild{{Repo: "a", Priority: 0, Queued: now}, {Repo: "b", Priority: 0, Queued: now.Add(time.Second)}},
+			running: map[string]int{"a": 2, "b": 1},
+			want:    1,
+		},
+		{
+			name:    "oldest last start",
+			queued:  []*QueuedBuild{{Repo: "a", Priority: 0, Queued: now}, {Repo: "b", Priority: 0, Queued: now.Add(time.Second)}},
+			started: map[string]time.Time{"a": now, "b": now.Add(-time.Minute)},
+			want:    1,
+		},
+		{
+			name:    "never started",
+			queued:  []*QueuedBuild{{Repo: "a", Priority: 0, Queued: now}, {Repo: "b", Priority: 0, Queued: now.Add(time.Second)}},
+			started: map[string]time.Time{"a": now},
+			want:    1,
+		},
+		{
+			name:   "first queued",
+			queued: []*QueuedBuild{{Repo: "a", Priority: 0, Queued: now.Add(time.Second)}, {Repo: "a", Priority: 0, Queued: now}, {Repo: "a", Priority: 0, Queued: now.Add(time.Minute)}},
+			want:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewBuildQueue(1, nil)
+			q.queued = tt.queued
+			for k, v := range tt.running {
+				q.repoRunning[k] = v
+			}
+			for k, v := range tt.started {
+				q.repoStarted[k] = v
+			}
+			if got := q.next(); got != tt.want {
+				t.Errorf("next() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildQueue(t *testing.T) {
+	q := NewBuildQueue(1, []BranchPriority{{"main", 0}})
+	started := make(chan string)
+	release := make(chan bool)
+	submit := func(repo, branch, sha string) {
+		name := fmt.Sprintf("%s/%s@%s", repo, branch, sha)
+		q.Submit(repo, branch, sha, QueueSourceAPI, func(ctx context.Context) error {
+			started <- name
+			<-release
+			return nil
+		})
+	}
+	// The first build holds the only slot while the others are queued.
+	go submit("a", "hold", "1")
+	if got := <-started; got != "a/hold@1" {
+		t.Fatalf("started %s, want a/hold@1", got)
+	}
+	submit("a", "main", "1")
+	submit("a", "feat", "1")
+	submit("b", "feat", "1")
+	submit("c", "main", "1")
+	submit("a", "main", "2") // Replaces a/main@1 in its place.
+	want := []string{"c/main@1", "a/main@2", "b/feat@1", "a/feat@1"}
+
+	s := q.Status()
+	var queued []string
+	for _, qb := range s.Queued {
+		queued = append(queued, fmt.Sprintf("%s/%s@%s", qb.Repo, qb.Branch, qb.SHA))
+	}
+	if !reflect.DeepEqual(queued, want) {
+		t.Errorf("Status().Queued = %q, want %q", queued, want)
+	}
+	if s.Replaced != 1 || len(s.InFlight) != 1 {
+		t.Errorf("Status() = %d replaced, %d in flight, want 1 and 1", s.Replaced, len(s.InFlight))
+	}
+
+	var order []string
+	for range want {
+		release <- true
+		order = append(order, <-started)
+	}
+	release <- true
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("started %q, want %q", order, want)
+	}
+}
+
+func TestParseSchedules(t *testing.T) {
+	tests := []struct {
+		s     string
+		want  []QueueSchedule
+		valid bool
+	}{
+		{"", nil, true},
+		{"acme/api@main=1h", []QueueSchedule{{"acme/api", "main", time.Hour}}, true},
+		{"acme/api@main=1h, acme/web@release/1.2=30m", []QueueSchedule{{"acme/api", "main", time.Hour}, {"acme/web", "release/1.2", 30 * time.Minute}}, true},
+		{"acme/api@main=30s", nil, false},
+		{"acme/api@main", nil, false},
+		{"acme/api=1h", nil, false},
+		{"@main=1h", nil, false},
+		{"acme/api@=1h", nil, false},
+		{"acme/api@main=hourly", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseSchedules(tt.s)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseSchedules(%q) = %v, want valid %v", tt.s, err, tt.valid)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseSchedules(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
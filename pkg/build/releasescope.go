@@ -0,0 +1,144 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ReleaseScope is what a release contains: every target, whether it changed
+// between the two release refs and the commits that changed it.
+type ReleaseScope struct {
+	From    string                `json:"from"`
+	To      string                `json:"to"`
+	Targets []*ReleaseScopeTarget `json:"targets"`
+}
+
+// ReleaseScopeTarget is a target of a ReleaseScope.
+type ReleaseScopeTarget struct {
+	Path    string    `json:"path"`
+	Name    string    `json:"name,omitempty"`
+	Changed bool      `json:"changed"`
+	Files   []string  `json:"files,omitempty"` // The changed files that affect the target.
+	Commits []*Commit `json:"commits,omitempty"`
+}
+
+// Commit is a commit of a ReleaseScopeTarget, newest first.
+type Commit struct {
+	SHA     string `json:"sha"`
+	Author  string `json:"author"`
+	Subject string `json:"subject"`
+}
+
+// ReleaseScope returns the targets that changed between the release refs
+// from and to, diffed as the from..to commit range of the build context,
+// with the commits of the range that touch the changed files of each.
+func (b *BuildContext) ReleaseScope(ctx context.Context, from, to string) (*ReleaseScope, error) {
+	ctx, span := tracer.Start(ctx, "*BuildContext.ReleaseScope()")
+	defer span.End()
+	s := &ReleaseScope{From: from, To: to, Targets: []*ReleaseScopeTarget{}}
+	changed := 0
+	for _, t := range b.Config.Targets {
+		rt := &ReleaseScopeTarget{Path: t.Path, Name: t.Name, Changed: len(t.Changes) > 0}
+		s.Targets = append(s.Targets, rt)
+		if !rt.Changed {
+			continue
+		}
+		changed++
+		var paths []string
+		for _, f := range t.Changes {
+			if !contains(rt.Files, f.Name) {
+				rt.Files = append(rt.Files, f.Name)
+				paths = append(paths, f.Name)
+			}
+			if f.From != "" && !contains(paths, f.From) {
+				paths = append(paths, f.From)
+			}
+		}
+		commits, err := rangeLog(ctx, from+".."+to, paths)
+		if err != nil {
+			return nil, errors.Wrapf(err, "target %s", t.Path)
+		}
+		rt.Commits = commits
+	}
+	span.SetAttributes(attribute.Int("changed", changed))
+	return s, nil
+}
+
+// rangeLog returns the commits of a commit range that touch the paths.
+func rangeLog(ctx context.Context, commitRange string, paths []string) ([]*Commit, error) {
+	lines, err := gitLines(ctx, append([]string{"log", "--format=%H%x1f%an%x1f%s", commitRange, "--"}, paths...)...)
+	if err != nil {
+		return nil, err
+	}
+	var commits []*Commit
+	for _, l := range lines {
+		f := strings.SplitN(l, "\x1f", 3)
+		if len(f) != 3 {
+			continue
+		}
+		commits = append(commits, &Commit{SHA: f[0], Author: f[1], Subject: f[2]})
+	}
+	return commits, nil
+}
+
+// Changed returns the changed targets of the release.
+func (s *ReleaseScope) Changed() []*ReleaseScopeTarget {
+	changed := []*ReleaseScopeTarget{}
+	for _, t := range s.Targets {
+		if t.Changed {
+			changed = append(changed, t)
+		}
+	}
+	return changed
+}
+
+// Write writes the release scope as text, one line per target followed by
+// its commits, as json, or as the markdown of release notes, which only
+// lists the changed targets.
+func (s *ReleaseScope) Write(w io.Writer, format string) error {
+	switch format {
+	case "text":
+		for _, t := range s.Targets {
+			if !t.Changed {
+				fmt.Fprintf(w, "%-10s %s\n", "unchanged", t.Path)
+				continue
+			}
+			fmt.Fprintf(w, "%-10s %s (%d commits)\n", "changed", t.Path, len(t.Commits))
+			for _, c := range t.Commits {
+				fmt.Fprintf(w, "           %s %s (%s)\n", shortSHA(c.SHA), c.Subject, c.Author)
+			}
+		}
+		return nil
+	case "json":
+		b, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	case "markdown":
+		changed := s.Changed()
+		fmt.Fprintf(w, "## Changes from %s to %s\n\n%d of %d targets changed.\n", s.From, s.To, len(changed), len(s.Targets))
+		for _, t := range changed {
+			fmt.Fprintf(w, "\n### %s\n\n", t.Path)
+			for _, c := range t.Commits {
+				fmt.Fprintf(w, "- %s %s (%s)\n", shortSHA(c.SHA), c.Subject, c.Author)
+			}
+		}
+		return nil
+	}
+	return errors.Errorf("unknown release scope format %q", format)
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
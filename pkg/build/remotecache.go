@@ -0,0 +1,442 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Backends of the remote build cache.
+const (
+	CacheS3   = "s3"
+	CacheGCS  = "gcs"
+	CacheHTTP = "http"
+)
+
+// CacheConfig represents the cache config: the remote store shared by the CI
+// runners, in addition to the local build cache.
+type CacheConfig struct {
+	Backend  string `yaml:"backend"`   // s3, gcs or http. No remote cache when empty.
+	Bucket   string `yaml:"bucket"`    // The bucket of the s3 and gcs backends.
+	Prefix   string `yaml:"prefix"`    // Prepended to the names of the cache entries, e.g. monobuild/.
+	Region   string `yaml:"region"`    // The region of the s3 backend. Defaults to AWS_REGION, then us-east-1.
+	Endpoint string `yaml:"endpoint"`  // The URL of the http backend, or of an S3 or GCS compatible store.
+	ReadOnly bool   `yaml:"read_only"` // Only download the entries, e.g. for the local builds.
+}
+
+func (c CacheConfig) validate() error {
+	switch c.Backend {
+	case "":
+		return nil
+	case CacheS3, CacheGCS:
+		if c.Bucket == "" {
+			return errors.Errorf("cache.bucket: the %s backend needs a bucket", c.Backend)
+		}
+	case CacheHTTP:
+		if c.Endpoint == "" {
+			return errors.Errorf("cache.endpoint: the http backend needs an endpoint")
+		}
+	default:
+		return errors.Errorf("cache.backend: %s must be one of s3, gcs or http", c.Backend)
+	}
+	return nil
+}
+
+// errCacheMiss is returned by a RemoteCache without the entry.
+var errCacheMiss = errors.New("not in the cache")
+
+// RemoteCache stores the archives of the cache entries.
+type RemoteCache interface {
+	Get(ctx context.Context, name string) ([]byte, error)
+	Put(ctx context.Context, name string, data []byte) error
+}
+
+// newRemoteCache returns the remote cache of a config, nil when none.
+func newRemoteCache(c CacheConfig) RemoteCache {
+	switch c.Backend {
+	case CacheS3:
+		return &s3Cache{c}
+	case CacheGCS:
+		return &gcsCache{c}
+	case CacheHTTP:
+		return &httpCache{c}
+	}
+	return nil
+}
+
+// CacheStats counts the lookups of the build cache during a run.
+type CacheStats struct {
+	Hits       int `json:"hits"`
+	RemoteHits int `json:"remote_hits"` // Among the hits, the entries downloaded from the remote cache.
+	Misses     int `json:"misses"`
+	Uploads    int `json:"uploads"`
+}
+
+func (s *CacheStats) String() string {
+	return fmt.Sprintf("BUILD CACHE: %d hits (%d remote), %d misses, %d uploads", s.Hits, s.RemoteHits, s.Misses, s.Uploads)
+}
+
+// countCache records a lookup of the build cache in the run.
+func (r *Run) countCache(f func(s *CacheStats)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Cache == nil {
+		r.Cache = &CacheStats{}
+	}
+	f(r.Cache)
+}
+
+// downloadCache downloads the entry of a key from the remote cache into the
+// local cache. It reports whether the entry was found.
+func (b *BuildContext) downloadCache(ctx context.Context, key string) bool {
+	ctx, span := tracer.Start(ctx, "*BuildContext.downloadCache()")
+	defer span.End()
+	remote := newRemoteCache(b.Config.Cache)
+	if remote == nil {
+		return false
+	}
+	data, err := remote.Get(ctx, b.Config.Cache.Prefix+key+".tar.gz")
+	if err != nil {
+		if err != errCacheMiss {
+			Log.Warn("cannot get the build from the remote cache", "key", key, "error", err)
+		}
+		return false
+	}
+	if err := untarDir(data, b.cacheEntryDir(key)); err != nil {
+		Log.Warn("cannot extract the build of the remote cache", "key", key, "error", err)
+		return false
+	}
+	return true
+}
+
+// uploadCache uploads the local entry of a key to the remote cache.
+func (b *BuildContext) uploadCache(ctx context.Context, key string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "*BuildContext.uploadCache()")
+	defer span.End()
+	remote := newRemoteCache(b.Config.Cache)
+	if remote == nil || b.Config.Cache.ReadOnly {
+		return false, nil
+	}
+	data, err := tarDir(b.cacheEntryDir(key))
+	if err != nil {
+		return false, err
+	}
+	return true, remote.Put(ctx, b.Config.Cache.Prefix+key+".tar.gz", data)
+}
+
+// tarDir archives the regular files of a directory.
+func tarDir(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: filepath.ToSlash(rel), Mode: int64(info.Mode().Perm()), Size: info.Size(), ModTime: info.ModTime()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// untarDir extracts an archive of tarDir into a directory. Only regular files
+// are extracted, and never through a symlink of the directory.
+func untarDir(data []byte, dir string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if !strings.HasPrefix(name, filepath.Clean(dir)+string(filepath.Separator)) || !hdr.FileInfo().Mode().IsRegular() {
+			return errors.Errorf("invalid cache entry file %s", hdr.Name)
+		}
+		for p := filepath.Dir(name); p != filepath.Clean(dir); p = filepath.Dir(p) {
+			if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				return errors.Errorf("invalid cache entry file %s: %s is a symlink", hdr.Name, p)
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		// Replace the file instead of writing to the target of a symlink.
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+}
+
+// doBlob sends a request with a binary body. A 404 is a cache miss.
+func doBlob(ctx context.Context, method, u string, header http.Header, body []byte) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "doBlob")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("method", method),
+		attribute.String("url", u),
+	)
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	rb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errCacheMiss
+	}
+	if resp.StatusCode >= 300 {
+		return nil, errors.Errorf("%s %s: %s: %s", method, u, resp.Status, bytes.TrimSpace(rb))
+	}
+	return rb, nil
+}
+
+// httpCache is a store that supports GET and PUT, authenticated with the
+// bearer token of MB_CACHE_TOKEN when set.
+type httpCache struct {
+	c CacheConfig
+}
+
+func (h *httpCache) url(name string) string {
+	return strings.TrimSuffix(h.c.Endpoint, "/") + "/" + name
+}
+
+func (h *httpCache) header() http.Header {
+	header := make(http.Header)
+	if token := os.Getenv("MB_CACHE_TOKEN"); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return header
+}
+
+func (h *httpCache) Get(ctx context.Context, name string) ([]byte, error) {
+	return doBlob(ctx, http.MethodGet, h.url(name), h.header(), nil)
+}
+
+func (h *httpCache) Put(ctx context.Context, name string, data []byte) error {
+	_, err := doBlob(ctx, http.MethodPut, h.url(name), h.header(), data)
+	return err
+}
+
+// gcsCache stores the entries in a Google Cloud Storage bucket with the XML
+// API, authenticated with GOOGLE_OAUTH_ACCESS_TOKEN or with the token of the
+// service account of the metadata server.
+type gcsCache struct {
+	c CacheConfig
+}
+
+func (g *gcsCache) url(name string) string {
+	endpoint := g.c.Endpoint
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/" + g.c.Bucket + "/" + name
+}
+
+func (g *gcsCache) header(ctx context.Context) (http.Header, error) {
+	token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	if token == "" {
+		h := http.Header{"Metadata-Flavor": []string{"Google"}}
+		var t struct {
+			AccessToken string `json:"access_token"`
+		}
+		b, err := doBlob(ctx, http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", h, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "gcs: no GOOGLE_OAUTH_ACCESS_TOKEN nor metadata server token")
+		}
+		if err := json.Unmarshal(b, &t); err != nil {
+			return nil, err
+		}
+		token = t.AccessToken
+	}
+	return http.Header{"Authorization": []string{"Bearer " + token}}, nil
+}
+
+func (g *gcsCache) Get(ctx context.Context, name string) ([]byte, error) {
+	h, err := g.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return doBlob(ctx, http.MethodGet, g.url(name), h, nil)
+}
+
+func (g *gcsCache) Put(ctx context.Context, name string, data []byte) error {
+	h, err := g.header(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = doBlob(ctx, http.MethodPut, g.url(name), h, data)
+	return err
+}
+
+// s3Cache stores the entries in an S3 bucket, or in an S3 compatible store
+// with a path-style endpoint, signing the requests with the credentials of
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+type s3Cache struct {
+	c CacheConfig
+}
+
+func (s *s3Cache) region() string {
+	return awsRegion(s.c.Region)
+}
+
+// awsRegion returns the configured region, or AWS_REGION, or
+// AWS_DEFAULT_REGION, or us-east-1.
+func awsRegion(configured string) string {
+	for _, r := range []string{configured, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")} {
+		if r != "" {
+			return r
+		}
+	}
+	return "us-east-1"
+}
+
+func (s *s3Cache) url(name string) string {
+	if s.c.Endpoint != "" {
+		return strings.TrimSuffix(s.c.Endpoint, "/") + "/" + s.c.Bucket + "/" + name
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.c.Bucket, s.region(), name)
+}
+
+func (s *s3Cache) Get(ctx context.Context, name string) ([]byte, error) {
+	return s.do(ctx, http.MethodGet, name, nil)
+}
+
+func (s *s3Cache) Put(ctx context.Context, name string, data []byte) error {
+	_, err := s.do(ctx, http.MethodPut, name, data)
+	return err
+}
+
+func (s *s3Cache) do(ctx context.Context, method, name string, body []byte) ([]byte, error) {
+	u, err := url.Parse(s.url(name))
+	if err != nil {
+		return nil, err
+	}
+	h, err := s.sign(method, u, body, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	return doBlob(ctx, method, u.String(), h, body)
+}
+
+// sign returns the headers of a request signed with AWS Signature Version 4.
+func (s *s3Cache) sign(method string, u *url.URL, body []byte, now time.Time) (http.Header, error) {
+	return awsSign("s3", s.region(), method, u, body, http.Header{}, now)
+}
+
+// awsSign adds the headers of AWS Signature Version 4 to h, signing the
+// request with the credentials of AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN. The headers already in h are signed too.
+func awsSign(service, region, method string, u *url.URL, body []byte, h http.Header, now time.Time) (http.Header, error) {
+	akid, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if akid == "" || secret == "" {
+		return nil, errors.Errorf("%s: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are not set", service)
+	}
+	payload := fmt.Sprintf("%x", sha256.Sum256(body))
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	h.Set("Host", u.Host)
+	h.Set("X-Amz-Date", amzDate)
+	h.Set("X-Amz-Content-Sha256", payload)
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		h.Set("X-Amz-Security-Token", token)
+	}
+	var names []string
+	for k := range h {
+		names = append(names, strings.ToLower(k))
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, n := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", n, strings.TrimSpace(h.Get(n)))
+	}
+	signed := strings.Join(names, ";")
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	request := strings.Join([]string{method, path, u.RawQuery, canonical.String(), signed, payload}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, fmt.Sprintf("%x", sha256.Sum256([]byte(request)))}, "\n")
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	h.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x", akid, scope, signed, hmacSHA256(key, toSign)))
+	// The Host header of the request is its URL host.
+	h.Del("Host")
+	return h, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
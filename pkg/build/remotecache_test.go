@@ -0,0 +1,93 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testArchive(t *testing.T, names ...string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(name))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUntarDir(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		valid bool
+	}{
+		{"files", []string{"a", "bin/server", "bin/sub/b"}, true},
+		{"dot segments inside", []string{"bin/../a", "./b"}, true},
+		{"absolute path is relative to the dir", []string{"/a"}, true},
+		{"parent", []string{"../a"}, false},
+		{"parent of a subdir", []string{"bin/../../a"}, false},
+		{"sibling with the dir prefix", []string{"../out-evil/a"}, false},
+		{"dir itself", []string{"."}, false},
+		{"escape after valid files", []string{"a", "../b"}, false},
+		{"symlink in the dir", []string{"link/a"}, false},
+		{"file replaces a symlink", []string{"link"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "monobuild-untar")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			dir, outside := filepath.Join(root, "out"), filepath.Join(root, "outside")
+			for _, d := range []string{dir, outside} {
+				if err := os.Mkdir(d, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+				t.Fatal(err)
+			}
+			err = untarDir(testArchive(t, tt.files...), dir)
+			if (err == nil) != tt.valid {
+				t.Fatalf("untarDir(%q) = %v, want valid %v", tt.files, err, tt.valid)
+			}
+			filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+				if err == nil && info.Mode().IsRegular() && !isSubPath(dir, p) {
+					t.Errorf("untarDir(%q) wrote %s outside of the dir", tt.files, p)
+				}
+				return nil
+			})
+			if !tt.valid {
+				return
+			}
+			for _, f := range tt.files {
+				p := filepath.Join(dir, filepath.FromSlash(f))
+				if data, err := ioutil.ReadFile(p); err != nil || string(data) != f {
+					t.Errorf("untarDir(%q): %s = %q, %v, want %q", tt.files, p, data, err, f)
+				}
+			}
+		})
+	}
+}
+
+func isSubPath(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !filepath.IsAbs(rel) && (len(rel) < 3 || rel[:3] != ".."+string(filepath.Separator))
+}
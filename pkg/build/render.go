@@ -0,0 +1,689 @@
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// A Renderer writes the diff and the progress of a build to the console. The
+// build reports its events to the Renderer of the BuildContext, so that a CI
+// specific console protocol is a new Renderer, not a change of the build.
+//
+// The writer of the target events is the console, or the buffer of the
+// target in a deterministic parallel build. The events of the targets built
+// at the same time may be interleaved.
+type Renderer interface {
+	// Diff renders the result of the diff, before the build.
+	Diff(w io.Writer, b *BuildContext) error
+	// Skip renders a target that is not built, and why.
+	Skip(w io.Writer, t *Target, reason string)
+	// Start renders the start of the build of a target.
+	Start(w io.Writer, t *Target)
+	// Output returns the writer of a stream of the build command of a
+	// target, "stdout" or "stderr", to w. It is flushed after the build when
+	// it has a Flush() error method.
+	Output(w io.Writer, t *Target, stream string) io.Writer
+	// Finish renders the end of the build of a target.
+	Finish(w io.Writer, t *Target, rt *RunTarget, err error)
+	// Summary renders the results of the built targets.
+	Summary(w io.Writer, results []*TargetOutcome)
+	// Info renders a message about the build, e.g. where the run is recorded.
+	Info(w io.Writer, msg string)
+	// Warn renders a warning.
+	Warn(w io.Writer, msg string)
+}
+
+// Reasons of the skipped targets.
+const (
+	SkipNotAffected    = "not affected"
+	SkipNoBuildCommand = "no build command"
+	SkipCached         = "cached"
+)
+
+// TargetOutcome is the result of a built target.
+type TargetOutcome struct {
+	Path     string
+	Status   string // success, failure, cancelled or skipped.
+	Error    error
+	TmpUsage int64 // Peak disk usage of the TMPDIR of the build, in bytes.
+	// The steps that exited with one of their allowed exit codes.
+	AllowedFailures []string
+	Group           string // The value of the label the summary is grouped by, if any.
+}
+
+// usage returns the TMPDIR usage and the allowed step failures of the
+// outcome, for the summaries.
+func (o *TargetOutcome) usage() string {
+	var notes []string
+	if o.TmpUsage != 0 {
+		notes = append(notes, "TMPDIR "+formatBytes(o.TmpUsage))
+	}
+	if len(o.AllowedFailures) > 0 {
+		notes = append(notes, "allowed failure of "+strings.Join(o.AllowedFailures, ", "))
+	}
+	if len(notes) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(notes, "; ") + ")"
+}
+
+// Renderer names accepted by -output.
+const (
+	RenderPretty   = "pretty"
+	RenderJSON     = "json"
+	RenderYAML     = "yaml"
+	RenderTable    = "table"
+	RenderQuiet    = "quiet"
+	RenderGitHub   = "github"
+	RenderTeamCity = "teamcity"
+	RenderBamboo   = "bamboo"
+)
+
+var renderers = map[string]func() Renderer{
+	RenderPretty:   func() Renderer { return prettyRenderer{} },
+	RenderJSON:     func() Renderer { return &jsonRenderer{} },
+	RenderYAML:     func() Renderer { return structuredRenderer{format: RenderYAML} },
+	RenderTable:    func() Renderer { return structuredRenderer{format: RenderTable} },
+	RenderQuiet:    func() Renderer { return quietRenderer{} },
+	RenderGitHub:   func() Renderer { return githubRenderer{} },
+	RenderTeamCity: func() Renderer { return teamcityRenderer{} },
+	RenderBamboo:   func() Renderer { return bambooRenderer{} },
+}
+
+// RegisterRenderer makes a Renderer available to NewRenderer.
+func RegisterRenderer(name string, r func() Renderer) {
+	renderers[name] = r
+}
+
+// NewRenderer returns the renderer of a name, pretty when empty.
+func NewRenderer(name string) (Renderer, error) {
+	if name == "" {
+		name = RenderPretty
+	}
+	r, ok := renderers[name]
+	if !ok {
+		var names []string
+		for n := range renderers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, errors.Errorf("unknown output %q, must be one of %s", name, strings.Join(names, ", "))
+	}
+	return r(), nil
+}
+
+// renderer returns the renderer of the build, pretty by default.
+func (b *BuildContext) renderer() Renderer {
+	if b.Renderer == nil {
+		return prettyRenderer{}
+	}
+	return b.Renderer
+}
+
+// prettyRenderer is the human readable output of mb.
+type prettyRenderer struct{}
+
+// Diff renders a table of the changed files and the targets they affect,
+// as a dependency or as a watched file, then the affected targets.
+func (prettyRenderer) Diff(w io.Writer, b *BuildContext) error {
+	Log.Debug("diff", "build_context", b)
+	p := colors(w)
+	// The sources of the files are only worth a column when there are several.
+	sources := len(b.Providers) > 1
+	header := []string{"FILE", "STATUS", "AFFECTS"}
+	if sources {
+		header = []string{"FILE", "STATUS", "SOURCE", "AFFECTS"}
+	}
+	rows := [][]string{header}
+	for _, f := range b.Files {
+		status := f.Status
+		if f.From != "" {
+			status += " from " + f.From
+		}
+		row := []string{f.Name, status, strings.Join(fileEffects(f, p), ", ")}
+		if sources {
+			row = []string{f.Name, status, strings.Join(f.Sources, ","), row[2]}
+		}
+		rows = append(rows, row)
+	}
+	if len(b.Files) > 0 {
+		widths := make([]int, len(header)-1)
+		for _, r := range rows {
+			for i := range widths {
+				if len(r[i]) > widths[i] {
+					widths[i] = len(r[i])
+				}
+			}
+		}
+		for i, r := range rows {
+			var line strings.Builder
+			for j, cell := range r {
+				padding := ""
+				if j < len(widths) {
+					padding = strings.Repeat(" ", widths[j]-len(cell)+2)
+				}
+				if i > 0 && j == 1 {
+					cell = p.status(cell)
+				}
+				line.WriteString(cell + padding)
+			}
+			if i == 0 {
+				fmt.Fprintln(w, p.paint(line.String(), ansiBold))
+				continue
+			}
+			fmt.Fprintln(w, line.String())
+		}
+	}
+	var affected []string
+	for _, t := range b.Config.Targets {
+		if len(t.Changes) > 0 || b.All {
+			affected = append(affected, p.paint(t.Path, ansiBold))
+		}
+	}
+	summary := fmt.Sprintf("%d changed files, %d of %d targets affected", len(b.Files), len(affected), len(b.Config.Targets))
+	if len(b.Pathspecs) > 0 {
+		summary = fmt.Sprintf("%d changed files in %s, %d of %d targets affected", len(b.Files), strings.Join(b.Pathspecs, " "), len(affected), len(b.Config.Targets))
+	}
+	if len(affected) > 0 {
+		summary += ": " + strings.Join(affected, ", ")
+	}
+	fmt.Fprintln(w, summary)
+	for _, warning := range b.Warnings() {
+		fmt.Fprintln(w, p.paint("WARNING:", ansiYellow), warning)
+	}
+	for _, o := range b.Overrides {
+		fmt.Fprintln(w, p.paint("OVERRIDE:", ansiMagenta), o)
+	}
+	return nil
+}
+
+// fileEffects returns the targets a changed file affects and why, e.g.
+// "cmd/server (dependency)", or "-" for none.
+func fileEffects(f *File, p palette) []string {
+	var paths []string
+	why := make(map[string][]string)
+	add := func(path, reason string) {
+		if _, ok := why[path]; !ok {
+			paths = append(paths, path)
+		}
+		why[path] = append(why[path], reason)
+	}
+	for _, path := range f.DependencyOf {
+		add(path, p.paint("dependency", ansiCyan))
+	}
+	for _, path := range f.WatchedBy {
+		add(path, p.paint("watched", ansiMagenta))
+	}
+	var effects []string
+	for _, path := range paths {
+		effects = append(effects, fmt.Sprintf("%s (%s)", path, strings.Join(why[path], ", ")))
+	}
+	for _, path := range f.SkippedDependents {
+		effects = append(effects, p.paint(path+" (not rebuilt, same API)", ansiDim))
+	}
+	if len(effects) == 0 {
+		return []string{p.paint("-", ansiDim)}
+	}
+	return effects
+}
+
+func (prettyRenderer) Skip(w io.Writer, t *Target, reason string) {
+	switch reason {
+	case SkipNoBuildCommand:
+		fmt.Fprintln(w, "SKIPPING BUILD TARGET WITHOUT BUILD COMMAND: ", t.Path)
+		return
+	case SkipCached:
+		fmt.Fprintln(w, "SKIPPING CACHED BUILD TARGET: ", t.Path)
+		return
+	}
+	fmt.Fprintln(w, "SKIPPING BUILD TARGET: ", t.Path)
+}
+
+func (prettyRenderer) Start(w io.Writer, t *Target) {
+	fmt.Fprintln(w, "-------------------------------")
+	fmt.Fprintln(w, "BUILDING TARGET: ", t.Path)
+	Log.Debug("target", "target", t.Path, "definition", t)
+	fmt.Fprintln(w, "-------------------------------")
+}
+
+// Output prefixes the output lines with the target path in non-interactive
+// mode and in parallel builds.
+func (prettyRenderer) Output(w io.Writer, t *Target, stream string) io.Writer {
+	if NonInteractive || t.prefixOutput {
+		return newPrefixWriter(w, "["+t.Path+"] ")
+	}
+	return w
+}
+
+func (prettyRenderer) Finish(w io.Writer, t *Target, rt *RunTarget, err error) {}
+
+func (prettyRenderer) Summary(w io.Writer, results []*TargetOutcome) {
+	fmt.Fprintln(w, "-------------------------------")
+	groups := groupOutcomes(results)
+	if groups == nil {
+		groups = []*summaryGroup{{Outcomes: results}}
+	}
+	for _, g := range groups {
+		indent := ""
+		if g.Name != "" {
+			fmt.Fprintln(w, g)
+			indent = "  "
+		}
+		for _, r := range g.Outcomes {
+			switch r.Status {
+			case ResultSkipped:
+				fmt.Fprintf(w, "%sSKIPPED: %s: %v\n", indent, r.Path, r.Error)
+			case RunFailure:
+				fmt.Fprintf(w, "%sFAILED: %s%s: %v\n", indent, r.Path, r.usage(), r.Error)
+			case RunCancelled:
+				fmt.Fprintf(w, "%sCANCELLED: %s\n", indent, r.Path)
+			default:
+				fmt.Fprintf(w, "%sSUCCEEDED: %s%s\n", indent, r.Path, r.usage())
+			}
+		}
+	}
+	fmt.Fprintln(w, "-------------------------------")
+}
+
+func (prettyRenderer) Info(w io.Writer, msg string) { fmt.Fprintln(w, msg) }
+
+func (prettyRenderer) Warn(w io.Writer, msg string) { fmt.Fprintln(w, "WARNING:", msg) }
+
+// quietRenderer only renders the failures, with the output of the failed
+// build commands.
+type quietRenderer struct{}
+
+func (quietRenderer) Diff(w io.Writer, b *BuildContext) error { return nil }
+
+func (quietRenderer) Skip(w io.Writer, t *Target, reason string) {}
+
+func (quietRenderer) Start(w io.Writer, t *Target) {}
+
+func (quietRenderer) Output(w io.Writer, t *Target, stream string) io.Writer { return ioutil.Discard }
+
+func (quietRenderer) Finish(w io.Writer, t *Target, rt *RunTarget, err error) {
+	if err == nil {
+		return
+	}
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	fmt.Fprintf(w, "FAILED: %s: %v\n", t.Path, err)
+	fmt.Fprint(w, t.BuildCommand.Output, t.BuildCommand.Error)
+}
+
+func (quietRenderer) Summary(w io.Writer, results []*TargetOutcome) {
+	for _, r := range results {
+		if r.Status == ResultSkipped {
+			fmt.Fprintf(w, "SKIPPED: %s: %v\n", r.Path, r.Error)
+		}
+	}
+}
+
+func (quietRenderer) Info(w io.Writer, msg string) {}
+
+func (quietRenderer) Warn(w io.Writer, msg string) { fmt.Fprintln(os.Stderr, "WARNING:", msg) }
+
+// structuredRenderer renders the diff result as YAML or as tables, and the
+// build as the pretty renderer.
+type structuredRenderer struct {
+	prettyRenderer
+	format string
+}
+
+func (r structuredRenderer) Diff(w io.Writer, b *BuildContext) error {
+	res := b.Result()
+	if r.format == RenderYAML {
+		out, err := yaml.Marshal(res)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(out)
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tAFFECTED\tCHANGES")
+	for _, t := range res.Targets {
+		affected := "no"
+		if t.Affected {
+			affected = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", t.Path, affected, strings.Join(t.Changes, ", "))
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "FILE\tSTATUS\tSOURCES\tDEPENDENCY OF\tWATCHED BY")
+	for _, f := range res.Files {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", f.Name, f.Status, strings.Join(f.Sources, ","), strings.Join(f.DependencyOf, ", "), strings.Join(f.WatchedBy, ", "))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, warning := range res.Warnings {
+		fmt.Fprintln(os.Stderr, "WARNING:", warning)
+	}
+	return nil
+}
+
+// jsonRenderer renders every event as a JSON object on its own line, with
+// the output lines of the build commands, so that stdout is only JSON.
+type jsonRenderer struct {
+	mu sync.Mutex
+}
+
+type jsonEvent struct {
+	Event    string        `json:"event"`
+	Target   string        `json:"target,omitempty"`
+	Stream   string        `json:"stream,omitempty"`
+	Line     string        `json:"line,omitempty"`
+	Status   string        `json:"status,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Message  string        `json:"message,omitempty"`
+	Problems []Problem     `json:"problems,omitempty"`
+	Time     time.Time     `json:"time"`
+	*DiffResult
+	Results []*jsonOutcome `json:"results,omitempty"`
+}
+
+type jsonOutcome struct {
+	Target   string `json:"target"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	TmpUsage int64  `json:"tmp_usage,omitempty"`
+	// The steps that exited with one of their allowed exit codes.
+	AllowedFailures []string `json:"allowed_failures,omitempty"`
+	Group           string   `json:"group,omitempty"`
+}
+
+func (r *jsonRenderer) emit(w io.Writer, e *jsonEvent) {
+	e.Time = time.Now().UTC()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w.Write(append(b, '\n'))
+}
+
+func (r *jsonRenderer) Diff(w io.Writer, b *BuildContext) error {
+	r.emit(w, &jsonEvent{Event: "diff", DiffResult: b.Result()})
+	return nil
+}
+
+func (r *jsonRenderer) Skip(w io.Writer, t *Target, reason string) {
+	r.emit(w, &jsonEvent{Event: "skip", Target: t.Path, Message: reason})
+}
+
+func (r *jsonRenderer) Start(w io.Writer, t *Target) {
+	r.emit(w, &jsonEvent{Event: "start", Target: t.Path})
+}
+
+func (r *jsonRenderer) Output(w io.Writer, t *Target, stream string) io.Writer {
+	return &lineWriter{line: func(l string) {
+		// The output of the commands goes to stdout, in JSON.
+		if w == os.Stderr {
+			w = os.Stdout
+		}
+		r.emit(w, &jsonEvent{Event: "output", Target: t.Path, Stream: stream, Line: l})
+	}}
+}
+
+func (r *jsonRenderer) Finish(w io.Writer, t *Target, rt *RunTarget, err error) {
+	e := &jsonEvent{Event: "finish", Target: t.Path, Status: rt.Status, Duration: rt.Duration, Problems: rt.Problems}
+	if err != nil {
+		e.Message = err.Error()
+	}
+	r.emit(w, e)
+}
+
+func (r *jsonRenderer) Summary(w io.Writer, results []*TargetOutcome) {
+	e := &jsonEvent{Event: "summary"}
+	for _, o := range results {
+		jo := &jsonOutcome{Target: o.Path, Status: o.Status, TmpUsage: o.TmpUsage, AllowedFailures: o.AllowedFailures, Group: o.Group}
+		if o.Error != nil {
+			jo.Error = o.Error.Error()
+		}
+		e.Results = append(e.Results, jo)
+	}
+	r.emit(w, e)
+}
+
+func (r *jsonRenderer) Info(w io.Writer, msg string) {
+	r.emit(w, &jsonEvent{Event: "info", Message: msg})
+}
+
+func (r *jsonRenderer) Warn(w io.Writer, msg string) {
+	r.emit(w, &jsonEvent{Event: "warning", Message: msg})
+}
+
+// githubRenderer groups the output of every target in the GitHub Actions log
+// and annotates the failures and warnings. The groups of a parallel build
+// are only contiguous with -deterministic.
+type githubRenderer struct {
+	prettyRenderer
+}
+
+func (githubRenderer) Diff(w io.Writer, b *BuildContext) error {
+	fmt.Fprintln(w, "::group::Diff")
+	fmt.Fprintln(w, b)
+	fmt.Fprintln(w, "::endgroup::")
+	var affected []string
+	for _, t := range b.Config.Targets {
+		if len(t.Changes) > 0 || b.All {
+			affected = append(affected, t.Path)
+		}
+	}
+	fmt.Fprintf(w, "::notice title=monobuild::%d affected targets: %s\n", len(affected), githubEscape(strings.Join(affected, ", ")))
+	for _, warning := range b.Warnings() {
+		fmt.Fprintf(w, "::warning::%s\n", githubEscape(warning))
+	}
+	return nil
+}
+
+func (githubRenderer) Start(w io.Writer, t *Target) {
+	fmt.Fprintf(w, "::group::Build %s\n", t.Path)
+}
+
+// Output does not prefix the lines, which are grouped, but still writes them
+// whole.
+func (githubRenderer) Output(w io.Writer, t *Target, stream string) io.Writer {
+	return newPrefixWriter(w, "")
+}
+
+func (githubRenderer) Finish(w io.Writer, t *Target, rt *RunTarget, err error) {
+	fmt.Fprintln(w, "::endgroup::")
+	for _, p := range rt.Problems {
+		var props []string
+		for _, kv := range [][2]string{{"file", p.File}, {"line", itoa(p.Line)}, {"col", itoa(p.Column)}, {"title", p.Owner}} {
+			if kv[1] != "" {
+				props = append(props, kv[0]+"="+githubPropertyEscape(kv[1]))
+			}
+		}
+		fmt.Fprintf(w, "::%s %s::%s\n", p.Severity, strings.Join(props, ","), githubEscape(p.Message))
+	}
+	if err != nil {
+		fmt.Fprintf(w, "::error title=%s failed::%s\n", githubEscape(t.Path), githubEscape(err.Error()))
+	}
+}
+
+func (githubRenderer) Warn(w io.Writer, msg string) {
+	fmt.Fprintf(w, "::warning::%s\n", githubEscape(msg))
+}
+
+func githubEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+func githubPropertyEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+// itoa formats a positive number, "" otherwise.
+func itoa(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// teamcityRenderer emits TeamCity service messages: a block per target,
+// whose output lines are messages of the flow of the target so that the
+// targets built at the same time are not mixed up, a build problem per
+// failure and the build duration of every target as a statistic.
+type teamcityRenderer struct {
+	prettyRenderer
+}
+
+func (teamcityRenderer) Diff(w io.Writer, b *BuildContext) error {
+	var affected []string
+	for _, t := range b.Config.Targets {
+		if len(t.Changes) > 0 || b.All {
+			affected = append(affected, t.Path)
+		}
+	}
+	fmt.Fprintf(w, "##teamcity[message text='%s']\n", teamcityEscape(fmt.Sprintf("%d affected targets: %s", len(affected), strings.Join(affected, ", "))))
+	fmt.Fprintf(w, "##teamcity[buildStatisticValue key='mb.affectedTargets' value='%d']\n", len(affected))
+	for _, warning := range b.Warnings() {
+		fmt.Fprintf(w, "##teamcity[message text='%s' status='WARNING']\n", teamcityEscape(warning))
+	}
+	return nil
+}
+
+func (teamcityRenderer) Skip(w io.Writer, t *Target, reason string) {
+	fmt.Fprintf(w, "##teamcity[message text='%s']\n", teamcityEscape(fmt.Sprintf("skipping target %s: %s", t.Path, reason)))
+}
+
+func (teamcityRenderer) Start(w io.Writer, t *Target) {
+	fmt.Fprintf(w, "##teamcity[flowStarted flowId='%s']\n", teamcityEscape(t.Path))
+	fmt.Fprintf(w, "##teamcity[blockOpened name='%s' flowId='%[1]s']\n", teamcityEscape(t.Path))
+}
+
+// Output writes the lines as messages of the flow of the target, the errors
+// of the stderr lines.
+func (teamcityRenderer) Output(w io.Writer, t *Target, stream string) io.Writer {
+	status := "NORMAL"
+	if stream == "stderr" {
+		status = "WARNING"
+	}
+	pw := newPrefixWriter(w, "")
+	return &lineWriter{line: func(l string) {
+		fmt.Fprintf(pw, "##teamcity[message text='%s' status='%s' flowId='%s']\n", teamcityEscape(l), status, teamcityEscape(t.Path))
+	}}
+}
+
+func (teamcityRenderer) Finish(w io.Writer, t *Target, rt *RunTarget, err error) {
+	flow := teamcityEscape(t.Path)
+	if err != nil {
+		fmt.Fprintf(w, "##teamcity[buildProblem description='%s' identity='%s' flowId='%s']\n", teamcityEscape(t.Path+": "+err.Error()), teamcityIdentity(t.Path), flow)
+	}
+	for _, p := range rt.Problems {
+		status := "ERROR"
+		if p.Severity != "error" {
+			status = "WARNING"
+		}
+		fmt.Fprintf(w, "##teamcity[message text='%s' status='%s' flowId='%s']\n", teamcityEscape(p.String()), status, flow)
+	}
+	fmt.Fprintf(w, "##teamcity[buildStatisticValue key='mb.%s.duration' value='%d' flowId='%s']\n", teamcityEscape(t.Path), rt.Duration.Milliseconds(), flow)
+	fmt.Fprintf(w, "##teamcity[buildStatisticValue key='mb.%s.tmpUsage' value='%d' flowId='%s']\n", teamcityEscape(t.Path), rt.TmpUsage, flow)
+	fmt.Fprintf(w, "##teamcity[blockClosed name='%s' flowId='%[1]s']\n", flow)
+	fmt.Fprintf(w, "##teamcity[flowFinished flowId='%s']\n", flow)
+}
+
+func (teamcityRenderer) Info(w io.Writer, msg string) {
+	fmt.Fprintf(w, "##teamcity[message text='%s']\n", teamcityEscape(msg))
+}
+
+func (teamcityRenderer) Warn(w io.Writer, msg string) {
+	fmt.Fprintf(w, "##teamcity[message text='%s' status='WARNING']\n", teamcityEscape(msg))
+}
+
+func teamcityEscape(s string) string {
+	return strings.NewReplacer("|", "||", "'", "|'", "\n", "|n", "\r", "|r", "[", "|[", "]", "|]").Replace(s)
+}
+
+// teamcityIdentity returns the identity of the build problem of a target,
+// which TeamCity limits to 60 characters.
+func teamcityIdentity(path string) string {
+	if len(path) <= 60 {
+		return teamcityEscape(path)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(path)))[:60]
+}
+
+// bambooRenderer writes a plain log for Bamboo, which has no service
+// messages: the output lines are prefixed with the target path and the
+// failures and warnings are written to stderr, which Bamboo shows as the
+// error log of the job.
+type bambooRenderer struct {
+	prettyRenderer
+}
+
+func (bambooRenderer) Start(w io.Writer, t *Target) {
+	fmt.Fprintf(w, "==== BUILDING TARGET %s ====\n", t.Path)
+}
+
+func (bambooRenderer) Output(w io.Writer, t *Target, stream string) io.Writer {
+	return newPrefixWriter(w, "["+t.Path+"] ")
+}
+
+func (bambooRenderer) Finish(w io.Writer, t *Target, rt *RunTarget, err error) {
+	for _, p := range rt.Problems {
+		fmt.Fprintf(os.Stderr, "%s: target %s: %s\n", strings.ToUpper(p.Severity), t.Path, p)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "BUILD FAILED: target %s: %v\n", t.Path, err)
+	}
+	fmt.Fprintf(w, "==== TARGET %s %s IN %s ====\n", t.Path, strings.ToUpper(rt.Status), rt.Duration.Round(time.Millisecond))
+}
+
+func (bambooRenderer) Summary(w io.Writer, results []*TargetOutcome) {
+	prettyRenderer{}.Summary(w, results)
+	// The failures are written by Finish.
+	for _, r := range results {
+		if r.Status == ResultSkipped {
+			fmt.Fprintf(os.Stderr, "BUILD SKIPPED: target %s: %v\n", r.Path, r.Error)
+		}
+	}
+}
+
+func (bambooRenderer) Warn(w io.Writer, msg string) { fmt.Fprintln(os.Stderr, "WARNING:", msg) }
+
+// lineWriter calls line for every line written to it.
+type lineWriter struct {
+	line func(string)
+	buf  []byte
+}
+
+func (l *lineWriter) Write(b []byte) (int, error) {
+	l.buf = append(l.buf, b...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		l.line(string(l.buf[:i]))
+		l.buf = l.buf[i+1:]
+	}
+}
+
+// Flush calls line with the last line when it does not end with a newline.
+func (l *lineWriter) Flush() error {
+	if len(l.buf) > 0 {
+		l.line(string(l.buf))
+		l.buf = nil
+	}
+	return nil
+}
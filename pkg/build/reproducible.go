@@ -0,0 +1,145 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// VerifyReproducible builds every affected target that declares outputs
+// twice, in two isolated git worktrees of the current state of the
+// repository, and fails if the artifacts of both builds differ.
+func (b *BuildContext) VerifyReproducible(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "*BuildContext.VerifyReproducible()")
+	defer span.End()
+	var targets []*Target
+	for _, t := range b.Config.Targets {
+		if len(t.Changes) == 0 && !b.All || !t.buildable() {
+			continue
+		}
+		if len(t.Outputs) == 0 {
+			fmt.Printf("SKIPPING TARGET WITHOUT OUTPUTS: %s\n", t.Path)
+			continue
+		}
+		if !b.approve(ctx, t) {
+			return errors.Errorf("target %s: %s", t.Path, t.Approval)
+		}
+		for _, c := range t.commands() {
+			if err := b.Config.Policy.check(c); err != nil {
+				return errors.Wrapf(err, "target %s", t.Path)
+			}
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 {
+		fmt.Println("no affected target with outputs to verify")
+		return nil
+	}
+
+	// The stash commit includes the uncommitted changes of tracked files.
+	rev, err := gitOutput(ctx, "stash", "create")
+	if err != nil {
+		return err
+	}
+	if rev == "" {
+		rev = "HEAD"
+	}
+	var digests [2][]map[string]string
+	for i := range digests {
+		ws, err := addWorktree(ctx, rev)
+		if err != nil {
+			return err
+		}
+		defer removeWorktree(ctx, ws)
+		for _, t := range targets {
+			fmt.Printf("BUILDING TARGET %s IN WORKSPACE %d\n", t.Path, i+1)
+			d, err := b.buildInWorkspace(ctx, t, ws)
+			if err != nil {
+				return err
+			}
+			digests[i] = append(digests[i], d)
+		}
+	}
+
+	var nondeterministic []string
+	for j, t := range targets {
+		a := &RunTarget{Artifacts: digests[0][j]}
+		c := &RunTarget{Artifacts: digests[1][j]}
+		var diffs []string
+		for _, name := range artifactNames(a, c) {
+			if a.Artifacts[name] != c.Artifacts[name] {
+				diffs = append(diffs, name)
+			}
+		}
+		if len(diffs) == 0 {
+			fmt.Printf("REPRODUCIBLE: %s\n", t.Path)
+			continue
+		}
+		fmt.Printf("NOT REPRODUCIBLE: %s: %s\n", t.Path, strings.Join(diffs, ", "))
+		nondeterministic = append(nondeterministic, t.Path)
+	}
+	if len(nondeterministic) > 0 {
+		return errors.Errorf("non-reproducible targets: %s", strings.Join(nondeterministic, ", "))
+	}
+	return nil
+}
+
+// buildInWorkspace runs the build command of a target in a worktree and
+// returns the digests of its outputs.
+func (b *BuildContext) buildInWorkspace(ctx context.Context, t *Target, ws string) (map[string]string, error) {
+	wt := *t
+	wt.BuildCommand.Dir = filepath.Join(ws, t.BuildCommand.Dir)
+	wt.Steps = nil
+	for _, s := range t.Steps {
+		wt.Steps = append(wt.Steps, s.clone())
+	}
+	if len(wt.Steps) > 0 {
+		for _, s := range wt.commandSteps() {
+			s.Dir = filepath.Join(ws, s.Dir)
+		}
+	}
+	env, err := t.environ(b.Config.Policy)
+	if err != nil {
+		return nil, err
+	}
+	tools, err := b.InstallTools(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wt.env = prependPath(env, tools)
+	wt.policy = b.Config.Policy
+	wt.timeout = b.Config.defaultTimeout()
+	wt.outputLimit = b.Config.OutputLimit.over(t.OutputLimit)
+	if err := wt.Run(ctx); err != nil {
+		return nil, err
+	}
+	d, err := artifactDigests(ws, t.Outputs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "target %s", t.Path)
+	}
+	return d, nil
+}
+
+func addWorktree(ctx context.Context, rev string) (string, error) {
+	dir, err := ioutil.TempDir("", "mb-reproducible-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := gitOutput(ctx, "worktree", "add", "--detach", dir, rev); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+func removeWorktree(ctx context.Context, dir string) {
+	if _, err := gitOutput(ctx, "worktree", "remove", "--force", dir); err != nil {
+		Log.Warn("cannot remove the worktree", "dir", dir, "error", err)
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,72 @@
+package build
+
+// DiffResult is the machine-readable result of a diff: the changed files,
+// the targets they affect and why.
+type DiffResult struct {
+	CommitRange string        `json:"commit_range" yaml:"commit_range"`
+	Files       []*DiffFile   `json:"files" yaml:"files"`
+	Targets     []*DiffTarget `json:"targets" yaml:"targets"`
+	Warnings    []string      `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+	Overrides   []string      `json:"overrides,omitempty" yaml:"overrides,omitempty"`
+	Pathspecs   []string      `json:"pathspecs,omitempty" yaml:"pathspecs,omitempty"`
+}
+
+// DiffFile is a changed file and the targets it affects.
+type DiffFile struct {
+	Name         string   `json:"name" yaml:"name"`
+	Status       string   `json:"status,omitempty" yaml:"status,omitempty"`
+	From         string   `json:"from,omitempty" yaml:"from,omitempty"`
+	Sources      []string `json:"sources" yaml:"sources"`
+	DependencyOf []string `json:"dependency_of,omitempty" yaml:"dependency_of,omitempty"`
+	WatchedBy    []string `json:"watched_by,omitempty" yaml:"watched_by,omitempty"`
+	// Not rebuilt with minimal_rebuild: the exported API did not change.
+	SkippedDependents []string `json:"skipped_dependents,omitempty" yaml:"skipped_dependents,omitempty"`
+}
+
+// DiffTarget is a target and the changed files that affect it.
+type DiffTarget struct {
+	Path     string   `json:"path" yaml:"path"`
+	Name     string   `json:"name,omitempty" yaml:"name,omitempty"`
+	Affected bool     `json:"affected" yaml:"affected"`
+	Changes  []string `json:"changes,omitempty" yaml:"changes,omitempty"`
+	// The Go packages and dependency directories of the target that the
+	// changed files touch.
+	Packages []string `json:"packages,omitempty" yaml:"packages,omitempty"`
+}
+
+// Result returns the result of the diff.
+func (b *BuildContext) Result() *DiffResult {
+	r := &DiffResult{
+		CommitRange: b.CommitRange,
+		Files:       []*DiffFile{},
+		Targets:     []*DiffTarget{},
+		Warnings:    b.Warnings(),
+		Pathspecs:   b.Pathspecs,
+	}
+	for _, o := range b.Overrides {
+		r.Overrides = append(r.Overrides, o.String())
+	}
+	for _, f := range b.Files {
+		r.Files = append(r.Files, &DiffFile{
+			Name:              f.Name,
+			Status:            f.Status,
+			From:              f.From,
+			Sources:           f.Sources,
+			DependencyOf:      f.DependencyOf,
+			WatchedBy:         f.WatchedBy,
+			SkippedDependents: f.SkippedDependents,
+		})
+	}
+	for _, t := range b.Config.Targets {
+		dt := &DiffTarget{Path: t.Path, Name: t.Name, Affected: len(t.Changes) > 0 || b.All, Packages: t.changedPackages()}
+		for _, f := range t.Changes {
+			// A file both watched by and a dependency of the target is recorded
+			// twice.
+			if !contains(dt.Changes, f.Name) {
+				dt.Changes = append(dt.Changes, f.Name)
+			}
+		}
+		r.Targets = append(r.Targets, dt)
+	}
+	return r
+}
@@ -0,0 +1,131 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Statuses of the result files that are not run statuses.
+const (
+	ResultRunning = "running"
+	ResultSkipped = "skipped"
+)
+
+// TargetResult is the result file of a target, written to the result
+// directory when its build starts and when it ends, so that an orchestrator
+// can react to the builds without parsing the logs.
+type TargetResult struct {
+	Path      string            `json:"path"`
+	Name      string            `json:"name,omitempty"`
+	Status    string            `json:"status"` // running, success, failure, skipped or cached.
+	Error     string            `json:"error,omitempty"`
+	RunID     string            `json:"run_id"`
+	Commit    string            `json:"commit"`
+	Started   *time.Time        `json:"started,omitempty"`
+	Finished  *time.Time        `json:"finished,omitempty"`
+	Duration  time.Duration     `json:"duration,omitempty"`
+	Inputs    string            `json:"inputs,omitempty"`    // Digest of the inputs of a target with outputs.
+	Artifacts map[string]string `json:"artifacts,omitempty"` // Artifact path to sha256.
+	Problems  []Problem         `json:"problems,omitempty"`
+	Steps     []RunStep         `json:"steps,omitempty"`
+}
+
+// resultDir returns the directory of the result files, none when empty.
+func (b *BuildContext) resultDir() string {
+	if b.ResultDir != "" {
+		return b.ResultDir
+	}
+	return b.Config.ResultDir
+}
+
+// writeResult writes the result file of a target whose build started, or
+// ended with an error or not.
+func (b *BuildContext) writeResult(run *Run, rt *RunTarget, err error) {
+	r := &TargetResult{
+		Path:      rt.Path,
+		Name:      rt.Name,
+		Status:    rt.Status,
+		RunID:     run.ID,
+		Commit:    run.Commit,
+		Started:   &rt.Started,
+		Duration:  rt.Duration,
+		Inputs:    rt.Inputs,
+		Artifacts: rt.Artifacts,
+		Problems:  rt.Problems,
+		Steps:     rt.Steps,
+	}
+	if r.Status == "" {
+		r.Status = ResultRunning
+	} else {
+		finished := rt.Started.Add(rt.Duration)
+		r.Finished = &finished
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	b.saveResult(r)
+}
+
+// writeSkipped writes the result file of a target that is not built because
+// of a failed dependency.
+func (b *BuildContext) writeSkipped(ctx context.Context, run *Run, t *Target, reason error) {
+	targetEvent(ctx, "target skipped", t, attribute.String("reason", reason.Error()))
+	t.skipped = reason.Error()
+	b.saveResult(&TargetResult{
+		Path:   t.Path,
+		Name:   t.Name,
+		Status: ResultSkipped,
+		Error:  reason.Error(),
+		RunID:  run.ID,
+		Commit: run.Commit,
+	})
+}
+
+// saveResult replaces the result file of a target, <dir>/<path>/result.json.
+// A failure to write it is a warning: the build goes on.
+func (b *BuildContext) saveResult(r *TargetResult) {
+	dir := b.resultDir()
+	if dir == "" {
+		return
+	}
+	name := filepath.Join(dir, filepath.FromSlash(CleanTreePath(r.Path)), "result.json")
+	if err := writeFileAtomic(name, r); err != nil {
+		Log.Warn("cannot write the result file", "target", r.Path, "error", err)
+	}
+}
+
+// writeFileAtomic writes the JSON of v to a temporary file renamed to name,
+// so that the readers of name never see a partial file.
+func writeFileAtomic(name string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), ".result-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
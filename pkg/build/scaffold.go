@@ -0,0 +1,164 @@
+package build
+
+import (
+	"bytes"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type scaffoldConfig struct {
+	DepSourceDirs []string          `yaml:"dep_source_dirs,omitempty"`
+	Targets       []*scaffoldTarget `yaml:"targets"`
+}
+
+type scaffoldTarget struct {
+	Path         string          `yaml:"path"`
+	BuildCommand scaffoldCommand `yaml:"build_command"`
+}
+
+type scaffoldCommand struct {
+	Dir     string   `yaml:"dir,omitempty"`
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args,omitempty"`
+}
+
+// ScaffoldConfig inspects the repository in root and returns a starter
+// config: a target per Go main package and per Cargo, Maven or Gradle
+// project, and the top-level directories of the other Go packages as
+// dep_source_dirs.
+func ScaffoldConfig(root string) ([]byte, error) {
+	var goMains, projects []string
+	depDirs := make(map[string]bool)
+	builders := make(map[string]scaffoldCommand)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !info.IsDir() {
+			return nil
+		}
+		if rel != "." && skipScaffoldDir(info.Name()) {
+			return filepath.SkipDir
+		}
+		switch pkg := goPackageName(p); {
+		case pkg == "main":
+			goMains = append(goMains, rel)
+		case pkg != "" && rel != ".":
+			depDirs[strings.SplitN(rel, "/", 2)[0]] = true
+		}
+		for _, b := range []struct {
+			file string
+			cmd  scaffoldCommand
+		}{
+			{"Cargo.toml", scaffoldCommand{Command: "cargo", Args: []string{"build", "--release"}}},
+			{"pom.xml", scaffoldCommand{Command: "mvn", Args: []string{"-q", "package"}}},
+			{"build.gradle", scaffoldCommand{Command: "gradle", Args: []string{"build"}}},
+			{"build.gradle.kts", scaffoldCommand{Command: "gradle", Args: []string{"build"}}},
+		} {
+			if fileExists(filepath.Join(p, b.file)) {
+				projects = append(projects, rel)
+				b.cmd.Dir = rel
+				builders[rel] = b.cmd
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	cfg := &scaffoldConfig{}
+	for _, m := range goMains {
+		out, pkg := path.Base(m), "./"+m
+		if m == "." {
+			// The binary of a root main package is named after the module.
+			out, pkg = path.Base(goModulePath(root)), "."
+		}
+		cfg.Targets = append(cfg.Targets, &scaffoldTarget{
+			Path:         m,
+			BuildCommand: scaffoldCommand{Command: "go", Args: []string{"build", "-o", "bin/" + out, pkg}},
+		})
+	}
+	for _, p := range projects {
+		if !isWorkspace(p, projects) {
+			cfg.Targets = append(cfg.Targets, &scaffoldTarget{Path: p, BuildCommand: builders[p]})
+		}
+	}
+	for d := range depDirs {
+		cfg.DepSourceDirs = append(cfg.DepSourceDirs, d)
+	}
+	sort.Strings(cfg.DepSourceDirs)
+	body, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	b.WriteString("# Generated by mb init: review the targets and their build commands.\n")
+	b.Write(body)
+	return b.Bytes(), nil
+}
+
+// isWorkspace reports whether a project has other projects below it, e.g. a
+// Cargo workspace or a multi-module Maven build. Its modules are the targets.
+func isWorkspace(p string, projects []string) bool {
+	for _, o := range projects {
+		if o != p && (p == "." || strings.HasPrefix(o, p+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipScaffoldDir reports whether a directory has no targets: the hidden,
+// vendored and test data directories.
+func skipScaffoldDir(name string) bool {
+	switch name {
+	case "vendor", "node_modules", "testdata":
+		return true
+	}
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// goModulePath returns the module path of the go.mod of a directory, "app"
+// when there is none.
+func goModulePath(dir string) string {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return "app"
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if f := strings.Fields(l); len(f) == 2 && f[0] == "module" {
+			return strings.Trim(f[1], `"`)
+		}
+	}
+	return "app"
+}
+
+// goPackageName returns the package of the non-test Go files of a directory,
+// "" when there is none.
+func goPackageName(dir string) string {
+	names, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	for _, n := range names {
+		if strings.HasSuffix(n, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), n, nil, parser.PackageClauseOnly)
+		if err == nil {
+			return f.Name.Name
+		}
+	}
+	return ""
+}
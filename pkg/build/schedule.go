@@ -0,0 +1,79 @@
+package build
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// schedule returns the targets in the order they are built, every target
+// after the targets it depends on. The targets are in config order, or in
+// path order when the build is deterministic.
+func (b *BuildContext) schedule(targets []*Target) []*Target {
+	if b.Deterministic {
+		targets = append([]*Target{}, targets...)
+		sort.SliceStable(targets, func(i, j int) bool {
+			return CleanTreePath(targets[i].Path) < CleanTreePath(targets[j].Path)
+		})
+	}
+	return buildOrder(targets)
+}
+
+// priorities ranks the targets of a parallel build: of the targets ready to
+// be built, the one with the lowest rank is started first.
+//
+// By default the targets that took the longest in their last successful
+// build start first, so that a long build does not start last and hold the
+// whole run. The targets of the same expected duration, e.g. the ones never
+// built, are ranked at random with the seed of the run. A deterministic build
+// keeps the order of the targets.
+func (b *BuildContext) priorities(run *Run, targets []*Target) []int {
+	order := make([]int, len(targets))
+	for i := range order {
+		order[i] = i
+	}
+	if !b.Deterministic {
+		run.Seed = b.Seed
+		if run.Seed == 0 {
+			run.Seed = time.Now().UnixNano()
+		}
+		expected := b.expectedDurations()
+		order = rand.New(rand.NewSource(run.Seed)).Perm(len(targets))
+		sort.SliceStable(order, func(i, j int) bool {
+			return expected[CleanTreePath(targets[order[i]].Path)] > expected[CleanTreePath(targets[order[j]].Path)]
+		})
+	}
+	rank := make([]int, len(targets))
+	for r, i := range order {
+		rank[i] = r
+	}
+	return rank
+}
+
+// expectedDurations returns the duration of the last successful build of
+// every target recorded in the runs directory.
+func (b *BuildContext) expectedDurations() map[string]time.Duration {
+	durations := make(map[string]time.Duration)
+	runs, err := ReadRuns(b.RunsDir)
+	if err != nil {
+		return durations
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Time.Before(runs[j].Time) })
+	for _, r := range runs {
+		for _, rt := range r.Targets {
+			if rt.Status == RunSuccess {
+				durations[CleanTreePath(rt.Path)] = rt.Duration
+			}
+		}
+	}
+	return durations
+}
+
+// Sort sorts the changed files of the plan by name, so that the plans of the
+// same changes are equal whatever the order of the diff sources.
+func (b *BuildContext) Sort() {
+	sort.SliceStable(b.Files, func(i, j int) bool { return b.Files[i].Name < b.Files[j].Name })
+	for _, t := range b.Config.Targets {
+		sort.SliceStable(t.Changes, func(i, j int) bool { return t.Changes[i].Name < t.Changes[j].Name })
+	}
+}
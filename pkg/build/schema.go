@@ -0,0 +1,96 @@
+package build
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// schemaEnums are the allowed values of the string settings, by Go type and
+// YAML key.
+var schemaEnums = map[string][]string{
+	"Target.analyzer":        {AnalyzerGo, AnalyzerCargo, AnalyzerMaven, AnalyzerGradle, AnalyzerNone},
+	"GuardrailConfig.action": {GuardrailWarn, GuardrailAll, GuardrailConfirm, GuardrailFail},
+	"Config.config_change":   {ConfigChangeAll, ConfigChangePrecise, ConfigChangeWarn, ConfigChangeIgnore},
+	"CacheConfig.backend":    {CacheS3, CacheGCS, CacheHTTP},
+	"LockConfig.provider":    {LockFile, LockRedis, LockDynamoDB},
+	"OutputLimit.keep":       {OutputKeepBoth, OutputKeepHead, OutputKeepTail},
+}
+
+// schemaRequired are the required YAML keys, by Go type.
+var schemaRequired = map[string][]string{
+	"Target":          {"path"},
+	"DirectoryConfig": {"path"},
+}
+
+// ConfigSchema returns the JSON Schema of the config file, derived from the
+// YAML keys of Config, so that editors can validate monobuild.yaml. Like the
+// config parsing, it rejects the unknown keys.
+func ConfigSchema() ([]byte, error) {
+	s := schemaOf(reflect.TypeOf(Config{}))
+	s["$schema"] = "http://json-schema.org/draft-07/schema#"
+	s["title"] = "monobuild config"
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func schemaOf(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := strings.Split(f.Tag.Get("yaml"), ",")
+			if f.PkgPath != "" || tag[0] == "-" {
+				continue
+			}
+			if len(tag) > 1 && tag[1] == "inline" {
+				// The keys of an inlined struct are keys of its parent.
+				for k, v := range schemaOf(f.Type)["properties"].(map[string]interface{}) {
+					props[k] = v
+				}
+				continue
+			}
+			name := tag[0]
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			ps := schemaOf(f.Type)
+			if enum, ok := schemaEnums[t.Name()+"."+name]; ok {
+				ps["enum"] = enum
+			}
+			props[name] = ps
+		}
+		s := map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+		if required, ok := schemaRequired[t.Name()]; ok {
+			sorted := append([]string(nil), required...)
+			sort.Strings(sorted)
+			s["required"] = sorted
+		}
+		return s
+	}
+	// Any value, e.g. an interface.
+	return map[string]interface{}{}
+}
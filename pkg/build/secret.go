@@ -0,0 +1,162 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Encrypted config values are written as `!secret mbenc:v1:<base64>` where
+// the payload is an AES-256-GCM nonce followed by the ciphertext. The key is
+// read from MB_CONFIG_KEY (base64) or from the file named by MB_CONFIG_KEY_FILE.
+const secretPrefix = "mbenc:v1:"
+
+var (
+	secretRe = regexp.MustCompile(`!secret\s+(?:"([^"]*)"|'([^']*)'|([^\s,\]}]+))`)
+	sopsRe   = regexp.MustCompile(`(?m)^sops:\s*$`)
+
+	// secretValues are the decrypted !secret values, redacted from the dumps
+	// of the config.
+	secretValues []string
+)
+
+// decryptConfig decrypts a SOPS-encrypted config file with the sops CLI and
+// replaces every !secret value with its plaintext.
+func decryptConfig(ctx context.Context, raw []byte) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "decryptConfig")
+	defer span.End()
+	if sopsRe.Match(raw) {
+		var err error
+		if raw, err = sopsDecrypt(ctx, raw); err != nil {
+			return nil, err
+		}
+	}
+	if !secretRe.Match(raw) {
+		return raw, nil
+	}
+	key, err := ConfigKey()
+	if err != nil {
+		return nil, err
+	}
+	var derr error
+	out := secretRe.ReplaceAllFunc(raw, func(m []byte) []byte {
+		sm := secretRe.FindSubmatch(m)
+		token := string(bytes.Join(sm[1:], nil))
+		plain, err := decryptSecret(key, token)
+		if err != nil {
+			derr = err
+			return m
+		}
+		if plain != "" {
+			secretValues = append(secretValues, plain)
+		}
+		// A JSON string is a valid YAML double-quoted scalar.
+		quoted, _ := json.Marshal(plain)
+		return quoted
+	})
+	return out, derr
+}
+
+// RedactSecrets replaces the decrypted !secret values of a JSON dump.
+func RedactSecrets(s string) string {
+	for _, v := range secretValues {
+		quoted, _ := json.Marshal(v)
+		s = strings.Replace(s, string(quoted[1:len(quoted)-1]), "***", -1)
+	}
+	return s
+}
+
+func sopsDecrypt(ctx context.Context, raw []byte) ([]byte, error) {
+	f, err := ioutil.TempFile("", "mb-sops-*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(raw); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Close()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sops", "--decrypt", "--input-type", "yaml", "--output-type", "yaml", f.Name())
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Errorf("sops --decrypt: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func ConfigKey() ([]byte, error) {
+	encoded := os.Getenv("MB_CONFIG_KEY")
+	if name := os.Getenv("MB_CONFIG_KEY_FILE"); encoded == "" && name != "" {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(b)
+	}
+	if encoded == "" {
+		return nil, errors.Errorf("the config has !secret values but neither MB_CONFIG_KEY nor MB_CONFIG_KEY_FILE is set")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, errors.Errorf("the config key must be 32 bytes encoded in base64")
+	}
+	return key, nil
+}
+
+func EncryptSecret(key []byte, plain string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), nil)
+	return secretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(key []byte, token string) (string, error) {
+	if !strings.HasPrefix(token, secretPrefix) {
+		return "", errors.Errorf("!secret value %q does not start with %s", token, secretPrefix)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(token, secretPrefix))
+	if err != nil {
+		return "", errors.Errorf("!secret value is not valid base64: %v", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.Errorf("!secret value is too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.Errorf("cannot decrypt !secret value: %v", err)
+	}
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
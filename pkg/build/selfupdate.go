@@ -0,0 +1,189 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Release is the manifest of a release of mb on a release endpoint: at
+// <endpoint>/latest.json for the latest release, <endpoint>/<version>.json
+// for a given one. Its Ed25519 signature, base64 encoded, is at the URL of
+// the manifest with a .sig suffix.
+type Release struct {
+	Version  string                    `json:"version"`
+	Binaries map[string]*ReleaseBinary `json:"binaries"` // By platform, e.g. linux_amd64.
+
+	url *url.URL
+}
+
+// ReleaseBinary is the binary of a release for a platform.
+type ReleaseBinary struct {
+	URL    string `json:"url"` // Absolute, or relative to the manifest.
+	SHA256 string `json:"sha256"`
+}
+
+// FetchRelease fetches the manifest of a release from the release endpoint,
+// the latest one when version is empty, and verifies its signature with the
+// Ed25519 public key of keyFile, a PKIX PEM file, or else with the ReleaseKey
+// of the build. Only an insecure fetch accepts a manifest without a key to
+// verify it.
+func FetchRelease(ctx context.Context, endpoint, version, keyFile string, insecure bool) (*Release, error) {
+	ctx, span := tracer.Start(ctx, "FetchRelease")
+	defer span.End()
+	name := "latest"
+	if version != "" {
+		name = version
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + name + ".json")
+	if err != nil {
+		return nil, errors.Wrap(err, "release endpoint")
+	}
+	pub, err := releaseKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if pub == nil && !insecure {
+		return nil, errors.New("no release key to verify the release manifest with, set one or allow insecure updates")
+	}
+	data, err := getRelease(ctx, u.String())
+	if err != nil {
+		return nil, err
+	}
+	if pub != nil {
+		sig, err := getRelease(ctx, u.String()+".sig")
+		if err != nil {
+			return nil, err
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+		if err != nil || !ed25519.Verify(pub, data, raw) {
+			return nil, errors.Errorf("release %s: no valid signature of key %s", u, keyID(pub))
+		}
+	}
+	r := &Release{url: u}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, errors.Wrapf(err, "release %s", u)
+	}
+	if r.Version == "" || (version != "" && r.Version != version) {
+		return nil, errors.Errorf("release %s: version %q, want %q", u, r.Version, version)
+	}
+	span.SetAttributes(attribute.String("version", r.Version))
+	return r, nil
+}
+
+// releaseKey returns the public key of keyFile, else the ReleaseKey of the
+// build, nil when there is none.
+func releaseKey(keyFile string) (ed25519.PublicKey, error) {
+	if keyFile != "" {
+		return readVerifyingKey(keyFile)
+	}
+	if ReleaseKey == "" {
+		return nil, nil
+	}
+	der, err := base64.StdEncoding.DecodeString(ReleaseKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "release key of the build")
+	}
+	k, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "release key of the build")
+	}
+	pub, ok := k.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("release key of the build: not an Ed25519 key")
+	}
+	return pub, nil
+}
+
+// Binary returns the binary of the release for the running platform.
+func (r *Release) Binary() (*ReleaseBinary, error) {
+	bin, ok := r.Binaries[platform()]
+	if !ok || bin.URL == "" || bin.SHA256 == "" {
+		return nil, errors.Errorf("release %s has no binary for %s", r.Version, platform())
+	}
+	return bin, nil
+}
+
+// SelfUpdate downloads the binary of the release for the running platform,
+// verifies its sha256 and replaces the running binary with it. It returns
+// the path of the replaced binary.
+func (r *Release) SelfUpdate(ctx context.Context) (string, error) {
+	ctx, span := tracer.Start(ctx, "*Release.SelfUpdate()")
+	defer span.End()
+	bin, err := r.Binary()
+	if err != nil {
+		return "", err
+	}
+	u, err := r.url.Parse(bin.URL)
+	if err != nil {
+		return "", errors.Wrapf(err, "release %s", r.Version)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", err
+	}
+	data, err := getRelease(ctx, u.String())
+	if err != nil {
+		return "", err
+	}
+	if got := fmt.Sprintf("%x", sha256.Sum256(data)); !strings.EqualFold(got, bin.SHA256) {
+		return "", errors.Errorf("%s: sha256 %s does not match the expected %s", u, got, bin.SHA256)
+	}
+	// The new binary is written next to the running one, which it replaces
+	// with an atomic rename.
+	tmp := filepath.Join(filepath.Dir(exe), fmt.Sprintf(".mb-update-%d", os.Getpid()))
+	defer os.Remove(tmp)
+	if err := writeFile(tmp, bytes.NewReader(data), 0755); err != nil {
+		return "", errors.Wrapf(err, "cannot replace %s", exe)
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		return "", errors.Wrapf(err, "cannot replace %s", exe)
+	}
+	span.SetAttributes(attribute.String("version", r.Version), attribute.String("binary", exe))
+	return exe, nil
+}
+
+// SignRelease writes the signature of a release manifest, signed with the
+// Ed25519 private key of keyFile, a PKCS #8 PEM file, to <manifest>.sig.
+func SignRelease(manifest, keyFile string) error {
+	key, err := readSigningKey(keyFile)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		return err
+	}
+	var r Release
+	if err := json.Unmarshal(data, &r); err != nil {
+		return errors.Wrapf(err, "release %s", manifest)
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return ioutil.WriteFile(manifest+".sig", []byte(sig+"\n"), 0644)
+}
+
+// getRelease downloads a file of the release endpoint.
+func getRelease(ctx context.Context, u string) ([]byte, error) {
+	data, err := doBlob(ctx, http.MethodGet, u, nil, nil)
+	if err == errCacheMiss {
+		return nil, errors.Errorf("%s: not found", u)
+	}
+	return data, err
+}
@@ -0,0 +1,105 @@
+package build
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/pkg/errors"
+)
+
+// isSparseCheckout reports whether the working tree is a git sparse checkout.
+func isSparseCheckout(ctx context.Context) bool {
+	out, _ := gitOutput(ctx, "config", "--bool", "core.sparseCheckout")
+	return out == "true"
+}
+
+// isPartialClone reports whether the repository is a partial clone, whose
+// missing objects are fetched on demand from a promisor remote.
+func isPartialClone(ctx context.Context) bool {
+	if out, _ := gitOutput(ctx, "config", "--get", "extensions.partialClone"); out != "" {
+		return true
+	}
+	lines, _ := gitLines(ctx, "config", "--get-regexp", `^remote\..*\.promisor$`)
+	for _, l := range lines {
+		if strings.HasSuffix(l, " true") {
+			return true
+		}
+	}
+	return false
+}
+
+// notCheckedOut reports whether a path is missing from the working tree but
+// exists at HEAD, i.e. it is outside of the sparse checkout.
+func notCheckedOut(ctx context.Context, p string) bool {
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		return false
+	}
+	return exec.CommandContext(ctx, "git", "cat-file", "-e", "HEAD:"+CleanTreePath(p)).Run() == nil
+}
+
+// analyzeHead analyzes a target from the HEAD tree, as for a bare repository,
+// when the target or its dependencies are not checked out. The files under the target directory are always
+// dependencies of the target. When the Go sources cannot be read, e.g. their
+// blobs were not fetched by a partial clone, only the target directory is
+// considered.
+func (t *Target) analyzeHead(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "*Target.analyzeHead")
+	defer span.End()
+	t.addDepDir(t.Path)
+	repo, err := git.PlainOpenWithOptions(".", &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return errors.Wrapf(err, "target %s", t.Path)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return errors.Wrapf(err, "target %s", t.Path)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return errors.Wrapf(err, "target %s", t.Path)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return errors.Wrapf(err, "target %s", t.Path)
+	}
+	r := &BareRepo{Path: ".", Head: head.Hash().String(), repo: repo, headTree: tree}
+	t.NotCheckedOut = true
+	t.CheckoutDirs = []string{CleanTreePath(t.Path)}
+	if t.Analyzer == "" || t.Analyzer == AnalyzerGo {
+		if t.Deps, err = r.goDeps(t.Path); err != nil {
+			hint := ""
+			if isPartialClone(ctx) {
+				hint = " (the blobs may not be fetched by the partial clone)"
+			}
+			Log.Warn("cannot analyze the Go dependencies of the target from HEAD"+hint+", only its directory is analyzed", "target", t.Path, "error", err)
+		}
+		dirs, err := r.goPackageDirs()
+		if err != nil {
+			return errors.Wrapf(err, "target %s", t.Path)
+		}
+		for _, d := range t.Deps {
+			if dir, ok := resolveImportDir(d, dirs); ok {
+				t.CheckoutDirs = append(t.CheckoutDirs, dir)
+			}
+		}
+	}
+	return nil
+}
+
+// checkout adds the directories of a target and of its Go dependencies to
+// the sparse checkout, so that the target can be built. In a partial clone,
+// git fetches the missing blobs.
+func (t *Target) checkout(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "*Target.checkout")
+	defer span.End()
+	Log.Info("checking out the target", "target", t.Path, "dirs", strings.Join(t.CheckoutDirs, ","))
+	args := append([]string{"sparse-checkout", "add", "--"}, t.CheckoutDirs...)
+	if _, err := gitOutput(ctx, args...); err != nil {
+		return errors.Wrapf(err, "target %s", t.Path)
+	}
+	t.NotCheckedOut = false
+	return nil
+}
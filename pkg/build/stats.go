@@ -0,0 +1,147 @@
+package build
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TargetStats summarizes the builds of a target over a time window.
+type TargetStats struct {
+	Path        string        `json:"path"`           // The latest path of the target.
+	Name        string        `json:"name,omitempty"` // The name of the target, when it has one.
+	Window      string        `json:"window"`
+	Builds      int           `json:"builds"`
+	Failures    int           `json:"failures"`
+	SuccessRate float64       `json:"success_rate"`
+	P50         time.Duration `json:"p50"`
+	P95         time.Duration `json:"p95"`
+
+	latest time.Time // Start of the latest build, of Path.
+}
+
+// ReadRuns reads every run record of the runs directory.
+func ReadRuns(dir string) ([]*Run, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var runs []*Run
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		r := &Run{}
+		if err := json.Unmarshal(b, r); err != nil {
+			return nil, errors.Errorf("%s: %v", name, err)
+		}
+		runs = append(runs, r)
+	}
+	return runs, nil
+}
+
+// TargetStatsSince computes the stats of every target built since the start of
+// the window, by ID: the builds of a named target in its previous directories
+// count.
+func TargetStatsSince(runs []*Run, window string, since time.Time) []*TargetStats {
+	durations := make(map[string][]time.Duration)
+	byID := make(map[string]*TargetStats)
+	var ids []string
+	for _, r := range runs {
+		for _, rt := range r.Targets {
+			if rt.Started.Before(since) || rt.Status == "" || rt.Status == RunCancelled {
+				continue
+			}
+			s, ok := byID[rt.ID()]
+			if !ok {
+				s = &TargetStats{Name: rt.Name, Window: window}
+				byID[rt.ID()] = s
+				ids = append(ids, rt.ID())
+			}
+			if !rt.Started.Before(s.latest) {
+				s.Path, s.latest = rt.Path, rt.Started
+			}
+			s.Builds++
+			if rt.Status != RunSuccess {
+				s.Failures++
+			}
+			durations[rt.ID()] = append(durations[rt.ID()], rt.Duration)
+		}
+	}
+	sort.Strings(ids)
+	var stats []*TargetStats
+	for _, id := range ids {
+		s := byID[id]
+		s.SuccessRate = float64(s.Builds-s.Failures) / float64(s.Builds)
+		s.P50 = percentile(durations[id], 50)
+		s.P95 = percentile(durations[id], 95)
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// CacheWindowStats summarizes the lookups of the build cache over a time
+// window.
+type CacheWindowStats struct {
+	Window string `json:"window"`
+	CacheStats
+	HitRate float64 `json:"hit_rate"`
+}
+
+// CacheStatsSince sums the cache lookups of the runs since the start of the
+// window.
+func CacheStatsSince(runs []*Run, window string, since time.Time) *CacheWindowStats {
+	s := &CacheWindowStats{Window: window}
+	for _, r := range runs {
+		if r.Cache == nil || r.Time.Before(since) {
+			continue
+		}
+		s.Hits += r.Cache.Hits
+		s.RemoteHits += r.Cache.RemoteHits
+		s.Misses += r.Cache.Misses
+		s.Uploads += r.Cache.Uploads
+	}
+	if lookups := s.Hits + s.Misses; lookups > 0 {
+		s.HitRate = float64(s.Hits) / float64(lookups)
+	}
+	return s
+}
+
+// percentile returns the nearest-rank percentile of the durations.
+func percentile(d []time.Duration, p float64) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(d))
+	copy(sorted, d)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// ParseWindow parses a duration that also accepts days, e.g. 7d.
+func ParseWindow(w string) (time.Duration, error) {
+	if strings.HasSuffix(w, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(w, "d"))
+		if err != nil || days <= 0 {
+			return 0, errors.Errorf("invalid window %q", w)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(w)
+	if err != nil || d <= 0 {
+		return 0, errors.Errorf("invalid window %q", w)
+	}
+	return d, nil
+}
@@ -0,0 +1,203 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Step is a build step of a target: a command run after the previous step
+// of the target succeeded, e.g. go generate, then go test, then go build.
+//
+// A step may declare the nonzero exit codes that do not fail the build, e.g.
+// 1 of a diff check that found changes, which a following step handles with
+// the MB_PREVIOUS_EXIT_CODE of its environment.
+//
+// A step may instead be a group of parallel steps, e.g. lint and test, run
+// at the same time after the previous step, and before the next one.
+type Step struct {
+	Name             string `yaml:"name"` // Shown in the build output and recorded in the run. Defaults to the command.
+	BuildCommand     `yaml:",inline"`
+	AllowedExitCodes []int   `yaml:"allowed_exit_codes"` // Nonzero exit codes that do not fail the build.
+	AllowFailure     bool    `yaml:"allow_failure"`      // No failure of the step fails the build.
+	Protected        bool    `yaml:"protected"`          // Requires an approval to run in CI mode, e.g. a deploy or publish step.
+	Parallel         []*Step `yaml:"parallel"`           // Steps run at the same time instead of a command. The first failure cancels the others.
+}
+
+// StepAllowedFailure is the status of a step that failed without failing
+// the build.
+const StepAllowedFailure = "allowed_failure"
+
+// RunStep is the result of a build step in the record of a run.
+type RunStep struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"` // success, failure or allowed_failure.
+	Duration time.Duration `json:"duration"`
+	ExitCode int           `json:"exit_code,omitempty"` // -1 when the command did not exit, e.g. was not found.
+}
+
+func (s *Step) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	if len(s.Parallel) > 0 {
+		var names []string
+		for _, p := range s.Parallel {
+			names = append(names, p.name())
+		}
+		return strings.Join(names, ", ")
+	}
+	return s.Command
+}
+
+// clone returns a copy of the step and of the steps of its group.
+func (s *Step) clone() *Step {
+	c := *s
+	c.Parallel = nil
+	for _, p := range s.Parallel {
+		c.Parallel = append(c.Parallel, p.clone())
+	}
+	return &c
+}
+
+// allows reports whether a failure of the step with an exit code does not
+// fail the build.
+func (s *Step) allows(code int) bool {
+	if s.AllowFailure {
+		return true
+	}
+	for _, c := range s.AllowedExitCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// exitCode returns the exit code of a command that returned err, or -1 when
+// it did not exit.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		return ee.ExitCode()
+	}
+	return -1
+}
+
+// buildable reports whether the target has a build_command or steps.
+func (t *Target) buildable() bool {
+	return t.BuildCommand.defined() || len(t.Steps) > 0
+}
+
+// steps returns the build steps of the target, its build_command alone when
+// it has no steps.
+func (t *Target) steps() []*Step {
+	if len(t.Steps) > 0 {
+		return t.Steps
+	}
+	if !t.BuildCommand.defined() {
+		return nil
+	}
+	return []*Step{{BuildCommand: t.BuildCommand}}
+}
+
+// commandSteps returns the build steps of the target that run a command,
+// the steps of its parallel groups included.
+func (t *Target) commandSteps() []*Step {
+	var steps []*Step
+	for _, s := range t.steps() {
+		if len(s.Parallel) > 0 {
+			steps = append(steps, s.Parallel...)
+		} else {
+			steps = append(steps, s)
+		}
+	}
+	return steps
+}
+
+// commands returns the commands of the build steps of the target, e.g. to
+// check them against the policy.
+func (t *Target) commands() []BuildCommand {
+	var commands []BuildCommand
+	for _, s := range t.commandSteps() {
+		commands = append(commands, s.BuildCommand)
+	}
+	return commands
+}
+
+// validateSteps checks that a target has either a build_command or steps,
+// and that each step has a command and a distinct name.
+func validateSteps(t *Target) error {
+	if len(t.Steps) == 0 {
+		return nil
+	}
+	if t.BuildCommand.defined() {
+		return errors.Errorf("target.steps: target %s has both a build_command and steps", t.Path)
+	}
+	names := make(map[string]bool)
+	for i, s := range t.Steps {
+		if s == nil || len(s.Parallel) == 0 {
+			if err := validateStep(t, s, fmt.Sprintf("steps[%d]", i), names); err != nil {
+				return err
+			}
+			continue
+		}
+		switch {
+		case s.defined():
+			return errors.Errorf("target.steps[%d]: step %s of target %s has both a command and parallel steps", i, s.name(), t.Path)
+		case len(s.AllowedExitCodes) > 0 || s.AllowFailure || s.Protected:
+			return errors.Errorf("target.steps[%d]: the parallel group %s of target %s sets allowed_exit_codes, allow_failure or protected, set them on its steps", i, s.name(), t.Path)
+		}
+		for j, p := range s.Parallel {
+			field := fmt.Sprintf("steps[%d].parallel[%d]", i, j)
+			if p != nil && len(p.Parallel) > 0 {
+				return errors.Errorf("target.%s: step %s of target %s nests a parallel group", field, p.name(), t.Path)
+			}
+			if err := validateStep(t, p, field, names); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateStep checks that a step of a target has a command, valid allowed
+// exit codes and a name distinct from the names of the other steps.
+func validateStep(t *Target, s *Step, field string, names map[string]bool) error {
+	if s == nil || !s.defined() {
+		return errors.Errorf("target.%s: step of target %s has no command", field, t.Path)
+	}
+	if err := s.validate(field, t.Path); err != nil {
+		return err
+	}
+	for _, c := range s.AllowedExitCodes {
+		if c <= 0 || c > 255 {
+			return errors.Errorf("target.%s.allowed_exit_codes: %d of target %s is not a nonzero exit code", field, c, t.Path)
+		}
+	}
+	if names[s.name()] {
+		return errors.Errorf("target.steps: target %s has more than one step named %s", t.Path, s.name())
+	}
+	names[s.name()] = true
+	return nil
+}
+
+// syncBuffer buffers the output of a step of a parallel group, written by
+// the stdout and the stderr of its command at the same time.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
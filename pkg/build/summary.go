@@ -0,0 +1,144 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// unlabeled is the group of the targets without the label of the grouping.
+const unlabeled = "(unlabeled)"
+
+// summaryGroup is the outcomes of the targets of a label value, e.g. of a
+// team.
+type summaryGroup struct {
+	Name     string
+	Outcomes []*TargetOutcome
+}
+
+// String returns the counts of the group, e.g. "platform: 12 built, 1
+// failed" or "payments: all green".
+func (g *summaryGroup) String() string {
+	var built, failed, cancelled, skipped int
+	for _, o := range g.Outcomes {
+		switch o.Status {
+		case ResultSkipped:
+			skipped++
+		case RunFailure:
+			built++
+			failed++
+		case RunCancelled:
+			cancelled++
+		default:
+			built++
+		}
+	}
+	if failed == 0 && cancelled == 0 && skipped == 0 {
+		return fmt.Sprintf("%s: all green", g.Name)
+	}
+	counts := []string{fmt.Sprintf("%d built", built)}
+	if failed > 0 {
+		counts = append(counts, fmt.Sprintf("%d failed", failed))
+	}
+	if cancelled > 0 {
+		counts = append(counts, fmt.Sprintf("%d cancelled", cancelled))
+	}
+	if skipped > 0 {
+		counts = append(counts, fmt.Sprintf("%d skipped", skipped))
+	}
+	return g.Name + ": " + strings.Join(counts, ", ")
+}
+
+// groupOutcomes groups the outcomes by their Group, in name order with the
+// unlabeled targets last. It returns nil when the outcomes are not grouped.
+func groupOutcomes(results []*TargetOutcome) []*summaryGroup {
+	byName := make(map[string]*summaryGroup)
+	var groups []*summaryGroup
+	for _, o := range results {
+		if o.Group == "" {
+			return nil
+		}
+		g, ok := byName[o.Group]
+		if !ok {
+			g = &summaryGroup{Name: o.Group}
+			byName[o.Group] = g
+			groups = append(groups, g)
+		}
+		g.Outcomes = append(g.Outcomes, o)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if (groups[i].Name == unlabeled) != (groups[j].Name == unlabeled) {
+			return groups[j].Name == unlabeled
+		}
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+// summary groups the outcomes of a run by the GroupBy label, renders them
+// and appends them to the markdown summary file.
+func (b *BuildContext) summary(results []*TargetOutcome) {
+	if b.GroupBy != "" {
+		labels := make(map[string]string)
+		for _, t := range b.Config.Targets {
+			labels[t.Path] = t.Labels[b.GroupBy]
+		}
+		for _, o := range results {
+			if o.Group = labels[o.Path]; o.Group == "" {
+				o.Group = unlabeled
+			}
+		}
+	}
+	b.renderer().Summary(os.Stdout, results)
+	if b.MarkdownSummary == "" {
+		return
+	}
+	f, err := os.OpenFile(b.MarkdownSummary, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err == nil {
+		writeMarkdownSummary(f, results)
+		err = f.Close()
+	}
+	if err != nil {
+		b.renderer().Warn(os.Stdout, fmt.Sprintf("cannot write the markdown summary: %v", err))
+	}
+}
+
+// writeMarkdownSummary writes the outcomes as a markdown table, one per
+// group when they are grouped.
+func writeMarkdownSummary(w io.Writer, results []*TargetOutcome) {
+	failed := 0
+	for _, o := range results {
+		if o.Status != RunSuccess {
+			failed++
+		}
+	}
+	fmt.Fprintf(w, "### monobuild: %d of %d targets succeeded\n\n", len(results)-failed, len(results))
+	groups := groupOutcomes(results)
+	if groups == nil {
+		groups = []*summaryGroup{{Outcomes: results}}
+	}
+	for _, g := range groups {
+		if g.Name != "" {
+			fmt.Fprintf(w, "#### %s\n\n", g)
+		}
+		fmt.Fprintln(w, "| Target | Status | Details |")
+		fmt.Fprintln(w, "| --- | --- | --- |")
+		for _, o := range g.Outcomes {
+			status := map[string]string{RunSuccess: ":white_check_mark: succeeded", RunFailure: ":x: failed", RunCancelled: ":no_entry_sign: cancelled", ResultSkipped: ":fast_forward: skipped"}[o.Status]
+			details := strings.TrimSuffix(strings.TrimPrefix(o.usage(), " ("), ")")
+			if o.Error != nil {
+				details = o.Error.Error()
+			}
+			fmt.Fprintf(w, "| `%s` | %s | %s |\n", o.Path, status, markdownCell(details))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// markdownCell escapes a value for a cell of a markdown table.
+func markdownCell(s string) string {
+	s = strings.Replace(s, "|", `\|`, -1)
+	return strings.Replace(s, "\n", " ", -1)
+}
@@ -0,0 +1,99 @@
+package build
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var targetNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// ID returns the stable ID of the target: its name, or its path when it has
+// none. The run history and the cache are keyed by the ID, so that moving
+// the directory of a named target keeps them.
+func (t *Target) ID() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return CleanTreePath(t.Path)
+}
+
+// ID returns the stable ID of the built target, as Target.ID.
+func (rt *RunTarget) ID() string {
+	if rt.Name != "" {
+		return rt.Name
+	}
+	return CleanTreePath(rt.Path)
+}
+
+// Target returns the target of the config selected by its name or its path,
+// nil when there is none.
+func (c *Config) Target(sel string) *Target {
+	for _, t := range c.Targets {
+		if t.Name != "" && t.Name == sel {
+			return t
+		}
+	}
+	for _, t := range c.Targets {
+		if CleanTreePath(t.Path) == CleanTreePath(sel) {
+			return t
+		}
+	}
+	return nil
+}
+
+// SuggestTargets returns the names and the paths of the targets nearest to
+// a selection that matches no target.
+func (c *Config) SuggestTargets(sel string) []string {
+	var candidates []string
+	for _, t := range c.Targets {
+		if t.Name != "" {
+			candidates = append(candidates, t.Name)
+		}
+		candidates = append(candidates, CleanTreePath(t.Path))
+	}
+	return suggest(CleanTreePath(sel), candidates)
+}
+
+// noTarget is the error of a selection that matches no target.
+func (c *Config) noTarget(prefix, sel string) error {
+	return errors.Errorf("%s: no target %s%s", prefix, sel, didYouMean(c.SuggestTargets(sel)))
+}
+
+// validateNames checks that the target names are unique and that none is
+// the path of another target, so that a selection is never ambiguous.
+func (c *Config) validateNames() error {
+	paths := make(map[string]*Target)
+	for _, t := range c.Targets {
+		paths[CleanTreePath(t.Path)] = t
+	}
+	names := make(map[string]*Target)
+	for _, t := range c.Targets {
+		if t.Name == "" {
+			continue
+		}
+		if !targetNameRe.MatchString(t.Name) {
+			return errors.Errorf("target.name: %q of target %s must be letters, digits, '_', '.' and '-'", t.Name, t.Path)
+		}
+		if other, ok := names[t.Name]; ok {
+			return errors.Errorf("target.name: targets %s and %s are both named %s", other.Path, t.Path, t.Name)
+		}
+		if other, ok := paths[t.Name]; ok && other != t {
+			return errors.Errorf("target.name: the name %s of target %s is the path of another target", t.Name, t.Path)
+		}
+		names[t.Name] = t
+	}
+	return nil
+}
+
+// relocate returns the name of a file of the directory from in the
+// directory to, unchanged when it is not under from.
+func relocate(name, from, to string) string {
+	from, to = CleanTreePath(from), CleanTreePath(to)
+	if from == to || !strings.HasPrefix(name, from+"/") {
+		return name
+	}
+	return path.Join(to, strings.TrimPrefix(name, from+"/"))
+}
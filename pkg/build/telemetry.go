@@ -0,0 +1,123 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TelemetryConfig is the opt-in usage telemetry, e.g. for a platform team
+// rolling out mb to measure its adoption and its savings. It is disabled
+// when the endpoint is empty, or when DO_NOT_TRACK is set.
+type TelemetryConfig struct {
+	Endpoint string `yaml:"endpoint"` // URL where the usage report of every run is posted as JSON.
+}
+
+// UsageReport is the anonymous usage report of a run. It has counts and
+// durations only: no path, name, branch or command of the repository.
+type UsageReport struct {
+	Schema            int     `json:"schema"`
+	Repository        string  `json:"repository"` // SHA-256 of the origin URL, to count the repositories. Empty without an origin.
+	Version           string  `json:"version"`    // Of mb.
+	OS                string  `json:"os"`
+	Arch              string  `json:"arch"`
+	CI                bool    `json:"ci"`
+	DurationSeconds   float64 `json:"duration_seconds"`
+	Targets           int     `json:"targets"`
+	AffectedTargets   int     `json:"affected_targets"`
+	UnaffectedTargets int     `json:"unaffected_targets"` // Not rebuilt thanks to the change detection.
+	BuiltTargets      int     `json:"built_targets"`
+	FailedTargets     int     `json:"failed_targets"`
+	CacheHits         int     `json:"cache_hits"`
+	CacheMisses       int     `json:"cache_misses"`
+	CacheHitRate      float64 `json:"cache_hit_rate"` // 0 without cache lookups.
+	Cancelled         bool    `json:"cancelled"`
+}
+
+// usageReportSchema is the version of UsageReport, increased on incompatible
+// changes.
+const usageReportSchema = 1
+
+func (c TelemetryConfig) enabled() bool {
+	return c.Endpoint != "" && os.Getenv("DO_NOT_TRACK") == ""
+}
+
+// usageReport returns the usage report of a recorded run.
+func (b *BuildContext) usageReport(ctx context.Context, run *Run) *UsageReport {
+	m := b.runMetrics(run)
+	r := &UsageReport{
+		Schema:          usageReportSchema,
+		Version:         CurrentVersion().Version,
+		OS:              runtime.GOOS,
+		Arch:            runtime.GOARCH,
+		CI:              os.Getenv("CI") != "",
+		DurationSeconds: m.Duration.Seconds(),
+		Targets:         len(b.Config.Targets),
+		AffectedTargets: m.AffectedTargets,
+		FailedTargets:   m.Failures,
+		CacheHits:       m.Cache.Hits,
+		CacheMisses:     m.Cache.Misses,
+		Cancelled:       run.Cancelled,
+	}
+	r.UnaffectedTargets = r.Targets - r.AffectedTargets
+	for _, t := range m.Targets {
+		if t.Status == RunSuccess || t.Status == RunFailure {
+			r.BuiltTargets++
+		}
+	}
+	if lookups := r.CacheHits + r.CacheMisses; lookups > 0 {
+		r.CacheHitRate = float64(r.CacheHits) / float64(lookups)
+	}
+	if origin, err := gitOutput(ctx, "config", "--get", "remote.origin.url"); err == nil && origin != "" {
+		sum := sha256.Sum256([]byte(origin))
+		r.Repository = hex.EncodeToString(sum[:])
+	}
+	return r
+}
+
+// sendTelemetry posts the usage report of a recorded run to the telemetry
+// endpoint. Telemetry never gets in the way of a build: a failure is only
+// logged at the debug level.
+func (b *BuildContext) sendTelemetry(ctx context.Context, run *Run) {
+	if !b.Config.Telemetry.enabled() {
+		return
+	}
+	ctx, span := tracer.Start(ctx, "*BuildContext.sendTelemetry()")
+	defer span.End()
+	if err := postUsageReport(ctx, b.Config.Telemetry.Endpoint, b.usageReport(ctx, run)); err != nil {
+		Log.Debug("cannot send the usage report", "endpoint", b.Config.Telemetry.Endpoint, "error", err)
+	}
+}
+
+func postUsageReport(ctx context.Context, endpoint string, r *UsageReport) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		rb, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("POST %s: %s: %s", endpoint, resp.Status, bytes.TrimSpace(rb))
+	}
+	return nil
+}
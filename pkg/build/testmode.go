@@ -0,0 +1,69 @@
+package build
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// The run records and the full output of mb test are kept apart from the
+// ones of the builds.
+const (
+	DefaultTestRunsDir = ".monobuild/test-runs"
+	DefaultTestLogsDir = ".monobuild/test-logs"
+)
+
+// SkipNoTestCommand is the reason mb test skips an affected target that is
+// neither a Go target nor has a test_command.
+const SkipNoTestCommand = "no test command"
+
+// UseTestCommands replaces the build commands and the steps of the targets
+// with their tests, so that MonoBuild tests the affected targets instead of
+// building them, with the same change detection, cache, logs and reports.
+// The test command of a target is its test_command, else go test of its
+// packages and of its changed dependencies for a Go target, with the args
+// appended, e.g. -race. The test commands keep the env, env_file and timeout
+// of the build command. The other targets have no command and are skipped.
+func (b *BuildContext) UseTestCommands(args []string) {
+	b.Test = true
+	for _, t := range b.Config.Targets {
+		build := t.BuildCommand
+		switch {
+		case t.TestCommand.defined():
+			t.BuildCommand = t.TestCommand
+			t.BuildCommand.Args = append(append([]string{}, t.TestCommand.Args...), args...)
+		case t.goTarget():
+			t.BuildCommand = BuildCommand{Command: "go", Args: append(append([]string{"test"}, args...), t.testPackages()...), Env: build.Env, EnvFile: build.EnvFile, Timeout: build.Timeout}
+		default:
+			t.BuildCommand = BuildCommand{}
+		}
+		t.Steps, t.Outputs = nil, nil
+		t.logsDir = DefaultTestLogsDir
+	}
+}
+
+// goTarget reports whether the dependencies of the target are analyzed as
+// the ones of a Go package.
+func (t *Target) goTarget() bool {
+	if t.Analyzer == "" {
+		return detectAnalyzer(t) == AnalyzerGo
+	}
+	return t.Analyzer == AnalyzerGo
+}
+
+// testPackages returns the go test patterns of the packages of the target,
+// and of the Go packages of its dependencies that the changed files touch.
+func (t *Target) testPackages() []string {
+	dir := CleanTreePath(t.Path)
+	pkgs := []string{"./" + filepath.ToSlash(filepath.Join(dir, "..."))}
+	for _, p := range t.changedPackages() {
+		switch {
+		case strings.HasSuffix(p, "/"):
+			// A dependency directory, not a package.
+		case contains(t.Deps, p):
+			pkgs = append(pkgs, p)
+		default:
+			pkgs = append(pkgs, "./"+p)
+		}
+	}
+	return pkgs
+}
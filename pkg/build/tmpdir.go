@@ -0,0 +1,118 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tmpRoot is where the build commands get their TMPDIR, one directory per
+// target, so that a misbehaving build does not fill the /tmp of the agent.
+const tmpRoot = ".monobuild/tmp"
+
+// tmpDir returns the TMPDIR of the build of the target. The path of the
+// target is flattened so that the directories of nested targets are
+// distinct.
+func (t *Target) tmpDir() string {
+	name := CleanTreePath(t.Path)
+	if name == "." {
+		name = "_root"
+	}
+	return filepath.Join(tmpRoot, strings.Replace(name, "/", "_", -1))
+}
+
+// prepareTmpDir empties the TMPDIR of the target, which a failed build may
+// have kept, and sets TMPDIR, TMP and TEMP in the environment of the build
+// command.
+func (t *Target) prepareTmpDir() (string, error) {
+	dir, err := filepath.Abs(t.tmpDir())
+	if err != nil {
+		return "", err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	env := t.env
+	if env == nil {
+		env = os.Environ()
+	}
+	t.env = setEnv(env, map[string]string{"TMPDIR": dir, "TMP": dir, "TEMP": dir})
+	return dir, nil
+}
+
+// setEnv returns env with the variables of vars set, replacing their
+// previous values.
+func setEnv(env []string, vars map[string]string) []string {
+	out := make([]string, 0, len(env)+len(vars))
+	for _, kv := range env {
+		if _, ok := vars[strings.SplitN(kv, "=", 2)[0]]; !ok {
+			out = append(out, kv)
+		}
+	}
+	for k, v := range vars {
+		out = append(out, k+"="+v)
+	}
+	return out
+}
+
+// trackDiskUsage samples the disk usage of a directory every interval until
+// the returned function is called, which returns the peak usage in bytes.
+func trackDiskUsage(dir string, interval time.Duration) func() int64 {
+	var peak int64
+	sample := func() {
+		if n := diskUsage(dir); n > peak {
+			peak = n
+		}
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+				sample()
+			}
+		}
+	}()
+	return func() int64 {
+		close(stop)
+		<-done
+		sample()
+		return peak
+	}
+}
+
+// diskUsage returns the size of the regular files under dir.
+func diskUsage(dir string) int64 {
+	var n int64
+	filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			n += fi.Size()
+		}
+		return nil
+	})
+	return n
+}
+
+// formatBytes formats a size in bytes with a binary unit, e.g. 1.5 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
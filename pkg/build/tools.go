@@ -0,0 +1,308 @@
+package build
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ToolsDir is the per-repository tool cache, where the tools of the config
+// are installed in <name>/<version>.
+const ToolsDir = ".monobuild/tools"
+
+// Tool represents a tool of the config: a pinned version of a binary the
+// build commands run, downloaded from URL and verified with its checksum,
+// or installed with go install.
+type Tool struct {
+	Name      string            `yaml:"name"`
+	Version   string            `yaml:"version"`
+	URL       string            `yaml:"url"`       // Archive (.tar.gz, .tgz or .zip) or binary URL, a template of {{.Version}}, {{.OS}} and {{.Arch}}.
+	SHA256    string            `yaml:"sha256"`    // Checksum of the download.
+	Checksums map[string]string `yaml:"checksums"` // Checksums of the downloads by <os>_<arch>, e.g. linux_amd64, instead of sha256.
+	Bin       string            `yaml:"bin"`       // Directory of the binaries in the archive, e.g. protoc-{{.Version}}/bin. Defaults to its root.
+	Go        string            `yaml:"go"`        // Package installed with go install <go>@<version>, instead of url.
+}
+
+// toolData is the data of the URL and bin templates of a tool.
+type toolData struct {
+	Version string
+	OS      string
+	Arch    string
+}
+
+func (t *Tool) data() toolData {
+	return toolData{Version: t.Version, OS: runtime.GOOS, Arch: runtime.GOARCH}
+}
+
+func (t *Tool) validate() error {
+	switch {
+	case t.Name == "" || strings.ContainsAny(t.Name, `/\`) || strings.HasPrefix(t.Name, "."):
+		return errors.Errorf("tools.name: %q is not a valid tool name", t.Name)
+	case t.Version == "" || strings.ContainsAny(t.Version, `/\`) || strings.HasPrefix(t.Version, "."):
+		return errors.Errorf("tools.version: tool %s needs a valid version", t.Name)
+	case (t.URL == "") == (t.Go == ""):
+		return errors.Errorf("tools: tool %s needs either a url or a go package", t.Name)
+	case t.URL != "" && t.SHA256 == "" && len(t.Checksums) == 0:
+		return errors.Errorf("tools.sha256: tool %s needs the checksum of its download", t.Name)
+	}
+	if _, err := renderTemplate(t.URL, t.data()); err != nil {
+		return errors.Errorf("tools.url: tool %s: %v", t.Name, err)
+	}
+	if _, err := renderTemplate(t.Bin, t.data()); err != nil {
+		return errors.Errorf("tools.bin: tool %s: %v", t.Name, err)
+	}
+	return nil
+}
+
+// checksum returns the expected checksum of the download of the platform.
+func (t *Tool) checksum() (string, error) {
+	if sum, ok := t.Checksums[runtime.GOOS+"_"+runtime.GOARCH]; ok {
+		return strings.ToLower(sum), nil
+	}
+	if t.SHA256 == "" {
+		return "", errors.Errorf("tool %s has no checksum for %s_%s", t.Name, runtime.GOOS, runtime.GOARCH)
+	}
+	return strings.ToLower(t.SHA256), nil
+}
+
+// dir returns the absolute directory the tool is installed in.
+func (t *Tool) dir() (string, error) {
+	return filepath.Abs(filepath.Join(ToolsDir, t.Name, t.Version))
+}
+
+// binDir returns the directory of the binaries of the installed tool.
+func (t *Tool) binDir() (string, error) {
+	dir, err := t.dir()
+	if err != nil {
+		return "", err
+	}
+	bin, err := renderTemplate(t.Bin, t.data())
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(bin)), nil
+}
+
+// InstallTools installs the tools of the config missing from the tool cache
+// and returns the directories of their binaries, in config order.
+func (b *BuildContext) InstallTools(ctx context.Context) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "*BuildContext.InstallTools()")
+	defer span.End()
+	var dirs []string
+	for _, t := range b.Config.Tools {
+		dir, err := t.dir()
+		if err != nil {
+			return nil, err
+		}
+		// The marker is written last: a directory without it is the leftover
+		// of an interrupted install.
+		marker := filepath.Join(dir, ".installed")
+		if !fileExists(marker) {
+			if !b.Quiet {
+				Log.Info("installing tool", "tool", t.Name, "version", t.Version)
+			}
+			if err := os.RemoveAll(dir); err != nil {
+				return nil, err
+			}
+			if err := t.install(ctx, dir); err != nil {
+				os.RemoveAll(dir)
+				return nil, errors.Wrapf(err, "tool %s %s", t.Name, t.Version)
+			}
+			if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+				return nil, err
+			}
+		}
+		bin, err := t.binDir()
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, bin)
+	}
+	return dirs, nil
+}
+
+func (t *Tool) install(ctx context.Context, dir string) error {
+	ctx, span := tracer.Start(ctx, "*Tool.install()")
+	defer span.End()
+	span.SetAttributes(attribute.String("tool", t.Name+"@"+t.Version))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if t.Go != "" {
+		cmd := exec.CommandContext(ctx, "go", "install", t.Go+"@"+t.Version)
+		cmd.Env = setEnv(os.Environ(), map[string]string{"GOBIN": dir})
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return errors.Errorf("go install %s@%s: %v: %s", t.Go, t.Version, err, bytes.TrimSpace(out))
+		}
+		return nil
+	}
+	u, err := renderTemplate(t.URL, t.data())
+	if err != nil {
+		return err
+	}
+	want, err := t.checksum()
+	if err != nil {
+		return err
+	}
+	data, err := doBlob(ctx, http.MethodGet, u, nil, nil)
+	if err == errCacheMiss {
+		return errors.Errorf("%s: not found", u)
+	}
+	if err != nil {
+		return err
+	}
+	if got := fmt.Sprintf("%x", sha256.Sum256(data)); got != want {
+		return errors.Errorf("%s: sha256 %s does not match the expected %s", u, got, want)
+	}
+	name := path.Base(strings.SplitN(u, "?", 2)[0])
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return extractTarGz(data, dir)
+	case strings.HasSuffix(name, ".zip"):
+		return extractZip(data, dir)
+	}
+	// A bare binary is installed under the name of the tool.
+	return ioutil.WriteFile(filepath.Join(dir, t.Name), data, 0755)
+}
+
+// extractPath returns the path of an archive entry in dir, or an error when
+// the entry is outside of it.
+func extractPath(dir, name string) (string, error) {
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if p != filepath.Clean(dir) && !strings.HasPrefix(p, filepath.Clean(dir)+string(filepath.Separator)) {
+		return "", errors.Errorf("invalid archive entry %s", name)
+	}
+	return p, nil
+}
+
+func writeFile(p string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// extractTarGz extracts the directories and regular files of a gzipped tar
+// archive into dir.
+func extractTarGz(data []byte, dir string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p, err := extractPath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(p, 0755)
+		case tar.TypeReg:
+			err = writeFile(p, tr, os.FileMode(hdr.Mode).Perm())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extractZip extracts the directories and regular files of a zip archive
+// into dir.
+func extractZip(data []byte, dir string) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		p, err := extractPath(dir, f.Name)
+		if err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = writeFile(p, r, f.Mode().Perm())
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prependPath returns env, nil for the environment of mb, with dirs
+// prepended to its PATH.
+func prependPath(env []string, dirs []string) []string {
+	if len(dirs) == 0 {
+		return env
+	}
+	if env == nil {
+		env = os.Environ()
+	}
+	p := strings.Join(dirs, string(os.PathListSeparator))
+	if old := envMap(env)["PATH"]; old != "" {
+		p += string(os.PathListSeparator) + old
+	}
+	return setEnv(env, map[string]string{"PATH": p})
+}
+
+// lookPath returns the path of the executable file in the PATH of env, or
+// file itself when it has a separator, env is nil or no file is found, for
+// exec to look it up in the PATH of mb.
+func lookPath(file string, env []string) string {
+	if env == nil || strings.ContainsRune(file, filepath.Separator) || strings.Contains(file, "/") {
+		return file
+	}
+	for _, dir := range filepath.SplitList(envMap(env)["PATH"]) {
+		if dir == "" {
+			continue
+		}
+		p := filepath.Join(dir, file)
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() && fi.Mode().Perm()&0111 != 0 {
+			return p
+		}
+	}
+	return file
+}
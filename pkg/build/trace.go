@@ -0,0 +1,20 @@
+package build
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer starts the spans of the build package. Its spans are exported once
+// the program sets the global tracer provider, e.g. mb with -trace.
+var tracer = otel.Tracer("github.com/bzon/monobuild/pkg/build")
+
+// targetEvent adds an event about a target to the span of the context, e.g.
+// "target built", so that the trace shows the outcome of every target.
+func targetEvent(ctx context.Context, name string, t *Target, kv ...attribute.KeyValue) {
+	kv = append([]attribute.KeyValue{attribute.String("target", t.Path)}, kv...)
+	trace.SpanFromContext(ctx).AddEvent(name, trace.WithAttributes(kv...))
+}
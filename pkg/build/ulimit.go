@@ -0,0 +1,129 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// UlimitExec is the hidden argument of mb that runs a build command with the
+// resource limits of its target: mb __ulimit <limits> -- <command> <args>.
+const UlimitExec = "__ulimit"
+
+// Ulimit are the resource limits of the build commands of a target, its
+// steps and its hooks, set as both their soft and their hard limits.
+type Ulimit struct {
+	NoFile int    `yaml:"nofile"` // Open files.
+	CPU    string `yaml:"cpu"`    // CPU time, e.g. 10m.
+	AS     string `yaml:"as"`     // Virtual memory, e.g. 4G.
+	Data   string `yaml:"data"`   // Data segment, e.g. 2G.
+	Stack  string `yaml:"stack"`  // Stack, e.g. 8M.
+	FSize  string `yaml:"fsize"`  // Largest written file, e.g. 1G.
+	Core   string `yaml:"core"`   // Largest core dump, 0 disables them.
+}
+
+var ulimitResources = map[string]int{
+	"nofile": syscall.RLIMIT_NOFILE,
+	"cpu":    syscall.RLIMIT_CPU,
+	"as":     syscall.RLIMIT_AS,
+	"data":   syscall.RLIMIT_DATA,
+	"stack":  syscall.RLIMIT_STACK,
+	"fsize":  syscall.RLIMIT_FSIZE,
+	"core":   syscall.RLIMIT_CORE,
+}
+
+// limits returns the limits that are set as name=value, in seconds for the
+// CPU time and in bytes for the sizes.
+func (u Ulimit) limits() ([]string, error) {
+	var limits []string
+	if u.NoFile < 0 {
+		return nil, errors.Errorf("nofile: %d is negative", u.NoFile)
+	}
+	if u.NoFile > 0 {
+		limits = append(limits, fmt.Sprintf("nofile=%d", u.NoFile))
+	}
+	if u.CPU != "" {
+		d, err := time.ParseDuration(u.CPU)
+		if err != nil || d < time.Second {
+			return nil, errors.Errorf("cpu: %q is not a duration of at least 1s", u.CPU)
+		}
+		limits = append(limits, fmt.Sprintf("cpu=%d", int64(d/time.Second)))
+	}
+	for _, s := range []struct{ name, value string }{{"as", u.AS}, {"data", u.Data}, {"stack", u.Stack}, {"fsize", u.FSize}, {"core", u.Core}} {
+		if s.value == "" {
+			continue
+		}
+		n, err := parseSize(s.value)
+		if err != nil {
+			return nil, errors.Wrap(err, s.name)
+		}
+		limits = append(limits, fmt.Sprintf("%s=%d", s.name, n))
+	}
+	return limits, nil
+}
+
+func (u Ulimit) validate(field string) error {
+	_, err := u.limits()
+	return errors.Wrap(err, field)
+}
+
+// wrap returns the command line that runs a command with the limits through
+// mb, the command itself when there are none.
+func (u Ulimit) wrap(command string, args []string) (string, []string, error) {
+	limits, err := u.limits()
+	if err != nil || len(limits) == 0 {
+		return command, args, err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "ulimit")
+	}
+	return exe, append([]string{UlimitExec, strings.Join(limits, ","), "--", command}, args...), nil
+}
+
+// ExecUlimited sets the limits of args, e.g. nofile=1024,cpu=60, then
+// executes the command after --. It only returns on failure, exiting with
+// 126 as a shell does for a command it cannot execute.
+func ExecUlimited(args []string) {
+	err := execUlimited(args)
+	fmt.Fprintf(os.Stderr, "mb: ulimit: %v\n", err)
+	os.Exit(126)
+}
+
+func execUlimited(args []string) error {
+	if len(args) < 3 || args[1] != "--" {
+		return errors.New("usage: mb __ulimit <name=value,...> -- <command> [args...]")
+	}
+	for _, l := range strings.Split(args[0], ",") {
+		kv := strings.SplitN(l, "=", 2)
+		resource, ok := ulimitResources[kv[0]]
+		if !ok || len(kv) != 2 {
+			return errors.Errorf("invalid limit %q", l)
+		}
+		v, err := strconv.ParseUint(kv[1], 10, 64)
+		if err != nil {
+			return errors.Errorf("invalid limit %q", l)
+		}
+		var current syscall.Rlimit
+		if err := syscall.Getrlimit(resource, &current); err != nil {
+			return errors.Wrap(err, kv[0])
+		}
+		if v > uint64(current.Max) {
+			return errors.Errorf("%s %d is above the hard limit %d", kv[0], v, current.Max)
+		}
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: v, Max: v}); err != nil {
+			return errors.Wrap(err, kv[0])
+		}
+	}
+	path, err := exec.LookPath(args[2])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, args[2:], os.Environ())
+}
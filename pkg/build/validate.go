@@ -0,0 +1,104 @@
+package build
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// unmarshalConfig decodes a config file strictly: an unknown or duplicated
+// key is an error, not a setting silently ignored. The unknown keys are
+// ConfigErrors, with the nearest known keys.
+func unmarshalConfig(fb []byte, c *Config) error {
+	if err := yaml.UnmarshalStrict(fb, c); err != nil {
+		if errs := unknownFieldErrors(err); errs != nil {
+			return errs
+		}
+		return errors.Wrap(err, "invalid config")
+	}
+	return nil
+}
+
+// validate checks that a command is not blank and has no settings without
+// the command itself.
+func (c BuildCommand) validate(field, target string) error {
+	switch {
+	case c.defined() && strings.TrimSpace(c.Command) == "":
+		return errors.Errorf("target.%s: target %s has a blank command", field, target)
+	case !c.defined() && len(c.Args) > 0:
+		return errors.Errorf("target.%s: target %s has args but no command", field, target)
+	case !c.defined() && c.Dir != "":
+		return errors.Errorf("target.%s: target %s has a dir but no command", field, target)
+	case !c.defined() && (len(c.Env) > 0 || c.EnvFile != ""):
+		return errors.Errorf("target.%s: target %s has an environment but no command", field, target)
+	case !c.defined() && c.Timeout != "":
+		return errors.Errorf("target.%s: target %s has a timeout but no command", field, target)
+	}
+	if err := validateTimeout(c.Timeout); err != nil {
+		return errors.Errorf("target.%s.timeout: target %s: %v", field, target, err)
+	}
+	for k := range c.Env {
+		if !envKeyRe.MatchString(k) {
+			return errors.Errorf("target.%s.env: %q of target %s is not a valid variable name", field, k, target)
+		}
+	}
+	return nil
+}
+
+// validatePatterns checks the glob patterns of a target, and that none of
+// its watch patterns is already matched by another one.
+func validatePatterns(t *Target) error {
+	for i, p := range t.WatchPattern {
+		if strings.HasPrefix(p, "!") && i == 0 {
+			return errors.Errorf("target.watch_pattern: the negated pattern %s of target %s excludes no file, it must follow the patterns it excludes files of", p, t.Path)
+		}
+		if err := validWatchPattern(strings.TrimPrefix(p, "!")); err != nil || p == "!" {
+			return errors.Errorf("target.watch_pattern: %q of target %s is not a valid glob pattern", p, t.Path)
+		}
+	}
+	for _, p := range t.Outputs {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return errors.Errorf("target.outputs: %q of target %s is not a valid glob pattern", p, t.Path)
+		}
+	}
+	for _, p := range t.FetchRefs {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.Errorf("target.fetch_refs: %q of target %s is not a valid glob pattern", p, t.Path)
+		}
+	}
+	for i, p := range t.WatchPattern {
+		if strings.HasPrefix(p, "!") {
+			// A pattern after a negated one may include its files again.
+			break
+		}
+		for j, o := range t.WatchPattern {
+			if strings.HasPrefix(o, "!") {
+				break
+			}
+			if i == j || (p == o && j > i) {
+				continue
+			}
+			// A pattern matches the patterns of a subset of its files, e.g.
+			// pkg/* matches pkg/*.go and pkg/** matches pkg/**/*.go.
+			if matchWatchPattern(o, p) {
+				return errors.Errorf("target.watch_pattern: %s of target %s is already matched by %s, the watch patterns of its directories included", p, t.Path, o)
+			}
+		}
+	}
+	return nil
+}
+
+// validateTimeout checks that a timeout is empty or a positive duration.
+func validateTimeout(timeout string) error {
+	if timeout == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(timeout); err != nil || d <= 0 {
+		return errors.Errorf("%q is not a positive duration, e.g. 10m", timeout)
+	}
+	return nil
+}
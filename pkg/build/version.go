@@ -0,0 +1,63 @@
+package build
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// The version of mb and its build metadata, set by the release builds with
+// -ldflags "-X github.com/bzon/monobuild/pkg/build.Version=v1.3.0 ...".
+var (
+	Version   = ""
+	GitCommit = ""
+	BuildDate = ""
+	// ReleaseKey is the Ed25519 public key that the release manifests of mb
+	// self-update are signed with: the base64 PKIX encoding, the body of the
+	// PEM file of mb attest keygen.
+	ReleaseKey = ""
+)
+
+// VersionInfo is the version of the running mb binary.
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+}
+
+// CurrentVersion returns the version of the running binary: the one set at
+// build time, else the module version of go install, else dev.
+func CurrentVersion() *VersionInfo {
+	v := &VersionInfo{Version: Version, Commit: GitCommit, BuildDate: BuildDate, GoVersion: runtime.Version(), OS: runtime.GOOS, Arch: runtime.GOARCH}
+	if v.Version == "" {
+		if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			v.Version = bi.Main.Version
+		}
+	}
+	if v.Version == "" {
+		v.Version = "dev"
+	}
+	return v
+}
+
+// String returns the version on one line, as printed by mb version.
+func (v *VersionInfo) String() string {
+	s := "mb " + v.Version
+	if v.Commit != "" {
+		s += " (" + v.Commit
+		if v.BuildDate != "" {
+			s += ", " + v.BuildDate
+		}
+		s += ")"
+	}
+	return s + fmt.Sprintf(" %s %s/%s", v.GoVersion, v.OS, v.Arch)
+}
+
+// platform is the key of the binary of the running OS and architecture in
+// a release manifest, e.g. linux_amd64.
+func platform() string {
+	return runtime.GOOS + "_" + runtime.GOARCH
+}
@@ -0,0 +1,260 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// DefaultDebounce is how long a watch waits for the file events to settle
+// before rebuilding.
+const DefaultDebounce = 300 * time.Millisecond
+
+// Watch rebuilds the targets affected by the files saved in the working
+// tree, until its context is done.
+type Watch struct {
+	ConfigFile string
+	Debounce   time.Duration
+	// Prepare sets the build options of the BuildContext of every rebuild,
+	// e.g. its renderer.
+	Prepare func(b *BuildContext)
+
+	watcher *fsnotify.Watcher
+	watched map[string]bool
+	targets []*Target // The targets of the last loaded config, to ignore their outputs.
+}
+
+// Run watches the directories of the targets, their dependencies, the
+// dep_source_dirs and the watch patterns. The changed files are collected
+// until no event came in for Debounce, then the targets they affect are
+// built. A failed build is reported and the watch goes on; the config is
+// reloaded before every rebuild.
+func (w *Watch) Run(ctx context.Context) error {
+	b, err := NewBuildContext(ctx, w.ConfigFile, "")
+	if err != nil {
+		return err
+	}
+	if w.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return err
+	}
+	defer w.watcher.Close()
+	w.watched = make(map[string]bool)
+	if err := w.watch(b); err != nil {
+		return err
+	}
+	debounce := w.Debounce
+	if debounce <= 0 {
+		debounce = DefaultDebounce
+	}
+	fmt.Printf("WATCHING %d directories, press Ctrl+C to stop\n", len(w.watched))
+
+	pending := make(map[string]bool)
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-w.watcher.Errors:
+			Log.Warn("watch failed", "error", err)
+		case ev := <-w.watcher.Events:
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+			name := CleanTreePath(filepath.ToSlash(ev.Name))
+			if ev.Op&fsnotify.Create != 0 {
+				// The files of a new directory are watched from now on: its
+				// creation alone does not change any input.
+				if fi, err := os.Stat(name); err == nil && fi.IsDir() {
+					if !w.ignored(name) {
+						if err := w.addTree(name); err != nil {
+							Log.Warn("cannot watch the new directory", "dir", name, "error", err)
+						}
+					}
+					continue
+				}
+			}
+			if w.ignored(name) {
+				continue
+			}
+			pending[name] = true
+			settled = time.After(debounce)
+		case <-settled:
+			settled = nil
+			var files []string
+			for f := range pending {
+				files = append(files, f)
+			}
+			pending = make(map[string]bool)
+			if files = gitUnignored(ctx, files); len(files) == 0 {
+				continue
+			}
+			sort.Strings(files)
+			if err := w.rebuild(ctx, files); err != nil {
+				Log.Error("rebuild failed", "error", err)
+			}
+		}
+	}
+}
+
+// rebuild builds the targets affected by the changed files with a fresh
+// BuildContext, so that the changes of the config are applied too.
+func (w *Watch) rebuild(ctx context.Context, files []string) error {
+	ctx, span := tracer.Start(ctx, "*Watch.rebuild()")
+	defer span.End()
+	span.SetAttributes(attribute.Int64("files", int64(len(files))))
+	b, err := NewBuildContext(ctx, w.ConfigFile, "")
+	if err != nil {
+		return err
+	}
+	if err := w.watch(b); err != nil {
+		return err
+	}
+	b.Quiet = true
+	b.Providers = []DiffProvider{&FileList{Files: files}}
+	if w.Prepare != nil {
+		w.Prepare(b)
+	}
+	if err := b.Diff(ctx); err != nil {
+		return err
+	}
+	b.renderer().Info(os.Stdout, fmt.Sprintf("CHANGED: %s", strings.Join(files, ", ")))
+	affected := false
+	for _, t := range b.Config.Targets {
+		if len(t.Changes) > 0 {
+			affected = true
+		}
+	}
+	if !affected {
+		b.renderer().Info(os.Stdout, "no target is affected")
+		return nil
+	}
+	return b.MonoBuild(ctx)
+}
+
+// watch adds the directories the targets of b depend on to the watcher.
+func (w *Watch) watch(b *BuildContext) error {
+	w.targets = b.Config.Targets
+	dirs := append([]string{}, b.ConfigFiles...)
+	dirs = append(dirs, b.Config.DepSourceDirs...)
+	for _, t := range b.Config.Targets {
+		dirs = append(dirs, t.Path)
+		dirs = append(dirs, t.DepDirs...)
+		for _, f := range t.DepFiles {
+			dirs = append(dirs, patternDir(f))
+		}
+		for _, p := range t.WatchPattern {
+			if !strings.HasPrefix(p, "!") {
+				dirs = append(dirs, patternDir(p))
+			}
+		}
+	}
+	for _, d := range dirs {
+		d = CleanTreePath(d)
+		fi, err := os.Stat(d)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			// Config files are watched through their directory, which
+			// survives the editors that save by renaming a new file.
+			d = filepath.Dir(d)
+			if err := w.add(d); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.addTree(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTree watches a directory and its subdirectories, but the hidden
+// ones and the outputs of the targets.
+func (w *Watch) addTree(root string) error {
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		p = CleanTreePath(filepath.ToSlash(p))
+		if p != "." && (strings.HasPrefix(fi.Name(), ".") || w.ignored(p)) {
+			return filepath.SkipDir
+		}
+		return w.add(p)
+	})
+}
+
+func (w *Watch) add(dir string) error {
+	if w.watched[dir] {
+		return nil
+	}
+	if err := w.watcher.Add(dir); err != nil {
+		return errors.Wrapf(err, "watch %s", dir)
+	}
+	w.watched[dir] = true
+	return nil
+}
+
+// ignored reports whether a file is hidden, e.g. under .git or .monobuild,
+// or an output of a target, which the builds themselves write.
+func (w *Watch) ignored(p string) bool {
+	for _, part := range strings.Split(p, "/") {
+		if strings.HasPrefix(part, ".") && part != "." && part != ".." {
+			return true
+		}
+	}
+	for _, t := range w.targets {
+		if t.isOutput(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// patternDir returns the directory of the part of a watch pattern before
+// its first wildcard.
+func patternDir(pattern string) string {
+	parts := strings.Split(CleanTreePath(pattern), "/")
+	for i, part := range parts {
+		if hasMeta(part) {
+			return strings.Join(append([]string{"."}, parts[:i]...), "/")
+		}
+	}
+	return filepath.Dir(CleanTreePath(pattern))
+}
+
+// gitUnignored returns the files that are not ignored by git, e.g. the
+// build artifacts and the editor swap files.
+func gitUnignored(ctx context.Context, files []string) []string {
+	cmd := exec.CommandContext(ctx, "git", "check-ignore", "--stdin")
+	cmd.Stdin = strings.NewReader(strings.Join(files, "\n") + "\n")
+	out, _ := cmd.Output() // Exits with 1 when no file is ignored.
+	ignored := make(map[string]bool)
+	for _, l := range bytes.Split(out, []byte("\n")) {
+		ignored[CleanTreePath(string(l))] = true
+	}
+	var kept []string
+	for _, f := range files {
+		if !ignored[f] {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
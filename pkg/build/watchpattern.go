@@ -0,0 +1,64 @@
+package build
+
+import (
+	"path"
+	"strings"
+)
+
+// matchWatchPattern reports whether a file of the tree matches a watch
+// pattern: a path.Match pattern of each path element, where a ** element
+// matches any number of elements, e.g. configs/**/*.yaml matches both
+// configs/a.yaml and configs/prod/eu/a.yaml.
+func matchWatchPattern(pattern, name string) bool {
+	return matchElems(strings.Split(CleanTreePath(pattern), "/"), strings.Split(CleanTreePath(name), "/"))
+}
+
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// validWatchPattern returns path.ErrBadPattern for a malformed element of a
+// watch pattern.
+func validWatchPattern(pattern string) error {
+	for _, e := range strings.Split(CleanTreePath(pattern), "/") {
+		if _, err := path.Match(e, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchedByPattern reports whether a file is watched by the watch patterns
+// of the target. As in a .gitignore file, a pattern starting with ! excludes
+// the files it matches from the preceding patterns, and the last pattern
+// that matches a file decides.
+func (t *Target) watchedByPattern(f string) bool {
+	watched := false
+	for _, p := range t.WatchPattern {
+		if strings.HasPrefix(p, "!") {
+			if watched && matchWatchPattern(p[1:], f) {
+				watched = false
+			}
+		} else if !watched && matchWatchPattern(p, f) {
+			watched = true
+		}
+	}
+	return watched
+}
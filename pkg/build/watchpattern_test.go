@@ -0,0 +1,96 @@
+package build
+
+import "testing"
+
+func TestMatchWatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"configs/*.yaml", "configs/a.yaml", true},
+		{"./configs/*.yaml", "configs/a.yaml", true},
+		{"configs/*.yaml", "configs/prod/a.yaml", false},
+		{"configs/**/*.yaml", "configs/a.yaml", true},
+		{"configs/**/*.yaml", "configs/prod/eu/a.yaml", true},
+		{"configs/**/*.yaml", "configs/prod/a.txt", false},
+		{"configs/**", "configs/prod/a.txt", true},
+		{"configs/**", "other/a.txt", false},
+		{"**/Dockerfile", "Dockerfile", true},
+		{"**/Dockerfile", "cmd/server/Dockerfile", true},
+		{"cmd/*/main.go", "cmd/server/main.go", true},
+	}
+	for _, tt := range tests {
+		if got := matchWatchPattern(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchWatchPattern(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsFileWatchedByTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		watched  []string
+		ignored  []string
+	}{
+		{
+			name:     "multiple patterns",
+			patterns: []string{"configs/*.yaml", "docs/*.md", "Makefile"},
+			watched:  []string{"configs/a.yaml", "docs/a.md", "Makefile"},
+			ignored:  []string{"configs/a.txt", "docs/sub/a.md"},
+		},
+		{
+			name:     "negated pattern",
+			patterns: []string{"configs/**", "!configs/secrets/**"},
+			watched:  []string{"configs/a.yaml", "configs/prod/a.yaml"},
+			ignored:  []string{"configs/secrets/a.yaml", "configs/secrets/prod/a.yaml"},
+		},
+		{
+			name:     "pattern after a negated one",
+			patterns: []string{"configs/**", "!configs/prod/**", "configs/prod/keep.yaml"},
+			watched:  []string{"configs/a.yaml", "configs/prod/keep.yaml"},
+			ignored:  []string{"configs/prod/a.yaml"},
+		},
+		{
+			name:     "negated pattern of another pattern",
+			patterns: []string{"docs/*.md", "!configs/**", "configs/*.yaml"},
+			watched:  []string{"docs/a.md", "configs/a.yaml"},
+			ignored:  []string{"configs/prod/a.yaml"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &Target{Path: "cmd/server", WatchPattern: tt.patterns}
+			for _, f := range tt.watched {
+				if !isFileWatchedByTarget(f, target) {
+					t.Errorf("%s is not watched by %q", f, tt.patterns)
+				}
+			}
+			for _, f := range tt.ignored {
+				if isFileWatchedByTarget(f, target) {
+					t.Errorf("%s is watched by %q", f, tt.patterns)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateWatchPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		valid    bool
+	}{
+		{[]string{"configs/**", "!configs/secrets/**"}, true},
+		{[]string{"configs/**", "!configs/prod/**", "configs/prod/keep.yaml"}, true},
+		{[]string{"!configs/secrets/**", "configs/**"}, false},
+		{[]string{"configs/**", "!"}, false},
+		{[]string{"configs/**", "!configs/[a"}, false},
+		{[]string{"configs/**", "configs/**/*.yaml"}, false},
+	}
+	for _, tt := range tests {
+		err := validatePatterns(&Target{Path: "cmd/server", WatchPattern: tt.patterns})
+		if (err == nil) != tt.valid {
+			t.Errorf("validatePatterns(%q) = %v, want valid %v", tt.patterns, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func releaseScopeCommand() *ffcli.Command {
+	var (
+		fs         = flag.NewFlagSet("mb release-scope", flag.ExitOnError)
+		configFile = fs.String("config", "./monobuild.yaml", "mb config file")
+		from       = fs.String("from", "", "Ref of the previous release, e.g. v1.2.0")
+		to         = fs.String("to", "HEAD", "Ref of the release, e.g. v1.3.0")
+		changed    = fs.Bool("changed", false, "Only list the changed targets")
+		format     = fs.String("format", "text", "Output format: text, json or markdown release notes")
+	)
+	return &ffcli.Command{
+		Name:      "release-scope",
+		Usage:     "mb release-scope -from <ref> [-to <ref>] [flags]",
+		ShortHelp: "List the targets a release changes and the commits involved",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Compare two release refs, e.g. tags: list whether each target changed
+			between them, with the commits of the range that touch its changed
+			files, for release notes or to deploy only the services that changed.
+			The targets and their dependencies are the ones of the checkout.
+		`, 80),
+		Exec: func([]string) error {
+			ctx := context.Background()
+			ctx, span := tracer.Start(ctx, "mb release-scope")
+			defer span.End()
+			if *from == "" {
+				return errors.New("-from is required")
+			}
+			b, err := build.NewLazyBuildContext(ctx, *configFile, *from+".."+*to)
+			if err != nil {
+				return err
+			}
+			b.Quiet = true
+			if err := b.Diff(ctx); err != nil {
+				return err
+			}
+			s, err := b.ReleaseScope(ctx, *from, *to)
+			if err != nil {
+				return err
+			}
+			if *changed {
+				s.Targets = s.Changed()
+			}
+			return s.Write(os.Stdout, *format)
+		},
+	}
+}
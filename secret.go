@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+func secretCommand() *ffcli.Command {
+	keygen := &ffcli.Command{
+		Name:      "keygen",
+		Usage:     "mb secret keygen",
+		ShortHelp: "Generate a config key to set as MB_CONFIG_KEY",
+		Exec: func([]string) error {
+			key := make([]byte, 32)
+			if _, err := io.ReadFull(rand.Reader, key); err != nil {
+				return err
+			}
+			fmt.Println(base64.StdEncoding.EncodeToString(key))
+			return nil
+		},
+	}
+	encrypt := &ffcli.Command{
+		Name:      "encrypt",
+		Usage:     "mb secret encrypt [value]",
+		ShortHelp: "Encrypt a value, read from stdin when omitted, with MB_CONFIG_KEY",
+		Exec: func(args []string) error {
+			key, err := build.ConfigKey()
+			if err != nil {
+				return err
+			}
+			var plain string
+			if len(args) > 0 {
+				plain = strings.Join(args, " ")
+			} else if build.NonInteractive {
+				return build.ErrStdinNonInteractive
+			} else {
+				b, err := ioutil.ReadAll(os.Stdin)
+				if err != nil {
+					return err
+				}
+				plain = strings.TrimRight(string(b), "\n")
+			}
+			token, err := build.EncryptSecret(key, plain)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("!secret %s\n", token)
+			return nil
+		},
+	}
+	return &ffcli.Command{
+		Name:        "secret",
+		Usage:       "mb secret <subcommand>",
+		ShortHelp:   "Manage encrypted config values",
+		FlagSet:     flag.NewFlagSet("mb secret", flag.ExitOnError),
+		Options:     []ff.Option{ff.WithEnvVarPrefix("MB")},
+		Subcommands: []*ffcli.Command{keygen, encrypt},
+		LongHelp: collapse(`
+			Config values can be committed encrypted as !secret values, which are
+			decrypted at load time with the key of MB_CONFIG_KEY or
+			MB_CONFIG_KEY_FILE. Config files encrypted with SOPS are decrypted
+			with the sops CLI.
+		`, 80),
+	}
+}
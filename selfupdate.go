@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func selfUpdateCommand() *ffcli.Command {
+	sfs := flag.NewFlagSet("mb self-update sign", flag.ExitOnError)
+	signKey := sfs.String("key", "", "Ed25519 private key, a PKCS #8 PEM file, e.g. of mb attest keygen")
+	sign := &ffcli.Command{
+		Name:      "sign",
+		Usage:     "mb self-update sign -key <private key> <manifest>",
+		ShortHelp: "Sign a release manifest",
+		FlagSet:   sfs,
+		LongHelp: collapse(`
+			Write the signature of a release manifest to <manifest>.sig, to
+			publish next to it on the release endpoint.
+		`, 80),
+		Exec: func(args []string) error {
+			if len(args) != 1 || *signKey == "" {
+				return errors.New("usage: mb self-update sign -key <private key> <manifest>")
+			}
+			if err := build.SignRelease(args[0], *signKey); err != nil {
+				return err
+			}
+			fmt.Printf("wrote %s.sig\n", args[0])
+			return nil
+		},
+	}
+	var (
+		fs       = flag.NewFlagSet("mb self-update", flag.ExitOnError)
+		endpoint = fs.String("release-endpoint", "", "URL of the release manifests, <url>/latest.json and <url>/<version>.json")
+		key      = fs.String("release-key", "", "Ed25519 public key, a PKIX PEM file, that the release manifests must be signed with. Defaults to the release key built into mb")
+		insecure = fs.Bool("insecure", false, "Install a release without verifying its manifest when there is no release key, only the sha256 of the binary")
+		version  = fs.String("version", "", "Install this version instead of the latest one, e.g. to pin the version of the CI agents")
+		check    = fs.Bool("check", false, "Only print whether an update is available")
+		force    = fs.Bool("force", false, "Install the release even when it is the running version")
+	)
+	return &ffcli.Command{
+		Name:      "self-update",
+		Usage:     "mb self-update [flags]",
+		ShortHelp: "Replace mb with the latest or a given release",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Fetch the manifest of the latest release, or of -version, from the
+			release endpoint, verify its signature with the release key, then
+			download the binary of the platform, verify its sha256 and replace
+			the running binary with it. The release key defaults to the one built
+			into mb by make release, and only -insecure updates without a key.
+		`, 80),
+		Subcommands: []*ffcli.Command{sign},
+		Exec: func([]string) error {
+			ctx := context.Background()
+			ctx, span := tracer.Start(ctx, "mb self-update")
+			defer span.End()
+			if *endpoint == "" {
+				return errors.New("-release-endpoint is required")
+			}
+			if *key == "" && build.ReleaseKey == "" {
+				if !*insecure {
+					return errors.New("-release-key is required: this mb has no release key built in, use -insecure to update without verifying the release manifest")
+				}
+				build.Log.Warn("no release key, the release manifest is not verified")
+			}
+			r, err := build.FetchRelease(ctx, *endpoint, *version, *key, *insecure)
+			if err != nil {
+				return err
+			}
+			current := build.CurrentVersion().Version
+			if r.Version == current && !*force {
+				fmt.Printf("mb %s is up to date\n", current)
+				return nil
+			}
+			if *check {
+				fmt.Printf("mb %s is available, running %s\n", r.Version, current)
+				return nil
+			}
+			exe, err := r.SelfUpdate(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("updated %s from %s to %s\n", exe, current, r.Version)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func statsCommand() *ffcli.Command {
+	var (
+		fs             = flag.NewFlagSet("mb stats targets", flag.ExitOnError)
+		runsDir        = fs.String("runs-dir", build.DefaultRunsDir, "the directory of the run records")
+		windows        = fs.String("window", "7d,30d", "Comma-separated time windows, e.g. 24h,7d")
+		target         = fs.String("target", "", "Only report the target with this name or path")
+		format         = fs.String("format", "text", "Output format: text or json")
+		minSuccessRate = fs.Float64("min-success-rate", 0, "Fail if the success rate of a target is below this ratio in any window, e.g. 0.95")
+	)
+	targets := &ffcli.Command{
+		Name:      "targets",
+		Usage:     "mb stats targets [flags]",
+		ShortHelp: "Report the success rate and build durations of the targets",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Report the success rate and the p50 and p95 build durations of every
+			target over time windows, from the run records. Use -min-success-rate
+			to check a build reliability SLO.
+		`, 80),
+		Exec: func([]string) error {
+			runs, err := build.ReadRuns(*runsDir)
+			if err != nil {
+				return err
+			}
+			var all []*build.TargetStats
+			now := time.Now()
+			for _, w := range build.SplitList(*windows) {
+				d, err := build.ParseWindow(w)
+				if err != nil {
+					return err
+				}
+				for _, s := range build.TargetStatsSince(runs, w, now.Add(-d)) {
+					if *target == "" || s.Name == *target || build.CleanTreePath(s.Path) == build.CleanTreePath(*target) {
+						all = append(all, s)
+					}
+				}
+			}
+			switch *format {
+			case "text":
+				tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(tw, "TARGET\tWINDOW\tBUILDS\tSUCCESS\tP50\tP95")
+				for _, s := range all {
+					fmt.Fprintf(tw, "%s\t%s\t%d\t%.1f%%\t%s\t%s\n", s.Path, s.Window, s.Builds, s.SuccessRate*100,
+						s.P50.Round(time.Millisecond), s.P95.Round(time.Millisecond))
+				}
+				tw.Flush()
+			case "json":
+				b, err := json.MarshalIndent(all, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(b))
+			default:
+				return errors.Errorf("unknown format %q", *format)
+			}
+			var below []string
+			for _, s := range all {
+				if s.SuccessRate < *minSuccessRate {
+					below = append(below, fmt.Sprintf("%s (%.1f%% over %s)", s.Path, s.SuccessRate*100, s.Window))
+				}
+			}
+			if len(below) > 0 {
+				return errors.Errorf("targets below the %.1f%% success rate: %s", *minSuccessRate*100, strings.Join(below, ", "))
+			}
+			return nil
+		},
+	}
+	var (
+		cfs       = flag.NewFlagSet("mb stats cache", flag.ExitOnError)
+		cacheRuns = cfs.String("runs-dir", build.DefaultRunsDir, "the directory of the run records")
+		cacheWins = cfs.String("window", "7d,30d", "Comma-separated time windows, e.g. 24h,7d")
+		cacheFmt  = cfs.String("format", "text", "Output format: text or json")
+	)
+	cache := &ffcli.Command{
+		Name:      "cache",
+		Usage:     "mb stats cache [flags]",
+		ShortHelp: "Report the hit rate of the build cache",
+		FlagSet:   cfs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Report the hits, remote hits, misses and uploads of the build cache
+			over time windows, from the run records.
+		`, 80),
+		Exec: func([]string) error {
+			runs, err := build.ReadRuns(*cacheRuns)
+			if err != nil {
+				return err
+			}
+			var all []*build.CacheWindowStats
+			now := time.Now()
+			for _, w := range build.SplitList(*cacheWins) {
+				d, err := build.ParseWindow(w)
+				if err != nil {
+					return err
+				}
+				all = append(all, build.CacheStatsSince(runs, w, now.Add(-d)))
+			}
+			switch *cacheFmt {
+			case "text":
+				tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(tw, "WINDOW\tHITS\tREMOTE HITS\tMISSES\tUPLOADS\tHIT RATE")
+				for _, s := range all {
+					fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%.1f%%\n", s.Window, s.Hits, s.RemoteHits, s.Misses, s.Uploads, s.HitRate*100)
+				}
+				return tw.Flush()
+			case "json":
+				b, err := json.MarshalIndent(all, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(b))
+				return nil
+			}
+			return errors.Errorf("unknown format %q", *cacheFmt)
+		},
+	}
+	return &ffcli.Command{
+		Name:        "stats",
+		Usage:       "mb stats <subcommand>",
+		ShortHelp:   "Report statistics of the build history",
+		FlagSet:     flag.NewFlagSet("mb stats", flag.ExitOnError),
+		Subcommands: []*ffcli.Command{targets, cache},
+	}
+}
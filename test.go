@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func testCommand() *ffcli.Command {
+	var (
+		fs       = flag.NewFlagSet("mb test", flag.ExitOnError)
+		df       = registerDiffFlags(fs)
+		output   = fs.String("output", build.RenderPretty, "Render the diff and the tests as pretty, json, yaml, table, quiet, github, teamcity or bamboo")
+		all      = fs.Bool("all", false, "Test every target regardless of the changes")
+		parallel = fs.Int("parallel", 0, "Maximum number of targets tested at the same time. Defaults to the parallel setting of the config, or 1")
+		keepGo   = fs.Bool("keep-going", false, "Test every affected target even when one fails, and fail at the end with the failed targets")
+		noCache  = fs.Bool("no-cache", false, "Test the affected targets even when the build cache has a successful test of their inputs")
+		cacheDir = fs.String("cache-dir", build.DefaultCacheDir(), "Directory of the build cache")
+		runsDir  = fs.String("runs-dir", build.DefaultTestRunsDir, "Where the test runs are recorded")
+		fetch    = fs.Bool("fetch", true, "Fetch the git history and refs required by the affected targets instead of failing")
+	)
+	var reports stringsFlag
+	fs.Var(&reports, "report", "Write a report of the tests: junit=<path>, a JUnit XML test case per target. Repeatable")
+	return &ffcli.Command{
+		Name:      "test",
+		Usage:     "mb test [flags] [-- <go test flags>]",
+		ShortHelp: "Run the tests of the affected targets instead of their build commands",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Run go test on the packages of every affected Go target and on its
+			dependencies that the changes touch, or the test_command of the target,
+			instead of its build command. The args after -- are passed to the
+			tests, e.g. -- -race -count=1. The targets that are neither Go targets
+			nor have a test_command are skipped. The full output of the tests of
+			every target is written under .monobuild/test-logs.
+		`, 80),
+		Exec: func(args []string) error {
+			ctx := context.Background()
+			ctx, span := tracer.Start(ctx, "mb test")
+			defer span.End()
+			renderer, err := build.NewRenderer(*output)
+			if err != nil {
+				return err
+			}
+			newBuildContext := df.buildContext
+			if *output != build.RenderPretty {
+				newBuildContext = df.buildContextQuiet
+			}
+			b, err := newBuildContext(ctx)
+			if err != nil {
+				return err
+			}
+			if b.Bare != nil {
+				return errors.New("mb test needs a checkout, it cannot test a -bare-repo")
+			}
+			b.All = *all
+			b.UseTestCommands(args)
+			b.Renderer = renderer
+			if err := renderer.Diff(os.Stdout, b); err != nil {
+				return err
+			}
+			b.RunsDir = *runsDir
+			b.Parallel = *parallel
+			b.KeepGoing = *keepGo
+			b.NoCache = *noCache
+			b.CacheDir = *cacheDir
+			for _, s := range reports {
+				r, err := build.ParseReport(s)
+				if err != nil {
+					return err
+				}
+				b.Reports = append(b.Reports, r)
+			}
+			if err := hidden.inject(b); err != nil {
+				return err
+			}
+			if err := b.PrepareGit(ctx, *fetch); err != nil {
+				return err
+			}
+			return b.MonoBuild(ctx)
+		},
+	}
+}
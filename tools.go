@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+func toolsCommand() *ffcli.Command {
+	var (
+		fs         = flag.NewFlagSet("mb tools path", flag.ExitOnError)
+		configFile = fs.String("config", "./monobuild.yaml", "mb config file")
+	)
+	path := &ffcli.Command{
+		Name:      "path",
+		Usage:     "mb tools path [flags]",
+		ShortHelp: "Install the tools of the config and print their PATH",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Install the missing tools of the config in the tool cache and print
+			the directories of their binaries as a PATH list, e.g. for
+			export PATH="$(mb tools path):$PATH" in a development shell.
+		`, 80),
+		Exec: func([]string) error {
+			ctx := context.Background()
+			b, err := build.NewBuildContext(ctx, *configFile, "")
+			if err != nil {
+				return err
+			}
+			b.Quiet = true
+			dirs, err := b.InstallTools(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Println(strings.Join(dirs, string(os.PathListSeparator)))
+			return nil
+		},
+	}
+	return &ffcli.Command{
+		Name:        "tools",
+		Usage:       "mb tools <subcommand>",
+		ShortHelp:   "Manage the pinned tools of the config",
+		FlagSet:     flag.NewFlagSet("mb tools", flag.ExitOnError),
+		Options:     []ff.Option{ff.WithEnvVarPrefix("MB")},
+		Subcommands: []*ffcli.Command{path},
+		LongHelp: collapse(`
+			The tools of the config are installed in .monobuild/tools and
+			prepended to the PATH of the build commands.
+		`, 80),
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+	"github.com/pkg/errors"
+)
+
+func versionCommand() *ffcli.Command {
+	var (
+		fs     = flag.NewFlagSet("mb version", flag.ExitOnError)
+		format = fs.String("format", "text", "Output format: text or json")
+	)
+	return &ffcli.Command{
+		Name:      "version",
+		Usage:     "mb version [flags]",
+		ShortHelp: "Print the version of mb and its build metadata",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		Exec: func([]string) error {
+			v := build.CurrentVersion()
+			switch *format {
+			case "text":
+				fmt.Println(v)
+				return nil
+			case "json":
+				out, err := json.MarshalIndent(v, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(out))
+				return nil
+			}
+			return errors.Errorf("unknown format %q", *format)
+		},
+	}
+}
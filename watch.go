@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+
+	"github.com/bzon/monobuild/pkg/build"
+	"github.com/peterbourgon/ff"
+	"github.com/peterbourgon/ff/ffcli"
+)
+
+func watchCommand() *ffcli.Command {
+	var (
+		fs         = flag.NewFlagSet("mb watch", flag.ExitOnError)
+		configFile = fs.String("config", "./monobuild.yaml", "mb config file")
+		debounce   = fs.Duration("debounce", build.DefaultDebounce, "How long to wait for the file events to settle before rebuilding")
+		output     = fs.String("output", build.RenderPretty, "Render the builds as pretty, json, yaml, table, quiet, github, teamcity or bamboo")
+		parallel   = fs.Int("parallel", 0, "Maximum number of targets built at the same time. Defaults to the parallel setting of the config, or 1")
+		noCache    = fs.Bool("no-cache", false, "Build the affected targets even when the build cache has a successful build of their inputs")
+		cacheDir   = fs.String("cache-dir", build.DefaultCacheDir(), "Directory of the build cache")
+	)
+	return &ffcli.Command{
+		Name:      "watch",
+		Usage:     "mb watch [flags]",
+		ShortHelp: "Rebuild the affected targets whenever a file is saved",
+		FlagSet:   fs,
+		Options:   []ff.Option{ff.WithEnvVarPrefix("MB")},
+		LongHelp: collapse(`
+			Watch the directories of the targets and of their dependencies, the
+			dep_source_dirs and the watch patterns, and build the targets
+			affected by the saved files once no file changed for -debounce.
+			The files ignored by git, the hidden files and the outputs of the
+			targets do not trigger a build. The config is reloaded before every
+			build and a failed build does not stop the watch.
+		`, 80),
+		Exec: func([]string) error {
+			renderer, err := build.NewRenderer(*output)
+			if err != nil {
+				return err
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt)
+			go func() {
+				<-sig
+				cancel()
+			}()
+			w := &build.Watch{
+				ConfigFile: *configFile,
+				Debounce:   *debounce,
+				Prepare: func(b *build.BuildContext) {
+					b.Renderer = renderer
+					b.RunsDir = build.DefaultRunsDir
+					b.Parallel = *parallel
+					b.NoCache = *noCache
+					b.CacheDir = *cacheDir
+				},
+			}
+			return w.Run(ctx)
+		},
+	}
+}